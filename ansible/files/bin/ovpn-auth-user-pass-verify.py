@@ -4,7 +4,7 @@ import sys, os, sqlite3, pyotp, ldap
 
 try:
   PASSWORD = os.environ.get("password", '')
-  USERNAME = os.environ.get("username", '')
+  USERNAME = os.environ.get("username", '').strip().lower()
   SQLITE_FILE = sys.argv[1]
 
   if not PASSWORD or not SQLITE_FILE or not USERNAME:
@@ -12,14 +12,35 @@ try:
     raise SystemExit(1)
 
   cxn = sqlite3.connect(SQLITE_FILE)
-  query = cxn.execute('select seed from totp where email=?', [USERNAME])
+  query = cxn.execute('select seed, email from totp where email=?', [USERNAME])
   result = query.fetchone()
-  if not result or len(result) != 1:
+  if not result:
+    # renamed users may keep logging in under their old email during the rename's grace period
+    query = cxn.execute(
+      "select t.seed, t.email from aliases as a, totp as t where a.email=t.email and a.old_email=? and a.grace_until > datetime('now')",
+      [USERNAME])
+    result = query.fetchone()
+  if not result or len(result) != 2:
     print "no seed for", USERNAME
     raise SystemExit(1)
 
   seed = result[0]
 
+  # suspended users keep their seed, but can't log in until the suspension is lifted or ends
+  query = cxn.execute(
+    "select reason from suspensions where email=? and (ends is null or ends > date('now'))", [result[1]])
+  suspended = query.fetchone()
+  if suspended:
+    print "user suspended", result[1], suspended[0]
+    raise SystemExit(1)
+
+  # during a lockdown, only the users on its break-glass list may log in
+  query = cxn.execute("select break_glass from lockdown")
+  lockdown = query.fetchone()
+  if lockdown and result[1] not in lockdown[0].split():
+    print "service locked down", result[1]
+    raise SystemExit(1)
+
   try:
     query.close()
     cxn.close()
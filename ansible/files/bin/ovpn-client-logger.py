@@ -5,7 +5,7 @@ import sys, os, sqlite3
 try:
   print sys.argv
   SQLITE_FILE = sys.argv[1]
-  COMMON_NAME = os.environ.get("common_name")
+  COMMON_NAME = os.environ.get("common_name", "").strip().lower()
   IP_ADDR = os.environ.get("trusted_ip")
   SCRIPT_TYPE = os.environ.get('script_type', 'unknown')
 
@@ -16,9 +16,36 @@ try:
     raise SystemExit(1)
 
   cxn = sqlite3.connect(SQLITE_FILE)
+  # certs issued before their user was renamed carry the old email; log under the current one
+  query = cxn.execute(
+    'select email from aliases where old_email=? and old_email not in (select email from totp)',
+    [COMMON_NAME])
+  result = query.fetchone()
+  if result:
+    COMMON_NAME = result[0]
   query = cxn.execute(
     "insert into events (email, event, value) values (?, ?, ?)",
     [COMMON_NAME, SCRIPT_TYPE, IP_ADDR])
+  # record the cert's use, so Heimdall can revoke certs that go unused (see dormancy.go). This runs
+  # only once the client has also passed TOTP auth, and again on disconnect, so long-lived
+  # connections keep their certs fresh. Certs issued before Heimdall recorded issuers pick up the
+  # CA's fingerprint, verified at depth 1, here too.
+  PEER_FINGERPRINT = os.environ.get("tls_digest_sha256_0", "").replace(":", "")
+  if PEER_FINGERPRINT:
+    cxn.execute(
+      "update certs set last_seen=datetime('now'), last_ip=?, issuer=ifnull(issuer, ?) where fingerprint=?",
+      [IP_ADDR, os.environ.get("tls_digest_sha256_1", "").replace(":", "") or None, PEER_FINGERPRINT])
+  # the first connection of a renewed cert's replacement retires the renewed cert (see renew.go)
+  if PEER_FINGERPRINT and SCRIPT_TYPE == "client-connect":
+    query = cxn.execute(
+      "select fingerprint, email from certs where replaced_by=? and cn is null and revoked is null",
+      [PEER_FINGERPRINT])
+    for renewed in query.fetchall():
+      cxn.execute(
+        "update certs set revoked=datetime('now'), revoke_reason='superseded' where fingerprint=?", [renewed[0]])
+      cxn.execute(
+        "insert into events (event, email, value) values ('certificate revoked', ?, ?)",
+        [renewed[1], "%s (superseded; renewed as %s)" % (renewed[0], PEER_FINGERPRINT)])
   cxn.commit()
   try:
     query.close()
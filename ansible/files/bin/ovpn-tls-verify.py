@@ -25,18 +25,56 @@ try:
 
   cxn = sqlite3.connect(SQLITE_FILE)
   query = cxn.execute(
-    'select email, revoked from certs where fingerprint=?',
+    'select ifnull(cn, email), revoked, email, ifnull(revoke_reason, "unspecified") from certs where fingerprint=?',
     [PEER_FINGERPRINT])
   result = query.fetchone()
-  if not result or len(result) != 2:
+  if not result or len(result) != 4:
     print "unknown cert"
     raise SystemExit(1)
+  # certs on hold are revoked with reason certificateHold until released, so they're refused too
   if result[1]:
-    print "revoked cert", result[1]
+    print "revoked cert", result[1], result[3]
     raise SystemExit(1)
-  if result[0] != CN:
+  # certs issued before emails were normalized may carry a differently-capitalized CN
+  if result[0].strip().lower() != CN.strip().lower():
     print "username mismatch", result[0], CN
     raise SystemExit(1)
+  # certs issued before their user was renamed only work during the rename's grace period
+  if result[0] != result[2]:
+    query = cxn.execute(
+      "select grace_until from aliases where old_email=? and email=? and grace_until > datetime('now')",
+      [result[0], result[2]])
+    if not query.fetchone():
+      print "grace period for renamed user has ended", result[0], result[2]
+      raise SystemExit(1)
+  EMAIL = result[2]
+  # during a lockdown, only the users on its break-glass list may connect
+  query = cxn.execute("select break_glass from lockdown")
+  lockdown = query.fetchone()
+  if lockdown and EMAIL not in lockdown[0].split():
+    print "service locked down", EMAIL
+    raise SystemExit(1)
+  # suspended users keep their certs, but can't use them until the suspension is lifted or ends
+  query = cxn.execute(
+    "select reason from suspensions where email=? and (ends is null or ends > date('now'))", [EMAIL])
+  suspended = query.fetchone()
+  if suspended:
+    print "user suspended", EMAIL, suspended[0]
+    raise SystemExit(1)
+  # certs stop working as soon as their user is no longer entitled to them: Bifrost's config-file
+  # admins (as Bifrost last reported them to Heimdall), users with the admin role, and whitelisted
+  # users & domains
+  query = cxn.execute("select value from settings where key='ConfigAdmins'")
+  config_admins = query.fetchone()
+  if not config_admins or EMAIL.lower() not in config_admins[0].lower().split():
+    query = cxn.execute(
+      "select 1 from roles where email=? and role='admin' " +
+      "union all select 1 from whitelist where email=? and (expires is null or expires >= date('now')) " +
+      "union all select 1 from domains where domain=? and enabled",
+      [EMAIL, EMAIL, EMAIL.rpartition("@")[2]])
+    if not query.fetchone():
+      print "user no longer entitled", EMAIL
+      raise SystemExit(1)
 
   try:
     query.close()
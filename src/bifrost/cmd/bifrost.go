@@ -15,9 +15,12 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -27,6 +30,8 @@ import (
 	"playground/httputil/static"
 	"playground/log"
 	"playground/session"
+
+	"validate"
 )
 
 /*
@@ -34,18 +39,22 @@ import (
  */
 
 type serverConfig struct {
-	Debug         bool
-	Port          int
-	HTTPPort      int
-	BindAddress   string
-	RedirectHost  string
-	LogFile       string
-	StaticContent string
-	AdminUsers    []string
-	HTTPSCertFile string
-	HTTPSKeyFile  string
-	Session       *session.ConfigType
-	APIClient     *apiclient.API
+	Debug               bool
+	Port                int
+	HTTPPort            int
+	BindAddress         string
+	RedirectHost        string
+	LogFile             string
+	StaticContent       string
+	AdminUsers          []string
+	RequireElevation    bool // admins act as regular users until they request elevation
+	ElevationApproval   bool // elevation requests must be approved by another admin
+	MaxElevationMinutes int
+	ApprovalRequired    []string // operations that need a second admin's approval; see changes.go
+	HTTPSCertFile       string
+	HTTPSKeyFile        string
+	Session             *session.ConfigType
+	APIClient           *apiclient.API
 }
 
 var cfg = &serverConfig{
@@ -57,6 +66,10 @@ var cfg = &serverConfig{
 	"./bifrost.log",
 	"./static",
 	[]string{},
+	false,
+	false,
+	60,
+	[]string{},
 	"",
 	"",
 	&session.Config,
@@ -77,11 +90,29 @@ func initConfig(cfg *serverConfig) {
 	if config.Debug || cfg.Debug {
 		log.SetLogLevel(log.LEVEL_DEBUG)
 	}
+
+	// emails are only ever compared in canonical form
+	for i, email := range cfg.AdminUsers {
+		canonical, err := validate.Email(email)
+		if err != nil {
+			panic(fmt.Sprintf("bad AdminUsers entry: %s", err))
+		}
+		cfg.AdminUsers[i] = canonical
+	}
+	if cfg.MaxElevationMinutes < 1 || cfg.MaxElevationMinutes > 24*60 {
+		panic("MaxElevationMinutes must be between 1 and 1440")
+	}
+	for _, op := range cfg.ApprovalRequired {
+		if _, ok := operations[op]; !ok {
+			panic(fmt.Sprintf("unknown ApprovalRequired operation '%s'", op))
+		}
+	}
 }
 
 func main() {
 	initConfig(cfg)
 	session.Ready()
+	go syncAdmins()
 
 	server, mux := httputil.NewHardenedServer(cfg.BindAddress, cfg.Port)
 
@@ -99,14 +130,32 @@ func main() {
 	w := httputil.Wrapper().WithPanicHandler().WithSessionSentry(authError)
 	mux.HandleFunc("/api/init", w.WithMethodSentry("GET").Wrap(initHandler))
 	mux.HandleFunc("/api/config", w.WithMethodSentry("GET", "PUT").Wrap(configHandler))
+	mux.HandleFunc("/api/config/domains", w.WithMethodSentry("GET").Wrap(domainsHandler))
+	mux.HandleFunc("/api/config/domains/", w.WithMethodSentry("PUT", "DELETE").Wrap(domainsHandler))
 	mux.HandleFunc("/api/whitelist", w.WithMethodSentry("GET").Wrap(whitelistHandler))
 	mux.HandleFunc("/api/whitelist/", w.WithMethodSentry("PUT", "DELETE").Wrap(whitelistHandler))
 	mux.HandleFunc("/api/users", w.WithMethodSentry("GET").Wrap(usersHandler))
 	mux.HandleFunc("/api/users/", w.WithMethodSentry("GET", "PUT", "DELETE").Wrap(usersHandler))
 	mux.HandleFunc("/api/certs", w.WithMethodSentry("GET", "POST").Wrap(certsHandler))
-	mux.HandleFunc("/api/certs/", w.WithMethodSentry("DELETE").Wrap(certsHandler))
+	mux.HandleFunc("/api/certs/", w.WithMethodSentry("POST", "PUT", "DELETE").Wrap(certsHandler))
 	mux.HandleFunc("/api/totp", w.WithMethodSentry("GET", "POST").Wrap(totpHandler))
-	mux.HandleFunc("/api/events", w.WithMethodSentry("GET").Wrap(eventsHandler))
+	mux.HandleFunc("/api/lost", w.WithMethodSentry("POST").Wrap(lostHandler))
+	mux.HandleFunc("/api/lockdown", w.WithMethodSentry("GET", "PUT", "DELETE").Wrap(lockdownHandler))
+	mux.HandleFunc("/api/massrevoke", w.WithMethodSentry("POST").Wrap(massRevokeHandler))
+	mux.HandleFunc("/api/events", w.WithMethodSentry("GET", "DELETE").Wrap(eventsHandler))
+	mux.HandleFunc("/api/export", w.WithMethodSentry("POST").Wrap(exportHandler))
+	mux.HandleFunc("/api/import", w.WithMethodSentry("POST").Wrap(importHandler))
+	mux.HandleFunc("/api/rename/", w.WithMethodSentry("POST").Wrap(renameHandler))
+	mux.HandleFunc("/api/roles", w.WithMethodSentry("GET").Wrap(rolesHandler))
+	mux.HandleFunc("/api/roles/", w.WithMethodSentry("PUT", "DELETE").Wrap(rolesHandler))
+	mux.HandleFunc("/api/elevation", w.WithMethodSentry("GET", "POST", "DELETE").Wrap(elevationHandler))
+	mux.HandleFunc("/api/elevation/", w.WithMethodSentry("PUT", "DELETE").Wrap(elevationHandler))
+	mux.HandleFunc("/api/suspensions", w.WithMethodSentry("GET").Wrap(suspensionsHandler))
+	mux.HandleFunc("/api/suspensions/", w.WithMethodSentry("PUT", "DELETE").Wrap(suspensionsHandler))
+	mux.HandleFunc("/api/revocations", w.WithMethodSentry("GET", "POST").Wrap(revocationsHandler))
+	mux.HandleFunc("/api/revocations/", w.WithMethodSentry("DELETE").Wrap(revocationsHandler))
+	mux.HandleFunc("/api/changes", w.WithMethodSentry("GET").Wrap(changesHandler))
+	mux.HandleFunc("/api/changes/", w.WithMethodSentry("PUT", "DELETE").Wrap(changesHandler))
 
 	if cfg.HTTPSCertFile != "" { // HTTPS mode -- not behind reverse proxy
 		// start up an HSTS redirector if requested
@@ -142,6 +191,21 @@ var (
 	clientURLError  = &apiError{"There was an error in data your client sent.", "Please reload the page.", false}
 	settingsError   = &apiError{"You must be an administrator to access settings.", "", false}
 	usersError      = &apiError{"You must be an administrator to manage users.", "", false}
+	scopeError      = &apiError{"You can only manage users in your own domains who aren't administrators.", "", true}
+	rolesError      = &apiError{"You must be an administrator to manage roles.", "", false}
+	elevationError  = &apiError{"You are not eligible for elevation.", "", false}
+	changeError     = &apiError{"The same change is already awaiting approval.", "", true}
+	decidedError    = &apiError{"That change has already been decided, or has expired.", "Please reload the page.", true}
+	elevatedError   = &apiError{"You already have an elevation active or awaiting approval.", "End or withdraw it first.", true}
+	limitError      = &apiError{"You already have as many devices as you're allowed.", "Deactivate one of them first.", true}
+	renameError     = &apiError{"That email address already belongs to another user.", "Reset that user first, or choose a different address.", true}
+	exportError     = &apiError{"You must be an administrator to export or import data.", "", false}
+	passphraseError = &apiError{"A passphrase is required to protect exported passwords.", "", true}
+	lockdownError   = &apiError{"The VPN is locked down right now.", "New devices and passwords are blocked until an administrator lifts the lockdown.", true}
+	previewError    = &apiError{"The matching devices have changed since your preview.", "Please preview them again.", true}
+	renewError      = &apiError{"That device can't be renewed.", "It may have been deactivated or renewed already. Please reload the page.", true}
+	approvedError   = &apiError{"That request has already been approved.", "Only its requester can end an elevation early. Please reload the page.", true}
+	renewCSRError   = &apiError{"That device's key was generated on the device.", "Paste a new certificate signing request to renew it.", true}
 )
 
 /* All handlers that return JSON use this general structure:
@@ -166,18 +230,98 @@ type apiResponse struct {
 }
 
 type settings struct {
-	ServiceName                     string
-	ClientLimit, IssuedCertDuration int
-	WhitelistedDomains              []string
-	WhitelistedUsers                []string `json:",omitEmpty"`
+	ServiceName                           string
+	ClientLimit, IssuedCertDuration       int
+	WhitelistedDomains                    []string
+	WhitelistedUsers                      []string `json:",omitEmpty"`
+	RateLimitWindow                       int
+	IssueLimitPerUser, IssueLimitGlobal   int
+	RevokeLimitPerUser, RevokeLimitGlobal int
+	TOTPLimitPerUser, TOTPLimitGlobal     int
+	DormancyDays, DormancyWarningDays     int
+	KeyAlgorithm, SignatureHash           string
+}
+
+// userLimits are a user's overrides of ClientLimit & IssuedCertDuration, and the limits that
+// result from those, their domain's policy, and the settings; a nil override means the others apply.
+type userLimits struct {
+	ClientLimit, IssuedCertDuration *int
+	Effective                       struct {
+		ClientLimit, IssuedCertDuration int
+		Profiles                        []string // the .ovpn profiles the user may choose, their default first
+	}
+}
+
+// loadLimits fetches the limits that apply to the indicated user.
+func loadLimits(email string) *userLimits {
+	res := &userLimits{}
+	status, err := cfg.APIClient.Call(apiclient.URLJoin("limits", email), "GET", nil, struct{}{}, res)
+	if err != nil {
+		panic(err)
+	}
+	if status >= 300 {
+		panic(fmt.Sprintf("non-200 status code %d from API server", status))
+	}
+	return res
+}
+
+// accessReport lists the users with active certs who lost access because of a whitelist or domain
+// change, and how many of their certs were revoked as a result, if that was requested.
+type accessReport struct {
+	LostAccess []string
+	Revoked    int
 }
 
-func loadSession(req *http.Request) (ssn *session.Session, s *settings, isAllowed bool, isAdmin bool) {
+// String summarizes r for the result of a change request.
+func (r *accessReport) String() string {
+	if r.Revoked > 0 {
+		return fmt.Sprintf("%d users lost access, %d certs revoked", len(r.LostAccess), r.Revoked)
+	}
+	return fmt.Sprintf("%d users lost access", len(r.LostAccess))
+}
+
+// withRevoke adds ?revoke=true to an API server path, if revoke is set, asking it to revoke the
+// certs of any users a change takes away access from.
+func withRevoke(u string, revoke bool) string {
+	if !revoke {
+		return u
+	}
+	v := url.Values{}
+	v.Add("revoke", "true")
+	return u + "?" + v.Encode()
+}
+
+// sendInvalidInput responds with a 400 that explains which input was rejected.
+func sendInvalidInput(writer http.ResponseWriter, err error) {
+	httputil.SendJSON(writer, http.StatusBadRequest, &apiResponse{Error: &apiError{"Some of the information you entered isn't valid.", err.Error(), true}})
+}
+
+// sendRateLimited passes a 429 from the API server through to the client as a recoverable error.
+func sendRateLimited(writer http.ResponseWriter, retryAfter int) {
+	wait := "a minute"
+	if retryAfter > 90 {
+		wait = fmt.Sprintf("%d minutes", (retryAfter+59)/60)
+	}
+	writer.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	httputil.SendJSON(writer, http.StatusTooManyRequests, &apiResponse{Error: &apiError{"You've done that too many times recently.", fmt.Sprintf("Please try again in %s.", wait), true}})
+}
+
+func loadSession(req *http.Request) (ssn *session.Session, s *settings, isAllowed bool, acc *access) {
 	s = &settings{}
+	acc = &access{}
 	if ssn = session.GetSession(req); !ssn.IsLoggedIn() {
 		return
 	}
 
+	// the identity provider may hand back any capitalization (e.g. "Alice@corp.com"), but there must
+	// only ever be one identity per mailbox; everything downstream sees the canonical form
+	email, err := validate.Email(ssn.Email)
+	if err != nil {
+		log.Warn("loadSession", "session has invalid email", ssn.Email)
+		return
+	}
+	ssn.Email = email
+
 	status, err := cfg.APIClient.Call("settings", "GET", nil, struct{}{}, s)
 	if err != nil {
 		panic(err)
@@ -186,15 +330,20 @@ func loadSession(req *http.Request) (ssn *session.Session, s *settings, isAllowe
 		panic(fmt.Sprintf("non-200 status code %d from API server", status))
 	}
 
-	for _, email := range cfg.AdminUsers {
-		if email == ssn.Email {
-			isAdmin = true
-			isAllowed = true
-			break
-		}
+	// suspended users may still log in, but can neither use the VPN nor act on any role they have
+	if loadSuspension(ssn.Email) != nil {
+		return
+	}
+
+	// full admins may always use the VPN, whether or not they're currently elevated; other roles
+	// follow the usual rules
+	acc = loadAccess(ssn.Email)
+	isAllowed = acc.Role == roleAdmin
+	if cfg.RequireElevation && acc.Role == roleAdmin {
+		acc = loadElevatedAccess(ssn.Email)
 	}
 
-	if !isAdmin {
+	if !isAllowed {
 		for _, domain := range s.WhitelistedDomains {
 			if strings.HasSuffix(ssn.Email, fmt.Sprintf("@%s", domain)) {
 				isAllowed = true
@@ -221,32 +370,60 @@ func loadSession(req *http.Request) (ssn *session.Session, s *settings, isAllowe
 func initHandler(writer http.ResponseWriter, req *http.Request) {
 	// GET /init -- fetch initial client state
 	//   I: none
-	//   O: {IsAdmin: false, ServiceTitle: "", ServiceName: "", DefaultPath: "", MaxClients: 42}
+	//   O: {IsAdmin: false, IsAllowed: false, Role: "", Can: {ViewUsers: false, ...}, CanElevate: false,
+	//       ElevatedUntil: "", ServiceTitle: "", ServiceName: "", DefaultPath: "", MaxClients: 42,
+	//       Profiles: [""], Suspended: false, SuspendedUntil: "", Lockdown: false}
 	//   200: success
+	//   Note: IsAdmin is true for any administrative role; Can indicates the specific permissions held.
+	//   CanElevate is true for admins who must request elevation first; ElevatedUntil is set while
+	//   they're elevated. MaxClients is the user's own client limit, if they or their domain have one;
+	//   Profiles are the .ovpn profiles they may choose from when adding a device. Suspended users are
+	//   never allowed, whatever their role; SuspendedUntil is when their suspension ends, if it does.
+	//   Lockdown is true while the service is locked down (see /api/lockdown).
 	// non-GET: 405 (method not allowed)
 
-	ssn, s, isAllowed, isAdmin := loadSession(req)
+	ssn, s, isAllowed, acc := loadSession(req)
 	if !ssn.IsLoggedIn() {
 		httputil.SendJSON(writer, http.StatusForbidden, &apiResponse{Error: authError})
 		return
 	}
 
 	res := &struct {
-		IsAdmin                  bool
+		IsAdmin, IsAllowed       bool
+		Role                     string
+		Can                      map[string]bool
+		CanElevate               bool
+		ElevatedUntil            string
 		ServiceName, DefaultPath string
 		MaxClients               int
+		Profiles                 []string
+		Suspended                bool
+		SuspendedUntil           string
+		Lockdown                 bool
 	}{
-		false, "Bifröst VPN", "/sorry", 2,
+		false, false, "", nil, false, "", "Bifröst VPN", "/sorry", 2, []string{}, false, "", false,
 	}
 
 	res.ServiceName = s.ServiceName
-	res.MaxClients = s.ClientLimit
+	limits := loadLimits(ssn.Email)
+	res.MaxClients, res.Profiles = limits.Effective.ClientLimit, limits.Effective.Profiles
+	res.IsAllowed = isAllowed
+	res.Role = acc.Role
+	res.Can = acc.permissions()
+	res.CanElevate = acc.Eligible != ""
+	res.ElevatedUntil = acc.Expires
+	if sus := loadSuspension(ssn.Email); sus != nil {
+		res.Suspended, res.SuspendedUntil = true, sus.Until
+	}
+	res.Lockdown = loadLockdown().Enabled
 	if isAllowed {
 		res.DefaultPath = "/devices"
 	}
-	if isAdmin {
+	if acc.Role != "" {
 		res.IsAdmin = true
-		res.DefaultPath = "/users"
+		if acc.can(viewUsers) {
+			res.DefaultPath = "/users"
+		}
 	}
 
 	// note: other handlers check isAllowed and 403 if false, but we can't since we are init and need
@@ -259,21 +436,28 @@ func configHandler(writer http.ResponseWriter, req *http.Request) {
 	// GET /api/config -- fetch current app configuration settings
 	//   I: none
 	//   O: {ClientLimit: 2, ServiceName: "", IssuedCertDuration: 90, WhitelistedDomains: ["domain.tld"]}
-	//   200: success; 403: not an admin
-	// PUT /api/config -- update app configuration
+	//   200: success; 403: not permitted to view settings
+	// PUT /api/config[?revoke=true] -- update app configuration
 	//   I: {ClientLimit: 2, ServiceName: "", IssuedCertDuration: 90, WhitelistedDomains: ["domain.tld"]}
-	//   O: {ClientLimit: 2, ServiceName: "", IssuedCertDuration: 90, WhitelistedDomains: ["domain.tld"]}
-	//   200: success; 400 (bad request): missing one or more values, or bad values; 403: not an admin
+	//   O: {ClientLimit: 2, ServiceName: "", IssuedCertDuration: 90, WhitelistedDomains: ["domain.tld"],
+	//      LostAccess: [""], Revoked: 0}
+	//   200: success; 202 (accepted): {Change: <change>} awaiting approval, if required (see
+	//   /api/changes); 400 (bad request): missing one or more values, or bad values; 403: not
+	//   permitted to change settings
+	//   Note: LostAccess lists users with devices who were only entitled by a removed domain; with
+	//   ?revoke=true their devices are revoked, and Revoked says how many
+	//   Note: the remaining fields (rate limits, dormancy, KeyAlgorithm & SignatureHash) are as for the
+	//   API server's /settings
 	// non-GET: 405 (method not allowed)
 
 	TAG := "configHandler"
 
-	ssn, s, _, isAdmin := loadSession(req)
+	ssn, s, _, acc := loadSession(req)
 	if !ssn.IsLoggedIn() {
 		httputil.SendJSON(writer, http.StatusForbidden, &apiResponse{Error: authError})
 		return
 	}
-	if !isAdmin {
+	if !acc.can(viewSettings) || (req.Method != "GET" && !acc.can(manageSettings)) {
 		httputil.SendJSON(writer, http.StatusForbidden, &apiResponse{Error: settingsError})
 		return
 	}
@@ -282,18 +466,34 @@ func configHandler(writer http.ResponseWriter, req *http.Request) {
 	case "GET":
 		httputil.SendJSON(writer, http.StatusOK, apiResponse{nil, s})
 	case "PUT":
+		before := &settings{}
+		*before = *s
+		before.WhitelistedDomains = append([]string{}, s.WhitelistedDomains...) // decoding reuses slices
+		before.WhitelistedUsers = append([]string{}, s.WhitelistedUsers...)
 		if err := httputil.PopulateFromBody(s, req); err != nil {
 			httputil.SendJSON(writer, http.StatusBadRequest, &apiResponse{Error: clientJSONError})
 			return
 		}
-		status, err := cfg.APIClient.Call("settings", "PUT", nil, s, s)
-		if err != nil {
-			panic(err)
+		for i, d := range s.WhitelistedDomains {
+			var err error
+			if s.WhitelistedDomains[i], err = validate.Domain(d); err != nil {
+				sendInvalidInput(writer, err)
+				return
+			}
 		}
-		if status >= 300 {
-			panic(fmt.Sprintf("non-200 status code %d from API server", status))
+		revoke := req.FormValue("revoke") == "true"
+		if holdForApproval(writer, ssn, settingsChange(before, s, revoke)) {
+			return
 		}
-		httputil.SendJSON(writer, http.StatusOK, apiResponse{nil, s})
+		report, err := storeSettings(s, revoke)
+		if err != nil {
+			sendInvalidInput(writer, err)
+			return
+		}
+		httputil.SendJSON(writer, http.StatusOK, apiResponse{nil, &struct {
+			*settings
+			*accessReport
+		}{s, report}})
 		log.Status(TAG, fmt.Sprintf("settings modified by '%s'", ssn.Email))
 	default:
 		panic("API method sentinel misconfiguration")
@@ -303,107 +503,171 @@ func configHandler(writer http.ResponseWriter, req *http.Request) {
 func whitelistHandler(writer http.ResponseWriter, req *http.Request) {
 	// GET /api/whitelist -- fetch current whitelist
 	//   I: none
-	//   O: {Users: [""]}
+	//   O: {Users: [""], Entries: [{Email: "", Expires: "", Sponsor: "", Note: "", Modified: ""}]}
 	//   200: success
-	// PUT /api/whitelist/<email> -- add a user to the whitelist
-	//   I: none
-	//   O: {Users: [""]}
-	//   200: success; 400: email missing
-	// DELETE /api/whitelist/<email> -- delete a user from the whitelist
+	// PUT /api/whitelist/<email> -- add a user to the whitelist, or update their entry
+	//   I: {Expires: "", Note: ""}
+	//   O: {Users: [""], Entries: [...]}
+	//   200: success; 400: email missing, or bad expiry or note
+	//   Note: both fields are optional; Expires is the last day of access, as YYYY-MM-DD. The current
+	//   user is recorded as the entry's sponsor, and reminded before it expires.
+	// DELETE /api/whitelist/<email>[?revoke=true] -- delete a user from the whitelist
 	//   I: none
-	//   O: {Users: [""]}
+	//   O: {Users: [""], Entries: [...], LostAccess: [""], Revoked: 0}
 	//   200: success; 404: email not whitelisted; 400: email missing
+	//   Note: LostAccess is the user, if they have devices and aren't entitled some other way; with
+	//   ?revoke=true their devices are revoked, and Revoked says how many
 	// non-GET: 405 (method not allowed)
+	// 403 unless permitted to view users (GET) or manage the indicated user (PUT/DELETE). Domain
+	// admins only see whitelisted users in their domains.
 
 	TAG := "whitelistHandler"
 
-	ssn, _, _, isAdmin := loadSession(req)
+	ssn, _, _, acc := loadSession(req)
 	if !ssn.IsLoggedIn() {
 		httputil.SendJSON(writer, http.StatusForbidden, &apiResponse{Error: authError})
 		return
 	}
-	if !isAdmin {
+	if !acc.can(viewUsers) {
 		httputil.SendJSON(writer, http.StatusForbidden, &apiResponse{Error: settingsError})
 		return
 	}
 
 	email := extractSegment(req.URL.Path, 3)
+	if email != "" {
+		var err error
+		if email, err = validate.Email(email); err != nil {
+			sendInvalidInput(writer, err)
+			return
+		}
+	}
+	if req.Method != "GET" && !acc.canFor(manageUsers, email) {
+		sendForbidden(writer, acc, manageUsers, usersError)
+		return
+	}
+	if req.Method != "GET" && email == "" {
+		httputil.SendJSON(writer, http.StatusBadRequest, apiResponse{Error: clientURLError})
+		return
+	}
 
+	type entry struct {
+		Email, Expires, Sponsor, Note, Modified string
+	}
+	res := &json.RawMessage{}
+	var status int
+	var err error
 	switch req.Method {
 	case "GET":
-		users := &struct{ Users []string }{}
-		status, err := cfg.APIClient.Call("whitelist", "GET", nil, &struct{}{}, users)
-		if err != nil {
-			panic(err)
-		}
-		if status >= 300 {
-			panic(fmt.Sprintf("non-200 status code %d from API server", status))
-		}
-		httputil.SendJSON(writer, http.StatusOK, apiResponse{nil, users})
+		status, err = cfg.APIClient.Call("whitelist", "GET", nil, &struct{}{}, res)
 	case "PUT":
-		if email == "" {
-			httputil.SendJSON(writer, http.StatusBadRequest, apiResponse{Error: clientURLError})
+		in := &struct{ Expires, Note string }{}
+		if err := httputil.PopulateFromBody(in, req); err != nil {
+			httputil.SendJSON(writer, http.StatusBadRequest, &apiResponse{Error: clientJSONError})
 			return
 		}
-		users := &struct{ Users []string }{}
-		status, err := cfg.APIClient.Call(apiclient.URLJoin("whitelist", email), "PUT", nil, &struct{}{}, users)
-		if err != nil {
-			panic(err)
-		}
-		if status >= 300 {
-			panic(fmt.Sprintf("non-200 status code %d from API server", status))
-		}
-		log.Status(TAG, fmt.Sprintf("user whitelist updated by '%s'", ssn.Email))
-		httputil.SendJSON(writer, http.StatusOK, apiResponse{nil, users})
+		body := &entry{Expires: in.Expires, Sponsor: ssn.Email, Note: in.Note}
+		status, err = cfg.APIClient.Call(apiclient.URLJoin("whitelist", email), "PUT", nil, body, res)
 	case "DELETE":
-		if email == "" {
-			httputil.SendJSON(writer, http.StatusBadRequest, apiResponse{Error: clientURLError})
-			return
-		}
-		users := &struct{ Users []string }{}
-		status, err := cfg.APIClient.Call(apiclient.URLJoin("whitelist", email), "DELETE", nil, &struct{}{}, users)
-		if err != nil {
-			panic(err)
-		}
-		if status >= 300 {
-			panic(fmt.Sprintf("non-200 status code %d from API server", status))
-		}
-		log.Status(TAG, fmt.Sprintf("user whitelist updated by '%s'", ssn.Email))
-		httputil.SendJSON(writer, http.StatusOK, apiResponse{nil, users})
+		u := withRevoke(apiclient.URLJoin("whitelist", email), req.FormValue("revoke") == "true")
+		status, err = cfg.APIClient.Call(u, "DELETE", nil, &struct{}{}, res)
 	default:
 		panic("API method sentinel misconfiguration")
 	}
+	if err != nil {
+		panic(err)
+	}
+	if status == http.StatusBadRequest && req.Method == "PUT" {
+		rejected := &struct{ Error string }{}
+		json.Unmarshal(*res, rejected)
+		sendInvalidInput(writer, errors.New(rejected.Error))
+		return
+	}
+	if status >= 300 {
+		panic(fmt.Sprintf("non-200 status code %d from API server", status))
+	}
+	if req.Method != "GET" {
+		log.Status(TAG, fmt.Sprintf("user whitelist updated by '%s'", ssn.Email))
+	}
+
+	all := &struct {
+		Entries []*entry
+		accessReport
+	}{}
+	if err = json.Unmarshal(*res, all); err != nil {
+		panic(err)
+	}
+	users := &struct {
+		Users   []string
+		Entries []*entry
+		accessReport
+	}{[]string{}, []*entry{}, all.accessReport}
+	for _, e := range all.Entries {
+		if acc.covers(e.Email) {
+			users.Users = append(users.Users, e.Email)
+			users.Entries = append(users.Entries, e)
+		}
+	}
+	httputil.SendJSON(writer, http.StatusOK, apiResponse{nil, users})
 }
 
 func usersHandler(writer http.ResponseWriter, req *http.Request) {
 	// GET /api/users -- fetch a list of all users with extant certs
 	//   I: none
-	//   O: {Users: [{Email: "", ActiveCerts: 42, InactiveCerts: 42}]}
+	//   O: {Users: [{Email: "", ActiveCerts: 42, InactiveCerts: 42, Suspended: false}]}
 	//   200: success
-	// GET /api/users/<email> -- fetch a list of a given user's certs
+	// GET /api/users/<email> -- fetch a list of a given user's certs, the renames they've been part
+	// of, their limits, their suspension if any, and their scheduled revocations
 	//   I: none
-	//   O: {Email: "", ActiveCerts: [<cert>]}
-	//      ...where <cert> == {Fingerprint: "", Description: "", Expires: ""}
+	//   O: {Email: "", ActiveCerts: [<cert>], HeldCerts: [<cert>], Aliases: [{OldEmail: "", Email: "", Created: "", GraceUntil: ""}],
+	//       Limits: <limits>, Suspension: <suspension>, Revocations: [<revocation>]}
+	//      ...where <cert> == {Fingerprint: "", Description: "", Expires: "", LastSeen: "", LastIP: "", KeyAlgorithm: ""}
+	//      ...and <limits> == {ClientLimit: null, IssuedCertDuration: null, Effective: {ClientLimit: 2, IssuedCertDuration: 90}}
+	//      ...and <suspension> == null, or as for GET /api/suspensions
+	//      ...and <revocation> is as for GET /api/revocations
 	//   200: success; 404: no such email
+	//   Note: Aliases are reported even for emails that no longer belong to a user, for audit lookups
+	// PUT /api/users/<email> -- override the client limit and/or cert lifetime (in days) for a user
+	//   I: {ClientLimit: null, IssuedCertDuration: null}
+	//   O: <limits>
+	//   200: success; 400: a limit less than 1, or email missing from request
+	//   Note: null means the service-wide setting applies; new limits apply to certs issued from now on
 	// DELETE /api/users/<email> -- revoke all of a user's certs and delete their account
 	//   I: none
 	//   O: {Email: "", InactiveCerts: 42}
-	//   200: success; 404: email not found; 400 (bad request): email missing from request
-	// non-GET: 405 (method not allowed)
+	//   200: success; 202 (accepted): {Change: <change>} awaiting approval, if required (see
+	//   /api/changes); 404: email not found; 400 (bad request): email missing from request
+	// non-GET/PUT/DELETE: 405 (method not allowed)
+	// 403 unless permitted to view (GET) or manage (PUT, DELETE) the indicated user. Domain admins
+	// only see users in their domains.
 
 	TAG := "usersHandler"
 
-	ssn, _, _, isAdmin := loadSession(req)
+	ssn, _, _, acc := loadSession(req)
 	if !ssn.IsLoggedIn() {
 		httputil.SendJSON(writer, http.StatusForbidden, &apiResponse{Error: authError})
 		return
 	}
-	if !isAdmin {
+	if !acc.can(viewUsers) {
 		httputil.SendJSON(writer, http.StatusForbidden, &apiResponse{Error: usersError})
 		return
 	}
 
 	email := extractSegment(req.URL.Path, 3)
+	if email != "" {
+		var err error
+		if email, err = validate.Email(email); err != nil {
+			sendInvalidInput(writer, err)
+			return
+		}
+	}
+	needed := viewUsers
+	if req.Method != "GET" {
+		needed = manageUsers
+	}
+	if email != "" && !acc.canFor(needed, email) {
+		sendForbidden(writer, acc, needed, usersError)
+		return
+	}
 
 	switch req.Method {
 	case "GET":
@@ -411,6 +675,7 @@ func usersHandler(writer http.ResponseWriter, req *http.Request) {
 			type user struct {
 				Email       string
 				ActiveCerts int
+				Suspended   bool
 			}
 			users := &struct {
 				Users []*user
@@ -423,16 +688,31 @@ func usersHandler(writer http.ResponseWriter, req *http.Request) {
 			if status >= 300 && status != http.StatusNotFound { // 404 just means no TOTP is set
 				panic(fmt.Sprintf("non-200 status code %d from API server", status))
 			}
+			visible := []*user{}
+			for _, u := range users.Users {
+				if acc.covers(u.Email) {
+					visible = append(visible, u)
+				}
+			}
+			users.Users = visible
 
 			httputil.SendJSON(writer, http.StatusOK, apiResponse{nil, users})
 		} else {
 			type cert struct {
-				Fingerprint, Expires, Description string
+				Fingerprint, Expires, Description, LastSeen, LastIP, KeyAlgorithm string
+			}
+			type alias struct {
+				OldEmail, Email, Created, GraceUntil string
 			}
 			res := &struct {
 				Email, Created string
 				ActiveCerts    []*cert
-			}{"", "", []*cert{}}
+				HeldCerts      []*cert
+				Aliases        []*alias
+				Limits         *userLimits
+				Suspension     *suspension
+				Revocations    []*scheduledRevocation
+			}{"", "", []*cert{}, []*cert{}, []*alias{}, nil, nil, nil}
 
 			status, err := cfg.APIClient.Call(apiclient.URLJoin("user", email), "GET", nil, struct{}{}, res)
 			if err != nil {
@@ -442,7 +722,19 @@ func usersHandler(writer http.ResponseWriter, req *http.Request) {
 				panic(fmt.Sprintf("non-200 status code %d from API server", status))
 			}
 
-			for _, c := range res.ActiveCerts {
+			aliases := &struct{ Aliases []*alias }{[]*alias{}}
+			if status, err = cfg.APIClient.Call(apiclient.URLJoin("aliases", email), "GET", nil, struct{}{}, aliases); err != nil {
+				panic(err)
+			}
+			if status >= 300 {
+				panic(fmt.Sprintf("non-200 status code %d from API server", status))
+			}
+			res.Aliases = aliases.Aliases
+			res.Limits = loadLimits(email)
+			res.Suspension = loadSuspension(email)
+			res.Revocations = loadScheduledRevocations(email)
+
+			for _, c := range append(res.ActiveCerts, res.HeldCerts...) {
 				if t, err := time.Parse("2006-01-02T15:04:05Z", c.Expires); err != nil {
 					panic(err)
 				} else {
@@ -452,14 +744,41 @@ func usersHandler(writer http.ResponseWriter, req *http.Request) {
 
 			httputil.SendJSON(writer, http.StatusOK, apiResponse{nil, res})
 		}
-	case "DELETE":
-		status, err := cfg.APIClient.Call(apiclient.URLJoin("user", email), "DELETE", nil, struct{}{}, nil)
+	case "PUT":
+		if email == "" {
+			httputil.SendJSON(writer, http.StatusBadRequest, apiResponse{Error: clientURLError})
+			return
+		}
+		in := &struct{ ClientLimit, IssuedCertDuration *int }{}
+		if err := httputil.PopulateFromBody(in, req); err != nil {
+			httputil.SendJSON(writer, http.StatusBadRequest, &apiResponse{Error: clientJSONError})
+			return
+		}
+		res := &json.RawMessage{}
+		status, err := cfg.APIClient.Call(apiclient.URLJoin("limits", email), "PUT", nil, in, res)
 		if err != nil {
 			panic(err)
 		}
-		if status >= 300 && status != http.StatusNotFound {
+		if status == http.StatusBadRequest {
+			rejected := &struct{ Error string }{}
+			json.Unmarshal(*res, rejected)
+			sendInvalidInput(writer, errors.New(rejected.Error))
+			return
+		}
+		if status >= 300 {
 			panic(fmt.Sprintf("non-200 status code %d from API server", status))
 		}
+		log.Status(TAG, fmt.Sprintf("limits of '%s' changed by '%s'", email, ssn.Email))
+		httputil.SendJSON(writer, http.StatusOK, apiResponse{nil, loadLimits(email)})
+	case "DELETE":
+		if email == "" {
+			httputil.SendJSON(writer, http.StatusBadRequest, apiResponse{Error: clientURLError})
+			return
+		}
+		if holdForApproval(writer, ssn, &change{Operation: opDeleteUser, Target: email, Summary: fmt.Sprintf("reset '%s', revoking all of their devices", email)}) {
+			return
+		}
+		resetUser(email)
 		log.Status(TAG, fmt.Sprintf("user '%s' reset by '%s'", email, ssn.Email))
 		httputil.SendJSON(writer, http.StatusOK, apiResponse{nil, &struct{ Email string }{email}})
 	default:
@@ -470,19 +789,49 @@ func usersHandler(writer http.ResponseWriter, req *http.Request) {
 func certsHandler(writer http.ResponseWriter, req *http.Request) {
 	// GET /api/certs -- fetch all certs for the current user (i.e. the one making the request)
 	//   I: none
-	//   O: {Certs: [{Fingerprint: "", Description: "", Expires: ""}]}
+	//   O: {Certs: [{Fingerprint: "", Description: "", Expires: "", ReissueBy: "", LastSeen: "", ReplacedBy: "", KeyAlgorithm: "",
+	//      FromCSR: false}],
+	//      HeldCerts: [<same>]}
 	//   200: success
+	//   Note: ReissueBy is set on certs issued before the user's email changed; they stop working then.
+	//   LastSeen is when the cert was last used to connect, if ever. ReplacedBy is set on certs that
+	//   have been renewed or reissued; they don't count against the client limit. FromCSR is set on
+	//   certs issued from a CSR, which can only be renewed with another.
+	//   HeldCerts are on hold: they don't work until released, but still count against the client limit
 	// POST /api/certs -- create a new client cert
-	//   I: {Email: "", Desc: ""}
+	//   I: {Email: "", Desc: "", Replaces: "", Profile: "", CSR: ""}
 	//   O: {OVPN: ""}
-	//   200: success; 400 (bad request): missing or bad fields;
-	//   403: requested email doesn't match session email; 404: Email not known to system (i.e. no TOTP creds)
+	//   200: success; 400 (bad request): missing or bad fields, Replaces (optional) is not a cert
+	//   awaiting reissue, Profile (optional; see /api/init) is not available to the user, or CSR
+	//   (optional) isn't an acceptable PEM-encoded certificate request;
+	//   403: requested email doesn't match session email, or user already has as many certs as their
+	//   client limit allows; 404: Email not known to system (i.e. no TOTP creds)
+	//   429: too many certs issued recently; 423: the service is locked down and Email isn't on its
+	//   break-glass list
 	//   Note that unless current user is admin, Email is optional but if present must match session email.
-	// DELETE /api/certs/<fingerprint> -- fetch details of a client cert
+	//   Note: with CSR, the cert is issued for the CSR's key, which never leaves the user's device; the
+	//   .ovpn has a placeholder where the key goes
+	// POST /api/certs/<fingerprint> -- renew one of the current user's certs
+	//   I: {Profile: "", CSR: ""}
+	//   O: {OVPNDataURL: ""}
+	//   200: success; 400: fingerprint malformed, Profile (optional) is not available to the user, or
+	//   CSR isn't acceptable; 403: session email doesn't own fingerprint (not even admins can renew
+	//   others' certs); 409: the cert can't be renewed, e.g. it isn't working or was renewed already,
+	//   or it was issued from a CSR and none was given; 423, 429: as for POST
+	//   Note: the old cert keeps working until it expires, or the new one first connects
+	// PUT /api/certs/<fingerprint> -- release a client cert from hold
+	//   I: none
+	//   O: same as GET (above), except that it returns all fingerprints for the user owning the one that was released
+	//   200: success; 403: session email doesn't own fingerprint and not admin; 409: cert isn't on hold;
+	//   400: fingerprint missing or malformed
+	// DELETE /api/certs/<fingerprint>?reason=<reason> -- revoke a client cert, or put it on hold
 	//   I: none
 	//   O: same as GET (above), except that it returns all fingerprints for the user owning the one that was revoked
 	//   200: success; 403: session email doesn't own fingerprint and not admin;
-	//   404: cert fingerprint not found; 400: fingerprint missing or malformed
+	//   404: cert fingerprint not found; 400: fingerprint missing or malformed, or unknown reason;
+	//   429: too many revocations recently
+	//   Note: reason is an RFC 5280 revocation reason such as "keyCompromise", defaulting to
+	//   "unspecified"; "certificateHold" puts the cert on hold
 	// non-GET: 405 (method not allowed)
 	//
 	// Note that this handler for /api/certs IS NOT isomorphic with the Heimdall API for certs.
@@ -491,60 +840,97 @@ func certsHandler(writer http.ResponseWriter, req *http.Request) {
 	// users, /certs/<email> for a specific user, and /cert/<fingerprint> for a specific cert.
 	TAG := "certsHandler"
 
-	ssn, _, isAllowed, isAdmin := loadSession(req)
+	ssn, _, isAllowed, acc := loadSession(req)
 	if !ssn.IsLoggedIn() || !isAllowed {
 		httputil.SendJSON(writer, http.StatusForbidden, &apiResponse{Error: authError})
 		return
 	}
 
 	type certMeta struct {
-		Fingerprint string
-		Description string
-		Expires     string
-		Created     string `json:",omitEmpty"`
-		Revoked     string `json:",omitEmpty"`
+		Fingerprint  string
+		Description  string
+		Expires      string
+		Created      string `json:",omitEmpty"`
+		Revoked      string `json:",omitEmpty"`
+		ReissueBy    string `json:",omitEmpty"`
+		LastSeen     string
+		ReplacedBy   string
+		KeyAlgorithm string
+		FromCSR      bool
 	}
-	switch req.Method {
-	case "GET":
+	type certList struct{ Certs, HeldCerts []*certMeta }
+	// listCerts fetches the certs of the indicated user that work or are on hold
+	listCerts := func(email string) *certList {
 		apiRes := &struct {
-			Email, Created            string
-			ActiveCerts, RevokedCerts []*certMeta
-		}{"", "", []*certMeta{}, []*certMeta{}}
+			Email, Created                       string
+			ActiveCerts, HeldCerts, RevokedCerts []*certMeta
+		}{"", "", []*certMeta{}, []*certMeta{}, []*certMeta{}}
 
-		status, err := cfg.APIClient.Call(apiclient.URLJoin("certs", ssn.Email), "GET", nil, struct{}{}, apiRes)
+		status, err := cfg.APIClient.Call(apiclient.URLJoin("certs", email), "GET", nil, struct{}{}, apiRes)
 		if err != nil {
 			panic(err)
 		}
 
 		if status == http.StatusNotFound {
 			// 404 just means no TOTP is set, not fatal
-			httputil.SendJSON(writer, http.StatusOK, apiResponse{nil, &struct{ Certs []*certMeta }{[]*certMeta{}}})
-			return
+			return &certList{[]*certMeta{}, []*certMeta{}}
 		}
 
 		if status >= 300 {
 			panic(fmt.Sprintf("non-200 status code %d from API server", status))
 		}
-		if apiRes.Email != ssn.Email {
+		if apiRes.Email != email {
 			panic(fmt.Sprintf("API server returned wrong email's certs"))
 		}
 
-		for _, c := range apiRes.ActiveCerts {
+		for _, c := range append(apiRes.ActiveCerts, apiRes.HeldCerts...) {
 			if t, err := time.Parse("2006-01-02T15:04:05Z", c.Expires); err != nil {
 				panic(err)
 			} else {
 				c.Expires = t.Format("2006-01-02")
 			}
+			if c.ReissueBy != "" {
+				if t, err := time.Parse("2006-01-02T15:04:05Z", c.ReissueBy); err != nil {
+					panic(err)
+				} else {
+					c.ReissueBy = t.Format("2006-01-02")
+				}
+			}
 		}
+		return &certList{apiRes.ActiveCerts, apiRes.HeldCerts}
+	}
 
-		httputil.SendJSON(writer, http.StatusOK, apiResponse{nil, &struct{ Certs []*certMeta }{apiRes.ActiveCerts}})
+	switch req.Method {
+	case "GET":
+		httputil.SendJSON(writer, http.StatusOK, apiResponse{nil, listCerts(ssn.Email)})
 	case "POST":
-		incert := &struct{ Email, Description string }{}
+		if fp := extractSegment(req.URL.Path, 3); fp != "" {
+			renewCert(writer, req, ssn.Email, fp)
+			return
+		}
+		incert := &struct{ Email, Description, Replaces, Profile, CSR string }{}
 
 		if err := httputil.PopulateFromBody(incert, req); err != nil {
 			httputil.SendJSON(writer, http.StatusBadRequest, apiResponse{Error: clientJSONError})
 			return
 		}
+		var err error
+		if incert.Description, err = validate.Description(incert.Description); err != nil {
+			sendInvalidInput(writer, err)
+			return
+		}
+		if incert.Email != "" {
+			if incert.Email, err = validate.Email(incert.Email); err != nil {
+				sendInvalidInput(writer, err)
+				return
+			}
+		}
+		if incert.Replaces != "" {
+			if incert.Replaces, err = validate.Fingerprint(incert.Replaces); err != nil {
+				sendInvalidInput(writer, err)
+				return
+			}
+		}
 		if incert.Email != "" && incert.Email != ssn.Email { // not even admins can create certs for other users
 			log.Warn(TAG, fmt.Sprintf("'%s' attempted to create cert for '%s'", ssn.Email, incert.Email))
 			httputil.SendJSON(writer, http.StatusForbidden, apiResponse{Error: clientJSONError})
@@ -557,20 +943,54 @@ func certsHandler(writer http.ResponseWriter, req *http.Request) {
 
 		incert.Email = email
 
-		res := &struct{ OVPNDataURL string }{}
+		res := &struct {
+			OVPNDataURL string
+			RetryAfter  int
+			Error       string
+		}{}
 		status, err := cfg.APIClient.Call(apiclient.URLJoin("certs", email), "POST", nil, incert, res)
 		if err != nil {
 			panic(err)
 		}
+		if status == http.StatusTooManyRequests {
+			log.Warn(TAG, fmt.Sprintf("'%s' hit the issuance rate limit", email))
+			sendRateLimited(writer, res.RetryAfter)
+			return
+		}
+		if status == http.StatusUnauthorized {
+			log.Warn(TAG, fmt.Sprintf("'%s' is at their client limit", email))
+			httputil.SendJSON(writer, http.StatusForbidden, apiResponse{Error: limitError})
+			return
+		}
+		if status == http.StatusLocked {
+			log.Warn(TAG, fmt.Sprintf("issuance to '%s' blocked by lockdown", email))
+			httputil.SendJSON(writer, http.StatusLocked, apiResponse{Error: lockdownError})
+			return
+		}
+		if status == http.StatusBadRequest && (incert.Replaces != "" || incert.Profile != "" || incert.CSR != "") {
+			sendInvalidInput(writer, errors.New(res.Error))
+			return
+		}
 		if status >= 300 {
 			panic(fmt.Sprintf("non-200 status code %d from API server", status))
 		}
-		log.Status(TAG, fmt.Sprintf("'%s' created new certificate '%s'", email, incert.Description))
+		if incert.Replaces != "" {
+			log.Status(TAG, fmt.Sprintf("'%s' reissued certificate '%s' replacing '%s'", email, incert.Description, incert.Replaces))
+		} else if incert.CSR != "" {
+			log.Status(TAG, fmt.Sprintf("'%s' created new certificate '%s' from a CSR", email, incert.Description))
+		} else {
+			log.Status(TAG, fmt.Sprintf("'%s' created new certificate '%s'", email, incert.Description))
+		}
 		httputil.SendJSON(writer, http.StatusOK, apiResponse{nil, res})
-	case "DELETE":
-		fp := extractSegment(req.URL.Path, 3)
-		if fp == "" {
-			httputil.SendJSON(writer, http.StatusBadRequest, apiResponse{Error: clientURLError})
+	case "PUT", "DELETE":
+		fp, err := validate.Fingerprint(extractSegment(req.URL.Path, 3))
+		if err != nil {
+			sendInvalidInput(writer, err)
+			return
+		}
+		reason, err := validate.RevocationReason(req.URL.Query().Get("reason"))
+		if err != nil {
+			sendInvalidInput(writer, err)
 			return
 		}
 
@@ -588,46 +1008,47 @@ func certsHandler(writer http.ResponseWriter, req *http.Request) {
 		if status >= 300 {
 			panic(fmt.Sprintf("non-200 status code %d from API server", status))
 		}
-		if apiRes.Email != ssn.Email && !isAdmin {
-			log.Warn(TAG, fmt.Sprintf("'%s' attempted to delete '%s' owned by '%s' without admin perms", ssn.Email, fp, apiRes.Email))
+		if apiRes.Email != ssn.Email && !acc.canFor(manageUsers, apiRes.Email) {
+			log.Warn(TAG, fmt.Sprintf("'%s' attempted to change '%s' owned by '%s' without admin perms", ssn.Email, fp, apiRes.Email))
 			httputil.SendJSON(writer, http.StatusForbidden, &apiResponse{Error: usersError})
 			return
 		}
 
-		// user is either an admin, or the cert belongs to current user; now do the actual delete
-		status, err = cfg.APIClient.Call(endpoint, "DELETE", nil, struct{}{}, apiRes)
-		if err != nil {
-			panic(err)
-		}
-		if status >= 300 {
-			panic(fmt.Sprintf("non-200 status code %d from API server", status))
+		// user is either an admin, or the cert belongs to current user; now do the actual release or delete
+		if req.Method == "PUT" {
+			status, err = cfg.APIClient.Call(endpoint, "PUT", nil, struct{}{}, nil)
+			if err != nil {
+				panic(err)
+			}
+			if status == http.StatusConflict {
+				httputil.SendJSON(writer, http.StatusConflict, apiResponse{Error: &apiError{"That device isn't on hold.", "Please reload the page.", true}})
+				return
+			}
+			if status >= 300 {
+				panic(fmt.Sprintf("non-200 status code %d from API server", status))
+			}
+			log.Status(TAG, fmt.Sprintf("'%s' released '%s' owned by '%s' from hold", ssn.Email, fp, apiRes.Email))
+		} else {
+			v := url.Values{}
+			v.Add("reason", reason)
+			limited := &struct{ RetryAfter int }{}
+			status, err = cfg.APIClient.Call(endpoint+"?"+v.Encode(), "DELETE", nil, struct{}{}, limited)
+			if err != nil {
+				panic(err)
+			}
+			if status == http.StatusTooManyRequests {
+				log.Warn(TAG, fmt.Sprintf("'%s' hit the revocation rate limit", ssn.Email))
+				sendRateLimited(writer, limited.RetryAfter)
+				return
+			}
+			if status >= 300 {
+				panic(fmt.Sprintf("non-200 status code %d from API server", status))
+			}
+			log.Status(TAG, fmt.Sprintf("'%s' deleted '%s' owned by '%s' (%s)", ssn.Email, fp, apiRes.Email, reason))
 		}
 
 		// ...and finally, fetch the new comprehensive list of certs for the affected user
-		getRes := &struct {
-			Email, Created            string
-			ActiveCerts, RevokedCerts []*certMeta
-		}{"", "", []*certMeta{}, []*certMeta{}}
-		status, err = cfg.APIClient.Call(apiclient.URLJoin("certs", apiRes.Email), "GET", nil, struct{}{}, getRes)
-		if err != nil {
-			panic(err)
-		}
-
-		if status == http.StatusNotFound {
-			// 404 just means no TOTP is set, not fatal
-			httputil.SendJSON(writer, http.StatusOK, apiResponse{nil, &struct{ Certs []*certMeta }{[]*certMeta{}}})
-			return
-		}
-
-		if status >= 300 {
-			panic(fmt.Sprintf("non-200 status code %d from API server", status))
-		}
-		if apiRes.Email != getRes.Email {
-			panic(fmt.Sprintf("API server returned wrong email's certs"))
-		}
-
-		log.Status(TAG, fmt.Sprintf("'%s' deleted '%s' owned by '%s'", ssn.Email, fp, apiRes.Email))
-		httputil.SendJSON(writer, http.StatusOK, apiResponse{nil, &struct{ Certs []*certMeta }{getRes.ActiveCerts}})
+		httputil.SendJSON(writer, http.StatusOK, apiResponse{nil, listCerts(apiRes.Email)})
 	default:
 		panic("API method sentinel misconfiguration")
 	}
@@ -641,7 +1062,8 @@ func totpHandler(writer http.ResponseWriter, req *http.Request) {
 	// POST /api/totp -- generate a new TOTP seed for the current user
 	//   I: none
 	//   O: {ImageURL: ""}
-	//   200: success; 400 (bad request): missing or bad fields;
+	//   200: success; 400 (bad request): missing or bad fields; 429: too many resets recently;
+	//   423: the service is locked down and the user isn't on its break-glass list
 	// non-GET: 405 (method not allowed)
 	//
 	// Note that this endpoint handles ONLY TOTP (re)generation for the current user. Deletion of other
@@ -680,13 +1102,22 @@ func totpHandler(writer http.ResponseWriter, req *http.Request) {
 		}
 	case "POST":
 		set := &struct{ ImageURL string }{}
-		res := &struct{ Email, TOTPURL string }{}
+		res := &struct {
+			Email, TOTPURL string
+			RetryAfter     int
+		}{}
 
 		status, err := cfg.APIClient.Call(endpoint, "PUT", nil, struct{}{}, res)
 		if err != nil {
 			panic(err)
 		}
-		if status <= 299 {
+		if status == http.StatusTooManyRequests {
+			log.Warn(TAG, fmt.Sprintf("'%s' hit the TOTP rate limit", ssn.Email))
+			sendRateLimited(writer, res.RetryAfter)
+		} else if status == http.StatusLocked {
+			log.Warn(TAG, fmt.Sprintf("TOTP seed for '%s' blocked by lockdown", ssn.Email))
+			httputil.SendJSON(writer, http.StatusLocked, apiResponse{Error: lockdownError})
+		} else if status <= 299 {
 			if res.Email != ssn.Email {
 				panic("API server returned results for wrong user")
 			}
@@ -706,20 +1137,37 @@ func eventsHandler(writer http.ResponseWriter, req *http.Request) {
 	//   I: none
 	//   O: {Events: [{Event: "", Email: "", Value: "", Timestamp: ""}]}
 	//   200: success
-	// non-GET: 405 (method not allowed)
+	// DELETE /api/events -- clear the event log
+	//   I: none
+	//   O: {Cleared: 0}
+	//   200: success; 202 (accepted): {Change: <change>} awaiting approval, if required (see
+	//   /api/changes); 403: not permitted to change settings
+	// non-GET/DELETE: 405 (method not allowed)
 	// Accepts a GET query parameter of "?before=" which is passed to the API server, for pagination
 	// If the value is "all", returns everything (i.e. a dump/export)
 
-	ssn, _, _, isAdmin := loadSession(req)
+	TAG := "eventsHandler"
+
+	ssn, _, _, acc := loadSession(req)
 	if !ssn.IsLoggedIn() {
 		httputil.SendJSON(writer, http.StatusForbidden, &apiResponse{Error: authError})
 		return
 	}
-	if !isAdmin {
+	if !acc.can(viewEvents) || (req.Method == "DELETE" && !acc.can(manageSettings)) {
 		httputil.SendJSON(writer, http.StatusForbidden, &apiResponse{Error: eventsError})
 		return
 	}
 
+	if req.Method == "DELETE" {
+		if holdForApproval(writer, ssn, &change{Operation: opClearEvents, Summary: "clear the event log"}) {
+			return
+		}
+		n := clearEvents()
+		log.Status(TAG, fmt.Sprintf("%d events cleared by '%s'", n, ssn.Email))
+		httputil.SendJSON(writer, http.StatusOK, apiResponse{nil, &struct{ Cleared int }{n}})
+		return
+	}
+
 	type event struct{ Event, Email, Value, Timestamp string }
 	res := &struct{ Events []*event }{}
 
@@ -748,5 +1196,187 @@ func eventsHandler(writer http.ResponseWriter, req *http.Request) {
 		panic(fmt.Sprintf("non-200 status code %d from API server", status))
 	}
 
+	if acc.Role == roleDomainAdmin {
+		// domain admins see only their own users' events, and not service-wide ones (i.e. with no email)
+		visible := []*event{}
+		for _, e := range res.Events {
+			if e.Email != "" && acc.covers(e.Email) {
+				visible = append(visible, e)
+			}
+		}
+		res.Events = visible
+	}
+
 	httputil.SendJSON(writer, http.StatusOK, &apiResponse{Artifact: res})
 }
+
+func exportHandler(writer http.ResponseWriter, req *http.Request) {
+	// POST /api/export -- fetch the complete service state, for migration or disaster recovery
+	//   I: {Passphrase: ""}
+	//   O: {Version: 1, Exported: "", KDF: {...}, Settings: {}, Whitelist: [], Users: [], Certs: [], Events: [], Aliases: [], Roles: [], Limits: [], Domains: [], Suspensions: [], Revocations: []}
+	//   200: success; 400: passphrase missing; 403: not an admin
+	// non-POST: 405 (method not allowed)
+	// The document is passed through from the API server unmodified; TOTP seeds in it are sealed
+	// using Passphrase.
+
+	TAG := "exportHandler"
+
+	ssn, _, _, acc := loadSession(req)
+	if !ssn.IsLoggedIn() {
+		httputil.SendJSON(writer, http.StatusForbidden, &apiResponse{Error: authError})
+		return
+	}
+	if !acc.can(exportState) {
+		httputil.SendJSON(writer, http.StatusForbidden, &apiResponse{Error: exportError})
+		return
+	}
+
+	in := &struct{ Passphrase string }{}
+	if err := httputil.PopulateFromBody(in, req); err != nil {
+		httputil.SendJSON(writer, http.StatusBadRequest, &apiResponse{Error: clientJSONError})
+		return
+	}
+	if in.Passphrase == "" {
+		httputil.SendJSON(writer, http.StatusBadRequest, &apiResponse{Error: passphraseError})
+		return
+	}
+
+	doc := &json.RawMessage{}
+	status, err := cfg.APIClient.Call("export", "POST", nil, in, doc)
+	if err != nil {
+		panic(err)
+	}
+	if status >= 300 {
+		panic(fmt.Sprintf("non-200 status code %d from API server", status))
+	}
+
+	log.Status(TAG, fmt.Sprintf("state exported by '%s'", ssn.Email))
+	httputil.SendJSON(writer, http.StatusOK, apiResponse{nil, doc})
+}
+
+func importHandler(writer http.ResponseWriter, req *http.Request) {
+	// POST /api/import -- import (or preview importing) a document produced by /api/export
+	//   I: {Mode: "merge"|"replace", DryRun: false, Passphrase: "", Document: {...}}
+	//   O: {Mode: "", DryRun: false, Settings: <diff>, Whitelist: <diff>, Users: <diff>, Certs: <diff>, Events: <diff>, Aliases: <diff>, Roles: <diff>, Limits: <diff>, Domains: <diff>, Suspensions: <diff>, Revocations: <diff>}
+	//      ...where <diff> == {Added: [""], Changed: [""], Removed: [""], Conflicts: [""], Unchanged: 0}
+	//   200: success (nothing changed if DryRun); 400: document rejected, or bad passphrase; 403: not an admin
+	// non-POST: 405 (method not allowed)
+
+	TAG := "importHandler"
+
+	ssn, _, _, acc := loadSession(req)
+	if !ssn.IsLoggedIn() {
+		httputil.SendJSON(writer, http.StatusForbidden, &apiResponse{Error: authError})
+		return
+	}
+	if !acc.can(exportState) {
+		httputil.SendJSON(writer, http.StatusForbidden, &apiResponse{Error: exportError})
+		return
+	}
+
+	in := &struct {
+		Mode       string
+		DryRun     bool
+		Passphrase string
+		Document   *json.RawMessage
+	}{}
+	if err := httputil.PopulateFromBody(in, req); err != nil || in.Document == nil {
+		httputil.SendJSON(writer, http.StatusBadRequest, &apiResponse{Error: clientJSONError})
+		return
+	}
+
+	res := &json.RawMessage{}
+	status, err := cfg.APIClient.Call("import", "POST", nil, in, res)
+	if err != nil {
+		panic(err)
+	}
+	if status == http.StatusBadRequest {
+		rejected := &struct{ Errors []string }{}
+		json.Unmarshal(*res, rejected)
+		log.Warn(TAG, fmt.Sprintf("import by '%s' rejected", ssn.Email), rejected.Errors)
+		httputil.SendJSON(writer, http.StatusBadRequest, &apiResponse{Error: &apiError{"The import document was rejected.", strings.Join(rejected.Errors, "; "), true}})
+		return
+	}
+	if status >= 300 {
+		panic(fmt.Sprintf("non-200 status code %d from API server", status))
+	}
+
+	if !in.DryRun {
+		log.Status(TAG, fmt.Sprintf("state imported (%s) by '%s'", in.Mode, ssn.Email))
+	}
+	httputil.SendJSON(writer, http.StatusOK, apiResponse{nil, res})
+}
+
+func renameHandler(writer http.ResponseWriter, req *http.Request) {
+	// POST /api/rename/<email> -- move a user to a new email, e.g. after a name or domain change
+	//   I: {Email: "", GraceDays: 14}
+	//   O: {Email: "", ReissueCerts: 0}
+	//   200: success; the user's ReissueCerts existing devices keep working for GraceDays, during which
+	//   they're prompted to reissue them; 400: bad emails or GraceDays; 403: not permitted to manage both emails;
+	//   404: no such user; 409 (conflict): new email already belongs to a user
+	// non-POST: 405 (method not allowed)
+
+	TAG := "renameHandler"
+
+	ssn, _, _, acc := loadSession(req)
+	if !ssn.IsLoggedIn() {
+		httputil.SendJSON(writer, http.StatusForbidden, &apiResponse{Error: authError})
+		return
+	}
+	if !acc.can(manageUsers) {
+		httputil.SendJSON(writer, http.StatusForbidden, &apiResponse{Error: usersError})
+		return
+	}
+
+	email, err := validate.Email(extractSegment(req.URL.Path, 3))
+	if err != nil {
+		sendInvalidInput(writer, err)
+		return
+	}
+	in := &struct {
+		Email     string
+		GraceDays *int // nil for the API server's default
+	}{}
+	if err = httputil.PopulateFromBody(in, req); err != nil {
+		httputil.SendJSON(writer, http.StatusBadRequest, &apiResponse{Error: clientJSONError})
+		return
+	}
+	if in.Email, err = validate.Email(in.Email); err != nil {
+		sendInvalidInput(writer, err)
+		return
+	}
+	if !acc.canFor(manageUsers, email) || !acc.canFor(manageUsers, in.Email) { // i.e. domain admins can't move users out of their domains
+		sendForbidden(writer, acc, manageUsers, usersError)
+		return
+	}
+
+	res := &struct {
+		Email        string
+		ReissueCerts int
+		Error        string
+	}{}
+	status, err := cfg.APIClient.Call(apiclient.URLJoin("rename", email), "POST", nil, in, res)
+	if err != nil {
+		panic(err)
+	}
+	switch status {
+	case http.StatusBadRequest:
+		sendInvalidInput(writer, errors.New(res.Error))
+		return
+	case http.StatusNotFound:
+		httputil.SendJSON(writer, http.StatusNotFound, &apiResponse{Error: clientURLError})
+		return
+	case http.StatusConflict:
+		httputil.SendJSON(writer, http.StatusConflict, &apiResponse{Error: renameError})
+		return
+	}
+	if status >= 300 {
+		panic(fmt.Sprintf("non-200 status code %d from API server", status))
+	}
+
+	log.Status(TAG, fmt.Sprintf("'%s' renamed to '%s' by '%s'", email, res.Email, ssn.Email))
+	httputil.SendJSON(writer, http.StatusOK, apiResponse{nil, &struct {
+		Email        string
+		ReissueCerts int
+	}{res.Email, res.ReissueCerts}})
+}
@@ -0,0 +1,396 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Two-person approval. Operations listed in the config's ApprovalRequired aren't carried out when
+// requested; instead they're recorded in Heimdall as change requests, and carried out once a
+// different admin approves them. Heimdall keeps the audit trail, and expires stale requests.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"playground/apiclient"
+	"playground/httputil"
+	"playground/log"
+	"playground/session"
+)
+
+const (
+	opDeleteUser     = "delete-user"
+	opChangeSettings = "change-settings"
+	opClearEvents    = "clear-events"
+	opChangeDomain   = "change-domain"
+	opMassRevoke     = "mass-revoke"
+)
+
+type change struct {
+	ID                     int64
+	Operation, Target      string
+	Payload, Summary       string
+	RequestedBy, Requested string
+	DecidedBy, Decided     string
+	Status, Result         string
+}
+
+type operation struct {
+	permission permission                      // needed both to request & to approve
+	denied     *apiError                       // sent to those without permission
+	apply      func(c *change) (string, error) // carries out c, returning a summary of the outcome
+}
+
+var operations = map[string]*operation{
+	opDeleteUser:     {manageUsers, usersError, applyDeleteUser},
+	opChangeSettings: {manageSettings, settingsError, applyChangeSettings},
+	opClearEvents:    {manageSettings, eventsError, applyClearEvents},
+	opChangeDomain:   {manageSettings, settingsError, applyChangeDomain},
+	opMassRevoke:     {manageUsers, usersError, applyMassRevoke},
+}
+
+// holdForApproval records c as a change request and responds with a 202, if its operation requires
+// approval. Otherwise it does nothing and returns false, and the caller should carry on.
+func holdForApproval(writer http.ResponseWriter, ssn *session.Session, c *change) bool {
+	required := false
+	for _, op := range cfg.ApprovalRequired {
+		required = required || op == c.Operation
+	}
+	if !required {
+		return false
+	}
+
+	c.RequestedBy = ssn.Email
+	res := &change{}
+	status, err := cfg.APIClient.Call("changes", "POST", nil, c, res)
+	if err != nil {
+		panic(err)
+	}
+	if status == http.StatusConflict {
+		httputil.SendJSON(writer, http.StatusConflict, &apiResponse{Error: changeError})
+		return true
+	}
+	if status >= 300 {
+		panic(fmt.Sprintf("non-200 status code %d from API server", status))
+	}
+	log.Status("holdForApproval", fmt.Sprintf("'%s' requested change #%d (%s)", ssn.Email, res.ID, res.Operation))
+	httputil.SendJSON(writer, http.StatusAccepted, apiResponse{nil, &struct{ Change *change }{res}})
+	return true
+}
+
+// normalizeSettings returns a copy of s in which missing lists are empty, since the API server
+// doesn't distinguish the two.
+func normalizeSettings(s *settings) *settings {
+	n := *s
+	if n.WhitelistedDomains == nil {
+		n.WhitelistedDomains = []string{}
+	}
+	if n.WhitelistedUsers == nil {
+		n.WhitelistedUsers = []string{}
+	}
+	return &n
+}
+
+// settingsChange describes replacing settings before with after, listing each setting that differs.
+// If revoke is set, the certs of users who lose access are revoked when the change is carried out.
+func settingsChange(before, after *settings, revoke bool) *change {
+	asMap := func(s *settings) map[string]interface{} {
+		m := make(map[string]interface{})
+		b, _ := json.Marshal(s)
+		json.Unmarshal(b, &m)
+		return m
+	}
+	old, new := asMap(normalizeSettings(before)), asMap(normalizeSettings(after))
+	keys := []string{}
+	for k := range new {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	diffs := []string{}
+	for _, k := range keys {
+		if !reflect.DeepEqual(old[k], new[k]) {
+			diffs = append(diffs, fmt.Sprintf("%s: %v -> %v", k, old[k], new[k]))
+		}
+	}
+	if len(diffs) == 0 {
+		diffs = append(diffs, "no differences")
+	}
+	if revoke {
+		diffs = append(diffs, "revoke the certs of users who lose access")
+	}
+
+	payload, err := json.Marshal(&struct {
+		Before, After *settings
+		Revoke        bool
+	}{before, after, revoke})
+	if err != nil {
+		panic(err)
+	}
+	return &change{Operation: opChangeSettings, Payload: string(payload), Summary: strings.Join(diffs, "; ")}
+}
+
+// setChangeStatus moves the indicated change to a new status in Heimdall. It returns the API
+// server's status code, and its explanation if that's a 400.
+func setChangeStatus(id int64, by, status, result string) (int, error) {
+	in := &struct{ By, Status, Result string }{by, status, result}
+	res := &json.RawMessage{}
+	code, err := cfg.APIClient.Call(apiclient.URLJoin("change", strconv.FormatInt(id, 10)), "PUT", nil, in, res)
+	if err != nil {
+		panic(err)
+	}
+	switch {
+	case code == http.StatusBadRequest:
+		rejected := &struct{ Error string }{}
+		json.Unmarshal(*res, rejected)
+		return code, errors.New(rejected.Error)
+	case code == http.StatusConflict:
+	case code >= 300:
+		panic(fmt.Sprintf("non-200 status code %d from API server", code))
+	}
+	return code, nil
+}
+
+/*
+ * Operations that may require approval
+ */
+
+// resetUser revokes all of a user's certs and deletes their TOTP seed.
+func resetUser(email string) {
+	status, err := cfg.APIClient.Call(apiclient.URLJoin("user", email), "DELETE", nil, struct{}{}, nil)
+	if err != nil {
+		panic(err)
+	}
+	if status >= 300 && status != http.StatusNotFound {
+		panic(fmt.Sprintf("non-200 status code %d from API server", status))
+	}
+}
+
+// storeSettings stores s, updating it with what the API server actually stored, and reports who lost
+// access (revoking their certs, if revoke is set). An error means the API server rejected the
+// settings, and explains why.
+func storeSettings(s *settings, revoke bool) (*accessReport, error) {
+	res := &json.RawMessage{}
+	status, err := cfg.APIClient.Call(withRevoke("settings", revoke), "PUT", nil, s, res)
+	if err != nil {
+		panic(err)
+	}
+	if status == http.StatusBadRequest { // the API server has the final word on what's valid
+		rejected := &struct{ Error string }{}
+		json.Unmarshal(*res, rejected)
+		return nil, errors.New(rejected.Error)
+	}
+	if status >= 300 {
+		panic(fmt.Sprintf("non-200 status code %d from API server", status))
+	}
+	report := &accessReport{}
+	if err = json.Unmarshal(*res, s); err != nil {
+		panic(err)
+	}
+	if err = json.Unmarshal(*res, report); err != nil {
+		panic(err)
+	}
+	return report, nil
+}
+
+// clearEvents empties the event log, returning how many events were cleared.
+func clearEvents() int {
+	res := &struct{ Events []json.RawMessage }{}
+	status, err := cfg.APIClient.Call("events", "DELETE", nil, struct{}{}, res)
+	if err != nil {
+		panic(err)
+	}
+	if status >= 300 {
+		panic(fmt.Sprintf("non-200 status code %d from API server", status))
+	}
+	return len(res.Events)
+}
+
+func applyDeleteUser(c *change) (string, error) {
+	if c.Payload != "" { // a reset scheduled for later; see revocationsHandler
+		r := &scheduledRevocation{Email: c.Target, ScheduledBy: c.RequestedBy}
+		if err := json.Unmarshal([]byte(c.Payload), r); err != nil {
+			panic(err)
+		}
+		if err := scheduleRevocation(r); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("reset of '%s' scheduled for %s", c.Target, r.Due), nil
+	}
+	resetUser(c.Target)
+	return fmt.Sprintf("'%s' reset", c.Target), nil
+}
+
+func applyChangeSettings(c *change) (string, error) {
+	payload := &struct {
+		Before, After *settings
+		Revoke        bool
+	}{}
+	if err := json.Unmarshal([]byte(c.Payload), payload); err != nil || payload.Before == nil || payload.After == nil {
+		return "", errors.New("malformed settings change")
+	}
+
+	// the change was approved as a diff against the settings at the time; don't let it silently
+	// revert anything that has changed since
+	current := &settings{}
+	status, err := cfg.APIClient.Call("settings", "GET", nil, struct{}{}, current)
+	if err != nil {
+		panic(err)
+	}
+	if status >= 300 {
+		panic(fmt.Sprintf("non-200 status code %d from API server", status))
+	}
+	if !reflect.DeepEqual(normalizeSettings(current), normalizeSettings(payload.Before)) {
+		return "", errors.New("settings have changed since this change was requested")
+	}
+
+	report, err := storeSettings(payload.After, payload.Revoke)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("settings updated; %s", report), nil
+}
+
+func applyClearEvents(c *change) (string, error) {
+	return fmt.Sprintf("%d events cleared", clearEvents()), nil
+}
+
+/*
+ * API endpoint handlers
+ */
+
+func changesHandler(writer http.ResponseWriter, req *http.Request) {
+	// GET /api/changes -- fetch the requests awaiting approval that the current user may decide or has made
+	//   I: none
+	//   O: {Changes: [<change>]}
+	//      ...where <change> == {ID: 0, Operation: "", Target: "", Summary: "", RequestedBy: "",
+	//      Requested: "", Mine: false}
+	//   200: success
+	// PUT /api/changes/<id> -- approve someone else's request, and carry it out
+	//   I: none
+	//   O: same as GET
+	//   200: success; 400: own request; 403: not permitted to carry out the operation;
+	//   404: no such request; 409 (conflict): already decided or expired, or carrying it out failed
+	// DELETE /api/changes/<id> -- deny someone else's request, or withdraw one's own
+	//   I: none
+	//   O: same as GET
+	//   200: success; 403, 404, 409: as for PUT
+	// non-GET/PUT/DELETE: 405 (method not allowed)
+
+	TAG := "changesHandler"
+
+	ssn, _, _, acc := loadSession(req)
+	if !ssn.IsLoggedIn() {
+		httputil.SendJSON(writer, http.StatusForbidden, &apiResponse{Error: authError})
+		return
+	}
+
+	if req.Method != "GET" {
+		id, err := strconv.ParseInt(extractSegment(req.URL.Path, 3), 10, 64)
+		if err != nil {
+			httputil.SendJSON(writer, http.StatusBadRequest, &apiResponse{Error: clientURLError})
+			return
+		}
+		c := &change{}
+		status, err := cfg.APIClient.Call(apiclient.URLJoin("change", strconv.FormatInt(id, 10)), "GET", nil, struct{}{}, c)
+		if err != nil {
+			panic(err)
+		}
+		if status == http.StatusNotFound {
+			httputil.SendJSON(writer, http.StatusNotFound, &apiResponse{Error: clientURLError})
+			return
+		}
+		if status >= 300 {
+			panic(fmt.Sprintf("non-200 status code %d from API server", status))
+		}
+		op, ok := operations[c.Operation]
+		if !ok {
+			panic(fmt.Sprintf("change #%d has unknown operation '%s'", id, c.Operation))
+		}
+		mine := c.RequestedBy == ssn.Email
+		if !mine && !acc.canFor(op.permission, c.Target) {
+			sendForbidden(writer, acc, op.permission, op.denied)
+			return
+		}
+
+		next := "approved"
+		if req.Method == "DELETE" {
+			next = "denied"
+			if mine {
+				next = "withdrawn"
+			}
+		}
+		switch code, err := setChangeStatus(id, ssn.Email, next, ""); code {
+		case http.StatusBadRequest:
+			sendInvalidInput(writer, err)
+			return
+		case http.StatusConflict:
+			httputil.SendJSON(writer, http.StatusConflict, &apiResponse{Error: decidedError})
+			return
+		}
+		log.Status(TAG, fmt.Sprintf("change #%d %s by '%s'", id, next, ssn.Email))
+
+		if next == "approved" {
+			// record a failure even if carrying the change out panics, so it isn't left half-done
+			// without a trace; the panic handler still reports the error
+			result, err := func() (result string, err error) {
+				defer func() {
+					if r := recover(); r != nil {
+						setChangeStatus(id, ssn.Email, "failed", fmt.Sprint(r))
+						panic(r)
+					}
+				}()
+				return op.apply(c)
+			}()
+			if err != nil {
+				setChangeStatus(id, ssn.Email, "failed", err.Error())
+				log.Warn(TAG, fmt.Sprintf("change #%d failed", id), err)
+				httputil.SendJSON(writer, http.StatusConflict, &apiResponse{Error: &apiError{"The change could not be carried out.", err.Error(), true}})
+				return
+			}
+			setChangeStatus(id, ssn.Email, "applied", result)
+			log.Status(TAG, fmt.Sprintf("change #%d applied: %s", id, result))
+		}
+	}
+
+	// all methods respond with the current list
+	type pending struct {
+		ID                     int64
+		Operation, Target      string
+		Summary                string
+		RequestedBy, Requested string
+		Mine                   bool
+	}
+	all := &struct{ Changes []*change }{}
+	status, err := cfg.APIClient.Call("changes", "GET", nil, struct{}{}, all)
+	if err != nil {
+		panic(err)
+	}
+	if status >= 300 {
+		panic(fmt.Sprintf("non-200 status code %d from API server", status))
+	}
+	res := &struct{ Changes []*pending }{[]*pending{}}
+	for _, c := range all.Changes {
+		op, ok := operations[c.Operation]
+		mine := c.RequestedBy == ssn.Email
+		if mine || (ok && acc.canFor(op.permission, c.Target)) {
+			res.Changes = append(res.Changes, &pending{c.ID, c.Operation, c.Target, c.Summary, c.RequestedBy, c.Requested, mine})
+		}
+	}
+	httputil.SendJSON(writer, http.StatusOK, apiResponse{nil, res})
+}
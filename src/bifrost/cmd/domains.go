@@ -0,0 +1,220 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Per-domain access policies, stored in Heimdall. Only enabled domains grant access (they're the
+// settings' WhitelistedDomains); a domain's policy may also override the client limit & cert
+// lifetime, and restrict its users to particular .ovpn profiles.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"playground/apiclient"
+	"playground/httputil"
+	"playground/log"
+
+	"validate"
+)
+
+type domainPolicy struct {
+	Domain                          string
+	Enabled                         bool
+	ClientLimit, IssuedCertDuration *int
+	Profiles                        []string
+	Modified                        string
+}
+
+// domainPayload is the payload of a change-domain request. Requests made before Remove & Revoke
+// existed have just the policy (or no payload, for a removal), which decode the same way.
+type domainPayload struct {
+	domainPolicy
+	Remove, Revoke bool `json:",omitempty"`
+}
+
+// storeDomainPolicy creates, replaces or (if p is nil) removes the policy of the indicated domain,
+// and reports who lost access (revoking their certs, if revoke is set). An error means the API
+// server rejected the policy, and explains why.
+func storeDomainPolicy(domain string, p *domainPolicy, revoke bool) (*accessReport, error) {
+	method, body := "PUT", interface{}(p)
+	if p == nil {
+		method, body = "DELETE", struct{}{}
+	}
+	res := &json.RawMessage{}
+	status, err := cfg.APIClient.Call(withRevoke(apiclient.URLJoin("domains", domain), revoke), method, nil, body, res)
+	if err != nil {
+		panic(err)
+	}
+	if status == http.StatusBadRequest {
+		rejected := &struct{ Error string }{}
+		json.Unmarshal(*res, rejected)
+		return nil, errors.New(rejected.Error)
+	}
+	if status >= 300 {
+		panic(fmt.Sprintf("non-200 status code %d from API server", status))
+	}
+	report := &accessReport{}
+	if err = json.Unmarshal(*res, report); err != nil {
+		panic(err)
+	}
+	return report, nil
+}
+
+// domainChange describes storing p as the policy of domain, or removing it if p is nil. If revoke is
+// set, the certs of users who lose access are revoked when the change is carried out.
+func domainChange(domain string, p *domainPolicy, revoke bool) *change {
+	c := &change{Operation: opChangeDomain, Target: domain, Summary: fmt.Sprintf("remove domain '%s'", domain)}
+	if p != nil || revoke {
+		payload := &domainPayload{Remove: p == nil, Revoke: revoke}
+		if p != nil {
+			payload.domainPolicy = *p
+		}
+		b, err := json.Marshal(payload)
+		if err != nil {
+			panic(err)
+		}
+		c.Payload = string(b)
+	}
+	if p != nil {
+		state := "enabled"
+		if !p.Enabled {
+			state = "disabled"
+		}
+		limit := func(v *int) string {
+			if v == nil {
+				return "default"
+			}
+			return fmt.Sprint(*v)
+		}
+		c.Summary = fmt.Sprintf("set policy of '%s': %s, ClientLimit %s, IssuedCertDuration %s, Profiles %v",
+			domain, state, limit(p.ClientLimit), limit(p.IssuedCertDuration), p.Profiles)
+	}
+	if revoke {
+		c.Summary += "; revoke the certs of users who lose access"
+	}
+	return c
+}
+
+func applyChangeDomain(c *change) (string, error) {
+	payload := &domainPayload{Remove: c.Payload == ""}
+	if c.Payload != "" {
+		if err := json.Unmarshal([]byte(c.Payload), payload); err != nil {
+			return "", errors.New("malformed domain policy change")
+		}
+	}
+	var p *domainPolicy
+	if !payload.Remove {
+		p = &payload.domainPolicy
+	}
+	report, err := storeDomainPolicy(c.Target, p, payload.Revoke)
+	if err != nil {
+		return "", err
+	}
+	if p == nil {
+		return fmt.Sprintf("'%s' removed; %s", c.Target, report), nil
+	}
+	return fmt.Sprintf("policy of '%s' updated; %s", c.Target, report), nil
+}
+
+/*
+ * API endpoint handlers
+ */
+
+func domainsHandler(writer http.ResponseWriter, req *http.Request) {
+	// GET /api/config/domains -- fetch the policies of all whitelisted domains
+	//   I: none
+	//   O: {Domains: [<policy>], Profiles: [""]}
+	//      ...where <policy> == {Domain: "", Enabled: true, ClientLimit: null, IssuedCertDuration: null,
+	//      Profiles: [""], Modified: ""}
+	//   200: success; 403: not permitted to view settings
+	//   Note: Profiles at the top level lists every .ovpn profile Heimdall offers
+	// PUT /api/config/domains/<domain>[?revoke=true] -- create or replace a domain's policy
+	//   I: {Enabled: true, ClientLimit: null, IssuedCertDuration: null, Profiles: [""]}
+	//   O: same as GET, plus {LostAccess: [""], Revoked: 0}
+	//   200: success; 202 (accepted): {Change: <change>} awaiting approval, if required (see
+	//   /api/changes); 400: bad domain, a limit less than 1, or an unknown profile; 403: not
+	//   permitted to manage settings
+	//   Note: null limits mean the service-wide settings apply; empty Profiles means any profile.
+	//   LostAccess lists users with devices who were only entitled by a disabled domain; with
+	//   ?revoke=true their devices are revoked, and Revoked says how many
+	// DELETE /api/config/domains/<domain>[?revoke=true] -- remove a domain and its policy altogether
+	//   I: none
+	//   O: same as PUT
+	//   200: success; 202: as for PUT; 400: bad domain; 403: as for PUT
+	// non-GET/PUT/DELETE: 405 (method not allowed)
+
+	TAG := "domainsHandler"
+
+	ssn, _, _, acc := loadSession(req)
+	if !ssn.IsLoggedIn() {
+		httputil.SendJSON(writer, http.StatusForbidden, &apiResponse{Error: authError})
+		return
+	}
+	if !acc.can(viewSettings) || (req.Method != "GET" && !acc.can(manageSettings)) {
+		httputil.SendJSON(writer, http.StatusForbidden, &apiResponse{Error: settingsError})
+		return
+	}
+
+	var report *accessReport
+	switch req.Method {
+	case "GET":
+	case "PUT", "DELETE":
+		domain, err := validate.Domain(extractSegment(req.URL.Path, 4))
+		if err != nil {
+			sendInvalidInput(writer, err)
+			return
+		}
+		var p *domainPolicy
+		if req.Method == "PUT" {
+			p = &domainPolicy{}
+			if err := httputil.PopulateFromBody(p, req); err != nil {
+				httputil.SendJSON(writer, http.StatusBadRequest, &apiResponse{Error: clientJSONError})
+				return
+			}
+			p.Domain = domain
+		}
+		revoke := req.FormValue("revoke") == "true"
+		if holdForApproval(writer, ssn, domainChange(domain, p, revoke)) {
+			return
+		}
+		if report, err = storeDomainPolicy(domain, p, revoke); err != nil {
+			sendInvalidInput(writer, err)
+			return
+		}
+		log.Status(TAG, fmt.Sprintf("policy of '%s' changed by '%s'", domain, ssn.Email))
+	default:
+		panic("API method sentinel misconfiguration")
+	}
+
+	// all methods respond with the complete list
+	res := &struct {
+		Domains  []*domainPolicy
+		Profiles []string
+	}{}
+	status, err := cfg.APIClient.Call("domains", "GET", nil, struct{}{}, res)
+	if err != nil {
+		panic(err)
+	}
+	if status >= 300 {
+		panic(fmt.Sprintf("non-200 status code %d from API server", status))
+	}
+	httputil.SendJSON(writer, http.StatusOK, apiResponse{nil, &struct {
+		Domains  []*domainPolicy
+		Profiles []string
+		*accessReport
+	}{res.Domains, res.Profiles, report}})
+}
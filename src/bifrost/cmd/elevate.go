@@ -0,0 +1,231 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Just-in-time elevation. With RequireElevation set, admins act as regular users until they request
+// admin rights for a limited time, giving a reason; with ElevationApproval also set, another admin
+// must approve the request first. Heimdall records each elevation and expires it.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"playground/apiclient"
+	"playground/httputil"
+	"playground/log"
+)
+
+type elevation struct {
+	ID                    int64
+	Email, Role, Reason   string
+	Minutes               int
+	Requested, ApprovedBy string
+	Started, Expires      string
+	Active                bool
+}
+
+// loadElevations fetches the active & pending elevations of the indicated user, or of everyone if
+// email is "".
+func loadElevations(email string) []*elevation {
+	res := &struct{ Elevations []*elevation }{}
+	status, err := cfg.APIClient.Call(apiclient.URLJoin("elevations", email), "GET", nil, struct{}{}, res)
+	if err != nil {
+		panic(err)
+	}
+	if status >= 300 {
+		panic(fmt.Sprintf("non-200 status code %d from API server", status))
+	}
+	return res.Elevations
+}
+
+// loadElevatedAccess determines what an admin who must elevate may currently do: nothing beyond a
+// regular user, unless they have an active elevation.
+func loadElevatedAccess(email string) *access {
+	acc := &access{Eligible: roleAdmin}
+	for _, e := range loadElevations(email) {
+		if e.Active && e.Role == roleAdmin {
+			acc.Role, acc.Expires = e.Role, e.Expires
+		}
+	}
+	return acc
+}
+
+// closeElevation ends an active elevation, or turns down a request, on behalf of by. It returns false
+// if the elevation is active and isn't by's own, since others may only turn down requests.
+func closeElevation(id int64, by string) bool {
+	v := url.Values{}
+	v.Add("by", by)
+	u := apiclient.URLJoin("elevation", strconv.FormatInt(id, 10)) + "?" + v.Encode()
+	status, err := cfg.APIClient.Call(u, "DELETE", nil, struct{}{}, nil)
+	if err != nil {
+		panic(err)
+	}
+	if status == http.StatusConflict {
+		return false
+	}
+	if status >= 300 {
+		panic(fmt.Sprintf("non-200 status code %d from API server", status))
+	}
+	return true
+}
+
+/*
+ * API endpoint handlers
+ */
+
+func elevationHandler(writer http.ResponseWriter, req *http.Request) {
+	// GET /api/elevation -- fetch the current user's elevation state
+	//   I: none
+	//   O: {Eligible: false, RequireApproval: false, MaxMinutes: 60, Mine: [<elevation>], Pending: [<elevation>]}
+	//      ...where <elevation> == {ID: 0, Email: "", Role: "", Reason: "", Minutes: 0, Requested: "",
+	//      ApprovedBy: "", Started: "", Expires: "", Active: false}
+	//   200: success
+	//   Note: Mine is the user's own active or pending elevation, if any; Pending is other admins'
+	//   requests awaiting approval, if the user is eligible to approve them
+	// POST /api/elevation -- request elevation to admin
+	//   I: {Reason: "", Minutes: 60}
+	//   O: same as GET
+	//   200: success; the elevation is active, unless RequireApproval; 400: missing reason, or bad
+	//   Minutes; 403: not eligible; 409 (conflict): already elevated or awaiting approval
+	// DELETE /api/elevation -- end the user's elevation early, or withdraw their request
+	//   I: none
+	//   O: same as GET
+	//   200: success; 403: not eligible
+	// PUT /api/elevation/<id> -- approve another admin's request
+	//   I: none
+	//   O: same as GET
+	//   200: success; 400: own request; 403: not eligible; 404: no such request awaiting approval
+	// DELETE /api/elevation/<id> -- turn down another admin's request
+	//   I: none
+	//   O: same as GET
+	//   200: success; 403: not eligible; 409: the request was already approved
+	// other methods: 405 (method not allowed)
+
+	TAG := "elevationHandler"
+
+	ssn, _, _, acc := loadSession(req)
+	if !ssn.IsLoggedIn() {
+		httputil.SendJSON(writer, http.StatusForbidden, &apiResponse{Error: authError})
+		return
+	}
+	if req.Method != "GET" && acc.Eligible == "" {
+		httputil.SendJSON(writer, http.StatusForbidden, &apiResponse{Error: elevationError})
+		return
+	}
+
+	var id int64
+	if segment := extractSegment(req.URL.Path, 3); segment != "" {
+		var err error
+		if id, err = strconv.ParseInt(segment, 10, 64); err != nil {
+			httputil.SendJSON(writer, http.StatusBadRequest, &apiResponse{Error: clientURLError})
+			return
+		}
+	}
+
+	switch {
+	case req.Method == "GET":
+	case req.Method == "POST":
+		in := &struct {
+			Reason  string
+			Minutes int
+		}{}
+		if err := httputil.PopulateFromBody(in, req); err != nil {
+			httputil.SendJSON(writer, http.StatusBadRequest, &apiResponse{Error: clientJSONError})
+			return
+		}
+		if in.Minutes < 1 || in.Minutes > cfg.MaxElevationMinutes {
+			sendInvalidInput(writer, fmt.Errorf("elevation may last at most %d minutes", cfg.MaxElevationMinutes))
+			return
+		}
+		body := &struct {
+			Role, Reason string
+			Minutes      int
+			Approved     bool
+		}{acc.Eligible, in.Reason, in.Minutes, !cfg.ElevationApproval}
+		res := &json.RawMessage{}
+		status, err := cfg.APIClient.Call(apiclient.URLJoin("elevations", ssn.Email), "POST", nil, body, res)
+		if err != nil {
+			panic(err)
+		}
+		switch status {
+		case http.StatusBadRequest:
+			rejected := &struct{ Error string }{}
+			json.Unmarshal(*res, rejected)
+			sendInvalidInput(writer, errors.New(rejected.Error))
+			return
+		case http.StatusConflict:
+			httputil.SendJSON(writer, http.StatusConflict, &apiResponse{Error: elevatedError})
+			return
+		}
+		if status >= 300 {
+			panic(fmt.Sprintf("non-200 status code %d from API server", status))
+		}
+		log.Status(TAG, fmt.Sprintf("'%s' requested elevation for %d minutes", ssn.Email, in.Minutes))
+	case req.Method == "DELETE" && id == 0:
+		for _, e := range loadElevations(ssn.Email) {
+			closeElevation(e.ID, ssn.Email)
+		}
+		log.Status(TAG, fmt.Sprintf("'%s' ended their elevation", ssn.Email))
+	case req.Method == "PUT":
+		res := &json.RawMessage{}
+		status, err := cfg.APIClient.Call(apiclient.URLJoin("elevation", strconv.FormatInt(id, 10)), "PUT", nil, &struct{ ApprovedBy string }{ssn.Email}, res)
+		if err != nil {
+			panic(err)
+		}
+		switch status {
+		case http.StatusBadRequest:
+			rejected := &struct{ Error string }{}
+			json.Unmarshal(*res, rejected)
+			sendInvalidInput(writer, errors.New(rejected.Error))
+			return
+		case http.StatusNotFound:
+			httputil.SendJSON(writer, http.StatusNotFound, &apiResponse{Error: clientURLError})
+			return
+		}
+		if status >= 300 {
+			panic(fmt.Sprintf("non-200 status code %d from API server", status))
+		}
+		log.Status(TAG, fmt.Sprintf("'%s' approved elevation %d", ssn.Email, id))
+	case req.Method == "DELETE":
+		if !closeElevation(id, ssn.Email) {
+			httputil.SendJSON(writer, http.StatusConflict, &apiResponse{Error: approvedError})
+			return
+		}
+		log.Status(TAG, fmt.Sprintf("'%s' turned down elevation %d", ssn.Email, id))
+	default:
+		panic("API method sentinel misconfiguration")
+	}
+
+	// all methods respond with the current state
+	res := &struct {
+		Eligible, RequireApproval bool
+		MaxMinutes                int
+		Mine, Pending             []*elevation
+	}{acc.Eligible != "", cfg.ElevationApproval, cfg.MaxElevationMinutes, []*elevation{}, []*elevation{}}
+	if res.Eligible {
+		for _, e := range loadElevations("") {
+			if e.Email == ssn.Email {
+				res.Mine = append(res.Mine, e)
+			} else if !e.Active {
+				res.Pending = append(res.Pending, e)
+			}
+		}
+	}
+	httputil.SendJSON(writer, http.StatusOK, apiResponse{nil, res})
+}
@@ -0,0 +1,151 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Lockdown mode, stored in Heimdall, which (with the OpenVPN hooks) enforces it. It's for emergencies,
+// so it never waits for a second admin's approval.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"playground/httputil"
+	"playground/log"
+
+	"validate"
+)
+
+type lockdown struct {
+	Enabled           bool
+	EnabledBy, Reason string
+	BreakGlass        []string
+	Created           string
+	SessionsEnded     int `json:",omitempty"`
+}
+
+// loadLockdown fetches the current lockdown; its Enabled is false if the service isn't locked down.
+func loadLockdown() *lockdown {
+	res := &lockdown{}
+	status, err := cfg.APIClient.Call("lockdown", "GET", nil, struct{}{}, res)
+	if err != nil {
+		panic(err)
+	}
+	if status >= 300 {
+		panic(fmt.Sprintf("non-200 status code %d from API server", status))
+	}
+	return res
+}
+
+/*
+ * API endpoint handlers
+ */
+
+func lockdownHandler(writer http.ResponseWriter, req *http.Request) {
+	// GET /api/lockdown -- fetch the current lockdown
+	//   I: none
+	//   O: {Enabled: false, EnabledBy: "", Reason: "", BreakGlass: [""], Created: ""}
+	//   200: success; 403: not permitted to view settings
+	// PUT /api/lockdown -- lock the service down, or change the current lockdown
+	//   I: {Reason: "", BreakGlass: [""], Disconnect: false}
+	//   O: as for GET, plus SessionsEnded: 0
+	//   200: success; 400: no reason, or bad break-glass emails; 403: not permitted to change settings
+	//   Note: the acting admin is always on the break-glass list. With Disconnect, everyone else's live
+	//   sessions are ended; SessionsEnded is -1 if that failed.
+	// DELETE /api/lockdown -- lift the lockdown
+	//   I: none
+	//   O: as for GET
+	//   200: success; 404: not locked down; 403: not permitted to change settings
+	// non-GET/PUT/DELETE: 405 (method not allowed)
+
+	TAG := "lockdownHandler"
+
+	ssn, _, _, acc := loadSession(req)
+	if !ssn.IsLoggedIn() {
+		httputil.SendJSON(writer, http.StatusForbidden, &apiResponse{Error: authError})
+		return
+	}
+	if !acc.can(viewSettings) || (req.Method != "GET" && !acc.can(manageSettings)) {
+		httputil.SendJSON(writer, http.StatusForbidden, &apiResponse{Error: settingsError})
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		httputil.SendJSON(writer, http.StatusOK, apiResponse{nil, loadLockdown()})
+	case "PUT":
+		body := &struct {
+			Reason     string
+			BreakGlass []string
+			Disconnect bool
+		}{}
+		if err := httputil.PopulateFromBody(body, req); err != nil {
+			httputil.SendJSON(writer, http.StatusBadRequest, &apiResponse{Error: clientJSONError})
+			return
+		}
+		for i, e := range body.BreakGlass {
+			var err error
+			if body.BreakGlass[i], err = validate.Email(e); err != nil {
+				sendInvalidInput(writer, err)
+				return
+			}
+		}
+		apiReq := &struct {
+			By, Reason string
+			BreakGlass []string
+			Disconnect bool
+		}{ssn.Email, body.Reason, body.BreakGlass, body.Disconnect}
+		res := &json.RawMessage{}
+		status, err := cfg.APIClient.Call("lockdown", "PUT", nil, apiReq, res)
+		if err != nil {
+			panic(err)
+		}
+		if status == http.StatusBadRequest {
+			rejected := &struct{ Error string }{}
+			json.Unmarshal(*res, rejected)
+			sendInvalidInput(writer, errors.New(rejected.Error))
+			return
+		}
+		if status >= 300 {
+			panic(fmt.Sprintf("non-200 status code %d from API server", status))
+		}
+		l := &lockdown{}
+		if err = json.Unmarshal(*res, l); err != nil {
+			panic(err)
+		}
+		log.Status(TAG, fmt.Sprintf("'%s' locked the service down (%s); %d sessions ended", ssn.Email, l.Reason, l.SessionsEnded))
+		httputil.SendJSON(writer, http.StatusOK, apiResponse{nil, l})
+	case "DELETE":
+		v := url.Values{}
+		v.Add("by", ssn.Email)
+		status, err := cfg.APIClient.Call("lockdown?"+v.Encode(), "DELETE", nil, struct{}{}, nil)
+		if err != nil {
+			panic(err)
+		}
+		if status == http.StatusNotFound {
+			httputil.SendJSON(writer, http.StatusNotFound, apiResponse{Error: &apiError{"The service isn't locked down.", "Please reload the page.", true}})
+			return
+		}
+		if status >= 300 {
+			panic(fmt.Sprintf("non-200 status code %d from API server", status))
+		}
+		log.Status(TAG, fmt.Sprintf("'%s' lifted the lockdown", ssn.Email))
+		httputil.SendJSON(writer, http.StatusOK, apiResponse{nil, loadLockdown()})
+	default:
+		panic("API method sentinel misconfiguration")
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Lost devices, which users report themselves. Heimdall does the work: see its lost.go.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"playground/apiclient"
+	"playground/httputil"
+	"playground/log"
+)
+
+/*
+ * API endpoint handlers
+ */
+
+func lostHandler(writer http.ResponseWriter, req *http.Request) {
+	// POST /api/lost -- report lost devices of the current user: deactivate them, end their VPN
+	// sessions, optionally reset the user's password (TOTP seed), and notify the admins
+	//   I: {Fingerprints: [""], RotateTOTP: false, Note: ""}
+	//   O: {ImageURL: "", SessionsEnded: 0}
+	//   200: success; 400: no devices or password given, or a device isn't one of the user's;
+	//   423: RotateTOTP while the service is locked down, in which case nothing is done
+	//   429: RotateTOTP, and too many passwords were reset recently; nothing is done
+	//   Note: ImageURL is the new TOTP seed's QR code, as for POST /api/totp, or "" unless RotateTOTP;
+	//   SessionsEnded is -1 if live sessions couldn't be ended
+	// non-POST: 405 (method not allowed)
+
+	TAG := "lostHandler"
+
+	ssn, _, isAllowed, _ := loadSession(req)
+	if !ssn.IsLoggedIn() || !isAllowed {
+		httputil.SendJSON(writer, http.StatusForbidden, &apiResponse{Error: authError})
+		return
+	}
+
+	body := &struct {
+		Fingerprints []string
+		RotateTOTP   bool
+		Note         string
+	}{}
+	if err := httputil.PopulateFromBody(body, req); err != nil {
+		httputil.SendJSON(writer, http.StatusBadRequest, &apiResponse{Error: clientJSONError})
+		return
+	}
+	if len(body.Fingerprints) == 0 && !body.RotateTOTP {
+		sendInvalidInput(writer, errors.New("Choose the devices you lost, or reset your password."))
+		return
+	}
+
+	// Heimdall only knows the admins with the admin role, so name the config-file ones too
+	apiReq := &struct {
+		Fingerprints []string
+		RotateTOTP   bool
+		Note         string
+		Notify       []string
+	}{body.Fingerprints, body.RotateTOTP, body.Note, cfg.AdminUsers}
+	res := &json.RawMessage{}
+	status, err := cfg.APIClient.Call(apiclient.URLJoin("lost", ssn.Email), "POST", nil, apiReq, res)
+	if err != nil {
+		panic(err)
+	}
+	if status == http.StatusBadRequest {
+		rejected := &struct{ Error string }{}
+		json.Unmarshal(*res, rejected)
+		sendInvalidInput(writer, errors.New(rejected.Error))
+		return
+	}
+	if status == http.StatusLocked {
+		httputil.SendJSON(writer, http.StatusLocked, apiResponse{Error: lockdownError})
+		return
+	}
+	if status == http.StatusTooManyRequests {
+		limited := &struct{ RetryAfter int }{}
+		json.Unmarshal(*res, limited)
+		log.Warn(TAG, fmt.Sprintf("'%s' hit the TOTP rate limit reporting a lost device", ssn.Email))
+		sendRateLimited(writer, limited.RetryAfter)
+		return
+	}
+	if status >= 300 {
+		panic(fmt.Sprintf("non-200 status code %d from API server", status))
+	}
+	result := &struct {
+		Revoked       []string
+		TOTPURL       string
+		SessionsEnded int
+	}{}
+	if err = json.Unmarshal(*res, result); err != nil {
+		panic(err)
+	}
+
+	log.Status(TAG, fmt.Sprintf("'%s' reported %d lost devices (password reset: %t)", ssn.Email, len(result.Revoked), body.RotateTOTP))
+	httputil.SendJSON(writer, http.StatusOK, apiResponse{nil, &struct {
+		ImageURL      string
+		SessionsEnded int
+	}{result.TOTPURL, result.SessionsEnded}})
+}
@@ -0,0 +1,182 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Mass revocation, for incident response; Heimdall does the work (see its massrevoke.go). Revoking a
+// batch needs approval when the "mass-revoke" operation does, and domain admins may only revoke
+// within one of their domains, and only if no one there holds a role (see canFor).
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"playground/httputil"
+	"playground/log"
+
+	"validate"
+)
+
+// massRevocation is a request to revoke the certs matching a selector, or to preview them if Digest
+// is "". The selector fields are as for Heimdall's certSelector.
+type massRevocation struct {
+	Since, Until, Domain, Issuer, Description string
+	All                                       bool
+	Reason, Digest                            string
+	Disconnect                                bool
+}
+
+type massRevocationResult struct {
+	Certs []*struct {
+		Email, Fingerprint, Description, Created, Issuer string
+	}
+	Digest, Criteria, Batch string
+	SessionsEnded           int
+}
+
+// callMassRevoke passes m to the API server, on behalf of the indicated admin. It returns the API
+// server's status code, which is 409 if Digest no longer matches; an error means the API server
+// rejected m, and explains why.
+func callMassRevoke(m *massRevocation, by string) (*massRevocationResult, int, error) {
+	apiReq := &struct {
+		massRevocation
+		By string
+	}{*m, by}
+	res := &json.RawMessage{}
+	status, err := cfg.APIClient.Call("massrevoke", "POST", nil, apiReq, res)
+	if err != nil {
+		panic(err)
+	}
+	if status == http.StatusBadRequest {
+		rejected := &struct{ Error string }{}
+		json.Unmarshal(*res, rejected)
+		return nil, status, errors.New(rejected.Error)
+	}
+	if status >= 300 && status != http.StatusConflict {
+		panic(fmt.Sprintf("non-200 status code %d from API server", status))
+	}
+	result := &massRevocationResult{}
+	if err = json.Unmarshal(*res, result); err != nil {
+		panic(err)
+	}
+	return result, status, nil
+}
+
+func applyMassRevoke(c *change) (string, error) {
+	m := &massRevocation{}
+	if err := json.Unmarshal([]byte(c.Payload), m); err != nil || m.Digest == "" {
+		return "", errors.New("malformed mass revocation")
+	}
+	res, status, err := callMassRevoke(m, c.RequestedBy)
+	if err != nil {
+		return "", err
+	}
+	if status == http.StatusConflict {
+		return "", errors.New("the matching devices have changed since this was requested")
+	}
+	return fmt.Sprintf("batch %s: %d devices revoked", res.Batch, len(res.Certs)), nil
+}
+
+/*
+ * API endpoint handlers
+ */
+
+func massRevokeHandler(writer http.ResponseWriter, req *http.Request) {
+	// POST /api/massrevoke -- preview, or carry out, the revocation of every device matching a selector
+	//   I: {Since: "", Until: "", Domain: "", Issuer: "", Description: "", All: false, Reason: "",
+	//       Digest: "", Disconnect: false}
+	//   O: {Certs: [{Email: "", Fingerprint: "", Description: "", Created: "", Issuer: ""}], Digest: "",
+	//       Criteria: "", Batch: "", SessionsEnded: 0}
+	//   200: success; 202: {Change: <change>} held for approval (see /api/changes); 400: bad fields;
+	//   403: not permitted to manage users, or (for domain admins) Domain isn't one of theirs, or
+	//   someone in it holds a role;
+	//   409: the matching devices have changed since the preview
+	//   Note: without Digest this is a preview, and nothing is revoked. Pass the preview's Digest to
+	//   revoke exactly those devices. Since & Until are timestamps; Issuer is a CA cert's SHA-256
+	//   fingerprint; Description may use * and ? as wildcards; All must be set, alone, to revoke
+	//   every device. Reason is as for DELETE /api/certs/<fingerprint>, except that it can't be a hold.
+	// non-POST: 405 (method not allowed)
+
+	TAG := "massRevokeHandler"
+
+	ssn, _, _, acc := loadSession(req)
+	if !ssn.IsLoggedIn() {
+		httputil.SendJSON(writer, http.StatusForbidden, &apiResponse{Error: authError})
+		return
+	}
+	if !acc.can(manageUsers) {
+		httputil.SendJSON(writer, http.StatusForbidden, &apiResponse{Error: usersError})
+		return
+	}
+
+	m := &massRevocation{}
+	if err := httputil.PopulateFromBody(m, req); err != nil {
+		httputil.SendJSON(writer, http.StatusBadRequest, &apiResponse{Error: clientJSONError})
+		return
+	}
+	target := ""
+	if m.Domain != "" {
+		var err error
+		if m.Domain, err = validate.Domain(m.Domain); err != nil {
+			sendInvalidInput(writer, err)
+			return
+		}
+		target = "*@" + m.Domain
+	}
+	if !acc.canFor(manageUsers, target) {
+		sendForbidden(writer, acc, manageUsers, usersError)
+		return
+	}
+
+	// always preview first, so that a request held for approval describes what it would revoke
+	digest := m.Digest
+	m.Digest = ""
+	res, _, err := callMassRevoke(m, ssn.Email)
+	if err != nil {
+		sendInvalidInput(writer, err)
+		return
+	}
+	if digest == "" {
+		httputil.SendJSON(writer, http.StatusOK, apiResponse{nil, res})
+		return
+	}
+	if digest != res.Digest {
+		httputil.SendJSON(writer, http.StatusConflict, apiResponse{Error: previewError})
+		return
+	}
+
+	m.Digest = digest
+	payload, err := json.Marshal(m)
+	if err != nil {
+		panic(err)
+	}
+	c := &change{Operation: opMassRevoke, Target: target, Payload: string(payload), Summary: fmt.Sprintf("revoke %d devices matching %s", len(res.Certs), res.Criteria)}
+	if holdForApproval(writer, ssn, c) {
+		return
+	}
+
+	res, status, err := callMassRevoke(m, ssn.Email)
+	if err != nil {
+		sendInvalidInput(writer, err)
+		return
+	}
+	if status == http.StatusConflict { // changed between the preview above and now
+		httputil.SendJSON(writer, http.StatusConflict, apiResponse{Error: previewError})
+		return
+	}
+	log.Status(TAG, fmt.Sprintf("'%s' revoked %d devices matching %s in batch %s", ssn.Email, len(res.Certs), res.Criteria, res.Batch))
+	httputil.SendJSON(writer, http.StatusOK, apiResponse{nil, res})
+}
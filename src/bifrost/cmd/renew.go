@@ -0,0 +1,103 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Cert renewal, on behalf of POST /api/certs/<fingerprint>. Heimdall issues the replacement and retires
+// the old cert once the new one is first used (see its renew.go).
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"playground/apiclient"
+	"playground/httputil"
+	"playground/log"
+
+	"validate"
+)
+
+// renewCert renews the indicated cert, which must belong to email, and sends the new .ovpn.
+func renewCert(writer http.ResponseWriter, req *http.Request, email, fp string) {
+	TAG := "renewCert"
+
+	fp, err := validate.Fingerprint(fp)
+	if err != nil {
+		sendInvalidInput(writer, err)
+		return
+	}
+	body := &struct{ Profile, CSR string }{}
+	if err = httputil.PopulateFromBody(body, req); err != nil {
+		httputil.SendJSON(writer, http.StatusBadRequest, apiResponse{Error: clientJSONError})
+		return
+	}
+
+	endpoint := apiclient.URLJoin("cert", fp)
+	owner := &struct {
+		Email   string
+		FromCSR bool
+	}{}
+	status, err := cfg.APIClient.Call(endpoint, "GET", nil, struct{}{}, owner)
+	if err != nil {
+		panic(err)
+	}
+	if status == http.StatusNotFound {
+		httputil.SendJSON(writer, http.StatusConflict, apiResponse{Error: renewError})
+		return
+	}
+	if status >= 300 {
+		panic(fmt.Sprintf("non-200 status code %d from API server", status))
+	}
+	if owner.Email != email { // not even admins can renew other users' certs
+		log.Warn(TAG, fmt.Sprintf("'%s' attempted to renew '%s' owned by '%s'", email, fp, owner.Email))
+		httputil.SendJSON(writer, http.StatusForbidden, apiResponse{Error: clientJSONError})
+		return
+	}
+	if owner.FromCSR && body.CSR == "" { // Heimdall has no key to give it
+		httputil.SendJSON(writer, http.StatusConflict, apiResponse{Error: renewCSRError})
+		return
+	}
+
+	res := &struct {
+		OVPNDataURL string
+		RetryAfter  int
+		Error       string
+	}{}
+	status, err = cfg.APIClient.Call(endpoint, "POST", nil, body, res)
+	if err != nil {
+		panic(err)
+	}
+	switch status {
+	case http.StatusTooManyRequests:
+		log.Warn(TAG, fmt.Sprintf("'%s' hit the issuance rate limit", email))
+		sendRateLimited(writer, res.RetryAfter)
+		return
+	case http.StatusLocked:
+		log.Warn(TAG, fmt.Sprintf("renewal for '%s' blocked by lockdown", email))
+		httputil.SendJSON(writer, http.StatusLocked, apiResponse{Error: lockdownError})
+		return
+	case http.StatusConflict, http.StatusNotFound:
+		httputil.SendJSON(writer, http.StatusConflict, apiResponse{Error: renewError})
+		return
+	case http.StatusBadRequest:
+		sendInvalidInput(writer, errors.New(res.Error))
+		return
+	}
+	if status >= 300 {
+		panic(fmt.Sprintf("non-200 status code %d from API server", status))
+	}
+	log.Status(TAG, fmt.Sprintf("'%s' renewed certificate '%s'", email, fp))
+	httputil.SendJSON(writer, http.StatusOK, apiResponse{nil, &struct{ OVPNDataURL string }{res.OVPNDataURL}})
+}
@@ -0,0 +1,335 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Administrative roles & permissions. Roles are stored in Heimdall, except for the AdminUsers in the
+// config file, who are always full admins. Handlers check for the specific permission they need;
+// a domain admin's permissions apply only to users in their domains.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"playground/apiclient"
+	"playground/httputil"
+	"playground/log"
+
+	"validate"
+)
+
+type permission int
+
+const (
+	viewUsers      permission = iota // list users, their devices & aliases, and the whitelist
+	manageUsers                      // reset & rename users, revoke their devices, edit the whitelist
+	viewEvents                       // read the event log
+	viewSettings                     // read service settings
+	manageSettings                   // change service settings
+	manageRoles                      // grant & revoke roles
+	exportState                      // export & import the complete service state
+)
+
+// permissionNames are the names under which permissions are reported to the client
+var permissionNames = map[permission]string{
+	viewUsers:      "ViewUsers",
+	manageUsers:    "ManageUsers",
+	viewEvents:     "ViewEvents",
+	viewSettings:   "ViewSettings",
+	manageSettings: "ManageSettings",
+	manageRoles:    "ManageRoles",
+	exportState:    "ExportState",
+}
+
+const (
+	roleAdmin       = "admin"
+	roleAuditor     = "auditor"
+	roleDomainAdmin = "domain-admin"
+)
+
+var rolePermissions = map[string][]permission{
+	roleAdmin:       {viewUsers, manageUsers, viewEvents, viewSettings, manageSettings, manageRoles, exportState},
+	roleAuditor:     {viewUsers, viewEvents, viewSettings},
+	roleDomainAdmin: {viewUsers, manageUsers, viewEvents},
+}
+
+// access is what a session may do beyond using the VPN itself. A zero access (i.e. Role "") is a
+// regular user with no administrative permissions.
+type access struct {
+	Role     string
+	Domains  []string // for domain admins, the domains whose users they may see & manage
+	Eligible string   // a role the session may elevate to; see elevate.go
+	Expires  string   // when Role lapses, if it's from an elevation
+}
+
+// can indicates whether the session has permission p for at least some users.
+func (a *access) can(p permission) bool {
+	for _, granted := range rolePermissions[a.Role] {
+		if granted == p {
+			return true
+		}
+	}
+	return false
+}
+
+// canFor indicates whether the session has permission p for the user with the indicated email, or
+// for every user in a domain given as "*@<domain>" ("" meaning all users), as for mass revocation.
+// Only those who can manage roles may manage users who hold one, so that e.g. a domain admin can't
+// revoke an admin's certs, nor a domain's if it has any admins.
+func (a *access) canFor(p permission, email string) bool {
+	if !a.can(p) || !a.covers(email) {
+		return false
+	}
+	if p != manageUsers || a.can(manageRoles) {
+		return true
+	}
+	if email == "" || strings.HasPrefix(email, "*@") {
+		return !roleHoldersIn(strings.TrimPrefix(email, "*@"))
+	}
+	return loadAccess(email).Role == ""
+}
+
+// roleHoldersIn indicates whether any user in the indicated domain ("" for any) holds a role,
+// config-file admins included.
+func roleHoldersIn(domain string) bool {
+	in := func(email string) bool { return domain == "" || strings.HasSuffix(email, "@"+domain) }
+	for _, admin := range cfg.AdminUsers {
+		if in(admin) {
+			return true
+		}
+	}
+	stored := &struct{ Roles []*struct{ Email string } }{}
+	status, err := cfg.APIClient.Call("roles", "GET", nil, struct{}{}, stored)
+	if err != nil {
+		panic(err)
+	}
+	if status >= 300 {
+		panic(fmt.Sprintf("non-200 status code %d from API server", status))
+	}
+	for _, r := range stored.Roles {
+		if in(r.Email) {
+			return true
+		}
+	}
+	return false
+}
+
+// covers indicates whether email falls within the session's domains, if it is limited to any.
+func (a *access) covers(email string) bool {
+	if a.Role != roleDomainAdmin {
+		return true
+	}
+	for _, d := range a.Domains {
+		if strings.HasSuffix(email, "@"+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// visible filters emails down to those within the session's domains.
+func (a *access) visible(emails []string) []string {
+	res := []string{}
+	for _, email := range emails {
+		if a.covers(email) {
+			res = append(res, email)
+		}
+	}
+	return res
+}
+
+// sendForbidden responds with a 403 for a session lacking permission for a particular user,
+// distinguishing a domain admin acting outside their domains from a session lacking it altogether.
+func sendForbidden(writer http.ResponseWriter, acc *access, p permission, err *apiError) {
+	if acc.can(p) {
+		err = scopeError
+	}
+	httputil.SendJSON(writer, http.StatusForbidden, &apiResponse{Error: err})
+}
+
+// permissions reports which permissions the session has, for the client to tailor its UI.
+func (a *access) permissions() map[string]bool {
+	res := make(map[string]bool)
+	for p, name := range permissionNames {
+		res[name] = a.can(p)
+	}
+	return res
+}
+
+// syncAdmins reports the config-file admins to Heimdall, which needs them for the entitlement checks
+// it makes on its own (e.g. when a whitelist entry expires). Heimdall may not be up yet, so it retries
+// each minute until it succeeds.
+func syncAdmins() {
+	TAG := "syncAdmins"
+	body := &struct{ Emails []string }{cfg.AdminUsers}
+	for {
+		status, err := cfg.APIClient.Call("admins", "PUT", nil, body, nil)
+		if err == nil && status < 300 {
+			log.Status(TAG, fmt.Sprintf("reported %d config-file admins to API server", len(cfg.AdminUsers)))
+			return
+		}
+		log.Warn(TAG, fmt.Sprintf("failed to report config-file admins (status %d); retrying in a minute", status), err)
+		time.Sleep(time.Minute)
+	}
+}
+
+// loadAccess determines the role of the indicated (canonical) email.
+func loadAccess(email string) *access {
+	for _, admin := range cfg.AdminUsers {
+		if admin == email {
+			return &access{Role: roleAdmin}
+		}
+	}
+
+	a := &access{}
+	status, err := cfg.APIClient.Call(apiclient.URLJoin("roles", email), "GET", nil, struct{}{}, a)
+	if err != nil {
+		panic(err)
+	}
+	if status == http.StatusNotFound {
+		return &access{}
+	}
+	if status >= 300 {
+		panic(fmt.Sprintf("non-200 status code %d from API server", status))
+	}
+	if _, ok := rolePermissions[a.Role]; !ok {
+		log.Warn("loadAccess", fmt.Sprintf("ignoring unknown role '%s' for '%s'", a.Role, email))
+		return &access{}
+	}
+	return a
+}
+
+/*
+ * API endpoint handlers
+ */
+
+func rolesHandler(writer http.ResponseWriter, req *http.Request) {
+	// GET /api/roles -- fetch every user with an administrative role
+	//   I: none
+	//   O: {Roles: [{Email: "", Role: "", Domains: [""], Modified: "", Fixed: false}]}
+	//   200: success; 403: not permitted to manage roles
+	//   Note: AdminUsers from the config file are included, with Fixed set, since they can't be changed here
+	// PUT /api/roles/<email> -- grant a role, replacing any the user already has
+	//   I: {Role: "admin"|"auditor"|"domain-admin", Domains: [""]}
+	//   O: same as GET
+	//   200: success; 400: bad email, role or domains, or email is a config-file admin; 403: not
+	//   permitted to manage roles, or attempted to change own role
+	// DELETE /api/roles/<email> -- revoke a user's role
+	//   I: none
+	//   O: same as GET
+	//   200: success; 400: bad email, or email is a config-file admin; 403: as for PUT
+	// non-GET/PUT/DELETE: 405 (method not allowed)
+
+	TAG := "rolesHandler"
+
+	ssn, _, _, acc := loadSession(req)
+	if !ssn.IsLoggedIn() {
+		httputil.SendJSON(writer, http.StatusForbidden, &apiResponse{Error: authError})
+		return
+	}
+	if !acc.can(manageRoles) {
+		httputil.SendJSON(writer, http.StatusForbidden, &apiResponse{Error: rolesError})
+		return
+	}
+
+	email := extractSegment(req.URL.Path, 3)
+	if email != "" {
+		var err error
+		if email, err = validate.Email(email); err != nil {
+			sendInvalidInput(writer, err)
+			return
+		}
+	}
+	if req.Method != "GET" {
+		if email == "" {
+			httputil.SendJSON(writer, http.StatusBadRequest, apiResponse{Error: clientURLError})
+			return
+		}
+		for _, admin := range cfg.AdminUsers {
+			if admin == email {
+				sendInvalidInput(writer, errors.New("'"+email+"' is an admin via the config file"))
+				return
+			}
+		}
+		if email == ssn.Email { // i.e. no lockouts or self-promotion
+			httputil.SendJSON(writer, http.StatusForbidden, &apiResponse{Error: &apiError{"You can't change your own role.", "", true}})
+			return
+		}
+	}
+
+	switch req.Method {
+	case "GET":
+	case "PUT":
+		in := &struct {
+			Role    string
+			Domains []string
+		}{}
+		if err := httputil.PopulateFromBody(in, req); err != nil {
+			httputil.SendJSON(writer, http.StatusBadRequest, &apiResponse{Error: clientJSONError})
+			return
+		}
+		res := &json.RawMessage{}
+		status, err := cfg.APIClient.Call(apiclient.URLJoin("roles", email), "PUT", nil, in, res)
+		if err != nil {
+			panic(err)
+		}
+		if status == http.StatusBadRequest {
+			rejected := &struct{ Error string }{}
+			json.Unmarshal(*res, rejected)
+			sendInvalidInput(writer, errors.New(rejected.Error))
+			return
+		}
+		if status >= 300 {
+			panic(fmt.Sprintf("non-200 status code %d from API server", status))
+		}
+		log.Status(TAG, fmt.Sprintf("'%s' granted role '%s' by '%s'", email, in.Role, ssn.Email))
+	case "DELETE":
+		status, err := cfg.APIClient.Call(apiclient.URLJoin("roles", email), "DELETE", nil, struct{}{}, nil)
+		if err != nil {
+			panic(err)
+		}
+		if status >= 300 {
+			panic(fmt.Sprintf("non-200 status code %d from API server", status))
+		}
+		log.Status(TAG, fmt.Sprintf("'%s' role revoked by '%s'", email, ssn.Email))
+	default:
+		panic("API method sentinel misconfiguration")
+	}
+
+	// all methods respond with the complete list
+	type role struct {
+		Email, Role string
+		Domains     []string
+		Modified    string
+		Fixed       bool
+	}
+	roles := &struct{ Roles []*role }{[]*role{}}
+	for _, admin := range cfg.AdminUsers {
+		roles.Roles = append(roles.Roles, &role{admin, roleAdmin, []string{}, "", true})
+	}
+	stored := &struct{ Roles []*role }{[]*role{}}
+	status, err := cfg.APIClient.Call("roles", "GET", nil, struct{}{}, stored)
+	if err != nil {
+		panic(err)
+	}
+	if status >= 300 {
+		panic(fmt.Sprintf("non-200 status code %d from API server", status))
+	}
+	roles.Roles = append(roles.Roles, stored.Roles...)
+	httputil.SendJSON(writer, http.StatusOK, apiResponse{nil, roles})
+}
@@ -0,0 +1,212 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Scheduled revocations, stored in Heimdall, which carries them out when they're due. Scheduling the
+// revocation of all of a user's access is a reset, so it needs approval whenever resetting a user
+// does (see applyDeleteUser).
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"playground/apiclient"
+	"playground/httputil"
+	"playground/log"
+
+	"validate"
+)
+
+type scheduledRevocation struct {
+	ID          int64
+	Email       string
+	Fingerprint string // "" for all of the user's access
+	Reason      string
+	Due         string // as "2006-01-02T15:04:05Z"
+	ScheduledBy string
+	Created     string
+}
+
+// loadScheduledRevocations fetches the pending revocations of the indicated user, or of all users
+// if email is "".
+func loadScheduledRevocations(email string) []*scheduledRevocation {
+	u := "revocations"
+	if email != "" {
+		v := url.Values{}
+		v.Add("email", email)
+		u += "?" + v.Encode()
+	}
+	res := &struct{ Revocations []*scheduledRevocation }{[]*scheduledRevocation{}}
+	status, err := cfg.APIClient.Call(u, "GET", nil, struct{}{}, res)
+	if err != nil {
+		panic(err)
+	}
+	if status >= 300 {
+		panic(fmt.Sprintf("non-200 status code %d from API server", status))
+	}
+	return res.Revocations
+}
+
+// scheduleRevocation stores r, updating it with what the API server actually stored. An error means
+// the API server rejected it, and explains why.
+func scheduleRevocation(r *scheduledRevocation) error {
+	res := &json.RawMessage{}
+	status, err := cfg.APIClient.Call("revocations", "POST", nil, r, res)
+	if err != nil {
+		panic(err)
+	}
+	if status == http.StatusBadRequest {
+		rejected := &struct{ Error string }{}
+		json.Unmarshal(*res, rejected)
+		return errors.New(rejected.Error)
+	}
+	if status >= 300 {
+		panic(fmt.Sprintf("non-200 status code %d from API server", status))
+	}
+	if err = json.Unmarshal(*res, r); err != nil {
+		panic(err)
+	}
+	return nil
+}
+
+/*
+ * API endpoint handlers
+ */
+
+func revocationsHandler(writer http.ResponseWriter, req *http.Request) {
+	// GET /api/revocations -- fetch every pending scheduled revocation
+	//   I: none
+	//   O: {Revocations: [{ID: 0, Email: "", Fingerprint: "", Reason: "", Due: "", ScheduledBy: "", Created: ""}]}
+	//   200: success; 403: not permitted to view users
+	// POST /api/revocations -- schedule the revocation of a cert, or of all of a user's access
+	//   I: {Email: "", Fingerprint: "", Reason: "", Due: ""}
+	//   O: same as GET
+	//   200: success; 202: {Change: <change>} held for approval (see /api/changes); 400: bad fields,
+	//   or Due isn't in the future; 403: not permitted to manage the user
+	//   Note: Fingerprint "" resets the user when Due comes; Reason is as for DELETE /api/certs/<fingerprint>,
+	//   except that a hold can't be scheduled
+	// DELETE /api/revocations/<id> -- cancel a scheduled revocation
+	//   I: none
+	//   O: same as GET
+	//   200: success; 404: no such pending revocation; 403: not permitted to manage the user
+	// non-GET/POST/DELETE: 405 (method not allowed)
+	// Domain admins only see revocations of users in their domains.
+
+	TAG := "revocationsHandler"
+
+	ssn, _, _, acc := loadSession(req)
+	if !ssn.IsLoggedIn() {
+		httputil.SendJSON(writer, http.StatusForbidden, &apiResponse{Error: authError})
+		return
+	}
+	if !acc.can(viewUsers) {
+		httputil.SendJSON(writer, http.StatusForbidden, &apiResponse{Error: usersError})
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+	case "POST":
+		r := &scheduledRevocation{}
+		if err := httputil.PopulateFromBody(r, req); err != nil {
+			httputil.SendJSON(writer, http.StatusBadRequest, &apiResponse{Error: clientJSONError})
+			return
+		}
+		var err error
+		if r.Email, err = validate.Email(r.Email); err != nil {
+			sendInvalidInput(writer, err)
+			return
+		}
+		if !acc.canFor(manageUsers, r.Email) {
+			sendForbidden(writer, acc, manageUsers, usersError)
+			return
+		}
+		if r.Reason, err = validate.RevocationReason(r.Reason); err != nil {
+			sendInvalidInput(writer, err)
+			return
+		}
+		if due, err := time.Parse(time.RFC3339, r.Due); err != nil || !due.After(time.Now()) {
+			sendInvalidInput(writer, errors.New("a revocation must be scheduled for a time in the future"))
+			return
+		}
+		if r.Fingerprint == "" {
+			payload, err := json.Marshal(&struct{ Reason, Due string }{r.Reason, r.Due})
+			if err != nil {
+				panic(err)
+			}
+			c := &change{Operation: opDeleteUser, Target: r.Email, Payload: string(payload), Summary: fmt.Sprintf("reset '%s' at %s, revoking all of their devices", r.Email, r.Due)}
+			if holdForApproval(writer, ssn, c) {
+				return
+			}
+		}
+		r.ScheduledBy = ssn.Email
+		if err = scheduleRevocation(r); err != nil {
+			sendInvalidInput(writer, err)
+			return
+		}
+		log.Status(TAG, fmt.Sprintf("'%s' scheduled revocation #%d of '%s' for %s", ssn.Email, r.ID, r.Email, r.Due))
+	case "DELETE":
+		id, err := strconv.ParseInt(extractSegment(req.URL.Path, 3), 10, 64)
+		if err != nil {
+			httputil.SendJSON(writer, http.StatusBadRequest, apiResponse{Error: clientURLError})
+			return
+		}
+		var target *scheduledRevocation
+		for _, r := range loadScheduledRevocations("") {
+			if r.ID == id {
+				target = r
+			}
+		}
+		if target == nil {
+			httputil.SendJSON(writer, http.StatusNotFound, apiResponse{Error: &apiError{"That revocation is no longer scheduled.", "Please reload the page.", true}})
+			return
+		}
+		if !acc.canFor(manageUsers, target.Email) {
+			sendForbidden(writer, acc, manageUsers, usersError)
+			return
+		}
+		v := url.Values{}
+		v.Add("by", ssn.Email)
+		u := apiclient.URLJoin("revocations", strconv.FormatInt(id, 10)) + "?" + v.Encode()
+		status, err := cfg.APIClient.Call(u, "DELETE", nil, struct{}{}, nil)
+		if err != nil {
+			panic(err)
+		}
+		if status == http.StatusNotFound { // carried out or cancelled meanwhile
+			httputil.SendJSON(writer, http.StatusNotFound, apiResponse{Error: &apiError{"That revocation is no longer scheduled.", "Please reload the page.", true}})
+			return
+		}
+		if status >= 300 {
+			panic(fmt.Sprintf("non-200 status code %d from API server", status))
+		}
+		log.Status(TAG, fmt.Sprintf("'%s' cancelled revocation #%d of '%s'", ssn.Email, id, target.Email))
+	default:
+		panic("API method sentinel misconfiguration")
+	}
+
+	// all methods respond with the complete list
+	res := &struct{ Revocations []*scheduledRevocation }{[]*scheduledRevocation{}}
+	for _, r := range loadScheduledRevocations("") {
+		if acc.covers(r.Email) {
+			res.Revocations = append(res.Revocations, r)
+		}
+	}
+	httputil.SendJSON(writer, http.StatusOK, apiResponse{nil, res})
+}
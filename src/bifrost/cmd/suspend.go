@@ -0,0 +1,182 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// User suspensions, stored in Heimdall. A suspended user keeps their password & devices, but can't
+// connect to the VPN (the OpenVPN hooks check) or do anything in Bifröst, including as an admin,
+// until the suspension is lifted or reaches its end date.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"playground/apiclient"
+	"playground/httputil"
+	"playground/log"
+
+	"validate"
+)
+
+type suspension struct {
+	Email, Reason string
+	Until         string // the day the suspension ends on its own; "" for until lifted
+	SuspendedBy   string
+	Created       string
+}
+
+// loadSuspension fetches the active suspension of the indicated user, or nil if they aren't suspended.
+func loadSuspension(email string) *suspension {
+	res := &suspension{}
+	status, err := cfg.APIClient.Call(apiclient.URLJoin("suspensions", email), "GET", nil, struct{}{}, res)
+	if err != nil {
+		panic(err)
+	}
+	if status == http.StatusNotFound {
+		return nil
+	}
+	if status >= 300 {
+		panic(fmt.Sprintf("non-200 status code %d from API server", status))
+	}
+	return res
+}
+
+/*
+ * API endpoint handlers
+ */
+
+func suspensionsHandler(writer http.ResponseWriter, req *http.Request) {
+	// GET /api/suspensions -- fetch every suspended user
+	//   I: none
+	//   O: {Suspensions: [{Email: "", Reason: "", Until: "", SuspendedBy: "", Created: ""}]}
+	//   200: success; 403: not permitted to view users
+	// PUT /api/suspensions/<email> -- suspend a user, or change their suspension
+	//   I: {Reason: "", Until: ""}
+	//   O: same as GET
+	//   200: success; 400: bad email, missing reason, bad end date, or email is a config-file admin;
+	//   403: not permitted to manage the user, attempted to suspend self, or the user has a role and
+	//   the current user can't manage roles
+	//   Note: Until is optional, as YYYY-MM-DD; the suspension ends on its own on that day
+	// DELETE /api/suspensions/<email> -- lift a user's suspension
+	//   I: none
+	//   O: same as GET
+	//   200: success; 404: user isn't suspended; 400, 403: as for PUT
+	// non-GET/PUT/DELETE: 405 (method not allowed)
+	// Domain admins only see suspended users in their domains.
+
+	TAG := "suspensionsHandler"
+
+	ssn, _, _, acc := loadSession(req)
+	if !ssn.IsLoggedIn() {
+		httputil.SendJSON(writer, http.StatusForbidden, &apiResponse{Error: authError})
+		return
+	}
+	if !acc.can(viewUsers) {
+		httputil.SendJSON(writer, http.StatusForbidden, &apiResponse{Error: usersError})
+		return
+	}
+
+	email := extractSegment(req.URL.Path, 3)
+	if email != "" {
+		var err error
+		if email, err = validate.Email(email); err != nil {
+			sendInvalidInput(writer, err)
+			return
+		}
+	}
+	if req.Method != "GET" {
+		if email == "" {
+			httputil.SendJSON(writer, http.StatusBadRequest, apiResponse{Error: clientURLError})
+			return
+		}
+		if !acc.canFor(manageUsers, email) {
+			sendForbidden(writer, acc, manageUsers, usersError)
+			return
+		}
+		for _, admin := range cfg.AdminUsers {
+			if admin == email {
+				sendInvalidInput(writer, errors.New("'"+email+"' is an admin via the config file"))
+				return
+			}
+		}
+		if email == ssn.Email { // i.e. no self-lockouts
+			httputil.SendJSON(writer, http.StatusForbidden, &apiResponse{Error: &apiError{"You can't suspend yourself.", "", true}})
+			return
+		}
+	}
+
+	switch req.Method {
+	case "GET":
+	case "PUT":
+		in := &struct{ Reason, Until string }{}
+		if err := httputil.PopulateFromBody(in, req); err != nil {
+			httputil.SendJSON(writer, http.StatusBadRequest, &apiResponse{Error: clientJSONError})
+			return
+		}
+		body := &suspension{Reason: in.Reason, Until: in.Until, SuspendedBy: ssn.Email}
+		res := &json.RawMessage{}
+		status, err := cfg.APIClient.Call(apiclient.URLJoin("suspensions", email), "PUT", nil, body, res)
+		if err != nil {
+			panic(err)
+		}
+		if status == http.StatusBadRequest {
+			rejected := &struct{ Error string }{}
+			json.Unmarshal(*res, rejected)
+			sendInvalidInput(writer, errors.New(rejected.Error))
+			return
+		}
+		if status >= 300 {
+			panic(fmt.Sprintf("non-200 status code %d from API server", status))
+		}
+		log.Status(TAG, fmt.Sprintf("'%s' suspended by '%s'", email, ssn.Email))
+	case "DELETE":
+		v := url.Values{}
+		v.Add("by", ssn.Email)
+		u := apiclient.URLJoin("suspensions", email) + "?" + v.Encode()
+		status, err := cfg.APIClient.Call(u, "DELETE", nil, struct{}{}, nil)
+		if err != nil {
+			panic(err)
+		}
+		if status == http.StatusNotFound {
+			httputil.SendJSON(writer, http.StatusNotFound, apiResponse{Error: &apiError{"That user isn't suspended.", "Please reload the page.", true}})
+			return
+		}
+		if status >= 300 {
+			panic(fmt.Sprintf("non-200 status code %d from API server", status))
+		}
+		log.Status(TAG, fmt.Sprintf("suspension of '%s' lifted by '%s'", email, ssn.Email))
+	default:
+		panic("API method sentinel misconfiguration")
+	}
+
+	// all methods respond with the complete list
+	all := &struct{ Suspensions []*suspension }{}
+	status, err := cfg.APIClient.Call("suspensions", "GET", nil, struct{}{}, all)
+	if err != nil {
+		panic(err)
+	}
+	if status >= 300 {
+		panic(fmt.Sprintf("non-200 status code %d from API server", status))
+	}
+	res := &struct{ Suspensions []*suspension }{[]*suspension{}}
+	for _, s := range all.Suspensions {
+		if acc.covers(s.Email) {
+			res.Suspensions = append(res.Suspensions, s)
+		}
+	}
+	httputil.SendJSON(writer, http.StatusOK, apiResponse{nil, res})
+}
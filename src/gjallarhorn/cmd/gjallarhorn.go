@@ -14,13 +14,16 @@
 
 package main
 
-// Gjallarhorn scans the database for soon-to-expire certs and sends emails to affected users.
-// Intended to be called as a cron job, pointed at the same database file Heimdall uses.
+// Gjallarhorn scans the database for soon-to-expire certs and sends emails to affected users, for
+// soon-to-expire whitelist entries and reminds their sponsors, and for certs about to be revoked as
+// unused and warns their owners. Intended to be called as a cron job, pointed at the same database
+// file Heimdall uses.
 
 import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
@@ -45,6 +48,16 @@ func main() {
 		return
 	}
 
+	if err = doSponsorReminders(serviceName); err != nil {
+		log.Error("main", "error sending sponsor reminders", err)
+		return
+	}
+
+	if err = doDormancyWarnings(serviceName); err != nil {
+		log.Error("main", "error sending dormancy warnings", err)
+		return
+	}
+
 	log.Status("main", "done")
 }
 
@@ -84,7 +97,7 @@ type resultSet struct {
 }
 
 func fetchExpirations(cxn *sql.DB, window string) ([]*result, error) {
-	q := "select email, desc, expires, fingerprint from certs where revoked is null and expires = date('now', 'localtime', ?)"
+	q := "select email, desc, expires, fingerprint from certs where revoked is null and replaced_by is null and expires = date('now', 'localtime', ?)"
 	rows, err := cxn.Query(q, window)
 	if err != nil {
 		return nil, err
@@ -210,3 +223,153 @@ func doNotifications(serviceName string, results map[string]*resultSet) error {
 
 	return nil
 }
+
+// sponsorTemplate is the name of the mail template for reminding sponsors of expiring whitelist
+// entries; if it isn't configured, no reminders are sent
+const sponsorTemplate = "sponsor"
+
+type sponsored struct {
+	Email, Sponsor, Note string
+	Expires              time.Time
+}
+
+func fetchSponsored(cxn *sql.DB, window string) ([]*sponsored, error) {
+	q := "select email, sponsor, note, expires from whitelist where sponsor != '' and expires = date('now', 'localtime', ?)"
+	rows, err := cxn.Query(q, window)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []*sponsored{}
+	for rows.Next() {
+		s := &sponsored{}
+		rows.Scan(&s.Email, &s.Sponsor, &s.Note, &s.Expires)
+		res = append(res, s)
+	}
+	return res, nil
+}
+
+// doSponsorReminders emails each sponsor a list of their whitelist entries that expire in a week or
+// a day, so they can extend any that are still needed.
+func doSponsorReminders(serviceName string) error {
+	type payload struct{ Recipients, SenderName, Sender, ServiceName, URL, List string }
+
+	var name, sender string
+	for _, t := range cfg.Mail.Templates {
+		if t.Name == sponsorTemplate {
+			name, sender = t.Name, t.SenderEmail
+		}
+	}
+	if name == "" {
+		log.Debug("doSponsorReminders", "no sponsor template configured; skipping")
+		return nil
+	}
+
+	cxn, err := sql.Open("sqlite3", cfg.DatabaseFile)
+	if err != nil {
+		return err
+	}
+	defer cxn.Close()
+
+	bySponsor := make(map[string][]string)
+	for _, window := range []string{"+7 days", "+1 days"} {
+		results, err := fetchSponsored(cxn, window)
+		if err != nil {
+			return err
+		}
+		for _, s := range results {
+			line := fmt.Sprintf("%s, on %s", s.Email, s.Expires.Format("Monday, 2 January, 2006"))
+			if s.Note != "" {
+				line += fmt.Sprintf(" (%s)", s.Note)
+			}
+			bySponsor[s.Sponsor] = append(bySponsor[s.Sponsor], line)
+		}
+	}
+
+	for sponsor, lines := range bySponsor {
+		p := payload{sponsor, cfg.SenderName, sender, serviceName, cfg.ServiceURL, strings.Join(lines, "\n")}
+		if err := mail.Send(name, []string{sponsor}, p); err != nil {
+			log.Warn("doSponsorReminders", fmt.Sprintf("error sending mail to '%s'", sponsor), err)
+		}
+	}
+
+	return nil
+}
+
+// dormantTemplate is the name of the mail template for warning users that certs they haven't used
+// are about to be revoked; if it isn't configured, no warnings are sent
+const dormantTemplate = "dormant"
+
+// dormancyClock is when a cert's dormancy started; it must match Heimdall's (see dormancy.go)
+const dormancyClock = "max(ifnull(last_seen, created), ifnull((select value from settings where key='UsageTrackedSince'), created))"
+
+// intSetting fetches the indicated integer setting, or def if it's never been set.
+func intSetting(cxn *sql.DB, key string, def int) (int, error) {
+	var v string
+	if err := cxn.QueryRow("select value from settings where key=?", key).Scan(&v); err == sql.ErrNoRows {
+		return def, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(v)
+}
+
+// doDormancyWarnings emails each user a list of their certs that Heimdall will revoke as unused in
+// DormancyWarningDays days, unless they connect with them first.
+func doDormancyWarnings(serviceName string) error {
+	type payload struct{ Recipients, SenderName, Sender, ServiceName, URL, When, List string }
+
+	var name, sender string
+	for _, t := range cfg.Mail.Templates {
+		if t.Name == dormantTemplate {
+			name, sender = t.Name, t.SenderEmail
+		}
+	}
+	if name == "" {
+		log.Debug("doDormancyWarnings", "no dormant template configured; skipping")
+		return nil
+	}
+
+	cxn, err := sql.Open("sqlite3", cfg.DatabaseFile)
+	if err != nil {
+		return err
+	}
+	defer cxn.Close()
+
+	days, err := intSetting(cxn, "DormancyDays", 0)
+	if err != nil {
+		return err
+	}
+	warning, err := intSetting(cxn, "DormancyWarningDays", 14)
+	if err != nil {
+		return err
+	}
+	if days <= 0 {
+		log.Debug("doDormancyWarnings", "dormant certs aren't revoked; skipping")
+		return nil
+	}
+
+	q := "select email, desc from certs where revoked is null and date(" + dormancyClock + ", ?, 'localtime') = date('now', 'localtime', ?)"
+	rows, err := cxn.Query(q, fmt.Sprintf("+%d days", days), fmt.Sprintf("+%d days", warning))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	byUser := make(map[string][]string)
+	for rows.Next() {
+		var email, desc string
+		rows.Scan(&email, &desc)
+		byUser[email] = append(byUser[email], desc)
+	}
+
+	when := time.Now().AddDate(0, 0, warning).Format("Monday, 2 January, 2006")
+	for email, descs := range byUser {
+		p := payload{email, cfg.SenderName, sender, serviceName, cfg.ServiceURL, when, strings.Join(descs, "\n")}
+		if err := mail.Send(name, []string{email}, p); err != nil {
+			log.Warn("doDormancyWarnings", fmt.Sprintf("error sending mail to '%s'", email), err)
+		}
+	}
+
+	return nil
+}
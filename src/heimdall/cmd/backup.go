@@ -0,0 +1,437 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Online backups of the database. The OpenVPN hook scripts write to the database at any time, so
+// simply copying the file can capture a half-written page; instead we use SQLite's backup API, which
+// produces a consistent snapshot even while other processes are writing.
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+
+	"playground/httputil"
+	"playground/log"
+)
+
+// encrypted backups are backupMagic, followed by a PBKDF2 salt, followed by a sealed copy of the
+// database file
+var backupMagic = []byte("HEIMDALL-BACKUP-1\n")
+
+const backupSaltSize = 16
+
+// backupLock serializes scheduled and on-demand backups, so that rotation never races a new file
+var backupLock sync.Mutex
+
+// copyDatabase copies the complete contents of the SQLite database at src into dest (which is
+// created if necessary) using the SQLite online backup API.
+func copyDatabase(dest, src string) error {
+	srcDB, err := sql.Open("sqlite3", src)
+	if err != nil {
+		return err
+	}
+	defer srcDB.Close()
+	destDB, err := sql.Open("sqlite3", dest)
+	if err != nil {
+		return err
+	}
+	defer destDB.Close()
+
+	ctx := context.Background()
+	srcCxn, err := srcDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcCxn.Close()
+	destCxn, err := destDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destCxn.Close()
+
+	return destCxn.Raw(func(destRaw interface{}) error {
+		return srcCxn.Raw(func(srcRaw interface{}) error {
+			backup, err := destRaw.(*sqlite3.SQLiteConn).Backup("main", srcRaw.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+			// the database is small, so copy it in a single step rather than holding the backup open
+			if _, err = backup.Step(-1); err != nil {
+				backup.Finish()
+				return err
+			}
+			return backup.Finish()
+		})
+	})
+}
+
+// checkDatabase verifies that the file at path is an intact SQLite database with Heimdall's tables.
+func checkDatabase(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	cxn, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer cxn.Close()
+
+	rows, err := cxn.Query("pragma integrity_check")
+	if err != nil {
+		return err
+	}
+	problems := []string{}
+	for rows.Next() {
+		var msg string
+		rows.Scan(&msg)
+		if msg != "ok" {
+			problems = append(problems, msg)
+		}
+	}
+	rows.Close()
+	if len(problems) > 0 {
+		return fmt.Errorf("integrity check failed: %s", strings.Join(problems, "; "))
+	}
+
+	for _, table := range []string{"certs", "totp", "events", "settings", "whitelist"} {
+		var n int
+		if err = cxn.QueryRow("select count(*) from sqlite_master where type='table' and name=?", table).Scan(&n); err != nil {
+			return err
+		}
+		if n != 1 {
+			return fmt.Errorf("missing table '%s'", table)
+		}
+	}
+	return nil
+}
+
+// databaseVersion returns the number of migrations applied to the SQLite database at path.
+func databaseVersion(path string) (int, error) {
+	cxn, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return 0, err
+	}
+	defer cxn.Close()
+	var version int
+	err = cxn.QueryRow("pragma user_version").Scan(&version)
+	return version, err
+}
+
+func encryptFile(path, passphrase string) error {
+	plain, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	salt := make([]byte, backupSaltSize)
+	if _, err = rand.Read(salt); err != nil {
+		return err
+	}
+	aead, err := deriveKey(passphrase, salt, kdfIterations)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return err
+	}
+	out := append(append(append([]byte{}, backupMagic...), salt...), aead.Seal(nonce, nonce, plain, nil)...)
+	return ioutil.WriteFile(path, out, 0600)
+}
+
+// decryptFile writes the plaintext of the encrypted backup at src to dest.
+func decryptFile(dest, src, passphrase string) error {
+	raw, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	raw = raw[len(backupMagic):]
+	if len(raw) < backupSaltSize {
+		return errors.New("encrypted backup is truncated")
+	}
+	aead, err := deriveKey(passphrase, raw[:backupSaltSize], kdfIterations)
+	if err != nil {
+		return err
+	}
+	raw = raw[backupSaltSize:]
+	if len(raw) < aead.NonceSize() {
+		return errors.New("encrypted backup is truncated")
+	}
+	plain, err := aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], nil)
+	if err != nil {
+		return errors.New("unable to decrypt backup; wrong passphrase?")
+	}
+	return ioutil.WriteFile(dest, plain, 0600)
+}
+
+func isEncryptedBackup(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	header := make([]byte, len(backupMagic))
+	n, _ := f.Read(header)
+	return n == len(header) && bytes.Equal(header, backupMagic), nil
+}
+
+// takeBackup writes a new backup of the live database into cfg.BackupDir, and then deletes all but
+// the newest cfg.BackupRetain backups. It returns the path of the new backup.
+func takeBackup() (string, error) {
+	backupLock.Lock()
+	defer backupLock.Unlock()
+
+	if cfg.BackupDir == "" {
+		return "", errors.New("no BackupDir configured")
+	}
+	if err := os.MkdirAll(cfg.BackupDir, 0700); err != nil {
+		return "", err
+	}
+
+	passphrase, err := readPassphrase(cfg.BackupPassphraseFile)
+	if err != nil {
+		return "", err
+	}
+
+	name := backupName(time.Now().UTC().Format("20060102-150405"), passphrase != "")
+	path := filepath.Join(cfg.BackupDir, name)
+	tmp := path + ".tmp"
+
+	// build the backup under a temporary name, so a crash never leaves a partial file that looks real
+	if err = copyDatabase(tmp, cfg.SQLiteDBFile); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if err = checkDatabase(tmp); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if err = os.Chmod(tmp, 0600); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if passphrase != "" {
+		if err = encryptFile(tmp, passphrase); err != nil {
+			os.Remove(tmp)
+			return "", err
+		}
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	rotateBackups()
+	writeDatabaseByQuery("insert into events (event, email, value) values (?, ?, ?)", "database backed up", "", name)
+	return path, nil
+}
+
+// backupName returns an unused file name for a backup taken at stamp. Names end in a sequence
+// number, so that an on-demand backup taken in the same second as a scheduled one doesn't overwrite
+// it; the number is zero-padded so names still sort in the order they were taken.
+func backupName(stamp string, encrypted bool) string {
+	for seq := 1; ; seq++ {
+		base := filepath.Join(cfg.BackupDir, fmt.Sprintf("heimdall-%s-%02d.sqlite3", stamp, seq))
+		_, plainErr := os.Stat(base)
+		_, encErr := os.Stat(base + ".enc")
+		if os.IsNotExist(plainErr) && os.IsNotExist(encErr) {
+			if encrypted {
+				base += ".enc"
+			}
+			return filepath.Base(base)
+		}
+	}
+}
+
+func rotateBackups() {
+	if cfg.BackupRetain < 1 {
+		return
+	}
+	existing := []string{}
+	for _, pattern := range []string{"heimdall-*.sqlite3", "heimdall-*.sqlite3.enc"} {
+		matches, err := filepath.Glob(filepath.Join(cfg.BackupDir, pattern))
+		if err != nil {
+			log.Warn("rotateBackups", "bad glob", err)
+			return
+		}
+		existing = append(existing, matches...)
+	}
+	// names embed a sortable timestamp, so newest sorts last
+	sort.Slice(existing, func(i, j int) bool { return filepath.Base(existing[i]) < filepath.Base(existing[j]) })
+	for len(existing) > cfg.BackupRetain {
+		if err := os.Remove(existing[0]); err != nil {
+			log.Warn("rotateBackups", "unable to remove old backup", existing[0], err)
+		} else {
+			log.Debug("rotateBackups", "removed old backup", existing[0])
+		}
+		existing = existing[1:]
+	}
+}
+
+// backupLoop takes a backup every cfg.BackupIntervalHours, forever. Intended to run as a goroutine.
+func backupLoop() {
+	TAG := "backupLoop"
+	for range time.Tick(time.Duration(cfg.BackupIntervalHours) * time.Hour) {
+		if path, err := takeBackup(); err != nil {
+			log.Error(TAG, "scheduled backup failed", err)
+		} else {
+			log.Status(TAG, fmt.Sprintf("wrote scheduled backup '%s'", path))
+		}
+	}
+}
+
+/*
+ * API endpoint handlers
+ */
+
+func backupHandler(writer http.ResponseWriter, req *http.Request) {
+	// POST /backup -- take an on-demand backup of the database
+	//   I: None
+	//   O: {File: "", Size: 0}
+	//   200: the backup was written; 400: backups are not configured
+	// Non-POST: 405 (method not allowed)
+	// The backup is written to the configured BackupDir and is subject to the same rotation as
+	// scheduled backups.
+
+	TAG := "/backup"
+
+	if cfg.BackupDir == "" {
+		log.Warn(TAG, "backup requested but no BackupDir configured")
+		httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+		return
+	}
+
+	path, err := takeBackup()
+	if err != nil {
+		panic(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		panic(err)
+	}
+
+	log.Status(TAG, fmt.Sprintf("wrote on-demand backup '%s'", path))
+	httputil.SendJSON(writer, http.StatusOK, &struct {
+		File string
+		Size int64
+	}{path, info.Size()})
+}
+
+/*
+ * Command-line equivalents
+ */
+
+// backupCommand implements `heimdall backup`.
+func backupCommand(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	flags.Parse(args)
+
+	path, err := takeBackup()
+	if err != nil {
+		return err
+	}
+	fmt.Println(path)
+	return nil
+}
+
+// restoreCommand implements `heimdall restore`. The backup is verified before anything is touched,
+// and the current database is itself backed up first, so a restore can always be undone.
+func restoreCommand(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	from := flags.String("from", "", "backup file to restore")
+	passFile := flags.String("passphrase-file", "", "file containing the passphrase for an encrypted backup (default: BackupPassphraseFile)")
+	flags.Parse(args)
+
+	if *from == "" {
+		return errors.New("-from is required")
+	}
+	if *passFile == "" {
+		*passFile = cfg.BackupPassphraseFile
+	}
+
+	// work on a private plaintext copy next to the live database
+	candidate := fmt.Sprintf("%s.restore-%d", cfg.SQLiteDBFile, os.Getpid())
+	defer os.Remove(candidate)
+	encrypted, err := isEncryptedBackup(*from)
+	if err != nil {
+		return err
+	}
+	if encrypted {
+		passphrase, err := readPassphrase(*passFile)
+		if err != nil {
+			return err
+		}
+		if passphrase == "" {
+			return errors.New("backup is encrypted; a passphrase is required")
+		}
+		if err = decryptFile(candidate, *from, passphrase); err != nil {
+			return err
+		}
+	} else if err = copyDatabase(candidate, *from); err != nil {
+		return err
+	}
+
+	if err = checkDatabase(candidate); err != nil {
+		return fmt.Errorf("refusing to restore '%s': %s", *from, err)
+	}
+
+	// a backup from a newer Heimdall has migrations this one doesn't know, and it would refuse to
+	// start; an older one is brought up to date by the migrations on the next start
+	version, err := databaseVersion(candidate)
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("refusing to restore '%s': it is version %d but this Heimdall only knows %d", *from, version, len(migrations))
+	}
+	if version < len(migrations) {
+		log.Warn("restore", fmt.Sprintf("'%s' is version %d; it will be migrated to %d when Heimdall next starts", *from, version, len(migrations)))
+		fmt.Printf("warning: '%s' is version %d; it will be migrated to %d when Heimdall next starts\n", *from, version, len(migrations))
+	}
+
+	// keep a copy of what we're about to replace
+	saved := fmt.Sprintf("%s.pre-restore-%s", cfg.SQLiteDBFile, time.Now().UTC().Format("20060102-150405"))
+	if err = copyDatabase(saved, cfg.SQLiteDBFile); err != nil {
+		return fmt.Errorf("unable to save current database: %s", err)
+	}
+
+	// copying via the backup API (rather than renaming files) swaps the contents in atomically, even
+	// if Heimdall or the OpenVPN hooks have the database open
+	if err = copyDatabase(cfg.SQLiteDBFile, candidate); err != nil {
+		return err
+	}
+	if err = checkDatabase(cfg.SQLiteDBFile); err != nil {
+		return fmt.Errorf("restored database failed verification (previous copy is at '%s'): %s", saved, err)
+	}
+
+	writeDatabaseByQuery("insert into events (event, email, value) values (?, ?, ?)", "database restored", "", filepath.Base(*from))
+	log.Status("restore", fmt.Sprintf("restored '%s'; previous database saved as '%s'", *from, saved))
+	fmt.Printf("restored '%s'; previous database saved as '%s'\n", *from, saved)
+	return nil
+}
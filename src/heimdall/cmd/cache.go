@@ -0,0 +1,68 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Cached keymatter & templates. Issuance needs the CA cert & key, the tls-auth secret and an .ovpn
+// template; rather than read and parse them every time, they're kept parsed, and reloaded when a
+// file's modification time or size changes, so that replacing one takes effect without a restart.
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"playground/log"
+)
+
+type cachedFile struct {
+	modTime time.Time
+	size    int64
+	value   interface{}
+}
+
+var fileCache = struct {
+	sync.Mutex
+	files map[string]*cachedFile
+	loads int // times a file was (re)loaded, for /metrics
+}{files: make(map[string]*cachedFile)}
+
+// loadCached returns what parse makes of the indicated file, calling it again only if the file has
+// changed since it last did. A given file must always be loaded with the same parse.
+func loadCached(path string, parse func(data []byte) (interface{}, error)) interface{} {
+	fi, err := os.Stat(path)
+	if err != nil {
+		panic(err)
+	}
+
+	fileCache.Lock()
+	defer fileCache.Unlock()
+
+	if c, ok := fileCache.files[path]; ok && c.modTime.Equal(fi.ModTime()) && c.size == fi.Size() {
+		return c.value
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		panic(err)
+	}
+	value, err := parse(data)
+	if err != nil {
+		panic(err)
+	}
+	fileCache.files[path] = &cachedFile{fi.ModTime(), fi.Size(), value}
+	fileCache.loads++
+	log.Debug("loadCached", "loaded "+path)
+	return value
+}
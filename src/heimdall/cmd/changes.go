@@ -0,0 +1,301 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Change requests, for sensitive operations that need a second admin's approval. Heimdall records
+// each request and moves it through its lifecycle:
+//
+//   pending -> approved -> applied | failed
+//   pending -> denied | withdrawn | expired
+//
+// Bifröst decides which operations need approval, and carries them out once approved; the
+// transitions here are atomic, so a request can only ever be carried out once.
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"playground/httputil"
+	"playground/log"
+
+	"validate"
+)
+
+const changeRequestHours = 24 // how long a request waits for approval before expiring
+
+type change struct {
+	ID                     int64
+	Operation, Target      string
+	Payload, Summary       string // Payload is opaque to Heimdall; Summary is the human-readable diff
+	RequestedBy, Requested string
+	DecidedBy, Decided     string
+	Status, Result         string
+}
+
+// pendingChanges selects requests awaiting approval that haven't expired
+var pendingChanges = fmt.Sprintf("status='pending' and requested > datetime('now', '-%d hours')", changeRequestHours)
+
+// transitions lists the statuses a change may move to from each status, by whom: the requester,
+// someone other than the requester, or the approver
+var transitions = map[string]map[string]string{
+	"pending":  {"approved": "other", "denied": "other", "withdrawn": "requester"},
+	"approved": {"applied": "approver", "failed": "approver"},
+}
+
+const changeColumns = `rowid, operation, target, payload, summary, requested_by,
+	strftime('%Y-%m-%dT%H:%M:%SZ', requested), ifnull(decided_by, ''),
+	ifnull(strftime('%Y-%m-%dT%H:%M:%SZ', decided), ''), status, result`
+
+func scanChange(rows *sql.Rows) *change {
+	c := &change{}
+	rows.Scan(&c.ID, &c.Operation, &c.Target, &c.Payload, &c.Summary, &c.RequestedBy, &c.Requested, &c.DecidedBy, &c.Decided, &c.Status, &c.Result)
+	return c
+}
+
+// loadChanges returns every request awaiting approval, oldest first.
+func loadChanges(cxn *sql.DB) []*change {
+	rows, err := cxn.Query("select " + changeColumns + " from changes where " + pendingChanges + " order by requested")
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+
+	res := []*change{}
+	for rows.Next() {
+		res = append(res, scanChange(rows))
+	}
+	return res
+}
+
+// loadChange returns the indicated change, whatever its status, or nil if there is no such change.
+func loadChange(cxn *sql.DB, id int64) *change {
+	rows, err := cxn.Query("select "+changeColumns+" from changes where rowid=?", id)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil
+	}
+	return scanChange(rows)
+}
+
+// changeEvent describes c for the event log.
+func changeEvent(c *change) string {
+	return fmt.Sprintf("#%d %s requested by '%s': %s", c.ID, c.Operation, c.RequestedBy, c.Summary)
+}
+
+// expireChanges marks requests that were never decided as expired, recording each in the event log.
+func expireChanges() error {
+	cxn := getDB()
+	defer cxn.Close()
+
+	rows, err := cxn.Query("select " + changeColumns + " from changes where status='pending' and not (" + pendingChanges + ")")
+	if err != nil {
+		return err
+	}
+	expired := []*change{}
+	for rows.Next() {
+		expired = append(expired, scanChange(rows))
+	}
+	rows.Close()
+
+	for _, c := range expired {
+		if _, err = cxn.Exec("update changes set status='expired', decided=current_timestamp where rowid=? and status='pending'", c.ID); err != nil {
+			return err
+		}
+		if _, err = cxn.Exec("insert into events (event, email, value) values (?, ?, ?)", "change expired", c.RequestedBy, changeEvent(c)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * API endpoint handlers
+ */
+
+func changesHandler(writer http.ResponseWriter, req *http.Request) {
+	// GET /changes -- fetch all requests awaiting approval
+	//   I: None
+	//   O: {Changes: [<change>]}
+	//      ...where <change> == {ID: 0, Operation: "", Target: "", Payload: "", Summary: "", RequestedBy: "",
+	//      Requested: "", DecidedBy: "", Decided: "", Status: "", Result: ""}
+	//   200: the object above
+	// POST /changes -- record a new request
+	//   I: {Operation: "", Target: "", Payload: "", Summary: "", RequestedBy: ""}
+	//   O: <change>
+	//   200: the request was recorded; 400: missing operation or summary, or malformed RequestedBy;
+	//   409 (conflict): an identical operation on the same target is already awaiting approval
+	//   Note: requests expire if not decided within 24 hours
+	// Non-GET/POST: 405 (method not allowed)
+
+	TAG := "/changes"
+
+	cxn := getDB()
+	defer cxn.Close()
+
+	switch req.Method {
+	case "GET":
+		httputil.SendJSON(writer, http.StatusOK, struct{ Changes []*change }{loadChanges(cxn)})
+	case "POST":
+		c := &change{}
+		if err := httputil.PopulateFromBody(c, req); err != nil {
+			log.Warn(TAG, "missing or malformed request JSON", req.URL.Path)
+			httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+			return
+		}
+		var err error
+		if c.RequestedBy, err = validate.Email(c.RequestedBy); err != nil {
+			sendBadRequest(writer, TAG, err)
+			return
+		}
+		if c.Operation == "" || c.Summary == "" {
+			sendBadRequest(writer, TAG, errors.New("operation and summary are required"))
+			return
+		}
+		for _, pending := range loadChanges(cxn) {
+			if pending.Operation == c.Operation && pending.Target == c.Target {
+				log.Warn(TAG, "duplicate change request", c.Operation, c.Target)
+				httputil.SendJSON(writer, http.StatusConflict, struct{}{})
+				return
+			}
+		}
+
+		res, err := cxn.Exec("insert into changes (operation, target, payload, summary, requested_by) values (?, ?, ?, ?, ?)",
+			c.Operation, c.Target, c.Payload, c.Summary, c.RequestedBy)
+		if err != nil {
+			panic(err)
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			panic(err)
+		}
+		c = loadChange(cxn, id)
+		writeDatabaseByQuery("insert into events (event, email, value) values (?, ?, ?)", "change requested", c.RequestedBy, changeEvent(c))
+		log.Status(TAG, fmt.Sprintf("'%s' requested change #%d (%s)", c.RequestedBy, c.ID, c.Operation))
+		httputil.SendJSON(writer, http.StatusOK, c)
+	default:
+		panic("API method sentinel misconfiguration")
+	}
+}
+
+func changeHandler(writer http.ResponseWriter, req *http.Request) {
+	// GET /change/<id> -- fetch the indicated change, whatever its status
+	//   I: None
+	//   O: {ID: 0, Operation: "", Target: "", Payload: "", Summary: "", RequestedBy: "", Requested: "",
+	//      DecidedBy: "", Decided: "", Status: "", Result: ""}
+	//   200: the object above; 400: malformed ID; 404: no such change
+	// PUT /change/<id> -- move the indicated change to a new status
+	//   I: {By: "", Status: "approved"|"denied"|"withdrawn"|"applied"|"failed", Result: ""}
+	//   O: same as GET
+	//   200: the change moved to Status; 400: malformed ID or By, or By may not make this move (e.g.
+	//   approving their own request); 404: no such change; 409 (conflict): the change can't move
+	//   to Status from its current status, e.g. because someone else decided it first
+	//   Note: only the requester may withdraw a request, and only its approver may record the
+	//   outcome (applied or failed, with a Result) of carrying it out
+	// Non-GET/PUT: 405 (method not allowed)
+
+	TAG := "/change/"
+
+	id, err := strconv.ParseInt(extractSegment(req.URL.Path, 2), 10, 64)
+	if err != nil {
+		sendBadRequest(writer, TAG, errors.New("malformed change ID"))
+		return
+	}
+
+	cxn := getDB()
+	defer cxn.Close()
+	c := loadChange(cxn, id)
+	if c == nil {
+		log.Warn(TAG, "request for nonexistent change", id)
+		httputil.SendJSON(writer, http.StatusNotFound, struct{}{})
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		httputil.SendJSON(writer, http.StatusOK, c)
+	case "PUT":
+		in := &struct{ By, Status, Result string }{}
+		if err := httputil.PopulateFromBody(in, req); err != nil {
+			log.Warn(TAG, "missing or malformed request JSON", req.URL.Path)
+			httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+			return
+		}
+		if in.By, err = validate.Email(in.By); err != nil {
+			sendBadRequest(writer, TAG, err)
+			return
+		}
+
+		from := c.Status
+		who, ok := transitions[from][in.Status]
+		if !ok {
+			log.Warn(TAG, fmt.Sprintf("change #%d can't move from '%s' to '%s'", id, from, in.Status))
+			httputil.SendJSON(writer, http.StatusConflict, struct{}{})
+			return
+		}
+		switch {
+		case who == "other" && in.By == c.RequestedBy:
+			sendBadRequest(writer, TAG, errors.New("a change must be decided by someone other than its requester"))
+			return
+		case who == "requester" && in.By != c.RequestedBy:
+			sendBadRequest(writer, TAG, errors.New("only the requester may withdraw a change"))
+			return
+		case who == "approver" && in.By != c.DecidedBy:
+			sendBadRequest(writer, TAG, errors.New("only the approver may record the outcome of a change"))
+			return
+		}
+
+		// the status check in the update is what makes a decision stick: of two admins approving at
+		// once, only one gets to carry the change out
+		q := "update changes set status=?, decided_by=?, decided=current_timestamp where rowid=? and status=?"
+		params := []interface{}{in.Status, in.By, id, from}
+		if who == "approver" {
+			q = "update changes set status=?, result=? where rowid=? and status=?"
+			params = []interface{}{in.Status, in.Result, id, from}
+		} else if from == "pending" {
+			q += " and " + pendingChanges
+		}
+		res, err := cxn.Exec(q, params...)
+		if err != nil {
+			panic(err)
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			panic(err)
+		} else if n == 0 {
+			log.Warn(TAG, fmt.Sprintf("change #%d is no longer '%s'", id, from))
+			httputil.SendJSON(writer, http.StatusConflict, struct{}{})
+			return
+		}
+
+		value := changeEvent(c)
+		switch in.Status {
+		case "approved", "denied":
+			value += fmt.Sprintf(" (%s by '%s')", in.Status, in.By)
+		case "applied", "failed":
+			value += fmt.Sprintf(" (approved by '%s'; %s)", c.DecidedBy, in.Result)
+		}
+		writeDatabaseByQuery("insert into events (event, email, value) values (?, ?, ?)", "change "+in.Status, c.RequestedBy, value)
+		log.Status(TAG, fmt.Sprintf("change #%d %s by '%s'", id, in.Status, in.By))
+		httputil.SendJSON(writer, http.StatusOK, loadChange(cxn, id))
+	default:
+		panic("API method sentinel misconfiguration")
+	}
+}
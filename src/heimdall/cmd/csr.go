@@ -0,0 +1,54 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Issuance from a PKCS#10 certificate signing request, so that a client's private key never leaves
+// its device. Heimdall signs only the CSR's public key: the subject is always its own, and the .ovpn
+// it returns has a placeholder where the key would otherwise go.
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// csrKeyPlaceholder stands in for the private key in the .ovpn of a cert issued from a CSR.
+const csrKeyPlaceholder = "# Replace this line with the private key you generated your certificate signing request with."
+
+// parseCSR checks a PEM-encoded CSR received from a client: it must be self-signed, and its key must
+// be RSA of at least 2048 bits, ECDSA on P-256 or P-384, or Ed25519.
+func parseCSR(s string) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode([]byte(strings.TrimSpace(s)))
+	if block == nil || (block.Type != "CERTIFICATE REQUEST" && block.Type != "NEW CERTIFICATE REQUEST") {
+		return nil, errors.New("CSR must be a PEM-encoded PKCS#10 certificate request")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("malformed CSR: %s", err)
+	}
+	if err = csr.CheckSignature(); err != nil {
+		return nil, errors.New("CSR signature doesn't match its key")
+	}
+	if k, ok := csr.PublicKey.(*rsa.PublicKey); ok && k.N.BitLen() < 2048 {
+		return nil, fmt.Errorf("CSR's RSA key is %d bits; at least 2048 are required", k.N.BitLen())
+	}
+	if keyAlgorithmOf(csr.PublicKey) == "" {
+		return nil, errors.New("CSR's key must be RSA, ECDSA on P-256 or P-384, or Ed25519")
+	}
+	return csr, nil
+}
@@ -0,0 +1,243 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Per-domain access policies. Each whitelisted domain has its own record, which may be disabled
+// without losing its policy, and may override the service-wide client limit & cert duration and
+// restrict its users to particular .ovpn profiles. The settings' WhitelistedDomains is the list of
+// enabled domains.
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"playground/httputil"
+	"playground/log"
+
+	"validate"
+)
+
+const defaultProfile = "default" // the profile built from OVPNTemplateFile
+
+type domainPolicy struct {
+	Domain                          string
+	Enabled                         bool
+	ClientLimit, IssuedCertDuration *int     // nil means the service-wide setting applies
+	Profiles                        []string // the .ovpn profiles users may choose from; empty means any
+	Modified                        string
+}
+
+// profileNames lists the configured .ovpn profiles, the default first.
+func profileNames() []string {
+	names := []string{}
+	for name := range cfg.OVPNProfiles {
+		if name != defaultProfile {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return append([]string{defaultProfile}, names...)
+}
+
+// profileTemplate returns the .ovpn template file of the indicated profile, or "" if there is no
+// such profile.
+func profileTemplate(name string) string {
+	if name == defaultProfile {
+		return cfg.OVPNTemplateFile
+	}
+	return cfg.OVPNProfiles[name]
+}
+
+// validateDomainPolicy checks a domain policy, canonicalizing its domain in place.
+func validateDomainPolicy(p *domainPolicy) error {
+	d, err := validate.Domain(p.Domain)
+	if err != nil {
+		return err
+	}
+	p.Domain = d
+	if (p.ClientLimit != nil && *p.ClientLimit < 1) || (p.IssuedCertDuration != nil && *p.IssuedCertDuration < 1) {
+		return errors.New("client limit and certificate duration must be at least 1")
+	}
+	if p.Profiles == nil {
+		p.Profiles = []string{}
+	}
+	for _, name := range p.Profiles {
+		if profileTemplate(name) == "" {
+			return fmt.Errorf("unknown profile '%s'", name)
+		}
+	}
+	return nil
+}
+
+// loadDomainPolicies returns the policy of the indicated domain, or of all domains if domain is "".
+func loadDomainPolicies(cxn *sql.DB, domain string) []*domainPolicy {
+	q := "select domain, enabled, client_limit, cert_duration, profiles, strftime('%Y-%m-%dT%H:%M:%SZ', modified) from domains"
+	params := []interface{}{}
+	if domain != "" {
+		q += " where domain=?"
+		params = append(params, domain)
+	}
+	rows, err := cxn.Query(q+" order by domain", params...)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+
+	res := []*domainPolicy{}
+	for rows.Next() {
+		p := &domainPolicy{}
+		var profiles string
+		rows.Scan(&p.Domain, &p.Enabled, &p.ClientLimit, &p.IssuedCertDuration, &profiles, &p.Modified)
+		p.Profiles = strings.Fields(profiles)
+		res = append(res, p)
+	}
+	return res
+}
+
+// domainPolicyFor returns the policy of the domain of the indicated email, or nil if it has none.
+func domainPolicyFor(cxn *sql.DB, email string) *domainPolicy {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return nil
+	}
+	if policies := loadDomainPolicies(cxn, email[at+1:]); len(policies) > 0 {
+		return policies[0]
+	}
+	return nil
+}
+
+// allowedProfiles lists the .ovpn profiles the indicated user may choose from, their default first.
+func allowedProfiles(cxn *sql.DB, email string) []string {
+	if p := domainPolicyFor(cxn, email); p != nil && len(p.Profiles) > 0 {
+		return p.Profiles
+	}
+	return profileNames()
+}
+
+// describePolicy renders a policy for the event log.
+func describePolicy(p *domainPolicy) string {
+	state := "enabled"
+	if !p.Enabled {
+		state = "disabled"
+	}
+	profiles := "any"
+	if len(p.Profiles) > 0 {
+		profiles = strings.Join(p.Profiles, " ")
+	}
+	return fmt.Sprintf("%s: %s, ClientLimit %s, IssuedCertDuration %s, profiles %s", p.Domain, state,
+		describeLimit(p.ClientLimit), describeLimit(p.IssuedCertDuration), profiles)
+}
+
+/*
+ * API endpoint handlers
+ */
+
+func domainsHandler(writer http.ResponseWriter, req *http.Request) {
+	// GET /domains -- fetch the policies of all whitelisted domains, and the available profiles
+	//   I: None
+	//   O: {Domains: [<policy>], Profiles: [""]}
+	//      ...where <policy> == {Domain: "", Enabled: true, ClientLimit: null, IssuedCertDuration: null,
+	//      Profiles: [""], Modified: ""}
+	//   200: the object above
+	// GET /domains/<domain> -- fetch the policy of the indicated domain
+	//   I: None
+	//   O: <policy>
+	//   200: the object above; 400: malformed domain; 404: no such domain
+	// PUT /domains/<domain>[?revoke=true] -- create or replace the policy of the indicated domain
+	//   I: {Enabled: true, ClientLimit: null, IssuedCertDuration: null, Profiles: [""]}
+	//   O: <policy> + {LostAccess: [""], Revoked: 0}
+	//   200: the policy was stored; 400: malformed domain, a limit less than 1, or an unknown profile
+	//   Note: null limits mean the service-wide settings apply; empty Profiles means any profile.
+	//   LostAccess lists users with active certs who were only entitled by the domain, if it was
+	//   disabled; with ?revoke=true their certs are revoked, and Revoked says how many
+	// DELETE /domains/<domain>[?revoke=true] -- remove the indicated domain altogether
+	//   I: None
+	//   O: {LostAccess: [""], Revoked: 0}
+	//   200: the domain was removed (idempotent); 400: malformed domain
+	//   Note: LostAccess and Revoked as for PUT
+	// Non-GET/PUT/DELETE: 405 (method not allowed)
+
+	TAG := "/domains/"
+
+	domain := extractSegment(req.URL.Path, 2)
+	if domain != "" {
+		var err error
+		if domain, err = validate.Domain(domain); err != nil {
+			sendBadRequest(writer, TAG, err)
+			return
+		}
+	}
+	if domain == "" && req.Method != "GET" {
+		httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+		return
+	}
+
+	cxn := getDB()
+	defer cxn.Close()
+
+	switch req.Method {
+	case "GET":
+		policies := loadDomainPolicies(cxn, domain)
+		if domain == "" {
+			httputil.SendJSON(writer, http.StatusOK, struct {
+				Domains  []*domainPolicy
+				Profiles []string
+			}{policies, profileNames()})
+			return
+		}
+		if len(policies) == 0 {
+			httputil.SendJSON(writer, http.StatusNotFound, struct{}{})
+			return
+		}
+		httputil.SendJSON(writer, http.StatusOK, policies[0])
+	case "PUT":
+		p := &domainPolicy{}
+		if err := httputil.PopulateFromBody(p, req); err != nil {
+			log.Warn(TAG, "missing or malformed request JSON", req.URL.Path)
+			httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+			return
+		}
+		p.Domain = domain
+		if err := validateDomainPolicy(p); err != nil {
+			sendBadRequest(writer, TAG, err)
+			return
+		}
+		before := entitledHolders(cxn, loadSettings())
+		writeDatabaseByQuery("insert or replace into domains (domain, enabled, client_limit, cert_duration, profiles) values (?, ?, ?, ?, ?)",
+			p.Domain, p.Enabled, p.ClientLimit, p.IssuedCertDuration, strings.Join(p.Profiles, " "))
+		writeDatabaseByQuery("insert into events (event, email, value) values (?, ?, ?)", "domain policy changed", "", describePolicy(p))
+		log.Status(TAG, fmt.Sprintf("stored policy of '%s'", domain))
+		httputil.SendJSON(writer, http.StatusOK, struct {
+			*domainPolicy
+			*accessReport
+		}{loadDomainPolicies(cxn, domain)[0], reportLostAccess(req, cxn, before, "domain '"+domain+"' changed")})
+	case "DELETE":
+		if len(loadDomainPolicies(cxn, domain)) == 0 {
+			httputil.SendJSON(writer, http.StatusOK, &accessReport{LostAccess: []string{}})
+			return
+		}
+		before := entitledHolders(cxn, loadSettings())
+		writeDatabaseByQuery("delete from domains where domain=?", domain)
+		writeDatabaseByQuery("insert into events (event, email, value) values (?, ?, ?)", "domain removed", "", domain)
+		log.Status(TAG, fmt.Sprintf("removed domain '%s'", domain))
+		httputil.SendJSON(writer, http.StatusOK, reportLostAccess(req, cxn, before, "domain '"+domain+"' removed"))
+	default:
+		panic("API method sentinel misconfiguration")
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Dormant certs: those that haven't been used to connect for the DormancyDays setting. The OpenVPN
+// client-connect & client-disconnect hook (ovpn-client-logger.py) records each cert's last use; a
+// cert that has never been used counts from when it was issued, or from when tracking began if that's
+// later. Gjallarhorn warns owners DormancyWarningDays ahead, and expiryLoop revokes dormant certs as
+// "cessationOfOperation".
+
+import (
+	"fmt"
+
+	"playground/log"
+)
+
+// dormancyClock is the SQL expression for when a cert's dormancy started, in the certs table
+const dormancyClock = "max(ifnull(last_seen, created), ifnull((select value from settings where key='UsageTrackedSince'), created))"
+
+// revokeDormantCerts revokes active certs unused for longer than the DormancyDays setting, if set.
+func revokeDormantCerts() error {
+	s := loadSettings()
+	if s.DormancyDays <= 0 {
+		return nil
+	}
+
+	cxn := getDB()
+	defer cxn.Close()
+
+	since := fmt.Sprintf("-%d days", s.DormancyDays)
+	rows, err := cxn.Query("select email, fingerprint, "+dormancyClock+" from certs where revoked is null and "+dormancyClock+" < datetime('now', ?)", since)
+	if err != nil {
+		return err
+	}
+	type dormant struct{ Email, Fingerprint, Since string }
+	certs := []*dormant{}
+	for rows.Next() {
+		d := &dormant{}
+		rows.Scan(&d.Email, &d.Fingerprint, &d.Since)
+		certs = append(certs, d)
+	}
+	rows.Close()
+
+	for _, d := range certs {
+		res, err := cxn.Exec("update certs set revoked=datetime('now'), revoke_reason='cessationOfOperation' where fingerprint=? and revoked is null and "+dormancyClock+" < datetime('now', ?)", d.Fingerprint, since)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 { // used or revoked meanwhile
+			continue
+		}
+		value := fmt.Sprintf("%s (cessationOfOperation; unused since %s)", d.Fingerprint, d.Since)
+		if _, err = cxn.Exec("insert into events (event, email, value) values (?, ?, ?)", "certificate revoked", d.Email, value); err != nil {
+			return err
+		}
+		log.Status("revokeDormantCerts", fmt.Sprintf("revoked '%s' cert %s, unused since %s", d.Email, d.Fingerprint, d.Since))
+	}
+	return nil
+}
@@ -0,0 +1,316 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Just-in-time elevation: a time-boxed grant of a role to a user who is eligible for it but doesn't
+// hold it day to day. Heimdall records requests, approvals and expiry; whether a user is eligible,
+// and whether a request needs approval, is up to Bifröst.
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"playground/httputil"
+	"playground/log"
+
+	"validate"
+)
+
+const (
+	elevationMaxMinutes     = 24 * 60 // longest elevation Heimdall accepts, whatever Bifröst allows
+	elevationRequestMinutes = 60      // how long a request waits for approval before lapsing
+)
+
+type elevation struct {
+	ID                    int64
+	Email, Role, Reason   string
+	Minutes               int
+	Requested, ApprovedBy string
+	Started, Expires      string
+	Active                bool // started & not yet expired; otherwise, awaiting approval
+}
+
+// openElevations selects elevations that are active, or awaiting approval and not yet lapsed
+var openElevations = fmt.Sprintf(`ended is null and (ifnull(expires, '') > current_timestamp or
+	(started is null and requested > datetime('now', '-%d minutes')))`, elevationRequestMinutes)
+
+// loadElevations returns the open elevations of the indicated user, or of all users if email is "".
+func loadElevations(cxn *sql.DB, email string) []*elevation {
+	q := `select rowid, email, role, reason, minutes, strftime('%Y-%m-%dT%H:%M:%SZ', requested),
+		ifnull(approved_by, ''), ifnull(strftime('%Y-%m-%dT%H:%M:%SZ', started), ''),
+		ifnull(strftime('%Y-%m-%dT%H:%M:%SZ', expires), ''), started is not null
+		from elevations where ` + openElevations
+	params := []interface{}{}
+	if email != "" {
+		q += " and email=?"
+		params = append(params, email)
+	}
+	rows, err := cxn.Query(q+" order by requested", params...)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+
+	res := []*elevation{}
+	for rows.Next() {
+		e := &elevation{}
+		rows.Scan(&e.ID, &e.Email, &e.Role, &e.Reason, &e.Minutes, &e.Requested, &e.ApprovedBy, &e.Started, &e.Expires, &e.Active)
+		res = append(res, e)
+	}
+	return res
+}
+
+// loadElevation returns the indicated open elevation, or nil if there is none.
+func loadElevation(cxn *sql.DB, id int64) *elevation {
+	for _, e := range loadElevations(cxn, "") {
+		if e.ID == id {
+			return e
+		}
+	}
+	return nil
+}
+
+// startElevation activates an elevation from now, for its requested duration.
+func startElevation(e *elevation, approvedBy string) {
+	writeDatabaseByQuery("update elevations set started=current_timestamp, expires=datetime('now', ?), approved_by=? where rowid=?",
+		fmt.Sprintf("+%d minutes", e.Minutes), approvedBy, e.ID)
+	value := fmt.Sprintf("%s for %dm: %s", e.Role, e.Minutes, e.Reason)
+	if approvedBy != "" {
+		value += fmt.Sprintf(" (approved by '%s')", approvedBy)
+	}
+	writeDatabaseByQuery("insert into events (event, email, value) values (?, ?, ?)", "elevation started", e.Email, value)
+}
+
+// expireElevations closes out elevations that have run their course, and requests that were never
+// approved, so that the end of each is recorded in the event log. Whether an elevation is active
+// never depends on this having run, though; see openElevations.
+func expireElevations() error {
+	cxn := getDB()
+	defer cxn.Close()
+
+	type closed struct {
+		id                 int64
+		email, role, event string
+	}
+	rows, err := cxn.Query(`select rowid, email, role, case when started is null then 'elevation lapsed' else 'elevation ended' end
+		from elevations where ended is null and not (` + openElevations + `)`)
+	if err != nil {
+		return err
+	}
+	done := []*closed{}
+	for rows.Next() {
+		c := &closed{}
+		rows.Scan(&c.id, &c.email, &c.role, &c.event)
+		done = append(done, c)
+	}
+	rows.Close()
+
+	for _, c := range done {
+		if _, err = cxn.Exec("update elevations set ended=ifnull(expires, current_timestamp) where rowid=?", c.id); err != nil {
+			return err
+		}
+		value := c.role + " expired"
+		if c.event == "elevation lapsed" {
+			value = c.role + " request not approved in time"
+		}
+		if _, err = cxn.Exec("insert into events (event, email, value) values (?, ?, ?)", c.event, c.email, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * API endpoint handlers
+ */
+
+func elevationsHandler(writer http.ResponseWriter, req *http.Request) {
+	// GET /elevations -- fetch all active elevations, and requests awaiting approval
+	//   I: None
+	//   O: {Elevations: [{ID: 0, Email: "", Role: "", Reason: "", Minutes: 0, Requested: "", ApprovedBy: "", Started: "", Expires: "", Active: false}]}
+	//   200: the object above
+	// GET /elevations/<email> -- as above, for the indicated user only
+	//   I: None
+	//   O: as above
+	//   200: the object above; 400: malformed email
+	// POST /elevations/<email> -- request elevation for the indicated user
+	//   I: {Role: "", Reason: "", Minutes: 60, Approved: false}
+	//   O: {ID: 0, Email: "", Role: "", Reason: "", Minutes: 0, Requested: "", ApprovedBy: "", Started: "", Expires: "", Active: false}
+	//   200: the elevation was recorded, and started if Approved; 400: malformed email, unknown role,
+	//   missing reason, or Minutes out of range; 409 (conflict): user already has an open elevation
+	//   Note: requests that aren't Approved lapse unless approved via /elevation/<id> within an hour
+	// Non-GET/POST: 405 (method not allowed)
+
+	TAG := "/elevations/"
+
+	email := extractSegment(req.URL.Path, 2)
+	if email != "" {
+		var err error
+		if email, err = validate.Email(email); err != nil {
+			sendBadRequest(writer, TAG, err)
+			return
+		}
+	}
+
+	cxn := getDB()
+	defer cxn.Close()
+
+	switch req.Method {
+	case "GET":
+		httputil.SendJSON(writer, http.StatusOK, struct{ Elevations []*elevation }{loadElevations(cxn, email)})
+	case "POST":
+		if email == "" {
+			httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+			return
+		}
+		in := &struct {
+			Role, Reason string
+			Minutes      int
+			Approved     bool
+		}{}
+		if err := httputil.PopulateFromBody(in, req); err != nil {
+			log.Warn(TAG, "missing or malformed request JSON", req.URL.Path)
+			httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+			return
+		}
+		if err := validateRole(&userRole{Email: email, Role: in.Role}); err != nil {
+			sendBadRequest(writer, TAG, err)
+			return
+		}
+		if strings.TrimSpace(in.Reason) == "" {
+			sendBadRequest(writer, TAG, errors.New("a reason is required"))
+			return
+		}
+		reason, err := validate.Description(in.Reason) // same rules as a description, since it ends up in events
+		if err != nil {
+			sendBadRequest(writer, TAG, fmt.Errorf("bad reason: %s", err))
+			return
+		}
+		if in.Minutes < 1 || in.Minutes > elevationMaxMinutes {
+			sendBadRequest(writer, TAG, fmt.Errorf("elevation must last between 1 and %d minutes", elevationMaxMinutes))
+			return
+		}
+		if len(loadElevations(cxn, email)) > 0 {
+			log.Warn(TAG, "duplicate elevation request", email)
+			httputil.SendJSON(writer, http.StatusConflict, struct{}{})
+			return
+		}
+
+		res, err := cxn.Exec("insert into elevations (email, role, reason, minutes) values (?, ?, ?, ?)", email, in.Role, reason, in.Minutes)
+		if err != nil {
+			panic(err)
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			panic(err)
+		}
+		e := loadElevation(cxn, id)
+		if in.Approved {
+			startElevation(e, "")
+			log.Status(TAG, fmt.Sprintf("elevated '%s' to '%s' for %d minutes", email, e.Role, e.Minutes))
+		} else {
+			writeDatabaseByQuery("insert into events (event, email, value) values (?, ?, ?)", "elevation requested", email, fmt.Sprintf("%s for %dm: %s", e.Role, e.Minutes, e.Reason))
+			log.Status(TAG, fmt.Sprintf("'%s' requested elevation to '%s'", email, e.Role))
+		}
+		httputil.SendJSON(writer, http.StatusOK, loadElevation(cxn, id))
+	default:
+		panic("API method sentinel misconfiguration")
+	}
+}
+
+func elevationHandler(writer http.ResponseWriter, req *http.Request) {
+	// PUT /elevation/<id> -- approve the indicated request, starting the elevation now
+	//   I: {ApprovedBy: ""}
+	//   O: {ID: 0, Email: "", Role: "", Reason: "", Minutes: 0, Requested: "", ApprovedBy: "", Started: "", Expires: "", Active: false}
+	//   200: the elevation started; 400: malformed ID or approver, or approver is the requester;
+	//   404: no such request awaiting approval
+	// DELETE /elevation/<id>?by=<email> -- end the indicated elevation early, or turn down a request
+	//   I: None
+	//   O: {}
+	//   200: the elevation was ended (idempotent); 400: malformed ID or email; 409: the elevation is
+	//   active and by isn't its holder (only requests can be turned down by others)
+	// Non-PUT/DELETE: 405 (method not allowed)
+
+	TAG := "/elevation/"
+
+	id, err := strconv.ParseInt(extractSegment(req.URL.Path, 2), 10, 64)
+	if err != nil {
+		sendBadRequest(writer, TAG, errors.New("malformed elevation ID"))
+		return
+	}
+
+	cxn := getDB()
+	defer cxn.Close()
+	e := loadElevation(cxn, id)
+
+	switch req.Method {
+	case "PUT":
+		in := &struct{ ApprovedBy string }{}
+		if err := httputil.PopulateFromBody(in, req); err != nil {
+			log.Warn(TAG, "missing or malformed request JSON", req.URL.Path)
+			httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+			return
+		}
+		approver, err := validate.Email(in.ApprovedBy)
+		if err != nil {
+			sendBadRequest(writer, TAG, err)
+			return
+		}
+		if e == nil || e.Active {
+			log.Warn(TAG, "attempt to approve nonexistent or active elevation", id)
+			httputil.SendJSON(writer, http.StatusNotFound, struct{}{})
+			return
+		}
+		if approver == e.Email {
+			sendBadRequest(writer, TAG, errors.New("elevation must be approved by someone else"))
+			return
+		}
+		startElevation(e, approver)
+		log.Status(TAG, fmt.Sprintf("'%s' approved elevation of '%s' to '%s'", approver, e.Email, e.Role))
+		httputil.SendJSON(writer, http.StatusOK, loadElevation(cxn, id))
+	case "DELETE":
+		if err := req.ParseForm(); err != nil {
+			panic(err)
+		}
+		by, err := validate.Email(req.FormValue("by"))
+		if err != nil {
+			sendBadRequest(writer, TAG, err)
+			return
+		}
+		if e == nil {
+			httputil.SendJSON(writer, http.StatusOK, struct{}{})
+			return
+		}
+		if e.Active && by != e.Email {
+			log.Warn(TAG, fmt.Sprintf("'%s' attempted to end elevation of '%s'", by, e.Email))
+			httputil.SendJSON(writer, http.StatusConflict, struct{}{})
+			return
+		}
+		writeDatabaseByQuery("update elevations set ended=current_timestamp where rowid=?", id)
+		event, value := "elevation ended", fmt.Sprintf("%s ended early by '%s'", e.Role, by)
+		if !e.Active {
+			event, value = "elevation denied", fmt.Sprintf("%s request turned down by '%s'", e.Role, by)
+		}
+		writeDatabaseByQuery("insert into events (event, email, value) values (?, ?, ?)", event, e.Email, value)
+		log.Status(TAG, fmt.Sprintf("'%s' closed elevation of '%s' to '%s'", by, e.Email, e.Role))
+		httputil.SendJSON(writer, http.StatusOK, struct{}{})
+	default:
+		panic("API method sentinel misconfiguration")
+	}
+}
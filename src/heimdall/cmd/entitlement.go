@@ -0,0 +1,167 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Loss of entitlement. OpenVPN's tls-verify hook refuses the certs of users who are no longer
+// whitelisted, in an enabled domain, or admins, so removing a whitelist entry or a domain takes
+// away the access of anyone relying on it. Changes that can do so report who lost access, and on
+// request revoke their certs outright rather than leaving them unusable.
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"playground/httputil"
+	"playground/log"
+
+	"validate"
+)
+
+type accessReport struct {
+	LostAccess []string // users with active certs who were entitled before the change, but aren't now
+	Revoked    int      // how many of their certs were revoked, if that was requested
+}
+
+// configAdminsKey is the settings row holding Bifröst's config-file admins (space-separated), as it
+// last reported them via PUT /admins.
+const configAdminsKey = "ConfigAdmins"
+
+// loadConfigAdmins returns Bifröst's config-file admins, as it last reported them.
+func loadConfigAdmins(cxn *sql.DB) []string {
+	var list string
+	if err := cxn.QueryRow("select value from settings where key=?", configAdminsKey).Scan(&list); err != nil && err != sql.ErrNoRows {
+		panic(err)
+	}
+	return strings.Fields(list)
+}
+
+// loadAdmins returns the set of users with the admin role, plus Bifröst's config-file admins.
+func loadAdmins(cxn *sql.DB) map[string]bool {
+	admins := make(map[string]bool)
+	for _, r := range loadRoles(cxn, "") {
+		if r.Role == roleAdmin {
+			admins[r.Email] = true
+		}
+	}
+	for _, a := range loadConfigAdmins(cxn) {
+		admins[a] = true
+	}
+	return admins
+}
+
+// entitledHolders returns the set of users with active certs who are entitled to them under s.
+func entitledHolders(cxn *sql.DB, s *settings) map[string]bool {
+	rows, err := cxn.Query("select distinct email from certs where revoked is null and expires >= date('now')")
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+
+	admins := loadAdmins(cxn)
+	res := make(map[string]bool)
+	var email string
+	for rows.Next() {
+		rows.Scan(&email)
+		if isEntitled(email, s, admins) {
+			res[email] = true
+		}
+	}
+	return res
+}
+
+// reportLostAccess lists the users in before (as returned by entitledHolders prior to a change)
+// who are no longer entitled, and revokes their certs if the request has ?revoke=true. cause
+// describes the change, for the event log.
+func reportLostAccess(req *http.Request, cxn *sql.DB, before map[string]bool, cause string) *accessReport {
+	after := entitledHolders(cxn, loadSettings())
+	r := &accessReport{LostAccess: []string{}}
+	for email := range before {
+		if !after[email] {
+			r.LostAccess = append(r.LostAccess, email)
+		}
+	}
+	sort.Strings(r.LostAccess)
+	if req.FormValue("revoke") != "true" {
+		return r
+	}
+
+	for _, email := range r.LostAccess {
+		res, err := cxn.Exec("update certs set revoked=datetime('now'), revoke_reason='affiliationChanged' where email=? and (revoked is null or revoke_reason=?)", email, validate.CertificateHold)
+		if err != nil {
+			panic(err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			panic(err)
+		}
+		r.Revoked += int(n)
+		writeDatabaseByQuery("insert into events (event, email, value) values (?, ?, ?)", "access withdrawn", email, fmt.Sprintf("%d certs revoked (%s)", n, cause))
+	}
+	log.Status("reportLostAccess", fmt.Sprintf("revoked %d certs of %d users after %s", r.Revoked, len(r.LostAccess), cause))
+	return r
+}
+
+/*
+ * API endpoint handlers
+ */
+
+func adminsHandler(writer http.ResponseWriter, req *http.Request) {
+	// GET /admins -- fetch Bifröst's config-file admins, as last reported
+	//   I: None
+	//   O: {Emails: [""]}
+	//   200: the object above
+	// PUT /admins -- report Bifröst's config-file admins
+	//   I: {Emails: [""]}
+	//   O: {Emails: [""]}
+	//   200: the list was stored; 400: malformed JSON or emails
+	//   Note: Bifröst reports them when it starts. They're entitled to certs regardless of the
+	//   whitelist, like users with the admin role, and are mailed about security incidents.
+	// Non-GET/PUT: 409 (bad method)
+
+	TAG := "/admins"
+
+	cxn := getDB()
+	defer cxn.Close()
+
+	if req.Method == "PUT" {
+		in := &struct{ Emails []string }{}
+		if err := httputil.PopulateFromBody(in, req); err != nil {
+			log.Warn(TAG, "missing or malformed request JSON", req.URL.Path)
+			httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+			return
+		}
+		emails := []string{}
+		for _, a := range in.Emails {
+			email, err := validate.Email(a)
+			if err != nil {
+				sendBadRequest(writer, TAG, err)
+				return
+			}
+			emails = append(emails, email)
+		}
+		sort.Strings(emails)
+		list := strings.Join(emails, " ")
+		if list != strings.Join(loadConfigAdmins(cxn), " ") {
+			writeDatabaseByQuery("insert or replace into settings (key, value) values (?, ?)", configAdminsKey, list)
+			writeDatabaseByQuery("insert into events (event, email, value) values (?, ?, ?)", "config admins changed", "", list)
+			log.Status(TAG, "config-file admins are now", list)
+		}
+	}
+
+	httputil.SendJSON(writer, http.StatusOK, &struct{ Emails []string }{loadConfigAdmins(cxn)})
+}
@@ -0,0 +1,993 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Full-state export & import, for moving a deployment to a new server or recovering from a disaster.
+// The document is plain JSON; everything in it is metadata except for TOTP seeds, which are sealed
+// with a key derived from an operator-supplied passphrase.
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"playground/httputil"
+	"playground/log"
+
+	"validate"
+)
+
+// exportVersion is the version of the document format written by this code. Bump it whenever the
+// meaning of an existing field changes; new optional fields don't require a bump.
+const exportVersion = 1
+
+const (
+	kdfAlgorithm  = "pbkdf2-sha256"
+	kdfIterations = 200000
+	kdfCheckValue = "heimdall"
+)
+
+type exportKDF struct {
+	Algorithm  string
+	Iterations int
+	Salt       string // base64
+	Check      string // kdfCheckValue, sealed; lets import detect a bad passphrase before touching anything
+}
+
+type exportUser struct{ Email, Seed, Created, Updated string }
+type exportCert struct {
+	Email, Fingerprint, Description, Created, Expires, Revoked string
+	CommonName, ReplacedBy                                     string `json:",omitempty"` // see renameUser
+	RevokeReason                                               string `json:",omitempty"` // see certHandler
+	LastSeen, LastIP                                           string `json:",omitempty"` // see dormancy.go
+	Issuer                                                     string `json:",omitempty"` // see massrevoke.go
+	KeyAlgorithm                                               string `json:",omitempty"` // see keys.go
+	FromCSR                                                    bool   `json:",omitempty"` // see csr.go
+}
+type exportWhitelist struct {
+	Email, Modified        string
+	Expires, Sponsor, Note string `json:",omitempty"` // see whitelist.go
+}
+type exportEvent struct{ Event, Email, Value, Timestamp string }
+type exportAlias struct{ OldEmail, Email, Created, GraceUntil string }
+type exportRole struct{ Email, Role, Domains, Modified string } // Domains is space-separated
+type exportLimit struct {
+	Email, ClientLimit, IssuedCertDuration, Modified string // "" for a limit that isn't overridden
+}
+type exportDomain struct {
+	Domain                          string
+	Enabled                         bool
+	ClientLimit, IssuedCertDuration string // as for exportLimit
+	Profiles, Modified              string // Profiles is space-separated
+}
+type exportSuspension struct {
+	Email, Reason, Until, SuspendedBy, Created string // Until is "" for a suspension that lasts until lifted
+}
+type exportRevocation struct {
+	Email, Fingerprint, Reason, Due, ScheduledBy, Created string // Fingerprint is "" for all of the user's access
+}
+
+// exportDocument is the complete exported state of a Heimdall database. Timestamps are carried in
+// SQLite's native text form so that they round-trip exactly.
+type exportDocument struct {
+	Version     int
+	Exported    string
+	KDF         *exportKDF `json:",omitempty"`
+	Settings    map[string]string
+	Whitelist   []*exportWhitelist
+	Users       []*exportUser
+	Certs       []*exportCert
+	Events      []*exportEvent
+	Aliases     []*exportAlias
+	Roles       []*exportRole
+	Limits      []*exportLimit
+	Domains     []*exportDomain
+	Suspensions []*exportSuspension
+	Revocations []*exportRevocation
+}
+
+/*
+ * Snapshots of database state
+ */
+
+// loadSnapshot reads the complete current state of the database. Seeds in the result are plaintext.
+func loadSnapshot(cxn *sql.DB) (*exportDocument, error) {
+	doc := &exportDocument{
+		Version:     exportVersion,
+		Exported:    time.Now().UTC().Format("2006-01-02 15:04:05"),
+		Settings:    make(map[string]string),
+		Whitelist:   []*exportWhitelist{},
+		Users:       []*exportUser{},
+		Certs:       []*exportCert{},
+		Events:      []*exportEvent{},
+		Aliases:     []*exportAlias{},
+		Roles:       []*exportRole{},
+		Limits:      []*exportLimit{},
+		Domains:     []*exportDomain{},
+		Suspensions: []*exportSuspension{},
+		Revocations: []*exportRevocation{},
+	}
+
+	// note that timestamps are cast to text, so that the driver hands back exactly what's stored
+	rows, err := cxn.Query("select key, value from settings")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var k, v string
+		rows.Scan(&k, &v)
+		doc.Settings[k] = v
+	}
+	rows.Close()
+
+	if rows, err = cxn.Query("select email, cast(modified as text), ifnull(cast(expires as text), ''), sponsor, note from whitelist order by email"); err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		w := &exportWhitelist{}
+		rows.Scan(&w.Email, &w.Modified, &w.Expires, &w.Sponsor, &w.Note)
+		doc.Whitelist = append(doc.Whitelist, w)
+	}
+	rows.Close()
+
+	if rows, err = cxn.Query("select email, seed, cast(created as text), cast(updated as text) from totp order by email"); err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		u := &exportUser{}
+		rows.Scan(&u.Email, &u.Seed, &u.Created, &u.Updated)
+		doc.Users = append(doc.Users, u)
+	}
+	rows.Close()
+
+	q := "select email, fingerprint, ifnull(desc, ''), cast(created as text), cast(expires as text), ifnull(cast(revoked as text), ''), ifnull(cn, ''), ifnull(replaced_by, ''), ifnull(revoke_reason, ''), ifnull(cast(last_seen as text), ''), ifnull(last_ip, ''), ifnull(issuer, ''), ifnull(key_algorithm, ''), from_csr from certs order by email, created"
+	if rows, err = cxn.Query(q); err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		c := &exportCert{}
+		rows.Scan(&c.Email, &c.Fingerprint, &c.Description, &c.Created, &c.Expires, &c.Revoked, &c.CommonName, &c.ReplacedBy, &c.RevokeReason, &c.LastSeen, &c.LastIP, &c.Issuer, &c.KeyAlgorithm, &c.FromCSR)
+		doc.Certs = append(doc.Certs, c)
+	}
+	rows.Close()
+
+	if rows, err = cxn.Query("select event, email, value, cast(ts as text) from events order by ts, rowid"); err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		ev := &exportEvent{}
+		rows.Scan(&ev.Event, &ev.Email, &ev.Value, &ev.Timestamp)
+		doc.Events = append(doc.Events, ev)
+	}
+	rows.Close()
+
+	if rows, err = cxn.Query("select old_email, email, cast(created as text), cast(grace_until as text) from aliases order by created, rowid"); err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		a := &exportAlias{}
+		rows.Scan(&a.OldEmail, &a.Email, &a.Created, &a.GraceUntil)
+		doc.Aliases = append(doc.Aliases, a)
+	}
+	rows.Close()
+
+	if rows, err = cxn.Query("select email, role, domains, cast(modified as text) from roles order by email"); err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		r := &exportRole{}
+		rows.Scan(&r.Email, &r.Role, &r.Domains, &r.Modified)
+		doc.Roles = append(doc.Roles, r)
+	}
+	rows.Close()
+
+	q = "select email, ifnull(cast(client_limit as text), ''), ifnull(cast(cert_duration as text), ''), cast(modified as text) from user_limits order by email"
+	if rows, err = cxn.Query(q); err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		l := &exportLimit{}
+		rows.Scan(&l.Email, &l.ClientLimit, &l.IssuedCertDuration, &l.Modified)
+		doc.Limits = append(doc.Limits, l)
+	}
+	rows.Close()
+
+	q = "select domain, enabled, ifnull(cast(client_limit as text), ''), ifnull(cast(cert_duration as text), ''), profiles, cast(modified as text) from domains order by domain"
+	if rows, err = cxn.Query(q); err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		d := &exportDomain{}
+		rows.Scan(&d.Domain, &d.Enabled, &d.ClientLimit, &d.IssuedCertDuration, &d.Profiles, &d.Modified)
+		doc.Domains = append(doc.Domains, d)
+	}
+	rows.Close()
+
+	q = "select email, reason, ifnull(cast(ends as text), ''), suspended_by, cast(created as text) from suspensions order by email"
+	if rows, err = cxn.Query(q); err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		su := &exportSuspension{}
+		rows.Scan(&su.Email, &su.Reason, &su.Until, &su.SuspendedBy, &su.Created)
+		doc.Suspensions = append(doc.Suspensions, su)
+	}
+	rows.Close()
+
+	q = "select email, ifnull(fingerprint, ''), reason, cast(due as text), scheduled_by, cast(created as text) from scheduled_revocations order by due, id"
+	if rows, err = cxn.Query(q); err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		r := &exportRevocation{}
+		rows.Scan(&r.Email, &r.Fingerprint, &r.Reason, &r.Due, &r.ScheduledBy, &r.Created)
+		doc.Revocations = append(doc.Revocations, r)
+	}
+	rows.Close()
+
+	return doc, nil
+}
+
+/*
+ * Passphrase-based sealing of TOTP seeds
+ */
+
+// deriveKey turns a passphrase into an AES-256-GCM cipher, via PBKDF2-SHA256.
+func deriveKey(passphrase string, salt []byte, iterations int) (cipher.AEAD, error) {
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, iterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func deriveSeedKey(passphrase string, kdf *exportKDF) (cipher.AEAD, error) {
+	if kdf.Algorithm != kdfAlgorithm {
+		return nil, fmt.Errorf("unsupported key derivation '%s'", kdf.Algorithm)
+	}
+	salt, err := base64.StdEncoding.DecodeString(kdf.Salt)
+	if err != nil {
+		return nil, err
+	}
+	return deriveKey(passphrase, salt, kdf.Iterations)
+}
+
+func seal(aead cipher.AEAD, plaintext string) string {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(plaintext), nil))
+}
+
+func unseal(aead cipher.AEAD, sealed string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", err
+	}
+	if len(raw) < aead.NonceSize() {
+		return "", errors.New("sealed value is truncated")
+	}
+	plain, err := aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// sealSeeds encrypts every TOTP seed in the document in place.
+func sealSeeds(doc *exportDocument, passphrase string) error {
+	if len(doc.Users) == 0 {
+		return nil
+	}
+	if passphrase == "" {
+		return errors.New("a passphrase is required to export TOTP seeds")
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	doc.KDF = &exportKDF{kdfAlgorithm, kdfIterations, base64.StdEncoding.EncodeToString(salt), ""}
+	aead, err := deriveSeedKey(passphrase, doc.KDF)
+	if err != nil {
+		return err
+	}
+	doc.KDF.Check = seal(aead, kdfCheckValue)
+	for _, u := range doc.Users {
+		u.Seed = seal(aead, u.Seed)
+	}
+	return nil
+}
+
+// unsealSeeds decrypts every TOTP seed in the document in place.
+func unsealSeeds(doc *exportDocument, passphrase string) error {
+	if len(doc.Users) == 0 {
+		return nil
+	}
+	if doc.KDF == nil {
+		return errors.New("document contains users but no KDF parameters")
+	}
+	aead, err := deriveSeedKey(passphrase, doc.KDF)
+	if err != nil {
+		return err
+	}
+	if check, err := unseal(aead, doc.KDF.Check); err != nil || check != kdfCheckValue {
+		return errors.New("incorrect passphrase")
+	}
+	for _, u := range doc.Users {
+		if u.Seed, err = unseal(aead, u.Seed); err != nil {
+			return fmt.Errorf("unable to decrypt seed for '%s'", u.Email)
+		}
+	}
+	return nil
+}
+
+/*
+ * Import validation, diffing & application
+ */
+
+func validTimestamp(ts string) bool {
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02"} {
+		if _, err := time.Parse(layout, ts); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// validateDocument checks an incoming document for structural problems, returning one message per
+// problem found. An empty result means the document is safe to diff & apply. Emails are
+// canonicalized in place.
+func validateDocument(doc *exportDocument) []string {
+	problems := []string{}
+	complain := func(format string, args ...interface{}) { problems = append(problems, fmt.Sprintf(format, args...)) }
+
+	if doc.Version < 1 || doc.Version > exportVersion {
+		complain("unsupported document version %d", doc.Version)
+		return problems
+	}
+
+	// loadSettings panics on a setting it can't parse, so a bad one would break the server
+	ints := []string{}
+	for k := range intSettings(&settings{}) {
+		ints = append(ints, k)
+	}
+	sort.Strings(ints)
+	for _, k := range ints {
+		if v, ok := doc.Settings[k]; ok {
+			if n, err := strconv.ParseInt(v, 10, 32); err != nil {
+				complain("setting '%s' is not an integer: '%s'", k, v)
+			} else if n < 0 {
+				complain("setting '%s' is negative: '%s'", k, v)
+			}
+		}
+	}
+	if v, ok := doc.Settings["KeyAlgorithm"]; ok && !knownKeyAlgorithm(v) {
+		complain("setting 'KeyAlgorithm' is not one of %s: '%s'", strings.Join(keyAlgorithms, ", "), v)
+	}
+	if v, ok := doc.Settings["SignatureHash"]; ok && !knownSignatureHash(v) {
+		complain("setting 'SignatureHash' is not one of %s: '%s'", strings.Join(signatureHashes, ", "), v)
+	}
+
+	// documents from before domain policies carry the whitelisted domains as a setting
+	if v, ok := doc.Settings["WhitelistedDomains"]; ok {
+		if len(doc.Domains) == 0 {
+			for _, d := range strings.Fields(v) {
+				doc.Domains = append(doc.Domains, &exportDomain{Domain: d, Enabled: true, Modified: doc.Exported})
+			}
+		}
+		delete(doc.Settings, "WhitelistedDomains")
+	}
+
+	canonical := func(email string) string {
+		if c, err := validate.Email(email); err == nil {
+			return c
+		}
+		complain("invalid email '%s'", email)
+		return email
+	}
+
+	seen := make(map[string]bool)
+	for _, w := range doc.Whitelist {
+		w.Email = canonical(w.Email)
+		if seen[w.Email] {
+			complain("duplicate whitelist entry '%s'", w.Email)
+		}
+		seen[w.Email] = true
+		if w.Modified != "" && !validTimestamp(w.Modified) {
+			complain("whitelist entry '%s' has malformed timestamp '%s'", w.Email, w.Modified)
+		}
+		if _, err := time.Parse("2006-01-02", w.Expires); w.Expires != "" && err != nil {
+			complain("whitelist entry '%s' has malformed expiry '%s'", w.Email, w.Expires)
+		}
+		if w.Sponsor != "" {
+			w.Sponsor = canonical(w.Sponsor)
+		}
+	}
+
+	seen = make(map[string]bool)
+	for _, u := range doc.Users {
+		u.Email = canonical(u.Email)
+		if seen[u.Email] {
+			complain("duplicate user '%s'", u.Email)
+		}
+		seen[u.Email] = true
+		if u.Seed == "" {
+			complain("user '%s' has no TOTP seed", u.Email)
+		}
+		if !validTimestamp(u.Created) || !validTimestamp(u.Updated) {
+			complain("user '%s' has malformed timestamps", u.Email)
+		}
+	}
+
+	seen = make(map[string]bool)
+	for _, c := range doc.Certs {
+		if fp, err := validate.Fingerprint(c.Fingerprint); err != nil || fp != c.Fingerprint {
+			complain("cert for '%s' has malformed fingerprint '%s'", c.Email, c.Fingerprint)
+			continue
+		} else if seen[c.Fingerprint] {
+			complain("duplicate cert '%s'", c.Fingerprint)
+		}
+		seen[c.Fingerprint] = true
+		c.Email = canonical(c.Email)
+		if c.CommonName != "" {
+			c.CommonName = canonical(c.CommonName)
+		}
+		if c.ReplacedBy != "" {
+			if fp, err := validate.Fingerprint(c.ReplacedBy); err != nil || fp != c.ReplacedBy {
+				complain("cert '%s' has malformed replacement '%s'", c.Fingerprint, c.ReplacedBy)
+			}
+		}
+		if c.Issuer != "" {
+			if fp, err := validate.Fingerprint(c.Issuer); err != nil || fp != c.Issuer {
+				complain("cert '%s' has malformed issuer '%s'", c.Fingerprint, c.Issuer)
+			}
+		}
+		if c.KeyAlgorithm != "" && !knownKeyAlgorithm(c.KeyAlgorithm) {
+			if bits, err := strconv.Atoi(strings.TrimPrefix(c.KeyAlgorithm, "rsa")); err != nil || bits < 2048 || !strings.HasPrefix(c.KeyAlgorithm, "rsa") {
+				complain("cert '%s' has unknown key algorithm '%s'", c.Fingerprint, c.KeyAlgorithm)
+			}
+		}
+		if !validTimestamp(c.Created) || !validTimestamp(c.Expires) || (c.Revoked != "" && !validTimestamp(c.Revoked)) || (c.LastSeen != "" && !validTimestamp(c.LastSeen)) {
+			complain("cert '%s' has malformed timestamps", c.Fingerprint)
+		}
+		if c.RevokeReason != "" {
+			if reason, err := validate.RevocationReason(c.RevokeReason); err != nil || reason != c.RevokeReason || c.Revoked == "" {
+				complain("cert '%s' has bad revocation reason '%s'", c.Fingerprint, c.RevokeReason)
+			}
+		}
+	}
+
+	for i, ev := range doc.Events {
+		if ev.Event == "" || !validTimestamp(ev.Timestamp) {
+			complain("event %d is malformed", i)
+		}
+	}
+
+	for _, a := range doc.Aliases {
+		a.OldEmail, a.Email = canonical(a.OldEmail), canonical(a.Email)
+		if !validTimestamp(a.Created) || !validTimestamp(a.GraceUntil) {
+			complain("alias '%s' has malformed timestamps", a.OldEmail)
+		}
+	}
+
+	seen = make(map[string]bool)
+	for _, r := range doc.Roles {
+		r.Email = canonical(r.Email)
+		if seen[r.Email] {
+			complain("duplicate role for '%s'", r.Email)
+		}
+		seen[r.Email] = true
+		role := &userRole{Email: r.Email, Role: r.Role, Domains: strings.Fields(r.Domains)}
+		if err := validateRole(role); err != nil {
+			complain("role for '%s': %s", r.Email, err)
+		}
+		r.Domains = strings.Join(role.Domains, " ")
+		if !validTimestamp(r.Modified) {
+			complain("role for '%s' has malformed timestamp", r.Email)
+		}
+	}
+
+	seen = make(map[string]bool)
+	for _, l := range doc.Limits {
+		l.Email = canonical(l.Email)
+		if seen[l.Email] {
+			complain("duplicate limits for '%s'", l.Email)
+		}
+		seen[l.Email] = true
+		for _, v := range []string{l.ClientLimit, l.IssuedCertDuration} {
+			if n, err := strconv.Atoi(v); v != "" && (err != nil || n < 1) {
+				complain("limits for '%s' are malformed", l.Email)
+			}
+		}
+		if !validTimestamp(l.Modified) {
+			complain("limits for '%s' have malformed timestamp", l.Email)
+		}
+	}
+
+	seen = make(map[string]bool)
+	for _, d := range doc.Domains {
+		p := &domainPolicy{Domain: d.Domain, Profiles: strings.Fields(d.Profiles)}
+		if err := validateDomainPolicy(p); err != nil {
+			complain("domain '%s': %s", d.Domain, err)
+		}
+		d.Domain, d.Profiles = p.Domain, strings.Join(p.Profiles, " ")
+		if seen[d.Domain] {
+			complain("duplicate domain '%s'", d.Domain)
+		}
+		seen[d.Domain] = true
+		for _, v := range []string{d.ClientLimit, d.IssuedCertDuration} {
+			if n, err := strconv.Atoi(v); v != "" && (err != nil || n < 1) {
+				complain("limits for domain '%s' are malformed", d.Domain)
+			}
+		}
+		if !validTimestamp(d.Modified) {
+			complain("domain '%s' has malformed timestamp", d.Domain)
+		}
+	}
+
+	seen = make(map[string]bool)
+	for _, su := range doc.Suspensions {
+		su.Email = canonical(su.Email)
+		if seen[su.Email] {
+			complain("duplicate suspension of '%s'", su.Email)
+		}
+		seen[su.Email] = true
+		if strings.TrimSpace(su.Reason) == "" {
+			complain("suspension of '%s' has no reason", su.Email)
+		}
+		if _, err := time.Parse("2006-01-02", su.Until); su.Until != "" && err != nil {
+			complain("suspension of '%s' has malformed end date '%s'", su.Email, su.Until)
+		}
+		if su.SuspendedBy != "" {
+			su.SuspendedBy = canonical(su.SuspendedBy)
+		}
+		if !validTimestamp(su.Created) {
+			complain("suspension of '%s' has malformed timestamp", su.Email)
+		}
+	}
+
+	for i, r := range doc.Revocations {
+		r.Email, r.ScheduledBy = canonical(r.Email), canonical(r.ScheduledBy)
+		if fp, err := validate.Fingerprint(r.Fingerprint); r.Fingerprint != "" && (err != nil || fp != r.Fingerprint) {
+			complain("scheduled revocation %d has malformed fingerprint '%s'", i, r.Fingerprint)
+		}
+		if reason, err := validate.RevocationReason(r.Reason); err != nil || reason != r.Reason {
+			complain("scheduled revocation %d has bad reason '%s'", i, r.Reason)
+		}
+		if !validTimestamp(r.Due) || !validTimestamp(r.Created) {
+			complain("scheduled revocation %d has malformed timestamps", i)
+		}
+	}
+
+	return problems
+}
+
+// tableDiff summarizes how an import changes (or would change) one table. Keys are emails,
+// fingerprints, domains, or setting names; events, which have no natural key, are identified by all
+// columns, and scheduled revocations by their due time, email and fingerprint.
+type tableDiff struct {
+	Added, Changed, Removed, Conflicts []string
+	Unchanged                          int
+}
+
+type importDiff struct {
+	Mode                                                                                                 string
+	DryRun                                                                                               bool
+	Settings, Whitelist, Users, Certs, Events, Aliases, Roles, Limits, Domains, Suspensions, Revocations *tableDiff
+}
+
+// importRow is one row of a table, reduced to what's needed to compare and write it.
+type importRow struct {
+	Digest    string        // canonical rendering of the row, to detect changes
+	Values    []interface{} // parameters for the table's upsert statement
+	KeyValues []interface{} // parameters for the table's delete statement
+}
+
+type importTable struct {
+	Upsert, Delete  string
+	Local, Incoming map[string]*importRow
+}
+
+func rowDigest(values ...interface{}) string {
+	chunks := []string{}
+	for _, v := range values {
+		chunks = append(chunks, fmt.Sprintf("%v", v))
+	}
+	return strings.Join(chunks, "\x00")
+}
+
+func nullable(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func buildImportTables(local, incoming *exportDocument) map[string]*importTable {
+	tables := map[string]*importTable{
+		"Settings":    {"insert or replace into settings (key, value) values (?, ?)", "delete from settings where key=?", nil, nil},
+		"Whitelist":   {"insert or replace into whitelist (email, modified, expires, sponsor, note) values (?, ?, ?, ?, ?)", "delete from whitelist where email=?", nil, nil},
+		"Users":       {"insert or replace into totp (email, seed, created, updated) values (?, ?, ?, ?)", "delete from totp where email=?", nil, nil},
+		"Certs":       {"insert or replace into certs (email, fingerprint, desc, created, expires, revoked, cn, replaced_by, revoke_reason, last_seen, last_ip, issuer, key_algorithm, from_csr) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", "delete from certs where fingerprint=?", nil, nil},
+		"Events":      {"insert into events (event, email, value, ts) values (?, ?, ?, ?)", "delete from events where event=? and email=? and value=? and ts=?", nil, nil},
+		"Aliases":     {"insert into aliases (old_email, email, created, grace_until) values (?, ?, ?, ?)", "delete from aliases where old_email=? and email=? and created=? and grace_until=?", nil, nil},
+		"Roles":       {"insert or replace into roles (email, role, domains, modified) values (?, ?, ?, ?)", "delete from roles where email=?", nil, nil},
+		"Limits":      {"insert or replace into user_limits (email, client_limit, cert_duration, modified) values (?, ?, ?, ?)", "delete from user_limits where email=?", nil, nil},
+		"Domains":     {"insert or replace into domains (domain, enabled, client_limit, cert_duration, profiles, modified) values (?, ?, ?, ?, ?, ?)", "delete from domains where domain=?", nil, nil},
+		"Suspensions": {"insert or replace into suspensions (email, reason, ends, suspended_by, created) values (?, ?, ?, ?, ?)", "delete from suspensions where email=?", nil, nil},
+		"Revocations": {"insert into scheduled_revocations (email, fingerprint, reason, due, scheduled_by, created) values (?, ?, ?, ?, ?, ?)", "delete from scheduled_revocations where email=? and ifnull(fingerprint, '')=? and due=?", nil, nil},
+	}
+
+	rowsOf := func(doc *exportDocument) map[string]map[string]*importRow {
+		res := map[string]map[string]*importRow{"Settings": {}, "Whitelist": {}, "Users": {}, "Certs": {}, "Events": {}, "Aliases": {}, "Roles": {}, "Limits": {}, "Domains": {}, "Suspensions": {}, "Revocations": {}}
+		for k, v := range doc.Settings {
+			res["Settings"][k] = &importRow{rowDigest(k, v), []interface{}{k, v}, []interface{}{k}}
+		}
+		for _, w := range doc.Whitelist {
+			modified := w.Modified
+			if modified == "" {
+				modified = time.Now().UTC().Format("2006-01-02 15:04:05")
+			}
+			values := []interface{}{w.Email, modified, nullable(w.Expires), w.Sponsor, w.Note}
+			res["Whitelist"][w.Email] = &importRow{rowDigest(w.Email, w.Expires, w.Sponsor, w.Note), values, []interface{}{w.Email}}
+		}
+		for _, u := range doc.Users {
+			res["Users"][u.Email] = &importRow{rowDigest(u.Email, u.Seed, u.Created, u.Updated), []interface{}{u.Email, u.Seed, u.Created, u.Updated}, []interface{}{u.Email}}
+		}
+		for _, c := range doc.Certs {
+			values := []interface{}{c.Email, c.Fingerprint, c.Description, c.Created, c.Expires, nullable(c.Revoked), nullable(c.CommonName), nullable(c.ReplacedBy), nullable(c.RevokeReason), nullable(c.LastSeen), nullable(c.LastIP), nullable(c.Issuer), nullable(c.KeyAlgorithm), c.FromCSR}
+			// as with whitelist modification times, usage alone doesn't make a cert differ
+			digest := rowDigest(c.Email, c.Fingerprint, c.Description, c.Created, c.Expires, c.Revoked, c.CommonName, c.ReplacedBy, c.RevokeReason)
+			res["Certs"][c.Fingerprint] = &importRow{digest, values, []interface{}{c.Fingerprint}}
+		}
+		for _, ev := range doc.Events {
+			values := []interface{}{ev.Event, ev.Email, ev.Value, ev.Timestamp}
+			key := strings.Join([]string{ev.Timestamp, ev.Event, ev.Email, ev.Value}, " ")
+			res["Events"][key] = &importRow{rowDigest(values...), values, values}
+		}
+		for _, a := range doc.Aliases {
+			values := []interface{}{a.OldEmail, a.Email, a.Created, a.GraceUntil}
+			key := strings.Join([]string{a.Created, a.OldEmail, a.Email}, " ")
+			res["Aliases"][key] = &importRow{rowDigest(values...), values, values}
+		}
+		for _, r := range doc.Roles {
+			res["Roles"][r.Email] = &importRow{rowDigest(r.Email, r.Role, r.Domains), []interface{}{r.Email, r.Role, r.Domains, r.Modified}, []interface{}{r.Email}}
+		}
+		for _, l := range doc.Limits {
+			values := []interface{}{l.Email, nullable(l.ClientLimit), nullable(l.IssuedCertDuration), l.Modified}
+			res["Limits"][l.Email] = &importRow{rowDigest(l.Email, l.ClientLimit, l.IssuedCertDuration), values, []interface{}{l.Email}}
+		}
+		for _, d := range doc.Domains {
+			values := []interface{}{d.Domain, d.Enabled, nullable(d.ClientLimit), nullable(d.IssuedCertDuration), d.Profiles, d.Modified}
+			res["Domains"][d.Domain] = &importRow{rowDigest(d.Domain, d.Enabled, d.ClientLimit, d.IssuedCertDuration, d.Profiles), values, []interface{}{d.Domain}}
+		}
+		for _, su := range doc.Suspensions {
+			values := []interface{}{su.Email, su.Reason, nullable(su.Until), su.SuspendedBy, su.Created}
+			res["Suspensions"][su.Email] = &importRow{rowDigest(su.Email, su.Reason, su.Until, su.SuspendedBy), values, []interface{}{su.Email}}
+		}
+		for _, r := range doc.Revocations {
+			values := []interface{}{r.Email, nullable(r.Fingerprint), r.Reason, r.Due, r.ScheduledBy, r.Created}
+			key := strings.Join([]string{r.Due, r.Email, r.Fingerprint}, " ")
+			res["Revocations"][key] = &importRow{rowDigest(r.Email, r.Fingerprint, r.Reason, r.Due, r.ScheduledBy), values, []interface{}{r.Email, r.Fingerprint, r.Due}}
+		}
+		return res
+	}
+
+	localRows, incomingRows := rowsOf(local), rowsOf(incoming)
+	for name, t := range tables {
+		t.Local = localRows[name]
+		t.Incoming = incomingRows[name]
+	}
+	return tables
+}
+
+// diffTable compares local and incoming rows. In "merge" mode, incoming rows only ever add to the
+// local state, and rows that differ are reported as conflicts (the local copy wins). In "replace"
+// mode, the incoming state wins outright, so differing rows are changed and missing rows removed.
+func diffTable(t *importTable, mode string) *tableDiff {
+	d := &tableDiff{[]string{}, []string{}, []string{}, []string{}, 0}
+	for k, in := range t.Incoming {
+		if local, ok := t.Local[k]; !ok {
+			d.Added = append(d.Added, k)
+		} else if local.Digest == in.Digest {
+			d.Unchanged++
+		} else if mode == "replace" {
+			d.Changed = append(d.Changed, k)
+		} else {
+			d.Conflicts = append(d.Conflicts, k)
+		}
+	}
+	if mode == "replace" {
+		for k := range t.Local {
+			if _, ok := t.Incoming[k]; !ok {
+				d.Removed = append(d.Removed, k)
+			}
+		}
+	}
+	sort.Strings(d.Added)
+	sort.Strings(d.Changed)
+	sort.Strings(d.Removed)
+	sort.Strings(d.Conflicts)
+	return d
+}
+
+// importDocument validates, diffs, and (unless dryRun) applies an import document in a single
+// transaction. The document's seeds must already be unsealed. A non-empty list of problems means
+// nothing was done.
+func importDocument(cxn *sql.DB, doc *exportDocument, mode string, dryRun bool) (*importDiff, []string, error) {
+	if mode != "merge" && mode != "replace" {
+		return nil, []string{fmt.Sprintf("unknown import mode '%s'", mode)}, nil
+	}
+	if problems := validateDocument(doc); len(problems) > 0 {
+		return nil, problems, nil
+	}
+
+	local, err := loadSnapshot(cxn)
+	if err != nil {
+		return nil, nil, err
+	}
+	tables := buildImportTables(local, doc)
+
+	diff := &importDiff{Mode: mode, DryRun: dryRun}
+	diffs := map[string]*tableDiff{}
+	for name, t := range tables {
+		diffs[name] = diffTable(t, mode)
+	}
+	diff.Settings, diff.Whitelist, diff.Users, diff.Certs, diff.Events = diffs["Settings"], diffs["Whitelist"], diffs["Users"], diffs["Certs"], diffs["Events"]
+	diff.Aliases, diff.Roles, diff.Limits, diff.Domains = diffs["Aliases"], diffs["Roles"], diffs["Limits"], diffs["Domains"]
+	diff.Suspensions, diff.Revocations = diffs["Suspensions"], diffs["Revocations"]
+
+	if dryRun {
+		return diff, nil, nil
+	}
+
+	tx, err := cxn.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, name := range []string{"Settings", "Whitelist", "Users", "Certs", "Events", "Aliases", "Roles", "Limits", "Domains", "Suspensions", "Revocations"} {
+		t, d := tables[name], diffs[name]
+		for _, k := range d.Removed {
+			if _, err = tx.Exec(t.Delete, t.Local[k].KeyValues...); err != nil {
+				tx.Rollback()
+				return nil, nil, err
+			}
+		}
+		for _, k := range append(append([]string{}, d.Added...), d.Changed...) {
+			if _, err = tx.Exec(t.Upsert, t.Incoming[k].Values...); err != nil {
+				tx.Rollback()
+				return nil, nil, err
+			}
+		}
+	}
+	summary := fmt.Sprintf("%s: %d users, %d certs, %d whitelist, %d settings, %d events added", mode,
+		len(diff.Users.Added), len(diff.Certs.Added), len(diff.Whitelist.Added), len(diff.Settings.Added), len(diff.Events.Added))
+	if _, err = tx.Exec("insert into events (event, email, value) values (?, ?, ?)", "state imported", "", summary); err != nil {
+		tx.Rollback()
+		return nil, nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+
+	return diff, nil, nil
+}
+
+/*
+ * API endpoint handlers
+ */
+
+func exportHandler(writer http.ResponseWriter, req *http.Request) {
+	// POST /export -- export the complete state of the database
+	//   I: {Passphrase: ""}
+	//   O: {Version: 1, Exported: "", KDF: {...}, Settings: {}, Whitelist: [], Users: [], Certs: [], Events: [], Aliases: [], Roles: [], Limits: [], Domains: [], Suspensions: [], Revocations: []}
+	//   200: the document; 400: missing passphrase (required if any users exist)
+	// Non-POST: 405 (method not allowed)
+	// TOTP seeds in the document are sealed with a key derived from Passphrase.
+
+	TAG := "/export"
+
+	reqBody := &struct{ Passphrase string }{}
+	if err := httputil.PopulateFromBody(reqBody, req); err != nil {
+		log.Warn(TAG, "missing or malformed request JSON")
+		httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+		return
+	}
+
+	cxn := getDB()
+	defer cxn.Close()
+	doc, err := loadSnapshot(cxn)
+	if err != nil {
+		panic(err)
+	}
+	if err = sealSeeds(doc, reqBody.Passphrase); err != nil {
+		log.Warn(TAG, "unable to seal seeds", err)
+		httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+		return
+	}
+
+	writeDatabaseByQuery("insert into events (event, email, value) values (?, ?, ?)", "state exported", "", fmt.Sprintf("%d users, %d certs", len(doc.Users), len(doc.Certs)))
+	log.Status(TAG, fmt.Sprintf("exported state (%d users, %d certs, %d events)", len(doc.Users), len(doc.Certs), len(doc.Events)))
+	httputil.SendJSON(writer, http.StatusOK, doc)
+}
+
+func importHandler(writer http.ResponseWriter, req *http.Request) {
+	// POST /import -- import (or preview importing) a document produced by /export
+	//   I: {Mode: "merge"|"replace", DryRun: false, Passphrase: "", Document: {...}}
+	//   O: {Mode: "", DryRun: false, Settings: <diff>, Whitelist: <diff>, Users: <diff>, Certs: <diff>, Events: <diff>, Aliases: <diff>, Roles: <diff>, Limits: <diff>, Domains: <diff>, Suspensions: <diff>, Revocations: <diff>}
+	//      <diff>: {Added: [""], Changed: [""], Removed: [""], Conflicts: [""], Unchanged: 0}
+	//   200: the diff (applied unless DryRun); 400: {Errors: [""]} if the document is invalid or the
+	//   passphrase is wrong -- nothing is changed in that case
+	// Non-POST: 405 (method not allowed)
+	// In merge mode, existing rows win over conflicting incoming rows; in replace mode, the database
+	// ends up identical to the document.
+
+	TAG := "/import"
+
+	reqBody := &struct {
+		Mode       string
+		DryRun     bool
+		Passphrase string
+		Document   *exportDocument
+	}{}
+	if err := httputil.PopulateFromBody(reqBody, req); err != nil || reqBody.Document == nil {
+		log.Warn(TAG, "missing or malformed request JSON")
+		httputil.SendJSON(writer, http.StatusBadRequest, &struct{ Errors []string }{[]string{"missing or malformed document"}})
+		return
+	}
+	if err := unsealSeeds(reqBody.Document, reqBody.Passphrase); err != nil {
+		log.Warn(TAG, "unable to unseal seeds", err)
+		httputil.SendJSON(writer, http.StatusBadRequest, &struct{ Errors []string }{[]string{err.Error()}})
+		return
+	}
+
+	cxn := getDB()
+	defer cxn.Close()
+	diff, problems, err := importDocument(cxn, reqBody.Document, reqBody.Mode, reqBody.DryRun)
+	if err != nil {
+		panic(err)
+	}
+	if len(problems) > 0 {
+		log.Warn(TAG, "rejected import document", strings.Join(problems, "; "))
+		httputil.SendJSON(writer, http.StatusBadRequest, &struct{ Errors []string }{problems})
+		return
+	}
+
+	if !reqBody.DryRun {
+		log.Status(TAG, fmt.Sprintf("imported state (%s)", reqBody.Mode))
+	}
+	httputil.SendJSON(writer, http.StatusOK, diff)
+}
+
+/*
+ * Command-line equivalents
+ */
+
+func readPassphrase(file string) (string, error) {
+	if file == "" {
+		return "", nil
+	}
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(raw), "\r\n"), nil
+}
+
+// exportCommand implements `heimdall export`.
+func exportCommand(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	out := flags.String("out", "", "file to write the document to (default stdout)")
+	passFile := flags.String("passphrase-file", "", "file containing the passphrase used to seal TOTP seeds")
+	flags.Parse(args)
+
+	passphrase, err := readPassphrase(*passFile)
+	if err != nil {
+		return err
+	}
+
+	cxn := getDB()
+	defer cxn.Close()
+	doc, err := loadSnapshot(cxn)
+	if err != nil {
+		return err
+	}
+	if err = sealSeeds(doc, passphrase); err != nil {
+		return err
+	}
+	raw, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if *out == "" {
+		os.Stdout.Write(raw)
+		fmt.Println()
+	} else if err = ioutil.WriteFile(*out, raw, 0600); err != nil {
+		return err
+	}
+	writeDatabaseByQuery("insert into events (event, email, value) values (?, ?, ?)", "state exported", "", fmt.Sprintf("%d users, %d certs", len(doc.Users), len(doc.Certs)))
+	return nil
+}
+
+// importCommand implements `heimdall import`.
+func importCommand(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	in := flags.String("in", "", "file to read the document from")
+	passFile := flags.String("passphrase-file", "", "file containing the passphrase used to seal TOTP seeds")
+	mode := flags.String("mode", "merge", "conflict handling: 'merge' keeps existing rows, 'replace' overwrites everything")
+	dryRun := flags.Bool("dry-run", false, "print the changes that would be made, without making them")
+	flags.Parse(args)
+
+	if *in == "" {
+		return errors.New("-in is required")
+	}
+	raw, err := ioutil.ReadFile(*in)
+	if err != nil {
+		return err
+	}
+	doc := &exportDocument{}
+	if err = json.Unmarshal(raw, doc); err != nil {
+		return err
+	}
+	passphrase, err := readPassphrase(*passFile)
+	if err != nil {
+		return err
+	}
+	if err = unsealSeeds(doc, passphrase); err != nil {
+		return err
+	}
+
+	cxn := getDB()
+	defer cxn.Close()
+	diff, problems, err := importDocument(cxn, doc, *mode, *dryRun)
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Fprintln(os.Stderr, p)
+		}
+		return errors.New("document rejected; nothing was imported")
+	}
+
+	if raw, err = json.MarshalIndent(diff, "", "  "); err != nil {
+		return err
+	}
+	os.Stdout.Write(raw)
+	fmt.Println()
+	return nil
+}
@@ -0,0 +1,301 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Database consistency checks. Several handlers tolerate inconsistent data rather than tripping
+// over it (e.g. GET /certs skips certs with no TOTP row); `heimdall fsck` finds such data and can
+// optionally repair it, recording an event for each repair.
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"validate"
+)
+
+type fsckProblem struct {
+	Email, Subject, Detail string
+}
+
+// fsckCheck is one class of problem. Find reports every instance; Fix repairs one, inside the
+// transaction used for all repairs.
+type fsckCheck struct {
+	Class, Description, FixDescription, FixEvent string
+	Find                                         func(cxn *sql.DB) ([]*fsckProblem, error)
+	Fix                                          func(tx *sql.Tx, p *fsckProblem) error
+}
+
+// fsckExplicitOnly lists classes whose repair destroys history, so that `-fix all` leaves them be;
+// they're repaired only when named.
+var fsckExplicitOnly = map[string]bool{"unknown-user-events": true}
+
+// queryProblems runs a query returning (email, subject, detail) rows.
+func queryProblems(cxn *sql.DB, q string, params ...interface{}) ([]*fsckProblem, error) {
+	rows, err := cxn.Query(q, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	problems := []*fsckProblem{}
+	for rows.Next() {
+		p := &fsckProblem{}
+		rows.Scan(&p.Email, &p.Subject, &p.Detail)
+		problems = append(problems, p)
+	}
+	return problems, nil
+}
+
+// isEntitled indicates whether email is allowed to hold certs, per the whitelist & domain settings.
+// extra is a set of emails (i.e. admins) that are entitled regardless.
+func isEntitled(email string, s *settings, extra map[string]bool) bool {
+	if extra[email] {
+		return true
+	}
+	for _, u := range s.WhitelistedUsers {
+		if u == email {
+			return true
+		}
+	}
+	for _, d := range s.WhitelistedDomains {
+		if strings.HasSuffix(email, "@"+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// revokeCertFix returns a fix that revokes the problem cert, or ends its hold, for the indicated reason.
+func revokeCertFix(reason string) func(tx *sql.Tx, p *fsckProblem) error {
+	return func(tx *sql.Tx, p *fsckProblem) error {
+		_, err := tx.Exec("update certs set revoked=datetime('now'), revoke_reason=? where fingerprint=? and (revoked is null or revoke_reason=?)", reason, p.Subject, validate.CertificateHold)
+		return err
+	}
+}
+
+func deleteCertFix(tx *sql.Tx, p *fsckProblem) error {
+	_, err := tx.Exec("delete from certs where fingerprint=?", p.Subject)
+	return err
+}
+
+func fsckChecks(admins map[string]bool) []*fsckCheck {
+	return []*fsckCheck{
+		{
+			"malformed-fingerprints", "certs whose fingerprint can never match a connecting client", "delete the cert record", "fsck: malformed cert deleted",
+			func(cxn *sql.DB) ([]*fsckProblem, error) {
+				all, err := queryProblems(cxn, "select email, fingerprint, ifnull(desc, '') from certs")
+				if err != nil {
+					return nil, err
+				}
+				res := []*fsckProblem{}
+				for _, p := range all {
+					if fp, err := validate.Fingerprint(p.Subject); err != nil || fp != p.Subject {
+						res = append(res, p)
+					}
+				}
+				return res, nil
+			},
+			deleteCertFix,
+		},
+		{
+			"orphan-certs", "active or held certs belonging to a user with no TOTP seed", "revoke the cert", "fsck: orphan cert revoked",
+			func(cxn *sql.DB) ([]*fsckProblem, error) {
+				return queryProblems(cxn, "select c.email, c.fingerprint, ifnull(c.desc, '') from certs as c left join totp as t on c.email=t.email where t.email is null and (c.revoked is null or c.revoke_reason='certificateHold')")
+			},
+			revokeCertFix("privilegeWithdrawn"),
+		},
+		{
+			"stale-revoked-certs", "revoked certs left behind by deleted users", "delete the cert record", "fsck: stale cert deleted",
+			func(cxn *sql.DB) ([]*fsckProblem, error) {
+				return queryProblems(cxn, "select c.email, c.fingerprint, ifnull(c.desc, '') from certs as c left join totp as t on c.email=t.email where t.email is null and c.revoked is not null and ifnull(c.revoke_reason, '') != 'certificateHold'")
+			},
+			deleteCertFix,
+		},
+		{
+			"unentitled-certs", "active or held certs whose owner is neither whitelisted nor in a whitelisted domain", "revoke the cert", "fsck: unentitled cert revoked",
+			func(cxn *sql.DB) ([]*fsckProblem, error) {
+				all, err := queryProblems(cxn, "select email, fingerprint, ifnull(desc, '') from certs where revoked is null or revoke_reason='certificateHold'")
+				if err != nil {
+					return nil, err
+				}
+				s := loadSettings()
+				entitled := loadAdmins(cxn)
+				for email := range admins {
+					entitled[email] = true
+				}
+				res := []*fsckProblem{}
+				for _, p := range all {
+					if !isEntitled(p.Email, s, entitled) {
+						res = append(res, p)
+					}
+				}
+				return res, nil
+			},
+			revokeCertFix("affiliationChanged"),
+		},
+		{
+			"expired-certs", "certs past their expiry date that were never marked revoked, or are still on hold", "mark the cert revoked", "fsck: expired cert revoked",
+			func(cxn *sql.DB) ([]*fsckProblem, error) {
+				return queryProblems(cxn, "select email, fingerprint, 'expired ' || expires from certs where (revoked is null or revoke_reason='certificateHold') and expires < date('now')")
+			},
+			revokeCertFix("cessationOfOperation"),
+		},
+		{
+			"lapsed-alias-certs", "active or held certs issued under a renamed user's old email, past the rename's grace period", "revoke the cert", "fsck: lapsed alias cert revoked",
+			func(cxn *sql.DB) ([]*fsckProblem, error) {
+				q := `select c.email, c.fingerprint, 'issued to ' || c.cn from certs as c
+					left join aliases as a on c.cn=a.old_email and c.email=a.email and a.grace_until > datetime('now')
+					where c.cn is not null and (c.revoked is null or c.revoke_reason='certificateHold') and a.old_email is null`
+				return queryProblems(cxn, q)
+			},
+			revokeCertFix("superseded"),
+		},
+		{
+			"unknown-user-events", "events naming an email that isn't an admin and has no seed, cert, whitelist entry, role, elevation, change request or decision, lockdown, limits override, suspension, scheduled revocation, or deletion record", "delete the events", "fsck: unknown user's events deleted",
+			func(cxn *sql.DB) ([]*fsckProblem, error) {
+				// the repair event has no email, lest it be one more event naming the unknown user
+				q := `select '', email, count(*) || ' events' from events where email != ''
+					and email not in (select email from totp)
+					and email not in (select email from certs)
+					and email not in (select email from whitelist)
+					and email not in (select sponsor from whitelist)
+					and email not in (select old_email from aliases)
+					and email not in (select email from roles)
+					and email not in (select email from elevations)
+					and email not in (select approved_by from elevations where approved_by is not null)
+					and email not in (select requested_by from changes)
+					and email not in (select decided_by from changes where decided_by is not null)
+					and email not in (select enabled_by from lockdown)
+					and email not in (select email from user_limits)
+					and email not in (select email from suspensions)
+					and email not in (select suspended_by from suspensions)
+					and email not in (select email from scheduled_revocations)
+					and email not in (select scheduled_by from scheduled_revocations)
+					and email not in (select email from events where event='user deleted')
+					group by email`
+				all, err := queryProblems(cxn, q)
+				if err != nil {
+					return nil, err
+				}
+				known := loadAdmins(cxn)
+				for email := range admins {
+					known[email] = true
+				}
+				res := []*fsckProblem{}
+				for _, p := range all {
+					if !known[p.Subject] {
+						res = append(res, p)
+					}
+				}
+				return res, nil
+			},
+			func(tx *sql.Tx, p *fsckProblem) error {
+				_, err := tx.Exec("delete from events where email=?", p.Subject)
+				return err
+			},
+		},
+	}
+}
+
+// fsckCommand implements `heimdall fsck`.
+func fsckCommand(args []string) error {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	fix := flags.String("fix", "", "comma-separated classes of problem to repair, or 'all' (which excludes unknown-user-events)")
+	adminList := flags.String("admins", "", "space-separated emails entitled to certs regardless of whitelist; admins recorded in the database, including Bifröst's AdminUsers as last reported, are always included")
+	flags.Parse(args)
+
+	admins := make(map[string]bool)
+	for _, a := range strings.Fields(*adminList) {
+		email, err := validate.Email(a)
+		if err != nil {
+			return err
+		}
+		admins[email] = true
+	}
+	checks := fsckChecks(admins)
+
+	toFix := make(map[string]bool)
+	for _, class := range strings.Split(*fix, ",") {
+		class = strings.TrimSpace(class)
+		if class == "" {
+			continue
+		}
+		known := class == "all"
+		for _, c := range checks {
+			known = known || c.Class == class
+		}
+		if !known {
+			return fmt.Errorf("unknown problem class '%s'", class)
+		}
+		toFix[class] = true
+	}
+
+	// SQLite's own consistency check comes first; domain checks on a damaged file are meaningless
+	if err := checkDatabase(cfg.SQLiteDBFile); err != nil {
+		fmt.Printf("sqlite: %s\n", err)
+		return errors.New("database is damaged; restore from a backup")
+	}
+	fmt.Println("sqlite: ok")
+
+	cxn := getDB()
+	defer cxn.Close()
+
+	remaining := 0
+	for _, c := range checks {
+		problems, err := c.Find(cxn)
+		if err != nil {
+			return err
+		}
+		if len(problems) == 0 {
+			fmt.Printf("%s: ok\n", c.Class)
+			continue
+		}
+		fmt.Printf("%s: %d found (%s)\n", c.Class, len(problems), c.Description)
+		for _, p := range problems {
+			fmt.Printf("    %s\t%s\t%s\n", p.Email, p.Subject, p.Detail)
+		}
+
+		if !toFix[c.Class] && (!toFix["all"] || fsckExplicitOnly[c.Class]) {
+			fmt.Printf("    to repair (%s), rerun with -fix %s\n", c.FixDescription, c.Class)
+			remaining += len(problems)
+			continue
+		}
+
+		tx, err := cxn.Begin()
+		if err != nil {
+			return err
+		}
+		for _, p := range problems {
+			if err = c.Fix(tx, p); err == nil {
+				_, err = tx.Exec("insert into events (event, email, value) values (?, ?, ?)", c.FixEvent, p.Email, p.Subject)
+			}
+			if err != nil {
+				tx.Rollback()
+				return fmt.Errorf("repairing %s '%s': %s", c.Class, p.Subject, err)
+			}
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+		fmt.Printf("    repaired %d\n", len(problems))
+	}
+
+	if remaining > 0 {
+		return fmt.Errorf("%d problems found and not repaired", remaining)
+	}
+	return nil
+}
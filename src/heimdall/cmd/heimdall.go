@@ -16,15 +16,22 @@ package main
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
 	"crypto/x509/pkix"
 	"database/sql"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"flag"
 	"fmt"
 	"image/png"
-	"io/ioutil"
 	"math/big"
 	"net/http"
+	"os"
 	"sort"
 	"strconv"
 	"strings"
@@ -34,10 +41,12 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/pquerna/otp/totp"
 
-	"playground/ca"
 	"playground/config"
 	"playground/httputil"
 	"playground/log"
+	"playground/mail"
+
+	"validate"
 )
 
 /*
@@ -58,8 +67,18 @@ type serverConfig struct {
 	CAKeyPassword            string
 	TLSAuthFile              string
 	OVPNTemplateFile         string
+	OVPNProfiles             map[string]string // additional .ovpn templates, by profile name; see domains.go
+	ProfileKeyAlgorithms     map[string]string // key algorithms overriding the KeyAlgorithm setting, by profile name; see keys.go
 	APIHeader                string
 	APISecret                string
+	BackupDir                string
+	BackupIntervalHours      int
+	BackupRetain             int
+	BackupPassphraseFile     string
+	OpenVPNManagementSocket  string // for ending the sessions of lost devices; "" if not available
+	KeyPoolSize              int    // pre-generated keys kept per key algorithm; 0 disables the pool (see keypool.go)
+	KeyPoolRefillPerMinute   int    // most keys the pool generates a minute; 0 disables refilling, and so the pool
+	Mail                     *mail.ConfigType
 }
 
 var cfg = &serverConfig{
@@ -76,8 +95,18 @@ var cfg = &serverConfig{
 	"Sekr1tPassw0rd!",
 	"./tls-auth.pem",
 	"./template.ovpn",
+	map[string]string{},
+	map[string]string{},
 	"X-Heimdall-Secret",
 	"Sekr1tPassw0rd",
+	"",
+	24,
+	14,
+	"",
+	"",
+	8,
+	30,
+	&mail.Config,
 }
 
 func initConfig(cfg *serverConfig) {
@@ -89,6 +118,35 @@ func initConfig(cfg *serverConfig) {
 	if config.Debug || cfg.Debug {
 		log.SetLogLevel(log.LEVEL_DEBUG)
 	}
+	for profile, alg := range cfg.ProfileKeyAlgorithms {
+		if profileTemplate(profile) == "" || !knownKeyAlgorithm(alg) {
+			panic(fmt.Sprintf("bad ProfileKeyAlgorithms entry '%s': '%s'", profile, alg))
+		}
+	}
+}
+
+// commands are the maintenance operations that can be run from the command line instead of starting
+// the server, e.g. `heimdall -config heimdall.json export -out state.json`
+var commands = map[string]func(args []string) error{
+	"export":  exportCommand,
+	"import":  importCommand,
+	"backup":  backupCommand,
+	"restore": restoreCommand,
+	"fsck":    fsckCommand,
+	"rename":  renameCommand,
+}
+
+func runCommand(args []string) {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command '%s'\n", args[0])
+		os.Exit(2)
+	}
+	if err := cmd(args[1:]); err != nil {
+		log.Error("main", args[0]+" failed", err)
+		fmt.Fprintf(os.Stderr, "%s: %s\n", args[0], err)
+		os.Exit(1)
+	}
 }
 
 /*
@@ -97,6 +155,26 @@ func initConfig(cfg *serverConfig) {
 func main() {
 	initConfig(cfg)
 
+	// restore replaces the database wholesale, so the restored copy is migrated on the next start
+	args := flag.Args()
+	if len(args) == 0 || args[0] != "restore" {
+		if err := migrateDatabase(); err != nil {
+			log.Error("main", "unable to migrate database", err)
+			fmt.Fprintf(os.Stderr, "unable to migrate database: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if len(args) > 0 {
+		runCommand(args)
+		return
+	}
+
+	// mail is optional; without an incident template, admins learn of lost devices from the event log
+	if len(cfg.Mail.Templates) > 0 {
+		mail.Ready()
+	}
+
 	server, mux := httputil.NewHardenedServer(cfg.BindAddress, cfg.Port)
 	server.RequireClientRoot(cfg.SelfSignedClientCertFile)
 	w := httputil.Wrapper().WithPanicHandler().WithSecretSentry(cfg.APIHeader, cfg.APISecret)
@@ -104,11 +182,37 @@ func main() {
 	mux.HandleFunc("/user/", w.WithMethodSentry("GET", "PUT", "DELETE").Wrap(userHandler))
 	mux.HandleFunc("/certs", w.WithMethodSentry("GET").Wrap(certsHandler))
 	mux.HandleFunc("/certs/", w.WithMethodSentry("GET", "POST").Wrap(certsHandler))
-	mux.HandleFunc("/cert/", w.WithMethodSentry("GET", "DELETE").Wrap(certHandler))
+	mux.HandleFunc("/cert/", w.WithMethodSentry("GET", "POST", "PUT", "DELETE").Wrap(certHandler))
 	mux.HandleFunc("/events", w.WithMethodSentry("GET", "DELETE").Wrap(eventsHandler))
 	mux.HandleFunc("/settings", w.WithMethodSentry("GET", "PUT").Wrap(settingsHandler))
 	mux.HandleFunc("/whitelist", w.WithMethodSentry("GET").Wrap(whitelistHandler))
 	mux.HandleFunc("/whitelist/", w.WithMethodSentry("DELETE", "PUT").Wrap(whitelistHandler))
+	mux.HandleFunc("/export", w.WithMethodSentry("POST").Wrap(exportHandler))
+	mux.HandleFunc("/import", w.WithMethodSentry("POST").Wrap(importHandler))
+	mux.HandleFunc("/backup", w.WithMethodSentry("POST").Wrap(backupHandler))
+	mux.HandleFunc("/rename/", w.WithMethodSentry("POST").Wrap(renameHandler))
+	mux.HandleFunc("/aliases", w.WithMethodSentry("GET").Wrap(aliasesHandler))
+	mux.HandleFunc("/aliases/", w.WithMethodSentry("GET").Wrap(aliasesHandler))
+	mux.HandleFunc("/roles", w.WithMethodSentry("GET").Wrap(rolesHandler))
+	mux.HandleFunc("/roles/", w.WithMethodSentry("GET", "PUT", "DELETE").Wrap(rolesHandler))
+	mux.HandleFunc("/domains", w.WithMethodSentry("GET").Wrap(domainsHandler))
+	mux.HandleFunc("/domains/", w.WithMethodSentry("GET", "PUT", "DELETE").Wrap(domainsHandler))
+	mux.HandleFunc("/limits", w.WithMethodSentry("GET").Wrap(limitsHandler))
+	mux.HandleFunc("/limits/", w.WithMethodSentry("GET", "PUT").Wrap(limitsHandler))
+	mux.HandleFunc("/elevations", w.WithMethodSentry("GET").Wrap(elevationsHandler))
+	mux.HandleFunc("/elevations/", w.WithMethodSentry("GET", "POST").Wrap(elevationsHandler))
+	mux.HandleFunc("/elevation/", w.WithMethodSentry("PUT", "DELETE").Wrap(elevationHandler))
+	mux.HandleFunc("/suspensions", w.WithMethodSentry("GET").Wrap(suspensionsHandler))
+	mux.HandleFunc("/suspensions/", w.WithMethodSentry("GET", "PUT", "DELETE").Wrap(suspensionsHandler))
+	mux.HandleFunc("/revocations", w.WithMethodSentry("GET", "POST").Wrap(revocationsHandler))
+	mux.HandleFunc("/revocations/", w.WithMethodSentry("DELETE").Wrap(revocationsHandler))
+	mux.HandleFunc("/lost/", w.WithMethodSentry("POST").Wrap(lostHandler))
+	mux.HandleFunc("/lockdown", w.WithMethodSentry("GET", "PUT", "DELETE").Wrap(lockdownHandler))
+	mux.HandleFunc("/massrevoke", w.WithMethodSentry("POST").Wrap(massRevokeHandler))
+	mux.HandleFunc("/metrics", w.WithMethodSentry("GET").Wrap(metricsHandler))
+	mux.HandleFunc("/admins", w.WithMethodSentry("GET", "PUT").Wrap(adminsHandler))
+	mux.HandleFunc("/changes", w.WithMethodSentry("GET", "POST").Wrap(changesHandler))
+	mux.HandleFunc("/change/", w.WithMethodSentry("GET", "PUT").Wrap(changeHandler))
 
 	mux.HandleFunc("/", w.WithMethodSentry("GET").Wrap(func(writer http.ResponseWriter, req *http.Request) {
 		// serve a 404 to all other requests; note that "/" is effectively a wildcard
@@ -116,6 +220,14 @@ func main() {
 		httputil.SendJSON(writer, http.StatusNotFound, struct{}{})
 	}))
 
+	if cfg.BackupDir != "" && cfg.BackupIntervalHours > 0 {
+		go backupLoop()
+	}
+	go expiryLoop()
+	if cfg.KeyPoolSize > 0 && cfg.KeyPoolRefillPerMinute > 0 {
+		go keyPoolLoop()
+	}
+
 	log.Status("server.http", "starting HTTP on port "+strconv.Itoa(cfg.Port))
 	log.Error("server.http", "shutting down; error?", server.ListenAndServeTLS(cfg.ServerCertFile, cfg.ServerKeyFile))
 }
@@ -124,6 +236,39 @@ func main() {
  * Package-local utilities
  */
 
+// expiryLoop closes out elevations, change requests, whitelist entries and suspensions whose time is
+// up, and carries out scheduled revocations that are due and revokes dormant certs, so that each is
+// recorded in the event log.
+func expiryLoop() {
+	TAG := "expiryLoop"
+	for range time.Tick(time.Minute) {
+		if err := expireElevations(); err != nil {
+			log.Error(TAG, "failed to expire elevations", err)
+		}
+		if err := expireChanges(); err != nil {
+			log.Error(TAG, "failed to expire change requests", err)
+		}
+		if err := expireWhitelist(); err != nil {
+			log.Error(TAG, "failed to expire whitelist entries", err)
+		}
+		if err := expireSuspensions(); err != nil {
+			log.Error(TAG, "failed to lift suspensions", err)
+		}
+		if err := runScheduledRevocations(); err != nil {
+			log.Error(TAG, "failed to carry out scheduled revocations", err)
+		}
+		if err := revokeDormantCerts(); err != nil {
+			log.Error(TAG, "failed to revoke dormant certs", err)
+		}
+		if err := revokeRenewedCerts(); err != nil {
+			log.Error(TAG, "failed to revoke expired renewed certs", err)
+		}
+		if err := pruneRateCounts(); err != nil {
+			log.Error(TAG, "failed to prune rate limit counts", err)
+		}
+	}
+}
+
 func extractSegment(path string, n int) string {
 	chunks := strings.Split(path, "/")
 	if len(chunks) > n {
@@ -132,6 +277,12 @@ func extractSegment(path string, n int) string {
 	return ""
 }
 
+// sendBadRequest responds with a 400 that explains which input was rejected.
+func sendBadRequest(writer http.ResponseWriter, tag string, err error) {
+	log.Warn(tag, "rejected input", err)
+	httputil.SendJSON(writer, http.StatusBadRequest, &struct{ Error string }{err.Error()})
+}
+
 // Database access helpers
 func getDB() *sql.DB {
 	cxn, err := sql.Open("sqlite3", cfg.SQLiteDBFile)
@@ -154,17 +305,42 @@ func writeDatabaseByQuery(query string, params ...interface{}) {
 // function & type to load settings from DB (generally needed fresh for each request, so not
 // cacheable)
 type settings struct {
-	ServiceName                     string
-	ClientLimit, IssuedCertDuration int
-	WhitelistedDomains              []string
-	WhitelistedUsers                []string `json:",omitEmpty"`
+	ServiceName                           string
+	ClientLimit, IssuedCertDuration       int
+	WhitelistedDomains                    []string
+	WhitelistedUsers                      []string `json:",omitEmpty"`
+	RateLimitWindow                       int      // minutes
+	IssueLimitPerUser, IssueLimitGlobal   int      // for all limits, 0 means unlimited
+	RevokeLimitPerUser, RevokeLimitGlobal int
+	TOTPLimitPerUser, TOTPLimitGlobal     int
+	DormancyDays                          int    // revoke certs unused for this many days; 0 means never
+	DormancyWarningDays                   int    // warn owners this many days before
+	KeyAlgorithm, SignatureHash           string // for issued certs; see keys.go
+}
+
+// intSettings maps the names of integer-valued settings to their fields in s
+func intSettings(s *settings) map[string]*int {
+	return map[string]*int{
+		"ClientLimit":         &s.ClientLimit,
+		"IssuedCertDuration":  &s.IssuedCertDuration,
+		"RateLimitWindow":     &s.RateLimitWindow,
+		"IssueLimitPerUser":   &s.IssueLimitPerUser,
+		"IssueLimitGlobal":    &s.IssueLimitGlobal,
+		"RevokeLimitPerUser":  &s.RevokeLimitPerUser,
+		"RevokeLimitGlobal":   &s.RevokeLimitGlobal,
+		"TOTPLimitPerUser":    &s.TOTPLimitPerUser,
+		"TOTPLimitGlobal":     &s.TOTPLimitGlobal,
+		"DormancyDays":        &s.DormancyDays,
+		"DormancyWarningDays": &s.DormancyWarningDays,
+	}
 }
 
 func loadSettings() *settings {
 	cxn := getDB()
 	defer cxn.Close()
 
-	ret := &settings{"Bifröst VPN", 2, 90, []string{}, []string{}}
+	ret := &settings{"Bifröst VPN", 2, 90, []string{}, []string{}, 60, 5, 50, 10, 100, 3, 30, 0, 14, defaultKeyAlgorithm, defaultSignatureHash}
+	ints := intSettings(ret)
 
 	if rows, err := cxn.Query("select key, value from settings"); err != nil {
 		panic(err)
@@ -176,30 +352,27 @@ func loadSettings() *settings {
 			switch k {
 			case "ServiceName":
 				ret.ServiceName = v
-			case "ClientLimit":
-				if tmp, err := strconv.ParseInt(v, 10, 32); err == nil {
-					ret.ClientLimit = int(tmp)
-				} else {
-					panic(err)
-				}
-			case "IssuedCertDuration":
-				if tmp, err := strconv.ParseInt(v, 10, 32); err == nil {
-					ret.IssuedCertDuration = int(tmp)
-				} else {
-					panic(err)
-				}
-			case "WhitelistedDomains":
-				for _, d := range strings.Split(v, " ") {
-					if d != "" {
-						ret.WhitelistedDomains = append(ret.WhitelistedDomains, d)
+			case "KeyAlgorithm":
+				ret.KeyAlgorithm = v
+			case "SignatureHash":
+				ret.SignatureHash = v
+			default:
+				if p, ok := ints[k]; ok {
+					if tmp, err := strconv.ParseInt(v, 10, 32); err == nil {
+						*p = int(tmp)
+					} else {
+						panic(err)
 					}
 				}
-				sort.Strings(ret.WhitelistedDomains)
-			default:
 			}
 		}
 	}
-	if rows, err := cxn.Query("select email from whitelist order by email"); err != nil {
+	for _, p := range loadDomainPolicies(cxn, "") {
+		if p.Enabled {
+			ret.WhitelistedDomains = append(ret.WhitelistedDomains, p.Domain)
+		}
+	}
+	if rows, err := cxn.Query("select email from whitelist where " + activeWhitelist + " order by email"); err != nil {
 		panic(err)
 	} else {
 		defer rows.Close()
@@ -214,11 +387,163 @@ func loadSettings() *settings {
 	return ret
 }
 
+// storeSettings stores s. WhitelistedDomains is the complete list of enabled domains: listed domains
+// are added (with no policy of their own) or re-enabled, and enabled domains that aren't listed are
+// removed; disabled domains are left alone.
 func storeSettings(s *settings) {
 	writeDatabaseByQuery("insert or replace into settings (key, value) values (?, ?)", "ServiceName", s.ServiceName)
-	writeDatabaseByQuery("insert or replace into settings (key, value) values (?, ?)", "IssuedCertDuration", s.IssuedCertDuration)
-	writeDatabaseByQuery("insert or replace into settings (key, value) values (?, ?)", "ClientLimit", s.ClientLimit)
-	writeDatabaseByQuery("insert or replace into settings (key, value) values (?, ?)", "WhitelistedDomains", strings.Join(s.WhitelistedDomains, " "))
+	writeDatabaseByQuery("insert or replace into settings (key, value) values (?, ?)", "KeyAlgorithm", s.KeyAlgorithm)
+	writeDatabaseByQuery("insert or replace into settings (key, value) values (?, ?)", "SignatureHash", s.SignatureHash)
+	listed := make(map[string]bool)
+	for _, d := range s.WhitelistedDomains {
+		listed[d] = true
+		writeDatabaseByQuery("insert or ignore into domains (domain) values (?)", d)
+		writeDatabaseByQuery("update domains set enabled=1, modified=current_timestamp where domain=? and enabled=0", d)
+	}
+	for _, d := range loadSettings().WhitelistedDomains {
+		if !listed[d] {
+			writeDatabaseByQuery("delete from domains where domain=?", d)
+		}
+	}
+	for k, p := range intSettings(s) {
+		writeDatabaseByQuery("insert or replace into settings (key, value) values (?, ?)", k, *p)
+	}
+}
+
+// validateSettings checks and canonicalizes settings received from a client.
+func validateSettings(s *settings) error {
+	s.ServiceName = strings.TrimSpace(s.ServiceName)
+	if s.ServiceName == "" || strings.ContainsAny(s.ServiceName, "\r\n") {
+		return errors.New("service name must be a single non-empty line")
+	}
+	domains := []string{}
+	for _, d := range s.WhitelistedDomains {
+		d, err := validate.Domain(d)
+		if err != nil {
+			return err
+		}
+		domains = append(domains, d)
+	}
+	s.WhitelistedDomains = domains
+	if s.ClientLimit < 1 || s.IssuedCertDuration < 1 {
+		return errors.New("client limit and certificate duration must be at least 1")
+	}
+	for k, p := range intSettings(s) {
+		if *p < 0 {
+			return fmt.Errorf("%s may not be negative", k)
+		}
+	}
+	if s.DormancyDays > 0 && s.DormancyWarningDays >= s.DormancyDays {
+		return errors.New("dormancy warning must come before certs are revoked")
+	}
+	if s.KeyAlgorithm == "" {
+		s.KeyAlgorithm = defaultKeyAlgorithm
+	}
+	if !knownKeyAlgorithm(s.KeyAlgorithm) {
+		return fmt.Errorf("key algorithm must be one of %s", strings.Join(keyAlgorithms, ", "))
+	}
+	if s.SignatureHash == "" {
+		s.SignatureHash = defaultSignatureHash
+	}
+	if !knownSignatureHash(s.SignatureHash) {
+		return fmt.Errorf("signature hash must be one of %s", strings.Join(signatureHashes, ", "))
+	}
+	return nil
+}
+
+// rateLimited checks whether another event of the given type would exceed either the per-user or
+// the global limit, counting events recorded in the last window minutes. It counts them in
+// rate_counts rather than events, which admins may clear (see migrate.go). It returns 0 if the action
+// may proceed, or else the number of seconds until enough counted events age out that it may.
+func rateLimited(event, email string, perUser, global, window int) int {
+	if window <= 0 {
+		return 0
+	}
+	cxn := getDB()
+	defer cxn.Close()
+
+	since := fmt.Sprintf("-%d minutes", window)
+	wait := 0
+	check := func(limit int, where string, params ...interface{}) {
+		if limit <= 0 {
+			return
+		}
+		var n int
+		q := "select count(*) from rate_counts where event=? and ts > datetime('now', ?)" + where
+		if err := cxn.QueryRow(q, append([]interface{}{event, since}, params...)...).Scan(&n); err != nil {
+			panic(err)
+		}
+		if n < limit {
+			return
+		}
+		// the action is allowed again once the (n-limit+1)th oldest counted event ages out
+		var ts string
+		q = "select cast(ts as text) from rate_counts where event=? and ts > datetime('now', ?)" + where + " order by ts limit 1 offset ?"
+		if err := cxn.QueryRow(q, append(append([]interface{}{event, since}, params...), n-limit)...).Scan(&ts); err != nil {
+			panic(err)
+		}
+		t, err := time.Parse("2006-01-02 15:04:05", ts)
+		if err != nil {
+			panic(err)
+		}
+		secs := int(time.Until(t.Add(time.Duration(window)*time.Minute)).Seconds()) + 1
+		if secs < 1 {
+			secs = 1
+		}
+		if secs > wait {
+			wait = secs
+		}
+	}
+	check(perUser, " and email=?", email)
+	check(global, "")
+	return wait
+}
+
+// sendRateLimited responds with a 429, and records that a client hit a rate limit, once per window
+// for each user & event, so that a client retrying in a loop can't flood the event log.
+func sendRateLimited(writer http.ResponseWriter, tag, event, email string, wait int) {
+	log.Warn(tag, fmt.Sprintf("rate limit on '%s' reached by '%s'; retry in %ds", event, email, wait))
+	since := fmt.Sprintf("-%d minutes", loadSettings().RateLimitWindow)
+	q := "insert into events (event, email, value) select ?, ?, ? where not exists (select 1 from events where event=? and email=? and value=? and ts > datetime('now', ?))"
+	writeDatabaseByQuery(q, "rate limited", email, event, "rate limited", email, event, since)
+	writer.Header().Set("Retry-After", strconv.Itoa(wait))
+	httputil.SendJSON(writer, http.StatusTooManyRequests, &struct{ RetryAfter int }{wait})
+}
+
+// pruneRateCounts drops counted events that have aged out of the rate limit window.
+func pruneRateCounts() error {
+	cxn := getDB()
+	defer cxn.Close()
+	_, err := cxn.Exec("delete from rate_counts where ts < datetime('now', ?)", fmt.Sprintf("-%d minutes", loadSettings().RateLimitWindow))
+	return err
+}
+
+// setTOTP generates and stores a new TOTP seed for email, creating the user if necessary, and records
+// the event. It returns the seed as a QR code, in a data: URL.
+func setTOTP(email, issuer string) string {
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      issuer,
+		AccountName: email,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	q := "insert or replace into totp (email, seed, updated) values (?, ?, datetime('now'))"
+	writeDatabaseByQuery(q, email, key.Secret())
+
+	// record the event
+	q = "insert into events (event, email, value) values (?, ?, ?)"
+	writeDatabaseByQuery(q, "TOTP set", email, "")
+
+	var buf bytes.Buffer
+	img, err := key.Image(200, 200)
+	if err != nil {
+		panic(err)
+	}
+	png.Encode(&buf, img)
+	imageURL := base64.StdEncoding.EncodeToString(buf.Bytes())
+	return fmt.Sprintf("data:image/png;base64,%s", imageURL)
 }
 
 // makeCertSerial generates a random string suitable for use as the serial number string in a
@@ -234,6 +559,87 @@ func makeCertSerial() string {
 	return fmt.Sprintf("%x", newSerial)
 }
 
+// chooseProfile returns the canonical name of the .ovpn profile to issue email's cert with: name if
+// it's allowed, or the first profile allowed if name is "".
+func chooseProfile(cxn *sql.DB, email, name string) (string, error) {
+	profiles := allowedProfiles(cxn, email)
+	if name == "" {
+		return profiles[0], nil
+	}
+	for _, p := range profiles {
+		if p == name {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("profile '%s' is not available to this user", name)
+}
+
+// issueCert creates a cert & key for email, signed by the CA and valid for certDuration days, and
+// records the cert. It returns the cert's fingerprint, and the .ovpn file for it built from the
+// indicated profile. The key is never written to disk; if csr isn't nil, there's no key at all, and
+// the cert is for the CSR's. Generated keys are of the profile's algorithm (see keys.go).
+func issueCert(s *settings, email, desc, profile string, certDuration int, csr *x509.CertificateRequest) (string, []byte) {
+	var key, crt []byte // the client's keymatter, to be embedded in the .ovpn file
+	var fp string
+	var ovpn bytes.Buffer
+
+	// generate a serial number for the new cert
+	serial := &big.Int{}
+	if _, ok := serial.SetString(makeCertSerial(), 16); !ok {
+		panic("unable to create serial number for new cert")
+	}
+
+	// generate a signed cert & private key
+	subject := &pkix.Name{
+		Organization: []string{s.ServiceName},
+		CommonName:   email,
+	}
+	var pub crypto.PublicKey
+	alg := profileKeyAlgorithm(s, profile)
+	if csr != nil { // the client holds the private key
+		pub, key = csr.PublicKey, []byte(csrKeyPlaceholder)
+		alg = keyAlgorithmOf(pub)
+	} else {
+		var priv crypto.Signer
+		priv, key = takeKey(alg)
+		pub = priv.Public()
+	}
+	crt = signClientCert(pub, subject, serial, certDuration, s.SignatureHash)
+	fp = pemFingerprint(crt)
+	ca, _ := loadCA()
+	tlsauth := loadCached(cfg.TLSAuthFile, func(data []byte) (interface{}, error) { return data, nil }).([]byte) // tls-auth shared secret
+
+	// construct the .ovpn from template
+	path := profileTemplate(profile)
+	t := loadCached(path, func(data []byte) (interface{}, error) { return template.New(path).Parse(string(data)) }).(*template.Template)
+	if err := t.Execute(&ovpn, struct{ CA, Cert, Key, TLSAuth string }{string(ca.chain), string(crt), string(key), string(tlsauth)}); err != nil {
+		panic(err)
+	}
+
+	// save a record of the cert to the database
+	q := fmt.Sprintf("insert into certs (email, fingerprint, desc, expires, issuer, key_algorithm, from_csr) values (?, ?, ?, date('now','+%d day'), ?, ?, ?)", certDuration)
+	writeDatabaseByQuery(q, email, fp, desc, nullable(pemFingerprint(ca.chain)), alg, csr != nil)
+
+	return fp, ovpn.Bytes()
+}
+
+// ovpnDataURL renders an .ovpn file as the data: URL clients download it from.
+func ovpnDataURL(ovpn []byte) string {
+	return fmt.Sprintf("data:image/ovpn;base64,%s", base64.StdEncoding.EncodeToString(ovpn))
+}
+
+// pemFingerprint returns the fingerprint of the first certificate in a PEM bundle, in the form
+// OpenVPN's tls_digest_sha256 gives it (without colons), or "" if there's no certificate.
+func pemFingerprint(bundle []byte) string {
+	for block, rest := pem.Decode(bundle); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "CERTIFICATE" {
+			sum := sha256.Sum256(block.Bytes)
+			return strings.ToUpper(hex.EncodeToString(sum[:]))
+		}
+	}
+	return ""
+}
+
 /*
  * API endpoint handlers
  */
@@ -241,7 +647,7 @@ func makeCertSerial() string {
 func usersHandler(writer http.ResponseWriter, req *http.Request) {
 	// GET /users -- fetch all known users
 	//   I: None
-	//   O: {Users: [{Email: "", ActiveCerts: 0, RevokedCerts: 0}]}
+	//   O: {Users: [{Email: "", ActiveCerts: 0, RevokedCerts: 0, Suspended: false}]}
 	//	 200: results
 	// Non-GET: 405 (method not allowed)
 
@@ -249,10 +655,11 @@ func usersHandler(writer http.ResponseWriter, req *http.Request) {
 		Email        string
 		ActiveCerts  int
 		RevokedCerts int
+		Suspended    bool
 	}
 	users := []user{}
 
-	q := "select t.email, count(distinct c.fingerprint), count(distinct c2.fingerprint) from totp as t left join certs as c on t.email=c.email and c.revoked is null left join certs as c2 on t.email=c2.email and c2.revoked is not null group by t.email"
+	q := "select t.email, count(distinct c.fingerprint), count(distinct c2.fingerprint), exists(select 1 from suspensions as s where s.email=t.email and " + activeSuspension + ") from totp as t left join certs as c on t.email=c.email and c.revoked is null left join certs as c2 on t.email=c2.email and c2.revoked is not null group by t.email"
 	cxn := getDB()
 	defer cxn.Close()
 	if rows, err := cxn.Query(q); err != nil {
@@ -261,7 +668,7 @@ func usersHandler(writer http.ResponseWriter, req *http.Request) {
 		defer rows.Close()
 		for rows.Next() {
 			u := user{}
-			rows.Scan(&u.Email, &u.ActiveCerts, &u.RevokedCerts)
+			rows.Scan(&u.Email, &u.ActiveCerts, &u.RevokedCerts, &u.Suspended)
 			users = append(users, u)
 		}
 	}
@@ -273,18 +680,21 @@ func usersHandler(writer http.ResponseWriter, req *http.Request) {
 func userHandler(writer http.ResponseWriter, req *http.Request) {
 	// GET /user/<email> -- fetch a list of user's certs
 	//   I: None
-	//   O: {Email: "", Created: "", ActiveCerts: [<cert>], RevokedCerts: [<cert>]}
+	//   O: {Email: "", Created: "", ActiveCerts: [<cert>], HeldCerts: [<cert>], RevokedCerts: [<cert>]}
 	//   200: the object requested; 404: Email not known
-	//   <cert>: {Fingerprint: "", Created: "", Expires: "", Revoked: "", Description: ""}
+	//   <cert>: {Fingerprint: "", Created: "", Expires: "", Revoked: "", Reason: "", Description: "", LastSeen: "", LastIP: ""}
+	//   Note: LastSeen & LastIP are when and from where the cert was last used to connect; "" if never
 	// PUT /user/<email> -- (re)generate a user's TOTP seed, creating user if necessary
 	//   I: None
 	//   O: {Email: "", TOTPURL: ""}
 	//   200: exists and TOTP reset; 201 (created): new user created & TOTP set
+	//   429: {RetryAfter: 0} TOTP rate limit hit; 423: the service is locked down (see /lockdown)
 	// DELETE /user/<email> -- delete a user's TOTP seed and revoke all certs
 	//   I: None
 	//   O: {RevokedCerts: [<cert>]}    (<cert> is as above)
 	//   200: deleted/revoked; 404: email not found
-	//   RevokedCerts can be empty if user had no certs
+	//   RevokedCerts can be empty if user had no working or held certs; they're revoked as
+	//   "privilegeWithdrawn"
 	// Non-GET/PUT/DELETE -- 405 (method not allowed): can't edit whitelists
 
 	TAG := "userHandler"
@@ -295,21 +705,26 @@ func userHandler(writer http.ResponseWriter, req *http.Request) {
 		httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
 		return
 	}
+	email, err := validate.Email(email)
+	if err != nil {
+		sendBadRequest(writer, TAG, err)
+		return
+	}
 
 	type cert struct {
-		Fingerprint, Created, Expires, Revoked, Description string
+		Fingerprint, Created, Expires, Revoked, Reason, Description, LastSeen, LastIP string
 	}
 
 	switch req.Method {
 	case "GET":
 		type user struct {
-			Email, Created            string
-			ActiveCerts, RevokedCerts []*cert
+			Email, Created                       string
+			ActiveCerts, HeldCerts, RevokedCerts []*cert
 		}
 
 		cxn := getDB()
 		defer cxn.Close()
-		u := &user{Email: email, ActiveCerts: []*cert{}, RevokedCerts: []*cert{}}
+		u := &user{Email: email, ActiveCerts: []*cert{}, HeldCerts: []*cert{}, RevokedCerts: []*cert{}}
 		q := "select created from totp where email=?"
 		if rows, err := cxn.Query(q, u.Email); err != nil {
 			panic(err)
@@ -327,21 +742,24 @@ func userHandler(writer http.ResponseWriter, req *http.Request) {
 				return
 			}
 		}
-		q = "select fingerprint, created, expires, desc, revoked from certs where email=?"
+		q = "select fingerprint, created, expires, desc, revoked, ifnull(revoke_reason, ''), ifnull(strftime('%Y-%m-%dT%H:%M:%SZ', last_seen), ''), ifnull(last_ip, '') from certs where email=?"
 		if rows, err := cxn.Query(q, u.Email); err != nil {
 			panic(err)
 		} else {
 			defer rows.Close()
 			for rows.Next() {
 				c := &cert{}
-				rows.Scan(&c.Fingerprint, &c.Created, &c.Expires, &c.Description, &c.Revoked)
+				rows.Scan(&c.Fingerprint, &c.Created, &c.Expires, &c.Description, &c.Revoked, &c.Reason, &c.LastSeen, &c.LastIP)
 				if c.Revoked == "" {
 					u.ActiveCerts = append(u.ActiveCerts, c)
+				} else if c.Reason == validate.CertificateHold {
+					u.HeldCerts = append(u.HeldCerts, c)
 				} else {
 					u.RevokedCerts = append(u.RevokedCerts, c)
 				}
 			}
 			sort.Slice(u.ActiveCerts, func(i, j int) bool { return u.ActiveCerts[i].Description < u.ActiveCerts[j].Description })
+			sort.Slice(u.HeldCerts, func(i, j int) bool { return u.HeldCerts[i].Description < u.HeldCerts[j].Description })
 			sort.Slice(u.RevokedCerts, func(i, j int) bool { return u.RevokedCerts[i].Description < u.RevokedCerts[j].Description })
 		}
 
@@ -352,40 +770,30 @@ func userHandler(writer http.ResponseWriter, req *http.Request) {
 			Email, TOTPURL string
 		}
 
-		settings := loadSettings()
-		key, err := totp.Generate(totp.GenerateOpts{
-			Issuer:      settings.ServiceName,
-			AccountName: email,
-		})
-		if err != nil {
-			panic(err)
+		cxn := getDB()
+		defer cxn.Close()
+		if lockedOut(cxn, email) {
+			sendLockedOut(writer, TAG, "TOTP set", email)
+			return
 		}
 
-		q := "insert or replace into totp (email, seed, updated) values (?, ?, datetime('now'))"
-		writeDatabaseByQuery(q, email, key.Secret(), email)
-
-		// record the event
-		q = "insert into events (event, email, value) values (?, ?, ?)"
-		writeDatabaseByQuery(q, "TOTP set", email, "")
-
-		var buf bytes.Buffer
-		img, err := key.Image(200, 200)
-		if err != nil {
-			panic(err)
+		settings := loadSettings()
+		if wait := rateLimited("TOTP set", email, settings.TOTPLimitPerUser, settings.TOTPLimitGlobal, settings.RateLimitWindow); wait > 0 {
+			sendRateLimited(writer, TAG, "TOTP set", email, wait)
+			return
 		}
-		png.Encode(&buf, img)
-		imageURL := base64.StdEncoding.EncodeToString(buf.Bytes())
-		imageURL = fmt.Sprintf("data:image/png;base64,%s", imageURL)
+
+		imageURL := setTOTP(email, settings.ServiceName)
 
 		log.Status(TAG, fmt.Sprintf("generated TOTP seed for '%s'", email))
 		httputil.SendJSON(writer, http.StatusOK, &res{email, imageURL})
 
 	case "DELETE":
 		fps := []string{}
-		q := "select fingerprint from certs where email=?"
+		q := "select fingerprint from certs where email=? and (revoked is null or revoke_reason=?)"
 		cxn := getDB()
 		defer cxn.Close()
-		if rows, err := cxn.Query(q, email); err != nil {
+		if rows, err := cxn.Query(q, email, validate.CertificateHold); err != nil {
 			panic(err)
 		} else {
 			defer rows.Close()
@@ -396,7 +804,7 @@ func userHandler(writer http.ResponseWriter, req *http.Request) {
 			}
 		}
 		if len(fps) > 0 {
-			writeDatabaseByQuery("update certs set revoked=datetime('now') where email=?", email)
+			writeDatabaseByQuery("update certs set revoked=datetime('now'), revoke_reason='privilegeWithdrawn' where email=? and (revoked is null or revoke_reason=?)", email, validate.CertificateHold)
 		}
 		writeDatabaseByQuery("delete from totp where email=?", email)
 
@@ -415,37 +823,61 @@ func userHandler(writer http.ResponseWriter, req *http.Request) {
 func certsHandler(writer http.ResponseWriter, req *http.Request) {
 	// GET /certs -- get all certs for all users
 	//   I: None
-	//   O: {Certs: [{Email: "", Created: "", ActiveCerts: [<cert>], RevokedCerts: [<cert>]}]}
+	//   O: {Certs: [{Email: "", Created: "", ActiveCerts: [<cert>], HeldCerts: [<cert>], RevokedCerts: [<cert>]}]}
 	//   200: the object above
 	// GET /certs/<email> -- get a list of certs for the indicated user
 	//   I: none
-	//   O: {Email: "", Created: "", ActiveCerts: [<cert>], RevokedCerts: [<cert>]}
+	//   O: {Email: "", Created: "", ActiveCerts: [<cert>], HeldCerts: [<cert>], RevokedCerts: [<cert>]}
 	//   200: the object requested; 404: email not found
 	//   Note: if email has no TOTP but does have certs, Created is ""
+	//   Note: HeldCerts are on hold (see /cert/); they're listed apart from RevokedCerts since they
+	//   can be released
+	//   Note: a cert's ReissueBy is set if it was issued before its user was renamed, and not yet
+	//   reissued; it stops working at that time
+	//   Note: a cert's LastSeen & LastIP are as for /user/
+	//   Note: a cert's ReplacedBy is the fingerprint of the cert that renewed or reissued it, if any
+	//   Note: a cert's KeyAlgorithm & FromCSR are as for /cert/
 	// POST /certs/<email> -- create a certificate for the indicated user
-	//   I: {Email: "", Description: ""}
+	//   I: {Email: "", Description: "", Replaces: "", Profile: "", CSR: ""}
 	//   O: {OVPNDataURL: ""} // Note: represented as the base64-encoded value of a data: href
-	//   201: created; 400 (bad request): missing email or description;
-	//   401 (unauthorized): user is already at cert limit
+	//   201: created; 400 (bad request): missing email or description, Replaces (optional) is not
+	//   the fingerprint of one of the user's certs awaiting reissue, Profile (optional) is not one
+	//   the user's domain allows, or CSR (optional) is malformed or has an unacceptable key
+	//   401 (unauthorized): user is already at cert limit; 423: the service is locked down (see /lockdown)
+	//   Note: the user's own client limit & cert duration apply, if they or their domain have
+	//   overrides (see /limits);
+	//   a reissue replaces a cert rather than adding one, so it doesn't count against the limit, while
+	//   a cert on hold still does; nor does a cert that has been renewed (see /cert/)
+	//   Note: with CSR, a PEM-encoded PKCS#10 request, the cert is issued for the CSR's key instead of
+	//   a generated one, and the .ovpn's <key> holds a placeholder for it (see csr.go). The CSR's
+	//   subject is ignored: the cert's is always the user's email, as for generated keys.
 	// Non-GET: 409 (bad method)
 
 	TAG := "/certs/"
 
 	email := extractSegment(req.URL.Path, 2)
+	if email != "" {
+		var err error
+		if email, err = validate.Email(email); err != nil {
+			sendBadRequest(writer, TAG, err)
+			return
+		}
+	}
 
 	type cert struct {
-		Fingerprint, Created, Expires, Revoked, Description string
+		Fingerprint, Created, Expires, Revoked, Reason, Description, ReissueBy, LastSeen, LastIP, ReplacedBy, KeyAlgorithm string
+		FromCSR                                                                                                            bool
 	}
 
 	switch req.Method {
 	case "GET":
 		if email == "" { // i.e. /certs or /certs/ -- means fetch all users
 			type user struct {
-				Email, Created            string
-				ActiveCerts, RevokedCerts []*cert
+				Email, Created                       string
+				ActiveCerts, HeldCerts, RevokedCerts []*cert
 			}
 			users := make(map[string]*user)
-			q := "select t.email, t.created, c.fingerprint, c.created, c.expires, c.revoked, c.desc from totp as t, certs as c where t.email=c.email"
+			q := "select t.email, t.created, c.fingerprint, c.created, c.expires, ifnull(c.revoked, ''), ifnull(c.revoke_reason, ''), c.desc, ifnull(strftime('%Y-%m-%dT%H:%M:%SZ', c.last_seen), ''), ifnull(c.last_ip, '') from totp as t, certs as c where t.email=c.email"
 			// note that this query skips certs that have no extant user; WAI
 			cxn := getDB()
 			defer cxn.Close()
@@ -456,17 +888,16 @@ func certsHandler(writer http.ResponseWriter, req *http.Request) {
 				for rows.Next() {
 					var email, created string
 					c := &cert{}
-					rows.Scan(&email, &created, &c.Fingerprint, &c.Created, &c.Expires, &c.Revoked, &c.Description)
-					var u *user
-					if u, ok := users[email]; !ok {
-						u = &user{Email: email}
+					rows.Scan(&email, &created, &c.Fingerprint, &c.Created, &c.Expires, &c.Revoked, &c.Reason, &c.Description, &c.LastSeen, &c.LastIP)
+					u, ok := users[email]
+					if !ok {
+						u = &user{Email: email, Created: created, ActiveCerts: []*cert{}, HeldCerts: []*cert{}, RevokedCerts: []*cert{}}
 						users[email] = u
-						u.ActiveCerts = []*cert{}
-						u.RevokedCerts = []*cert{}
-						u.Created = created
 					}
-					if c.Revoked != "" {
+					if c.Revoked == "" {
 						u.ActiveCerts = append(u.ActiveCerts, c)
+					} else if c.Reason == validate.CertificateHold {
+						u.HeldCerts = append(u.HeldCerts, c)
 					} else {
 						u.RevokedCerts = append(u.RevokedCerts, c)
 					}
@@ -474,6 +905,7 @@ func certsHandler(writer http.ResponseWriter, req *http.Request) {
 				res := struct{ Certs []*user }{[]*user{}}
 				for _, u := range users {
 					sort.Slice(u.ActiveCerts, func(i, j int) bool { return u.ActiveCerts[i].Description < u.ActiveCerts[j].Description })
+					sort.Slice(u.HeldCerts, func(i, j int) bool { return u.HeldCerts[i].Description < u.HeldCerts[j].Description })
 					sort.Slice(u.RevokedCerts, func(i, j int) bool { return u.RevokedCerts[i].Description < u.RevokedCerts[j].Description })
 					res.Certs = append(res.Certs, u)
 				}
@@ -482,7 +914,11 @@ func certsHandler(writer http.ResponseWriter, req *http.Request) {
 				return
 			}
 		} else { // i.e. /certs/<something> -- means fetch a particular user
-			q := "select t.created, c.fingerprint, c.created, c.expires, c.desc, c.revoked from totp as t left join certs as c on t.email=c.email where t.email=?"
+			q := `select t.created, c.fingerprint, c.created, c.expires, c.desc, ifnull(strftime('%Y-%m-%dT%H:%M:%SZ', a.grace_until), ''), c.revoked, ifnull(c.revoke_reason, ''),
+				ifnull(strftime('%Y-%m-%dT%H:%M:%SZ', c.last_seen), ''), ifnull(c.last_ip, ''), ifnull(c.replaced_by, ''), ifnull(c.key_algorithm, ''), ifnull(c.from_csr, 0)
+				from totp as t left join certs as c on t.email=c.email
+				left join aliases as a on c.cn=a.old_email and c.email=a.email and c.replaced_by is null
+				where t.email=?`
 			cxn := getDB()
 			defer cxn.Close()
 			if rows, err := cxn.Query(q, email); err != nil {
@@ -490,18 +926,20 @@ func certsHandler(writer http.ResponseWriter, req *http.Request) {
 			} else {
 				defer rows.Close()
 				res := struct {
-					Email, Created            string
-					ActiveCerts, RevokedCerts []cert
-				}{Email: email, ActiveCerts: []cert{}, RevokedCerts: []cert{}}
+					Email, Created                       string
+					ActiveCerts, HeldCerts, RevokedCerts []cert
+				}{Email: email, ActiveCerts: []cert{}, HeldCerts: []cert{}, RevokedCerts: []cert{}}
 				for rows.Next() {
 					c := cert{}
-					rows.Scan(&res.Created, &c.Fingerprint, &c.Created, &c.Expires, &c.Description, &c.Revoked)
+					rows.Scan(&res.Created, &c.Fingerprint, &c.Created, &c.Expires, &c.Description, &c.ReissueBy, &c.Revoked, &c.Reason, &c.LastSeen, &c.LastIP, &c.ReplacedBy, &c.KeyAlgorithm, &c.FromCSR)
 					if c.Fingerprint == "" {
 						// can happen if the user has TOTP and no certs, as a consequence of the left join; avoiding putting it in response
 						continue
 					}
 					if c.Revoked == "" {
 						res.ActiveCerts = append(res.ActiveCerts, c)
+					} else if c.Reason == validate.CertificateHold {
+						res.HeldCerts = append(res.HeldCerts, c)
 					} else {
 						res.RevokedCerts = append(res.RevokedCerts, c)
 					}
@@ -512,6 +950,7 @@ func certsHandler(writer http.ResponseWriter, req *http.Request) {
 					return
 				}
 				sort.Slice(res.ActiveCerts, func(i, j int) bool { return res.ActiveCerts[i].Description < res.ActiveCerts[j].Description })
+				sort.Slice(res.HeldCerts, func(i, j int) bool { return res.HeldCerts[i].Description < res.HeldCerts[j].Description })
 				sort.Slice(res.RevokedCerts, func(i, j int) bool { return res.RevokedCerts[i].Description < res.RevokedCerts[j].Description })
 				httputil.SendJSON(writer, http.StatusOK, &res)
 				return
@@ -524,29 +963,37 @@ func certsHandler(writer http.ResponseWriter, req *http.Request) {
 			return
 		}
 
-		reqBody := &struct{ Email, Description string }{}
+		reqBody := &struct{ Email, Description, Replaces, Profile, CSR string }{}
 		if err := httputil.PopulateFromBody(reqBody, req); err != nil {
 			log.Warn(TAG, "missing or malformed request JSON", req.URL.Path)
 			httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
 			return
 		}
 
-		if email != reqBody.Email {
+		if bodyEmail, err := validate.Email(reqBody.Email); err != nil || email != bodyEmail {
 			log.Warn(TAG, "mismatched URL/JSON request", req.URL.Path, email, reqBody.Email)
 			httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
 			return
 		}
-		if reqBody.Description == "" {
-			log.Warn(TAG, "JSON request missing description", req.URL.Path)
-			httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+		var err error
+		if reqBody.Description, err = validate.Description(reqBody.Description); err != nil {
+			sendBadRequest(writer, TAG, err)
+			return
+		}
+		var csr *x509.CertificateRequest
+		if reqBody.CSR != "" {
+			if csr, err = parseCSR(reqBody.CSR); err != nil {
+				sendBadRequest(writer, TAG, err)
+				return
+			}
+		}
+
+		s := loadSettings()
+		if wait := rateLimited("certificate issued", email, s.IssueLimitPerUser, s.IssueLimitGlobal, s.RateLimitWindow); wait > 0 {
+			sendRateLimited(writer, TAG, "certificate issued", email, wait)
 			return
 		}
 
-		var err error
-		var key, crt, cacrt, tlsauth []byte // various keymatter to be embedded in the .ovpn file
-		var fp string
-		var t *template.Template // .ovpn template
-		var ovpn bytes.Buffer
 		var rows *sql.Rows
 
 		// check that user exists
@@ -567,67 +1014,70 @@ func certsHandler(writer http.ResponseWriter, req *http.Request) {
 			// shouldn't be possible, if database constraints are correct
 			panic("multiple users returned by database")
 		}
-
-		// generate a serial number for the new cert
-		serial := &big.Int{}
-		if _, ok := serial.SetString(makeCertSerial(), 16); !ok {
-			panic("unable to create serial number for new cert")
+		if lockedOut(cxn, email) {
+			sendLockedOut(writer, TAG, "certificate issued", email)
+			return
 		}
 
-		// load up the CA signing cert & keys
-		authority := &ca.Authority{}
-		if err = authority.LoadFromPEM(cfg.CACertFile, cfg.CAKeyFile, cfg.CAKeyPassword); err != nil {
-			panic(err)
+		// a reissue must replace a cert of this user's that was issued under an email they've since
+		// been renamed from; the old cert keeps working until its alias's grace period ends
+		if reqBody.Replaces != "" {
+			if reqBody.Replaces, err = validate.Fingerprint(reqBody.Replaces); err != nil {
+				sendBadRequest(writer, TAG, err)
+				return
+			}
+			var n int
+			q = "select count(*) from certs where fingerprint=? and email=? and cn is not null and revoked is null and replaced_by is null"
+			if err = cxn.QueryRow(q, reqBody.Replaces, email).Scan(&n); err != nil {
+				panic(err)
+			}
+			if n == 0 {
+				sendBadRequest(writer, TAG, errors.New("cert to be replaced is not awaiting reissue"))
+				return
+			}
 		}
 
-		s := loadSettings()
-
-		// generate a signed cert & private key (never written to disk)
-		subject := &pkix.Name{
-			Organization: []string{s.ServiceName},
-			CommonName:   email,
+		if reqBody.Profile, err = chooseProfile(cxn, email, reqBody.Profile); err != nil {
+			sendBadRequest(writer, TAG, err)
+			return
 		}
-		var kp *ca.Keypair
-		if kp, err = authority.CreateClientKeypair(s.IssuedCertDuration, subject, serial, 4096); err != nil {
 
-			panic(err)
+		clientLimit, certDuration := effectiveLimits(cxn, s, email)
+		if reqBody.Replaces == "" {
+			var n int
+			q = "select count(*) from certs where email=? and (revoked is null or revoke_reason=?) and replaced_by is null"
+			if err = cxn.QueryRow(q, email, validate.CertificateHold).Scan(&n); err != nil {
+				panic(err)
+			}
+			if n >= clientLimit {
+				log.Warn(TAG, fmt.Sprintf("'%s' is already at their limit of %d certs", email, clientLimit))
+				httputil.SendJSON(writer, http.StatusUnauthorized, struct{}{})
+				return
+			}
 		}
 
-		if fp, err = kp.CertFingerprint(); err != nil {
-			panic(err)
-		}
+		fp, ovpn := issueCert(s, email, reqBody.Description, reqBody.Profile, certDuration, csr)
 
-		// gather all the keymatter in PEM
-		if crt, key, err = kp.ToPEM("", false); err != nil { // client cert & key
-			panic(err)
+		value := fmt.Sprintf("%s - %s", fp, reqBody.Description)
+		if reqBody.Profile != defaultProfile {
+			value = fmt.Sprintf("%s [%s]", value, reqBody.Profile)
 		}
-		if tlsauth, err = ioutil.ReadFile(cfg.TLSAuthFile); err != nil { // tls-auth shared secret
-			panic(err)
+		if reqBody.Replaces != "" {
+			writeDatabaseByQuery("update certs set replaced_by=? where fingerprint=?", fp, reqBody.Replaces)
+			value = fmt.Sprintf("%s (replaces %s)", value, reqBody.Replaces)
 		}
-		cacrt = authority.ExportCertChain() // CA cert
-
-		// construct the .ovpn from template
-		if t, err = template.ParseFiles(cfg.OVPNTemplateFile); err != nil {
-			panic(err)
-		}
-		if err = t.Execute(&ovpn, struct{ CA, Cert, Key, TLSAuth string }{string(cacrt), string(crt), string(key), string(tlsauth)}); err != nil {
-			panic(err)
+		if csr != nil {
+			value += " (from CSR)"
 		}
 
-		// save a record of the cert to the database
-		q = fmt.Sprintf("insert into certs (email, fingerprint, desc, expires) values (?, ?, ?, date('now','+%d day'))", s.IssuedCertDuration)
-		writeDatabaseByQuery(q, email, fp, reqBody.Description)
-
 		// record the event
 		q = "insert into events (event, email, value) values (?, ?, ?)"
-		writeDatabaseByQuery(q, "certificate issued", email, fmt.Sprintf("%s - %s", fp, reqBody.Description))
+		writeDatabaseByQuery(q, "certificate issued", email, value)
 
 		// transmit to client
 		log.Status(TAG, fmt.Sprintf("issued new certificate '%s' for '%s'", fp, email))
 
-		dataURL := base64.StdEncoding.EncodeToString(ovpn.Bytes())
-		dataURL = fmt.Sprintf("data:image/ovpn;base64,%s", dataURL)
-		httputil.SendJSON(writer, http.StatusCreated, struct{ OVPNDataURL string }{dataURL})
+		httputil.SendJSON(writer, http.StatusCreated, struct{ OVPNDataURL string }{ovpnDataURL(ovpn)})
 	default:
 		panic("API method sentinel misconfiguration")
 	}
@@ -636,26 +1086,53 @@ func certsHandler(writer http.ResponseWriter, req *http.Request) {
 func certHandler(writer http.ResponseWriter, req *http.Request) {
 	// GET /cert/<fingerprint> -- fetch details for the indicated cert
 	//   I: None
-	//   O: {Email: "", Fingerprint: "", Created: "", Expires: "", Revoked: "", Description: ""}
+	//   O: {Email: "", Fingerprint: "", Created: "", Expires: "", Revoked: "", Reason: "", Description: "", LastSeen: "", LastIP: "",
+	//       KeyAlgorithm: "", FromCSR: false}
 	//   200: the object above; 404: no such fingerprint
-	// DELETE /cert/<fingerprint> -- revoke the indicated cert
+	//   Note: Reason is the RFC 5280 revocation reason, if any; "" for certs revoked before reasons
+	//   were kept
+	//   Note: LastSeen & LastIP are when and from where the cert was last used to connect; "" if never
+	//   Note: KeyAlgorithm is as in keys.go; "" if the cert was issued before algorithms were recorded
+	//   Note: FromCSR is whether the cert was issued from a CSR (see /certs/), i.e. without a key from Heimdall
+	// POST /cert/<fingerprint> -- renew the indicated cert, issuing a replacement with the same owner
+	// and description
+	//   I: {Profile: "", CSR: ""}
+	//   O: {Fingerprint: "", OVPNDataURL: ""}
+	//   201: renewed; 404: no such fingerprint; 409: cert isn't working (e.g. revoked or on hold), has
+	//   already been renewed or reissued, awaits reissue after a rename (see POST /certs/<email>), or
+	//   was issued from a CSR and none was given; 400: malformed fingerprint, Profile (optional) is
+	//   not one the owner's domain allows, or CSR is malformed or has an unacceptable key;
+	//   423: the service is locked down (see /lockdown)
+	//   429: {RetryAfter: 0} issuance rate limit hit
+	//   Note: the old cert keeps working, without counting against the client limit, until it
+	//   expires or the new one first connects; it's then revoked as "superseded" (see renew.go)
+	//   Note: CSR is as for POST /certs/<email>. A cert issued from a CSR can only be renewed with
+	//   another, since Heimdall has no key for it; any other cert may be renewed with or without one.
+	// PUT /cert/<fingerprint> -- release the indicated cert from hold
 	//   I: None
-	//   O: {Email: "", Fingerprint: "", Created: "", Expires: "", Revoked: "", Description: ""}
-	//   200: the cert was revoked; 404: no such fingerprint; 400: malformed fingerprint
-	// Non-GET/DELETE: 409 (bad method)
+	//   O: {}
+	//   200: the cert works again; 404: no such fingerprint; 409: cert isn't on hold; 400: malformed fingerprint
+	// DELETE /cert/<fingerprint>?reason=<reason> -- revoke the indicated cert
+	//   I: None
+	//   O: {}
+	//   200: the cert was revoked; 404: no such fingerprint; 400: malformed fingerprint or unknown reason
+	//   429: {RetryAfter: 0} revocation rate limit hit
+	//   Note: reason is optional, and defaults to "unspecified"; "certificateHold" puts the cert on
+	//   hold until released by PUT. A held cert can be revoked for good with any other reason; a cert
+	//   that's already revoked for good is left as it is.
+	// Non-GET/POST/PUT/DELETE: 409 (bad method)
 
 	TAG := "/cert/"
 
-	fp := extractSegment(req.URL.Path, 2)
-	if fp == "" {
-		log.Warn(TAG, "missing fingerprint")
-		httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+	fp, err := validate.Fingerprint(extractSegment(req.URL.Path, 2))
+	if err != nil {
+		sendBadRequest(writer, TAG, err)
 		return
 	}
 
 	switch req.Method {
 	case "GET":
-		q := "select email, fingerprint, created, expires, revoked, desc from certs where fingerprint=?"
+		q := "select email, fingerprint, created, expires, revoked, ifnull(revoke_reason, ''), desc, ifnull(strftime('%Y-%m-%dT%H:%M:%SZ', last_seen), ''), ifnull(last_ip, ''), ifnull(key_algorithm, ''), from_csr from certs where fingerprint=?"
 		cxn := getDB()
 		defer cxn.Close()
 		if rows, err := cxn.Query(q, fp); err != nil {
@@ -667,8 +1144,11 @@ func certHandler(writer http.ResponseWriter, req *http.Request) {
 				httputil.SendJSON(writer, http.StatusNotFound, struct{}{})
 				return
 			}
-			res := struct{ Email, Fingerprint, Created, Expires, Revoked, Description string }{}
-			rows.Scan(&res.Email, &res.Fingerprint, &res.Created, &res.Expires, &res.Revoked, &res.Description)
+			res := struct {
+				Email, Fingerprint, Created, Expires, Revoked, Reason, Description, LastSeen, LastIP, KeyAlgorithm string
+				FromCSR                                                                                            bool
+			}{}
+			rows.Scan(&res.Email, &res.Fingerprint, &res.Created, &res.Expires, &res.Revoked, &res.Reason, &res.Description, &res.LastSeen, &res.LastIP, &res.KeyAlgorithm, &res.FromCSR)
 			if rows.Next() {
 				log.Error(TAG, "multiple results for fingerprint", fp)
 				httputil.SendJSON(writer, http.StatusInternalServerError, struct{}{})
@@ -677,31 +1157,146 @@ func certHandler(writer http.ResponseWriter, req *http.Request) {
 			httputil.SendJSON(writer, http.StatusOK, &res)
 		}
 
+	case "POST":
+		body := &struct{ Profile, CSR string }{}
+		if err := httputil.PopulateFromBody(body, req); err != nil {
+			log.Warn(TAG, "missing or malformed request JSON", req.URL.Path)
+			httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+			return
+		}
+		var csr *x509.CertificateRequest
+		if body.CSR != "" {
+			if csr, err = parseCSR(body.CSR); err != nil {
+				sendBadRequest(writer, TAG, err)
+				return
+			}
+		}
+
+		var email, desc string
+		var renewable, fromCSR bool
+		q := "select email, ifnull(desc, ''), revoked is null and replaced_by is null and cn is null, from_csr from certs where fingerprint=?"
+		cxn := getDB()
+		defer cxn.Close()
+		if err := cxn.QueryRow(q, fp).Scan(&email, &desc, &renewable, &fromCSR); err == sql.ErrNoRows {
+			log.Warn(TAG, "attempt to renew nonexistent cert", fp)
+			httputil.SendJSON(writer, http.StatusNotFound, struct{}{})
+			return
+		} else if err != nil {
+			panic(err)
+		}
+		if !renewable {
+			log.Warn(TAG, "attempt to renew cert that isn't working, or is already replaced", fp)
+			httputil.SendJSON(writer, http.StatusConflict, struct{}{})
+			return
+		}
+		if fromCSR && csr == nil { // i.e. don't hand a key to a device that keeps its own
+			log.Warn(TAG, "attempt to renew cert issued from a CSR without one", fp)
+			httputil.SendJSON(writer, http.StatusConflict, struct{}{})
+			return
+		}
+		if lockedOut(cxn, email) {
+			sendLockedOut(writer, TAG, "certificate issued", email)
+			return
+		}
+		profile, err := chooseProfile(cxn, email, body.Profile)
+		if err != nil {
+			sendBadRequest(writer, TAG, err)
+			return
+		}
+
+		s := loadSettings()
+		if wait := rateLimited("certificate issued", email, s.IssueLimitPerUser, s.IssueLimitGlobal, s.RateLimitWindow); wait > 0 {
+			sendRateLimited(writer, TAG, "certificate issued", email, wait)
+			return
+		}
+		_, certDuration := effectiveLimits(cxn, s, email)
+
+		newFP, ovpn := issueCert(s, email, desc, profile, certDuration, csr)
+		writeDatabaseByQuery("update certs set replaced_by=? where fingerprint=?", newFP, fp)
+
+		value := fmt.Sprintf("%s - %s", newFP, desc)
+		if profile != defaultProfile {
+			value = fmt.Sprintf("%s [%s]", value, profile)
+		}
+		if csr != nil {
+			value += " (from CSR)"
+		}
+		writeDatabaseByQuery("insert into events (event, email, value) values (?, ?, ?)", "certificate issued", email, fmt.Sprintf("%s (renews %s)", value, fp))
+
+		log.Status(TAG, fmt.Sprintf("renewed certificate '%s' for '%s' as '%s'", fp, email, newFP))
+		httputil.SendJSON(writer, http.StatusCreated, struct{ Fingerprint, OVPNDataURL string }{newFP, ovpnDataURL(ovpn)})
+
+	case "PUT":
+		var email string
+		var held bool
+		q := "select email, revoked is not null and ifnull(revoke_reason, '')=? from certs where fingerprint=?"
+		cxn := getDB()
+		defer cxn.Close()
+		if err := cxn.QueryRow(q, validate.CertificateHold, fp).Scan(&email, &held); err == sql.ErrNoRows {
+			log.Warn(TAG, "attempt to release nonexistent cert", fp)
+			httputil.SendJSON(writer, http.StatusNotFound, struct{}{})
+			return
+		} else if err != nil {
+			panic(err)
+		}
+		if !held {
+			log.Warn(TAG, "attempt to release cert that isn't on hold", fp)
+			httputil.SendJSON(writer, http.StatusConflict, struct{}{})
+			return
+		}
+
+		writeDatabaseByQuery("update certs set revoked=null, revoke_reason=null where fingerprint=?", fp)
+		writeDatabaseByQuery("insert into events (event, email, value) values (?, ?, ?)", "certificate released", email, fp)
+
+		log.Status(TAG, fmt.Sprintf("released certificate '%s' from hold", fp))
+		httputil.SendJSON(writer, http.StatusOK, struct{}{})
+
 	case "DELETE":
+		if err := req.ParseForm(); err != nil {
+			panic(err)
+		}
+		reason, err := validate.RevocationReason(req.FormValue("reason"))
+		if err != nil {
+			sendBadRequest(writer, TAG, err)
+			return
+		}
+
 		var email string
-		q := "select email from certs where fingerprint=?"
+		var revocable bool
+		q := "select email, revoked is null or ifnull(revoke_reason, '')=? from certs where fingerprint=?"
 		cxn := getDB()
 		defer cxn.Close()
-		if rows, err := cxn.Query(q, fp); err != nil {
+		if err := cxn.QueryRow(q, validate.CertificateHold, fp).Scan(&email, &revocable); err == sql.ErrNoRows {
+			log.Warn(TAG, "attempt to revoke nonexistent cert", fp)
+			httputil.SendJSON(writer, http.StatusOK, struct{}{})
+			return
+		} else if err != nil {
 			panic(err)
-		} else {
-			if !rows.Next() {
-				log.Warn(TAG, "attempt to revoke nonexistent cert", fp)
-				httputil.SendJSON(writer, http.StatusOK, struct{}{})
-				return
-			}
-			rows.Scan(&email)
-			rows.Close() // must manually close so that writes below work
+		}
+		if !revocable {
+			log.Status(TAG, "cert is already revoked", fp)
+			httputil.SendJSON(writer, http.StatusOK, struct{}{})
+			return
+		}
+
+		s := loadSettings()
+		if wait := rateLimited("certificate revoked", email, s.RevokeLimitPerUser, s.RevokeLimitGlobal, s.RateLimitWindow); wait > 0 {
+			sendRateLimited(writer, TAG, "certificate revoked", email, wait)
+			return
 		}
 		//cxn.Close()
-		q = "update certs set revoked=datetime('now') where fingerprint=?"
-		writeDatabaseByQuery(q, fp)
+		q = "update certs set revoked=datetime('now'), revoke_reason=? where fingerprint=?"
+		writeDatabaseByQuery(q, reason, fp)
 
 		// record the event
 		q = "insert into events (event, email, value) values (?, ?, ?)"
-		writeDatabaseByQuery(q, "certificate revoked", email, fp)
+		if reason == validate.CertificateHold {
+			writeDatabaseByQuery(q, "certificate held", email, fp)
+		} else {
+			writeDatabaseByQuery(q, "certificate revoked", email, fmt.Sprintf("%s (%s)", fp, reason))
+		}
 
-		log.Status(TAG, fmt.Sprintf("revoked certificate '%s'", fp))
+		log.Status(TAG, fmt.Sprintf("revoked certificate '%s' (%s)", fp, reason))
 		httputil.SendJSON(writer, http.StatusOK, struct{}{})
 
 	default:
@@ -718,6 +1313,7 @@ func eventsHandler(writer http.ResponseWriter, req *http.Request) {
 	//   I: None
 	//   O: {Events: [{Event: "", Email: "", Value: "", Timestamp: ""}]}
 	//   200: the object above + the log was cleared
+	//   Note: rate limits still count the cleared events (see rateLimited)
 	// Non-GET/DELETE: 409 (bad method)
 	// Accepts a GET query parameter of "?before=" for pagination. Unless the value of this parameter
 	// is "all", it returns at most 25 results
@@ -779,12 +1375,22 @@ func eventsHandler(writer http.ResponseWriter, req *http.Request) {
 func settingsHandler(writer http.ResponseWriter, req *http.Request) {
 	// GET /settings -- fetch service metadata
 	//   I: None
-	//   O: {ServiceName: "", ClientLimit: 2, IssuedCertDuration: 90, WhitelistedDomains:[""]}
+	//   O: {ServiceName: "", ClientLimit: 2, IssuedCertDuration: 90, WhitelistedDomains:[""], <limits>}
 	//   200: the object above
-	// PUT /settings -- update service metadata
-	//   I: {ServiceName: "", ClientLimit: 2, IssuedCertDuration: 90, WhitelistedDomains:[""]}
-	//   O: {ServiceName: "", ClientLimit: 2, IssuedCertDuration: 90, WhitelistedDomains:[""]}
+	// PUT /settings[?revoke=true] -- update service metadata
+	//   I: {ServiceName: "", ClientLimit: 2, IssuedCertDuration: 90, WhitelistedDomains:[""], <limits>}
+	//   O: {ServiceName: "", ClientLimit: 2, IssuedCertDuration: 90, WhitelistedDomains:[""], <limits>,
+	//      LostAccess: [""], Revoked: 0}
 	//   200: the object above + values stored; 400 (bad request): missing or malformed values, or empty body
+	//   Note: LostAccess lists users with active certs who were only entitled by a removed domain;
+	//   with ?revoke=true their certs are revoked, and Revoked says how many
+	//   <limits>: RateLimitWindow: 60, IssueLimitPerUser: 5, IssueLimitGlobal: 50, RevokeLimitPerUser: 10,
+	//             RevokeLimitGlobal: 100, TOTPLimitPerUser: 3, TOTPLimitGlobal: 30, DormancyDays: 0,
+	//             DormancyWarningDays: 14, KeyAlgorithm: "rsa4096", SignatureHash: "sha256"
+	//   Note: DormancyDays of 0 means unused certs are never revoked
+	//   Note: KeyAlgorithm & SignatureHash (see keys.go) apply to certs issued from then on; "" means
+	//   the default, rsa4096 & sha256
+	//   Note: WhitelistedDomains lists the enabled domains; see /domains for their policies
 	// Non-GET/DELETE: 409 (bad method)
 
 	TAG := "/settings"
@@ -796,9 +1402,20 @@ func settingsHandler(writer http.ResponseWriter, req *http.Request) {
 		if err := httputil.PopulateFromBody(&s, req); err != nil {
 			log.Error(TAG, "error parsing request body", req.Method)
 			httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+			return
+		}
+		if err := validateSettings(&s); err != nil {
+			sendBadRequest(writer, TAG, err)
+			return
 		}
+		cxn := getDB()
+		defer cxn.Close()
+		before := entitledHolders(cxn, loadSettings())
 		storeSettings(&s)
-		httputil.SendJSON(writer, http.StatusOK, loadSettings())
+		httputil.SendJSON(writer, http.StatusOK, struct {
+			*settings
+			*accessReport
+		}{loadSettings(), reportLostAccess(req, cxn, before, "settings changed")})
 	default:
 		panic("API method sentinel misconfiguration")
 	}
@@ -807,61 +1424,75 @@ func settingsHandler(writer http.ResponseWriter, req *http.Request) {
 func whitelistHandler(writer http.ResponseWriter, req *http.Request) {
 	// GET /whitelist -- fetch list of whitelisted users
 	//   I: None
-	//   O: {Users: [""]}
+	//   O: {Users: [""], Entries: [{Email: "", Expires: "", Sponsor: "", Note: "", Modified: ""}]}
 	//   200: the object above
-	// PUT /whitelist/<email> -- add a user to the whitelist
-	//   I: None
-	//   O: {Users: [""]}
-	//   200: new complete list of users; 400: malformed or missing email
-	//   Idempotent if user is already whitelisted.
-	// DELETE /whitelist/<email> -- delete a user to the whitelist
+	// PUT /whitelist/<email> -- add a user to the whitelist, or update their entry
+	//   I: {Expires: "", Sponsor: "", Note: ""}
+	//   O: {Users: [""], Entries: [...]}
+	//   200: new complete list of users; 400: malformed or missing email, or malformed entry
+	//   Note: all fields are optional. Expires is the last day of access, as YYYY-MM-DD; after it,
+	//   the entry is removed and the user's certs revoked, unless they're entitled some other way.
+	// DELETE /whitelist/<email>[?revoke=true] -- delete a user to the whitelist
 	//   I: None
-	//   O: {Users: [""]}
+	//   O: {Users: [""], Entries: [...], LostAccess: [""], Revoked: 0}
 	//   200: new complete list of users; 404: user not whitelisted; 400: malformed or missing email
+	//   Note: LostAccess is the user, if they have active certs and aren't entitled some other way;
+	//   with ?revoke=true their certs are revoked, and Revoked says how many
 	// Non-GET/DELETE: 409 (bad method)
-	// Returned list of users is sorted.
+	// Returned list of users is sorted, and excludes expired entries.
 
 	TAG := "whitelistHandler"
 
 	email := extractSegment(req.URL.Path, 2)
+	if email != "" && req.Method != "GET" {
+		var err error
+		if email, err = validate.Email(email); err != nil {
+			sendBadRequest(writer, TAG, err)
+			return
+		}
+	}
+	if (req.Method == "GET") != (email == "") {
+		httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+		return
+	}
 
+	cxn := getDB()
+	defer cxn.Close()
+
+	report := &accessReport{LostAccess: []string{}}
 	switch req.Method {
 	case "GET":
-		if email != "" {
+	case "PUT":
+		e := &whitelistEntry{}
+		if err := httputil.PopulateFromBody(e, req); err != nil {
+			log.Warn(TAG, "missing or malformed request JSON", req.URL.Path)
 			httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
 			return
 		}
-		q := "select email from whitelist order by email"
-		cxn := getDB()
-		defer cxn.Close()
-		emails := []string{}
-		if rows, err := cxn.Query(q); err != nil {
-			panic(err)
-		} else {
-			defer rows.Close()
-			for rows.Next() {
-				rows.Scan(&email)
-				emails = append(emails, email)
-			}
-		}
-		httputil.SendJSON(writer, http.StatusOK, struct{ Users []string }{emails})
-	case "PUT":
-		if email == "" {
-			httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+		e.Email = email
+		if err := validateWhitelistEntry(e); err != nil {
+			sendBadRequest(writer, TAG, err)
 			return
 		}
-		writeDatabaseByQuery("insert or replace into whitelist (email) values (?)", email)
+		writeDatabaseByQuery("insert or replace into whitelist (email, expires, sponsor, note) values (?, ?, ?, ?)", email, nullable(e.Expires), e.Sponsor, e.Note)
+		writeDatabaseByQuery("insert into events (event, email, value) values (?, ?, ?)", "whitelist added", email, describeWhitelistEntry(e))
 		log.Status(TAG, fmt.Sprintf("added '%s' to user whitelist", email))
-		httputil.SendJSON(writer, http.StatusOK, struct{ Users []string }{loadSettings().WhitelistedUsers})
 	case "DELETE":
-		if email == "" {
-			httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
-			return
-		}
+		before := entitledHolders(cxn, loadSettings())
 		writeDatabaseByQuery("delete from whitelist where email=?", email)
 		log.Status(TAG, fmt.Sprintf("deleted '%s' from user whitelist", email))
-		httputil.SendJSON(writer, http.StatusOK, struct{ Users []string }{loadSettings().WhitelistedUsers})
+		report = reportLostAccess(req, cxn, before, "removed from whitelist")
 	default:
 		panic("API method sentinel misconfiguration")
 	}
+
+	res := &struct {
+		Users   []string
+		Entries []*whitelistEntry
+		*accessReport
+	}{[]string{}, loadWhitelist(cxn), report}
+	for _, e := range res.Entries {
+		res.Users = append(res.Users, e.Email)
+	}
+	httputil.SendJSON(writer, http.StatusOK, res)
 }
@@ -0,0 +1,159 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// The key pool. Generating an RSA key can take seconds, so keyPoolLoop keeps up to KeyPoolSize keys
+// of each algorithm in use (the KeyAlgorithm setting, and heimdall.json's ProfileKeyAlgorithms)
+// generated ahead of time, in memory only, generating at most KeyPoolRefillPerMinute of them a
+// minute. Each pooled key is handed out once; when the pool is empty, issuance generates its own.
+
+import (
+	"crypto"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"playground/httputil"
+	"playground/log"
+)
+
+type pooledKey struct {
+	key crypto.Signer
+	pem []byte
+}
+
+var keyPool = struct {
+	sync.Mutex
+	keys                    map[string]chan *pooledKey // by algorithm
+	hits, misses, generated int
+}{keys: make(map[string]chan *pooledKey)}
+
+// pooledAlgorithms lists the algorithms that new keys are currently generated with.
+func pooledAlgorithms() []string {
+	in := map[string]bool{loadSettings().KeyAlgorithm: true}
+	for _, alg := range cfg.ProfileKeyAlgorithms {
+		in[alg] = true
+	}
+	algs := []string{}
+	for alg := range in {
+		algs = append(algs, alg)
+	}
+	sort.Strings(algs)
+	return algs
+}
+
+// takeKey returns a key of the indicated algorithm, with its PEM, from the pool if there is one.
+func takeKey(alg string) (crypto.Signer, []byte) {
+	keyPool.Lock()
+	pool := keyPool.keys[alg]
+	keyPool.Unlock()
+
+	if pool != nil {
+		select {
+		case k := <-pool:
+			keyPool.Lock()
+			keyPool.hits++
+			keyPool.Unlock()
+			return k.key, k.pem
+		default:
+		}
+	}
+	keyPool.Lock()
+	keyPool.misses++
+	keyPool.Unlock()
+	return generateKey(alg)
+}
+
+// keyPoolLoop keeps the pool topped up, one key at a time. Pools of algorithms no longer in use are
+// dropped, keys and all.
+func keyPoolLoop() {
+	TAG := "keyPoolLoop"
+	for range time.Tick(time.Minute / time.Duration(cfg.KeyPoolRefillPerMinute)) {
+		algs := pooledAlgorithms()
+
+		var pool chan *pooledKey
+		var alg string
+		keyPool.Lock()
+		inUse := make(map[string]bool)
+		for _, a := range algs {
+			inUse[a] = true
+			if keyPool.keys[a] == nil {
+				keyPool.keys[a] = make(chan *pooledKey, cfg.KeyPoolSize)
+			}
+			if pool == nil && len(keyPool.keys[a]) < cfg.KeyPoolSize {
+				pool, alg = keyPool.keys[a], a
+			}
+		}
+		for a := range keyPool.keys {
+			if !inUse[a] {
+				log.Status(TAG, "dropping pool of unused key algorithm "+a)
+				delete(keyPool.keys, a)
+			}
+		}
+		keyPool.Unlock()
+
+		if pool == nil { // all full
+			continue
+		}
+		key, pem := generateKey(alg)
+		select {
+		case pool <- &pooledKey{key, pem}:
+			keyPool.Lock()
+			keyPool.generated++
+			keyPool.Unlock()
+		default: // filled up meanwhile; can't happen while this is the only producer
+		}
+	}
+}
+
+/*
+ * API endpoint handlers
+ */
+
+func metricsHandler(writer http.ResponseWriter, req *http.Request) {
+	// GET /metrics -- fetch issuance performance counters
+	//   I: None
+	//   O: {KeyPool: {Size: 0, RefillPerMinute: 0, Available: {"<algorithm>": 0}, Hits: 0, Misses: 0, Generated: 0},
+	//       FileCache: {Files: 0, Loads: 0}}
+	//   200: the object above
+	//   Note: counters are since Heimdall started. Hits & Misses count issuances that did & didn't get
+	//   a pooled key; Generated counts keys added to the pool. Loads counts (re)loads of the CA,
+	//   tls-auth & template files (see cache.go).
+	// Non-GET: 409 (bad method)
+
+	type poolMetrics struct {
+		Size, RefillPerMinute   int
+		Available               map[string]int
+		Hits, Misses, Generated int
+	}
+	res := struct {
+		KeyPool   poolMetrics
+		FileCache struct{ Files, Loads int }
+	}{}
+
+	keyPool.Lock()
+	res.KeyPool = poolMetrics{cfg.KeyPoolSize, cfg.KeyPoolRefillPerMinute, make(map[string]int), keyPool.hits, keyPool.misses, keyPool.generated}
+	for alg, pool := range keyPool.keys {
+		res.KeyPool.Available[alg] = len(pool)
+	}
+	keyPool.Unlock()
+
+	fileCache.Lock()
+	res.FileCache.Files, res.FileCache.Loads = len(fileCache.files), fileCache.loads
+	fileCache.Unlock()
+
+	httputil.SendJSON(writer, http.StatusOK, &res)
+}
@@ -0,0 +1,212 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Client keys & signing. The KeyAlgorithm setting picks the kind of key generated for new certs,
+// unless heimdall.json's ProfileKeyAlgorithms overrides it for the cert's profile; SignatureHash picks
+// the hash the CA signs them with. Each cert's algorithm is recorded with it.
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+const (
+	defaultKeyAlgorithm  = "rsa4096"
+	defaultSignatureHash = "sha256"
+)
+
+// keyAlgorithms are the kinds of key Heimdall can generate. Ed25519 needs OpenVPN 2.4.7 or later,
+// built with OpenSSL 1.1.1 or later, on both server and client.
+var keyAlgorithms = []string{"rsa2048", "rsa3072", "rsa4096", "ecdsa-p256", "ecdsa-p384", "ed25519"}
+
+// signatureHashes are the hashes the CA may sign client certs with.
+var signatureHashes = []string{"sha256", "sha384", "sha512"}
+
+func knownKeyAlgorithm(alg string) bool {
+	for _, a := range keyAlgorithms {
+		if a == alg {
+			return true
+		}
+	}
+	return false
+}
+
+func knownSignatureHash(hash string) bool {
+	for _, h := range signatureHashes {
+		if h == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// profileKeyAlgorithm returns the kind of key to generate for a cert with the indicated profile.
+func profileKeyAlgorithm(s *settings, profile string) string {
+	if alg, ok := cfg.ProfileKeyAlgorithms[profile]; ok {
+		return alg
+	}
+	return s.KeyAlgorithm
+}
+
+// keyAlgorithmOf names the algorithm of a public key, as in keyAlgorithms; "" if it's not one that
+// Heimdall accepts. RSA keys of other sizes are named for their size.
+func keyAlgorithmOf(pub crypto.PublicKey) string {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("rsa%d", k.N.BitLen())
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return "ecdsa-p256"
+		case elliptic.P384():
+			return "ecdsa-p384"
+		}
+	case ed25519.PublicKey:
+		return "ed25519"
+	}
+	return ""
+}
+
+// generateKey generates a private key of the indicated algorithm, returning it with its PKCS#8 PEM.
+func generateKey(alg string) (crypto.Signer, []byte) {
+	var key crypto.Signer
+	var err error
+	switch alg {
+	case "rsa2048":
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "rsa3072":
+		key, err = rsa.GenerateKey(rand.Reader, 3072)
+	case "rsa4096":
+		key, err = rsa.GenerateKey(rand.Reader, 4096)
+	case "ecdsa-p256":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ecdsa-p384":
+		key, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case "ed25519":
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		panic(fmt.Sprintf("unknown key algorithm '%s'", alg))
+	}
+	if err != nil {
+		panic(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		panic(err)
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+// caCert is the CA cert file, with the CA cert parsed from it.
+type caCert struct {
+	chain []byte // the whole file, which may include intermediate certs; for .ovpn files
+	cert  *x509.Certificate
+}
+
+// loadCA returns the CA cert & private key, for signing client certs; see cache.go.
+func loadCA() (*caCert, crypto.Signer) {
+	ca := loadCached(cfg.CACertFile, func(data []byte) (interface{}, error) {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no PEM block in CA cert file")
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return &caCert{bytes.TrimSpace(data), cert}, nil
+	}).(*caCert)
+
+	key := loadCached(cfg.CAKeyFile, func(data []byte) (interface{}, error) {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no PEM block in CA key file")
+		}
+		der := block.Bytes
+		var err error
+		if x509.IsEncryptedPEMBlock(block) {
+			if der, err = x509.DecryptPEMBlock(block, []byte(cfg.CAKeyPassword)); err != nil {
+				return nil, err
+			}
+		}
+		var key interface{}
+		if key, err = x509.ParsePKCS1PrivateKey(der); err != nil {
+			if key, err = x509.ParsePKCS8PrivateKey(der); err != nil {
+				if key, err = x509.ParseECPrivateKey(der); err != nil {
+					return nil, errors.New("unrecognized CA private key format")
+				}
+			}
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, errors.New("CA private key can't sign")
+		}
+		return signer, nil
+	}).(crypto.Signer)
+
+	return ca, key
+}
+
+// signatureAlgorithm picks the algorithm for caKey to sign with, using the indicated hash. Ed25519
+// CAs have only the one.
+func signatureAlgorithm(caKey crypto.Signer, hash string) x509.SignatureAlgorithm {
+	switch caKey.Public().(type) {
+	case *rsa.PublicKey:
+		return map[string]x509.SignatureAlgorithm{"sha256": x509.SHA256WithRSA, "sha384": x509.SHA384WithRSA, "sha512": x509.SHA512WithRSA}[hash]
+	case *ecdsa.PublicKey:
+		return map[string]x509.SignatureAlgorithm{"sha256": x509.ECDSAWithSHA256, "sha384": x509.ECDSAWithSHA384, "sha512": x509.ECDSAWithSHA512}[hash]
+	case ed25519.PublicKey:
+		return x509.PureEd25519
+	}
+	return x509.UnknownSignatureAlgorithm // let x509 choose
+}
+
+// signClientCert issues a client cert for pub, with the indicated subject, returning it in PEM.
+func signClientCert(pub crypto.PublicKey, subject *pkix.Name, serial *big.Int, certDuration int, hash string) []byte {
+	ca, caKey := loadCA()
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               *subject,
+		NotBefore:             now.Add(-5 * time.Minute), // tolerate clients with slightly slow clocks
+		NotAfter:              now.AddDate(0, 0, certDuration),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		SignatureAlgorithm:    signatureAlgorithm(caKey, hash),
+	}
+	if _, ok := pub.(*rsa.PublicKey); ok {
+		tmpl.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, pub, caKey)
+	if err != nil {
+		panic(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
@@ -0,0 +1,179 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Per-user overrides of the ClientLimit & IssuedCertDuration settings. A user without an override,
+// or with only one of the two set, gets their domain's policy (see domains.go) or else the
+// service-wide setting for the rest.
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"playground/httputil"
+	"playground/log"
+
+	"validate"
+)
+
+type userLimits struct {
+	Email                           string
+	ClientLimit, IssuedCertDuration *int // nil means the service-wide setting applies
+	Modified                        string
+}
+
+// loadUserLimits returns the overrides of the indicated user, or of all users with overrides if
+// email is "".
+func loadUserLimits(cxn *sql.DB, email string) []*userLimits {
+	q := "select email, client_limit, cert_duration, strftime('%Y-%m-%dT%H:%M:%SZ', modified) from user_limits"
+	params := []interface{}{}
+	if email != "" {
+		q += " where email=?"
+		params = append(params, email)
+	}
+	rows, err := cxn.Query(q+" order by email", params...)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+
+	res := []*userLimits{}
+	for rows.Next() {
+		l := &userLimits{}
+		rows.Scan(&l.Email, &l.ClientLimit, &l.IssuedCertDuration, &l.Modified)
+		res = append(res, l)
+	}
+	return res
+}
+
+// effectiveLimits returns the client limit & cert duration that apply to the indicated user: their
+// own overrides, else their domain's, else the service-wide settings.
+func effectiveLimits(cxn *sql.DB, s *settings, email string) (clientLimit, certDuration int) {
+	clientLimit, certDuration = s.ClientLimit, s.IssuedCertDuration
+	if p := domainPolicyFor(cxn, email); p != nil {
+		if p.ClientLimit != nil {
+			clientLimit = *p.ClientLimit
+		}
+		if p.IssuedCertDuration != nil {
+			certDuration = *p.IssuedCertDuration
+		}
+	}
+	for _, l := range loadUserLimits(cxn, email) {
+		if l.ClientLimit != nil {
+			clientLimit = *l.ClientLimit
+		}
+		if l.IssuedCertDuration != nil {
+			certDuration = *l.IssuedCertDuration
+		}
+	}
+	return
+}
+
+// describeLimit renders an override for the event log.
+func describeLimit(v *int) string {
+	if v == nil {
+		return "default"
+	}
+	return strconv.Itoa(*v)
+}
+
+/*
+ * API endpoint handlers
+ */
+
+func limitsHandler(writer http.ResponseWriter, req *http.Request) {
+	// GET /limits -- fetch every user with overrides
+	//   I: None
+	//   O: {Limits: [{Email: "", ClientLimit: null, IssuedCertDuration: null, Modified: ""}]}
+	//   200: the object above
+	// GET /limits/<email> -- fetch the overrides of the indicated user, and the limits in effect
+	//   I: None
+	//   O: {Email: "", ClientLimit: null, IssuedCertDuration: null, Modified: "",
+	//      Effective: {ClientLimit: 0, IssuedCertDuration: 0, Profiles: [""]}}
+	//   200: the object above, even if the user has no overrides; 400: malformed email
+	//   Note: Effective takes the user's domain policy into account; Profiles are the .ovpn profiles
+	//   the user may choose from, their default first
+	// PUT /limits/<email> -- set the overrides of the indicated user
+	//   I: {ClientLimit: null, IssuedCertDuration: null}
+	//   O: same as GET
+	//   200: the overrides were set; 400: malformed email, or a limit less than 1
+	//   Note: null clears an override; clearing both removes the user's record entirely
+	// Non-GET/PUT: 405 (method not allowed)
+
+	TAG := "/limits/"
+
+	email := extractSegment(req.URL.Path, 2)
+	if email != "" {
+		var err error
+		if email, err = validate.Email(email); err != nil {
+			sendBadRequest(writer, TAG, err)
+			return
+		}
+	}
+	if email == "" && req.Method != "GET" {
+		httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+		return
+	}
+
+	cxn := getDB()
+	defer cxn.Close()
+
+	switch req.Method {
+	case "GET":
+		if email == "" {
+			httputil.SendJSON(writer, http.StatusOK, struct{ Limits []*userLimits }{loadUserLimits(cxn, "")})
+			return
+		}
+	case "PUT":
+		in := &struct{ ClientLimit, IssuedCertDuration *int }{}
+		if err := httputil.PopulateFromBody(in, req); err != nil {
+			log.Warn(TAG, "missing or malformed request JSON", req.URL.Path)
+			httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+			return
+		}
+		if (in.ClientLimit != nil && *in.ClientLimit < 1) || (in.IssuedCertDuration != nil && *in.IssuedCertDuration < 1) {
+			sendBadRequest(writer, TAG, errors.New("client limit and certificate duration must be at least 1"))
+			return
+		}
+		if in.ClientLimit == nil && in.IssuedCertDuration == nil {
+			writeDatabaseByQuery("delete from user_limits where email=?", email)
+		} else {
+			writeDatabaseByQuery("insert or replace into user_limits (email, client_limit, cert_duration) values (?, ?, ?)", email, in.ClientLimit, in.IssuedCertDuration)
+		}
+		value := fmt.Sprintf("ClientLimit %s, IssuedCertDuration %s", describeLimit(in.ClientLimit), describeLimit(in.IssuedCertDuration))
+		writeDatabaseByQuery("insert into events (event, email, value) values (?, ?, ?)", "limits changed", email, value)
+		log.Status(TAG, fmt.Sprintf("set limits of '%s' to %s", email, value))
+	default:
+		panic("API method sentinel misconfiguration")
+	}
+
+	res := &struct {
+		userLimits
+		Effective struct {
+			ClientLimit, IssuedCertDuration int
+			Profiles                        []string
+		}
+	}{}
+	res.Email = email
+	if limits := loadUserLimits(cxn, email); len(limits) > 0 {
+		res.userLimits = *limits[0]
+	}
+	res.Effective.ClientLimit, res.Effective.IssuedCertDuration = effectiveLimits(cxn, loadSettings(), email)
+	res.Effective.Profiles = allowedProfiles(cxn, email)
+	httputil.SendJSON(writer, http.StatusOK, res)
+}
@@ -0,0 +1,200 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Lockdown mode, for security incidents. While the service is locked down, only the users on its
+// break-glass list may connect (ovpn-tls-verify.py checks), be issued certs, or have their TOTP seeds
+// set; everyone else's existing certs stay as they are, for when the lockdown is lifted.
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"playground/httputil"
+	"playground/log"
+
+	"validate"
+)
+
+type lockdown struct {
+	EnabledBy, Reason string
+	BreakGlass        []string // the users who may still connect & set up access
+	Created           string
+}
+
+// loadLockdown returns the current lockdown, or nil if the service isn't locked down.
+func loadLockdown(cxn *sql.DB) *lockdown {
+	l := &lockdown{}
+	var breakGlass string
+	q := "select enabled_by, reason, break_glass, strftime('%Y-%m-%dT%H:%M:%SZ', created) from lockdown"
+	if err := cxn.QueryRow(q).Scan(&l.EnabledBy, &l.Reason, &breakGlass, &l.Created); err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		panic(err)
+	}
+	l.BreakGlass = strings.Fields(breakGlass)
+	return l
+}
+
+// lockedOut indicates whether a lockdown stops email from connecting & setting up access.
+func lockedOut(cxn *sql.DB, email string) bool {
+	l := loadLockdown(cxn)
+	if l == nil {
+		return false
+	}
+	for _, e := range l.BreakGlass {
+		if e == email {
+			return false
+		}
+	}
+	return true
+}
+
+// sendLockedOut responds with a 423, for an action on behalf of a user that a lockdown blocks.
+func sendLockedOut(writer http.ResponseWriter, tag, action, email string) {
+	log.Warn(tag, fmt.Sprintf("'%s' blocked by lockdown for '%s'", action, email))
+	httputil.SendJSON(writer, http.StatusLocked, struct{}{})
+}
+
+/*
+ * API endpoint handlers
+ */
+
+func lockdownHandler(writer http.ResponseWriter, req *http.Request) {
+	// GET /lockdown -- fetch the current lockdown
+	//   I: None
+	//   O: {Enabled: false, EnabledBy: "", Reason: "", BreakGlass: [""], Created: ""}
+	//   200: the object above
+	// PUT /lockdown -- lock the service down, or change the current lockdown
+	//   I: {By: "", Reason: "", BreakGlass: [""], Disconnect: false}
+	//   O: as for GET, plus SessionsEnded: 0
+	//   200: locked down; 400: malformed fields, or no reason
+	//   Note: By is always on the break-glass list. With Disconnect, the live sessions of everyone
+	//   else are ended; SessionsEnded is -1 if that failed.
+	// DELETE /lockdown?by=<email> -- lift the lockdown
+	//   I: None
+	//   O: as for GET
+	//   200: lifted; 404: not locked down; 400: malformed by
+	// Non-GET/PUT/DELETE: 405 (method not allowed)
+
+	TAG := "/lockdown"
+
+	type res struct {
+		Enabled bool
+		*lockdown
+		SessionsEnded int `json:",omitempty"`
+	}
+
+	cxn := getDB()
+	defer cxn.Close()
+
+	switch req.Method {
+	case "GET":
+		l := loadLockdown(cxn)
+		httputil.SendJSON(writer, http.StatusOK, &res{Enabled: l != nil, lockdown: l})
+	case "PUT":
+		body := &struct {
+			By, Reason string
+			BreakGlass []string
+			Disconnect bool
+		}{}
+		if err := httputil.PopulateFromBody(body, req); err != nil {
+			log.Warn(TAG, "missing or malformed request JSON", req.URL.Path)
+			httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+			return
+		}
+		by, err := validate.Email(body.By)
+		if err != nil {
+			sendBadRequest(writer, TAG, fmt.Errorf("bad By: %s", err))
+			return
+		}
+		reason := strings.TrimSpace(body.Reason)
+		if reason == "" || strings.ContainsAny(reason, "\r\n") {
+			sendBadRequest(writer, TAG, errors.New("reason must be a single non-empty line"))
+			return
+		}
+		exempt := map[string]bool{by: true}
+		for _, e := range body.BreakGlass {
+			if e, err = validate.Email(e); err != nil {
+				sendBadRequest(writer, TAG, err)
+				return
+			}
+			exempt[e] = true
+		}
+		breakGlass := []string{}
+		for e := range exempt {
+			breakGlass = append(breakGlass, e)
+		}
+		sort.Strings(breakGlass)
+
+		event := "lockdown enabled"
+		if loadLockdown(cxn) != nil {
+			event = "lockdown changed"
+		}
+		writeDatabaseByQuery("insert or replace into lockdown (id, enabled_by, reason, break_glass) values (1, ?, ?, ?)", by, reason, strings.Join(breakGlass, " "))
+		writeDatabaseByQuery("insert into events (event, email, value) values (?, ?, ?)", event, by,
+			fmt.Sprintf("%s (break-glass: %s)", reason, strings.Join(breakGlass, ", ")))
+		log.Status(TAG, fmt.Sprintf("'%s' locked the service down: %s", by, reason))
+
+		ended := 0
+		if body.Disconnect {
+			if ended, err = endLockedOutSessions(exempt); err != nil {
+				log.Error(TAG, "unable to end sessions for lockdown", err)
+				ended = -1
+			}
+			writeDatabaseByQuery("insert into events (event, email, value) values (?, ?, ?)", "lockdown disconnect", by, fmt.Sprintf("%d sessions ended", ended))
+		}
+		httputil.SendJSON(writer, http.StatusOK, &res{true, loadLockdown(cxn), ended})
+	case "DELETE":
+		by, err := validate.Email(req.URL.Query().Get("by"))
+		if err != nil {
+			sendBadRequest(writer, TAG, err)
+			return
+		}
+		l := loadLockdown(cxn)
+		if l == nil {
+			httputil.SendJSON(writer, http.StatusNotFound, struct{}{})
+			return
+		}
+		writeDatabaseByQuery("delete from lockdown")
+		writeDatabaseByQuery("insert into events (event, email, value) values (?, ?, ?)", "lockdown lifted", by,
+			fmt.Sprintf("enabled by '%s' at %s (%s)", l.EnabledBy, l.Created, l.Reason))
+		log.Status(TAG, fmt.Sprintf("'%s' lifted the lockdown", by))
+		httputil.SendJSON(writer, http.StatusOK, &res{})
+	default:
+		panic("API method sentinel misconfiguration")
+	}
+}
+
+// endLockedOutSessions ends the live sessions of everyone not in exempt, returning how many it ended.
+// Sessions are named by their certs' common names, so those of a renamed user still in their grace
+// period are ended even if they're exempt under their new email.
+func endLockedOutSessions(exempt map[string]bool) (int, error) {
+	names, err := connectedNames()
+	if err != nil {
+		return 0, err
+	}
+	victims := []string{}
+	for _, name := range names {
+		if !exempt[strings.ToLower(name)] {
+			victims = append(victims, name)
+		}
+	}
+	return endSessions(victims)
+}
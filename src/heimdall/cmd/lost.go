@@ -0,0 +1,242 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Lost devices. A user reports them once, and Heimdall revokes their certs as "keyCompromise",
+// optionally replaces the user's TOTP seed (in case their phone went too), ends any live VPN sessions
+// via OpenVPN's management interface, records a security incident, and mails the admins.
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"playground/httputil"
+	"playground/log"
+	"playground/mail"
+
+	"validate"
+)
+
+// incidentTemplate is the name of the mail template for telling admins about security incidents; if
+// it isn't configured, incidents are only recorded in the event log
+const incidentTemplate = "incident"
+
+// notifyIncident mails the admins with the admin role, plus those in extra, about a security incident
+// involving the indicated user.
+func notifyIncident(email, summary string, extra []string) {
+	TAG := "notifyIncident"
+
+	var name, sender string
+	for _, t := range cfg.Mail.Templates {
+		if t.Name == incidentTemplate {
+			name, sender = t.Name, t.SenderEmail
+		}
+	}
+	if name == "" {
+		log.Debug(TAG, "no incident template configured; skipping")
+		return
+	}
+
+	cxn := getDB()
+	defer cxn.Close()
+	admins := loadAdmins(cxn)
+	for _, a := range extra {
+		admins[a] = true
+	}
+	recipients := []string{}
+	for a := range admins {
+		recipients = append(recipients, a)
+	}
+	if len(recipients) == 0 {
+		log.Warn(TAG, "no admins to notify of incident involving", email)
+		return
+	}
+	sort.Strings(recipients)
+
+	type payload struct{ Recipients, Sender, ServiceName, Email, When, Summary string }
+	p := payload{strings.Join(recipients, ", "), sender, loadSettings().ServiceName, email, time.Now().UTC().Format(time.RFC1123), summary}
+	if err := mail.Send(name, recipients, p); err != nil {
+		log.Warn(TAG, fmt.Sprintf("error mailing admins about '%s'", email), err)
+	}
+}
+
+/*
+ * API endpoint handlers
+ */
+
+func lostHandler(writer http.ResponseWriter, req *http.Request) {
+	// POST /lost/<email> -- report lost devices, revoking their certs and optionally the TOTP seed
+	//   I: {Fingerprints: [""], RotateTOTP: false, Note: "", Notify: [""]}
+	//   O: {Revoked: [""], TOTPURL: "", SessionsEnded: 0}
+	//   200: done; 404: no such user; 400: malformed fields, nothing to do, or a fingerprint isn't
+	//   one of the user's working or held certs; 423: RotateTOTP while the service is locked down
+	//   (see /lockdown), in which case nothing is done
+	//   429: {RetryAfter: 0} RotateTOTP, and the TOTP rate limit was hit; nothing is done
+	//   Note: certs are revoked as "keyCompromise", which isn't rate limited; the new TOTP seed counts
+	//   against the TOTP limits, as for PUT /user/<email>. TOTPURL is as for that, or "" unless RotateTOTP.
+	//   Note: live sessions are ended for each common name the certs were issued to, which includes
+	//   any of the user's other devices connected at the time; SessionsEnded is -1 if that failed
+	//   Note: a "security incident" event is recorded, and the admins are mailed if an "incident"
+	//   template is configured: those with the admin role, plus Notify (e.g. Bifröst's config-file
+	//   admins, which Heimdall doesn't know). Mail is subject to the revocation rate limits, counting
+	//   incidents: past them, incidents are still recorded, but not mailed.
+	// Non-POST: 405 (method not allowed)
+
+	TAG := "/lost/"
+
+	email, err := validate.Email(extractSegment(req.URL.Path, 2))
+	if err != nil {
+		sendBadRequest(writer, TAG, err)
+		return
+	}
+
+	body := &struct {
+		Fingerprints []string
+		RotateTOTP   bool
+		Note         string
+		Notify       []string
+	}{}
+	if err := httputil.PopulateFromBody(body, req); err != nil {
+		log.Warn(TAG, "missing or malformed request JSON", req.URL.Path)
+		httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+		return
+	}
+	if len(body.Fingerprints) == 0 && !body.RotateTOTP {
+		sendBadRequest(writer, TAG, errors.New("no devices or password to revoke"))
+		return
+	}
+	body.Note = strings.TrimSpace(body.Note)
+	if strings.ContainsAny(body.Note, "\r\n") {
+		sendBadRequest(writer, TAG, errors.New("note must be a single line"))
+		return
+	}
+	for i, a := range body.Notify {
+		if body.Notify[i], err = validate.Email(a); err != nil {
+			sendBadRequest(writer, TAG, fmt.Errorf("bad Notify: %s", err))
+			return
+		}
+	}
+
+	cxn := getDB()
+	defer cxn.Close()
+
+	var n int
+	if err = cxn.QueryRow("select (select count(*) from totp where email=?) + (select count(*) from certs where email=?)", email, email).Scan(&n); err != nil {
+		panic(err)
+	}
+	if n == 0 {
+		log.Status(TAG, "report for nonexistent user", email)
+		httputil.SendJSON(writer, http.StatusNotFound, struct{}{})
+		return
+	}
+	if body.RotateTOTP && lockedOut(cxn, email) {
+		sendLockedOut(writer, TAG, "TOTP set", email)
+		return
+	}
+	s := loadSettings()
+	if body.RotateTOTP {
+		if wait := rateLimited("TOTP set", email, s.TOTPLimitPerUser, s.TOTPLimitGlobal, s.RateLimitWindow); wait > 0 {
+			sendRateLimited(writer, TAG, "TOTP set", email, wait)
+			return
+		}
+	}
+
+	fps, seen, names := []string{}, make(map[string]bool), make(map[string]bool)
+	for _, fp := range body.Fingerprints {
+		canonical, err := validate.Fingerprint(fp)
+		if err != nil {
+			sendBadRequest(writer, TAG, err)
+			return
+		}
+		var cn string
+		q := "select ifnull(cn, email) from certs where fingerprint=? and email=? and (revoked is null or revoke_reason=?)"
+		if err = cxn.QueryRow(q, canonical, email, validate.CertificateHold).Scan(&cn); err == sql.ErrNoRows {
+			sendBadRequest(writer, TAG, fmt.Errorf("'%s' is not an active cert of this user", fp))
+			return
+		} else if err != nil {
+			panic(err)
+		}
+		if !seen[canonical] {
+			fps = append(fps, canonical)
+		}
+		seen[canonical], names[cn] = true, true
+	}
+
+	tx, err := cxn.Begin()
+	if err != nil {
+		panic(err)
+	}
+	defer tx.Rollback()
+	for _, fp := range fps {
+		if _, err = tx.Exec("update certs set revoked=datetime('now'), revoke_reason='keyCompromise' where fingerprint=?", fp); err != nil {
+			panic(err)
+		}
+		if _, err = tx.Exec("insert into events (event, email, value) values (?, ?, ?)", "certificate revoked", email, fmt.Sprintf("%s (keyCompromise)", fp)); err != nil {
+			panic(err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		panic(err)
+	}
+
+	res := struct {
+		Revoked       []string
+		TOTPURL       string
+		SessionsEnded int
+	}{Revoked: fps}
+	if body.RotateTOTP {
+		res.TOTPURL = setTOTP(email, s.ServiceName)
+	}
+	if len(names) > 0 {
+		cns := []string{}
+		for cn := range names {
+			cns = append(cns, cn)
+		}
+		sort.Strings(cns)
+		if res.SessionsEnded, err = endSessions(cns); err != nil {
+			log.Error(TAG, fmt.Sprintf("unable to end sessions of '%s'", email), err)
+			res.SessionsEnded = -1
+		}
+	}
+
+	summary := fmt.Sprintf("lost device: %d certs revoked", len(res.Revoked))
+	if body.RotateTOTP {
+		summary += ", TOTP seed replaced"
+	}
+	if res.SessionsEnded >= 0 {
+		summary += fmt.Sprintf(", %d sessions ended", res.SessionsEnded)
+	} else {
+		summary += ", sessions could not be ended"
+	}
+	if body.Note != "" {
+		summary += fmt.Sprintf(" (%s)", body.Note)
+	}
+	// checked before recording this incident, so that it counts only those before it
+	mailWait := rateLimited("security incident", email, s.RevokeLimitPerUser, s.RevokeLimitGlobal, s.RateLimitWindow)
+	writeDatabaseByQuery("insert into events (event, email, value) values (?, ?, ?)", "security incident", email, summary)
+	log.Status(TAG, fmt.Sprintf("'%s' reported %s", email, summary))
+	if mailWait > 0 {
+		log.Warn(TAG, fmt.Sprintf("not mailing admins about '%s': too many incidents recently", email))
+	} else {
+		notifyIncident(email, summary, body.Notify)
+	}
+
+	httputil.SendJSON(writer, http.StatusOK, &res)
+}
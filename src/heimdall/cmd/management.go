@@ -0,0 +1,129 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// OpenVPN's management interface, for ending live sessions. OpenVPN listens on the Unix socket named
+// by `management` in its config, which must match the OpenVPNManagementSocket setting.
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+type management struct {
+	cxn net.Conn
+	r   *bufio.Reader
+}
+
+func dialManagement() (*management, error) {
+	if cfg.OpenVPNManagementSocket == "" {
+		return nil, errors.New("no OpenVPN management socket configured")
+	}
+	cxn, err := net.DialTimeout("unix", cfg.OpenVPNManagementSocket, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	cxn.SetDeadline(time.Now().Add(10 * time.Second))
+	return &management{cxn, bufio.NewReader(cxn)}, nil
+}
+
+func (m *management) close() {
+	fmt.Fprintf(m.cxn, "quit\n")
+	m.cxn.Close()
+}
+
+// command sends cmd and returns the lines of its response: for a single-line response, the SUCCESS
+// or ERROR line; for a multi-line one such as status, every line before END. The banner and any
+// real-time notifications, all of which start with '>', are skipped.
+func (m *management) command(cmd string, multiline bool) ([]string, error) {
+	if _, err := fmt.Fprintf(m.cxn, "%s\n", cmd); err != nil {
+		return nil, err
+	}
+	lines := []string{}
+	for {
+		line, err := m.r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, ">"):
+		case strings.HasPrefix(line, "ERROR:"):
+			return []string{line}, nil
+		case multiline && line == "END":
+			return lines, nil
+		case multiline:
+			lines = append(lines, line)
+		case strings.HasPrefix(line, "SUCCESS:"):
+			return []string{line}, nil
+		}
+	}
+}
+
+// connectedNames returns the common names of the clients connected right now.
+func connectedNames() ([]string, error) {
+	m, err := dialManagement()
+	if err != nil {
+		return nil, err
+	}
+	defer m.close()
+
+	lines, err := m.command("status 2", true)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	names := []string{}
+	for _, line := range lines {
+		// CLIENT_LIST,<common name>,<real address>,...
+		fields := strings.Split(line, ",")
+		if len(fields) > 1 && fields[0] == "CLIENT_LIST" && !seen[fields[1]] {
+			seen[fields[1]] = true
+			names = append(names, fields[1])
+		}
+	}
+	return names, nil
+}
+
+// endSessions disconnects the live VPN sessions of each of the indicated common names, returning how
+// many it ended. OpenVPN can only kill clients by common name or address, so this ends all of a name's
+// sessions, not just those using particular certs.
+func endSessions(names []string) (int, error) {
+	m, err := dialManagement()
+	if err != nil {
+		return 0, err
+	}
+	defer m.close()
+
+	ended := 0
+	for _, name := range names {
+		lines, err := m.command("kill "+name, false)
+		if err != nil {
+			return ended, err
+		}
+		// e.g. "SUCCESS: common name 'alice@example.com' found, 1 client(s) killed"; an ERROR means
+		// the name had no sessions
+		if i := strings.LastIndex(lines[0], ", "); strings.HasPrefix(lines[0], "SUCCESS:") && i >= 0 {
+			var n int
+			fmt.Sscanf(lines[0][i+2:], "%d", &n)
+			ended += n
+		}
+	}
+	return ended, nil
+}
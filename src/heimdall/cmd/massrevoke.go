@@ -0,0 +1,280 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Mass revocation, for incident response. An admin previews the certs matching a selector, then
+// revokes exactly those in one transaction. Every revocation in a batch is recorded with the batch's
+// ID, alongside a single "mass revocation" event describing the whole batch.
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"playground/httputil"
+	"playground/log"
+
+	"validate"
+)
+
+// certSelector picks the working and held certs to revoke. Its criteria are combined; All must be
+// set, alone, to pick every cert.
+type certSelector struct {
+	Since, Until string // issued in [Since, Until), as "2006-01-02T15:04:05Z"
+	Domain       string // owned by users in this domain
+	Issuer       string // issued by the CA with this fingerprint
+	Description  string // description matches this pattern, where * and ? are wildcards; ignores case
+	All          bool
+}
+
+type selectedCert struct{ Email, Fingerprint, Description, Created, Issuer string }
+
+// canonicalize checks a selector received from a client, canonicalizing it in place.
+func (sel *certSelector) canonicalize() error {
+	var err error
+	for _, ts := range []*string{&sel.Since, &sel.Until} {
+		if *ts == "" {
+			continue
+		}
+		var t time.Time
+		if t, err = time.Parse(time.RFC3339, *ts); err != nil {
+			return errors.New("times must be timestamps, as 2006-01-02T15:04:05Z")
+		}
+		*ts = t.UTC().Format("2006-01-02T15:04:05Z")
+	}
+	if sel.Domain != "" {
+		if sel.Domain, err = validate.Domain(sel.Domain); err != nil {
+			return err
+		}
+	}
+	if sel.Issuer != "" {
+		if sel.Issuer, err = validate.Fingerprint(sel.Issuer); err != nil {
+			return fmt.Errorf("bad Issuer: %s", err)
+		}
+		sel.Issuer = strings.ToUpper(sel.Issuer)
+	}
+	sel.Description = strings.TrimSpace(sel.Description)
+
+	criteria := sel.String()
+	if sel.All && criteria != "all certs" {
+		return errors.New("All can't be combined with other criteria")
+	}
+	if !sel.All && criteria == "all certs" {
+		return errors.New("no criteria given; set All to select every cert")
+	}
+	return nil
+}
+
+// String describes the selector, for the event log.
+func (sel *certSelector) String() string {
+	criteria := []string{}
+	if sel.Since != "" {
+		criteria = append(criteria, "issued from "+sel.Since)
+	}
+	if sel.Until != "" {
+		criteria = append(criteria, "issued before "+sel.Until)
+	}
+	if sel.Domain != "" {
+		criteria = append(criteria, "in "+sel.Domain)
+	}
+	if sel.Issuer != "" {
+		criteria = append(criteria, "issued by CA "+sel.Issuer)
+	}
+	if sel.Description != "" {
+		criteria = append(criteria, fmt.Sprintf("described as '%s'", sel.Description))
+	}
+	if len(criteria) == 0 {
+		return "all certs"
+	}
+	return strings.Join(criteria, ", ")
+}
+
+// selectCerts returns the certs that sel picks, with a digest of their fingerprints, so that a
+// revocation can check it's revoking what was previewed.
+func selectCerts(tx *sql.Tx, sel *certSelector) ([]*selectedCert, string) {
+	q := "select email, fingerprint, ifnull(desc, ''), cast(created as text), ifnull(issuer, '') from certs where (revoked is null or revoke_reason=?)"
+	params := []interface{}{validate.CertificateHold}
+	if sel.Since != "" {
+		q += " and created >= datetime(?)"
+		params = append(params, sel.Since)
+	}
+	if sel.Until != "" {
+		q += " and created < datetime(?)"
+		params = append(params, sel.Until)
+	}
+	if sel.Domain != "" {
+		q += " and email like ?"
+		params = append(params, "%@"+sel.Domain)
+	}
+	if sel.Issuer != "" {
+		q += " and issuer=?"
+		params = append(params, sel.Issuer)
+	}
+	if sel.Description != "" {
+		q += " and lower(ifnull(desc, '')) glob ?"
+		params = append(params, strings.ToLower(sel.Description))
+	}
+	rows, err := tx.Query(q+" order by email, created, fingerprint", params...)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+
+	certs := []*selectedCert{}
+	h := sha256.New()
+	for rows.Next() {
+		c := &selectedCert{}
+		rows.Scan(&c.Email, &c.Fingerprint, &c.Description, &c.Created, &c.Issuer)
+		certs = append(certs, c)
+		fmt.Fprintln(h, c.Fingerprint)
+	}
+	return certs, fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// makeBatchID generates a short random ID to correlate the events of one mass revocation.
+func makeBatchID() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%x", b)
+}
+
+/*
+ * API endpoint handlers
+ */
+
+func massRevokeHandler(writer http.ResponseWriter, req *http.Request) {
+	// POST /massrevoke -- preview, or carry out, the revocation of every cert matching a selector
+	//   I: {Since: "", Until: "", Domain: "", Issuer: "", Description: "", All: false,
+	//       Reason: "", By: "", Digest: "", Disconnect: false}
+	//   O: {Certs: [{Email: "", Fingerprint: "", Description: "", Created: "", Issuer: ""}], Digest: "",
+	//       Criteria: "", Batch: "", SessionsEnded: 0}
+	//   200: previewed or revoked; 400: malformed fields, no criteria, or All with other criteria;
+	//   409: the matching certs have changed since the preview, in which case nothing is revoked and
+	//   the response is a fresh preview
+	//   Note: the criteria are as for certSelector, and only working & held certs match. Without
+	//   Digest, nothing is revoked: Certs and Digest are a preview, and Batch is "". With the Digest of
+	//   a preview, Certs are revoked with Reason (default "unspecified"; not "certificateHold"), and
+	//   Batch correlates the events. Criteria describes the selector, as in the event log. Issuer is ""
+	//   for certs issued before issuers were recorded, and not yet used since.
+	//   Note: with Disconnect, live sessions of the certs' common names are ended, as for /lost/;
+	//   SessionsEnded is -1 if that failed
+	//   Note: the revocation rate limits don't apply, though the revocations count towards them after
+	// Non-POST: 405 (method not allowed)
+
+	TAG := "/massrevoke"
+
+	body := &struct {
+		certSelector
+		Reason, By, Digest string
+		Disconnect         bool
+	}{}
+	if err := httputil.PopulateFromBody(body, req); err != nil {
+		log.Warn(TAG, "missing or malformed request JSON", req.URL.Path)
+		httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+		return
+	}
+	sel := &body.certSelector
+	if err := sel.canonicalize(); err != nil {
+		sendBadRequest(writer, TAG, err)
+		return
+	}
+	reason, err := validate.RevocationReason(body.Reason)
+	if err != nil {
+		sendBadRequest(writer, TAG, err)
+		return
+	}
+	if reason == validate.CertificateHold {
+		sendBadRequest(writer, TAG, errors.New("certs can't be put on hold en masse"))
+		return
+	}
+	preview := body.Digest == ""
+	if !preview {
+		if body.By, err = validate.Email(body.By); err != nil {
+			sendBadRequest(writer, TAG, fmt.Errorf("bad By: %s", err))
+			return
+		}
+	}
+
+	res := struct {
+		Certs                   []*selectedCert
+		Digest, Criteria, Batch string
+		SessionsEnded           int
+	}{Criteria: sel.String()}
+
+	cxn := getDB()
+	defer cxn.Close()
+	tx, err := cxn.Begin()
+	if err != nil {
+		panic(err)
+	}
+	defer tx.Rollback()
+
+	res.Certs, res.Digest = selectCerts(tx, sel)
+	if preview {
+		httputil.SendJSON(writer, http.StatusOK, &res)
+		return
+	}
+	if res.Digest != body.Digest {
+		log.Warn(TAG, fmt.Sprintf("certs matching %s changed since preview by '%s'", sel, body.By))
+		httputil.SendJSON(writer, http.StatusConflict, &res)
+		return
+	}
+
+	res.Batch = makeBatchID()
+	summary := fmt.Sprintf("batch %s: %d certs revoked (%s; %s)", res.Batch, len(res.Certs), reason, sel)
+	if _, err = tx.Exec("insert into events (event, email, value) values (?, ?, ?)", "mass revocation", body.By, summary); err != nil {
+		panic(err)
+	}
+	names := make(map[string]bool)
+	for _, c := range res.Certs {
+		var cn string
+		if err = tx.QueryRow("select ifnull(cn, email) from certs where fingerprint=?", c.Fingerprint).Scan(&cn); err != nil {
+			panic(err)
+		}
+		names[cn] = true
+		if _, err = tx.Exec("update certs set revoked=datetime('now'), revoke_reason=? where fingerprint=?", reason, c.Fingerprint); err != nil {
+			panic(err)
+		}
+		value := fmt.Sprintf("%s (%s; batch %s)", c.Fingerprint, reason, res.Batch)
+		if _, err = tx.Exec("insert into events (event, email, value) values (?, ?, ?)", "certificate revoked", c.Email, value); err != nil {
+			panic(err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		panic(err)
+	}
+	log.Status(TAG, fmt.Sprintf("'%s' revoked %d certs matching %s in batch %s", body.By, len(res.Certs), sel, res.Batch))
+
+	if body.Disconnect && len(names) > 0 {
+		cns := []string{}
+		for cn := range names {
+			cns = append(cns, cn)
+		}
+		if res.SessionsEnded, err = endSessions(cns); err != nil {
+			log.Error(TAG, fmt.Sprintf("unable to end sessions for batch %s", res.Batch), err)
+			res.SessionsEnded = -1
+		}
+		writeDatabaseByQuery("insert into events (event, email, value) values (?, ?, ?)", "mass revocation disconnect", body.By,
+			fmt.Sprintf("batch %s: %d sessions ended", res.Batch, res.SessionsEnded))
+	}
+	httputil.SendJSON(writer, http.StatusOK, &res)
+}
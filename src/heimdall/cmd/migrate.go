@@ -0,0 +1,342 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Schema & data migrations. The Ansible playbook creates the original schema, which is version 0;
+// everything since is applied here, in order, when Heimdall starts. SQLite's user_version pragma
+// records how many migrations a database has had applied.
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"playground/log"
+
+	"validate"
+)
+
+// migrations must only ever be appended to; each runs in its own transaction
+var migrations = []func(tx *sql.Tx) error{
+	normalizeEmails,
+	addAliases,
+	addRoles,
+	addElevations,
+	addChanges,
+	addUserLimits,
+	addDomains,
+	addWhitelistExpiry,
+	addSuspensions,
+	addRevocationReasons,
+	addScheduledRevocations,
+	addCertUsage,
+	addLockdown,
+	addCertIssuer,
+	addKeyAlgorithm,
+	addCertCSR,
+	addRateCounts,
+}
+
+func migrateDatabase() error {
+	TAG := "migrateDatabase"
+
+	cxn := getDB()
+	defer cxn.Close()
+
+	var version int
+	if err := cxn.QueryRow("pragma user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database is version %d but this Heimdall only knows %d; refusing to run", version, len(migrations))
+	}
+
+	for ; version < len(migrations); version++ {
+		log.Status(TAG, fmt.Sprintf("applying migration %d", version+1))
+		tx, err := cxn.Begin()
+		if err != nil {
+			return err
+		}
+		if err = migrations[version](tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %s", version+1, err)
+		}
+		// pragmas don't accept parameters
+		if _, err = tx.Exec(fmt.Sprintf("pragma user_version = %d", version+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// execAll runs each statement in turn, stopping at the first error.
+func execAll(tx *sql.Tx, statements ...string) error {
+	for _, q := range statements {
+		if _, err := tx.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * Migrations
+ */
+
+// normalizeEmails (1) rewrites every email to its canonical form, as validate.Email gives it. Users
+// who ended up with several case-variant identities are merged, keeping the most recently updated
+// TOTP seed; their certs simply follow the rename. Emails validate.Email rejects are left as they
+// are, and logged, for an admin to deal with.
+func normalizeEmails(tx *sql.Tx) error {
+	TAG := "normalizeEmails"
+
+	skipped := make(map[string]bool)
+	canonical := func(email string) string {
+		c, err := validate.Email(email)
+		if err != nil {
+			if email != "" && !skipped[email] { // "" is the email of events not about any user
+				log.Warn(TAG, "leaving invalid email as is", err)
+				skipped[email] = true
+			}
+			return email
+		}
+		return c
+	}
+
+	// collect TOTP rows, newest first, so the first row seen for each identity is the one kept
+	type row struct {
+		rowid int64
+		email string
+	}
+	rows, err := tx.Query("select rowid, email from totp order by updated desc, rowid desc")
+	if err != nil {
+		return err
+	}
+	seeds := []row{}
+	for rows.Next() {
+		r := row{}
+		rows.Scan(&r.rowid, &r.email)
+		seeds = append(seeds, r)
+	}
+	rows.Close()
+
+	kept := make(map[string]string)
+	for _, r := range seeds {
+		c := canonical(r.email)
+		if winner, ok := kept[c]; ok {
+			if _, err = tx.Exec("delete from totp where rowid=?", r.rowid); err != nil {
+				return err
+			}
+			if _, err = tx.Exec("insert into events (event, email, value) values (?, ?, ?)", "user merged", c, fmt.Sprintf("'%s' merged into '%s'; seed of '%s' kept", r.email, c, winner)); err != nil {
+				return err
+			}
+			continue
+		}
+		kept[c] = r.email
+	}
+
+	// rename everything else; done in Go rather than SQL so that it matches validate.Email exactly
+	for _, table := range []string{"totp", "certs", "whitelist", "events"} {
+		rows, err := tx.Query(fmt.Sprintf("select distinct email from %s", table))
+		if err != nil {
+			return err
+		}
+		emails := []string{}
+		for rows.Next() {
+			var email string
+			rows.Scan(&email)
+			emails = append(emails, email)
+		}
+		rows.Close()
+
+		for _, email := range emails {
+			c := canonical(email)
+			if c == email {
+				continue
+			}
+			// whitelist entries can collide with an existing canonical entry, in which case the
+			// update is skipped and the variant simply dropped
+			if _, err = tx.Exec(fmt.Sprintf("update or ignore %s set email=? where email=?", table), c, email); err != nil {
+				return err
+			}
+			if _, err = tx.Exec(fmt.Sprintf("delete from %s where email=?", table), email); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addAliases (2) adds the record of renamed users. certs.cn is set on certs issued under an email
+// their owner has since been renamed from; replaced_by is the fingerprint of the cert reissued in
+// place of such a cert.
+func addAliases(tx *sql.Tx) error {
+	return execAll(tx,
+		"create table aliases (rowid integer primary key, old_email text not null, email text not null, created timestamp not null default current_timestamp, grace_until timestamp not null)",
+		"create index aliases_old_email_idx on aliases (old_email)",
+		"create index aliases_email_idx on aliases (email)",
+		"alter table certs add column cn text default null",
+		"alter table certs add column replaced_by text default null",
+	)
+}
+
+// addRoles (3) adds administrative roles; domains is a space-separated list, used by domain-admin.
+func addRoles(tx *sql.Tx) error {
+	return execAll(tx,
+		"create table roles (rowid integer primary key, email text not null unique, role text not null, domains text not null default '', modified timestamp not null default current_timestamp)",
+		"create index roles_email_idx on roles (email)",
+	)
+}
+
+// addElevations (4) adds time-boxed role grants. A row is awaiting approval until started is set,
+// and is closed once ended is set.
+func addElevations(tx *sql.Tx) error {
+	return execAll(tx,
+		"create table elevations (rowid integer primary key, email text not null, role text not null, reason text not null, minutes integer not null, requested timestamp not null default current_timestamp, approved_by text default null, started timestamp default null, expires timestamp default null, ended timestamp default null)",
+		"create index elevations_email_idx on elevations (email)",
+	)
+}
+
+// addChanges (5) adds change requests awaiting a second admin's approval; see changes.go for the
+// lifecycle that status follows.
+func addChanges(tx *sql.Tx) error {
+	return execAll(tx,
+		"create table changes (rowid integer primary key, operation text not null, target text not null default '', payload text not null default '', summary text not null, requested_by text not null, requested timestamp not null default current_timestamp, decided_by text default null, decided timestamp default null, status text not null default 'pending', result text not null default '')",
+		"create index changes_status_idx on changes (status)",
+	)
+}
+
+// addUserLimits (6) adds per-user overrides of ClientLimit & IssuedCertDuration; a null column means
+// the service-wide setting applies.
+func addUserLimits(tx *sql.Tx) error {
+	return execAll(tx,
+		"create table user_limits (email text primary key, client_limit integer default null, cert_duration integer default null, modified timestamp not null default current_timestamp)",
+	)
+}
+
+// addDomains (7) turns the WhitelistedDomains setting into per-domain policy records; see domains.go.
+// Null limits mean the service-wide settings apply, and profiles is a space-separated list.
+func addDomains(tx *sql.Tx) error {
+	err := execAll(tx,
+		"create table domains (domain text primary key, enabled integer not null default 1, client_limit integer default null, cert_duration integer default null, profiles text not null default '', modified timestamp not null default current_timestamp)",
+	)
+	if err != nil {
+		return err
+	}
+	var domains string
+	if err = tx.QueryRow("select value from settings where key='WhitelistedDomains'").Scan(&domains); err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	for _, d := range strings.Fields(domains) {
+		if _, err = tx.Exec("insert or ignore into domains (domain) values (?)", d); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("delete from settings where key='WhitelistedDomains'")
+	return err
+}
+
+// addWhitelistExpiry (8) adds an optional last day of access to whitelist entries, with the admin who
+// sponsored the entry and a note; see whitelist.go.
+func addWhitelistExpiry(tx *sql.Tx) error {
+	return execAll(tx,
+		"alter table whitelist add column expires date default null",
+		"alter table whitelist add column sponsor text not null default ''",
+		"alter table whitelist add column note text not null default ''",
+	)
+}
+
+// addSuspensions (9) adds user suspensions, which block a user without touching their TOTP seed or
+// certs; a null ends means the suspension lasts until lifted. See suspend.go.
+func addSuspensions(tx *sql.Tx) error {
+	return execAll(tx,
+		"create table suspensions (email text primary key, reason text not null, ends date default null, suspended_by text not null default '', created timestamp not null default current_timestamp)",
+	)
+}
+
+// addRevocationReasons (10) records the RFC 5280 reason a cert was revoked for; null for certs
+// revoked before reasons were kept. A cert revoked as "certificateHold" is on hold, and can be
+// released. See certHandler.
+func addRevocationReasons(tx *sql.Tx) error {
+	return execAll(tx,
+		"alter table certs add column revoke_reason text default null",
+	)
+}
+
+// addScheduledRevocations (11) adds revocations scheduled for a future time; a null fingerprint
+// means all of the user's access. See schedule.go.
+func addScheduledRevocations(tx *sql.Tx) error {
+	return execAll(tx,
+		"create table scheduled_revocations (id integer primary key autoincrement, email text not null, fingerprint text default null, reason text not null default 'unspecified', due timestamp not null, scheduled_by text not null, created timestamp not null default current_timestamp)",
+		"create index scheduled_revocations_due_idx on scheduled_revocations (due)",
+	)
+}
+
+// addCertUsage (12) records when each cert was last used to connect, and from where; see
+// ovpn-client-logger.py. UsageTrackedSince marks when tracking began, since certs never seen before
+// then may well have been in use; see dormancy.go.
+func addCertUsage(tx *sql.Tx) error {
+	return execAll(tx,
+		"alter table certs add column last_seen timestamp default null",
+		"alter table certs add column last_ip text default null",
+		"insert or replace into settings (key, value) values ('UsageTrackedSince', datetime('now'))",
+	)
+}
+
+// addLockdown (13) adds lockdown mode; the table has a row only while the service is locked down,
+// and break_glass is the space-separated list of users who are exempt. See lockdown.go.
+func addLockdown(tx *sql.Tx) error {
+	return execAll(tx,
+		"create table lockdown (id integer primary key check (id = 1), enabled_by text not null, reason text not null, break_glass text not null default '', created timestamp not null default current_timestamp)",
+	)
+}
+
+// addCertIssuer (14) records the fingerprint of the CA that issued each cert, so certs can be revoked
+// by CA; see massrevoke.go. Existing certs get theirs from ovpn-client-logger.py when next used.
+func addCertIssuer(tx *sql.Tx) error {
+	return execAll(tx,
+		"alter table certs add column issuer text default null",
+		"create index certs_issuer_idx on certs (issuer)",
+	)
+}
+
+// addKeyAlgorithm (15) records the algorithm of each cert's key; see keys.go. It's unknown for certs
+// issued before, which were all RSA unless issued from a CSR.
+func addKeyAlgorithm(tx *sql.Tx) error {
+	return execAll(tx, "alter table certs add column key_algorithm text default null")
+}
+
+// addCertCSR (16) records which certs were issued from a CSR, whose renewals need another; see csr.go.
+// Certs issued before can't be told apart, and renew as though they had generated keys.
+func addCertCSR(tx *sql.Tx) error {
+	return execAll(tx, "alter table certs add column from_csr integer not null default 0")
+}
+
+// addRateCounts (17) keeps a copy of each event that counts against a rate limit, so that clearing
+// the event log (DELETE /events) doesn't reset the limits; see rateLimited. A trigger fills it, so no
+// writer of those events can forget to, and expiryLoop prunes it. Recent events are copied over.
+func addRateCounts(tx *sql.Tx) error {
+	counted := "('TOTP set', 'certificate issued', 'certificate revoked', 'security incident')"
+	return execAll(tx,
+		"create table rate_counts (event text not null, email text not null, ts timestamp not null default current_timestamp)",
+		"create index rate_counts_event_ts_idx on rate_counts (event, ts)",
+		"create trigger rate_counts_events after insert on events when new.event in "+counted+" begin insert into rate_counts (event, email, ts) values (new.event, new.email, new.ts); end",
+		"insert into rate_counts (event, email, ts) select event, email, ts from events where event in "+counted+" and ts > datetime('now', '-1 day')",
+	)
+}
@@ -0,0 +1,264 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// User renames, for when someone's email changes. Everything the user owns moves to the new email,
+// and the old email is kept as an alias for audit lookups. Certs carry the email they were issued
+// under as their CN, which the OpenVPN hooks check; so certs issued before a rename keep working
+// only until the alias's grace period ends, and the user is prompted to reissue them meanwhile.
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+
+	"playground/httputil"
+	"playground/log"
+
+	"validate"
+)
+
+const defaultRenameGraceDays = 14
+
+var (
+	errNoSuchUser = errors.New("no such user")
+	errUserExists = errors.New("new email already belongs to a user")
+)
+
+type alias struct{ OldEmail, Email, Created, GraceUntil string }
+
+// renameUser moves oldEmail's seed, whitelist entry, certs, events, role and elevations to newEmail
+// in a single transaction. It returns the number of active certs that need to be reissued under the new email.
+func renameUser(cxn *sql.DB, oldEmail, newEmail string, graceDays int) (int, error) {
+	if oldEmail == newEmail {
+		return 0, errors.New("old and new emails are the same")
+	}
+	if graceDays < 0 {
+		return 0, errors.New("grace period may not be negative")
+	}
+
+	tx, err := cxn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	fail := func(err error) (int, error) {
+		tx.Rollback()
+		return 0, err
+	}
+
+	var n int
+	if err = tx.QueryRow("select count(*) from totp where email=?", oldEmail).Scan(&n); err != nil {
+		return fail(err)
+	}
+	if n == 0 {
+		return fail(errNoSuchUser)
+	}
+	if err = tx.QueryRow("select count(*) from totp where email=?", newEmail).Scan(&n); err != nil {
+		return fail(err)
+	}
+	if n > 0 {
+		return fail(errUserExists)
+	}
+
+	grace := fmt.Sprintf("+%d day", graceDays)
+	statements := []struct {
+		q      string
+		params []interface{}
+	}{
+		{"update totp set email=? where email=?", []interface{}{newEmail, oldEmail}},
+		{"update or replace whitelist set email=?, modified=current_timestamp where email=?", []interface{}{newEmail, oldEmail}},
+		{"update whitelist set sponsor=? where sponsor=?", []interface{}{newEmail, oldEmail}},
+		// a cert's CN is whatever email it was issued under, so remember that before moving it...
+		{"update certs set cn=ifnull(cn, email), email=? where email=?", []interface{}{newEmail, oldEmail}},
+		// ...unless the user is being renamed back to it
+		{"update certs set cn=null where email=? and cn=?", []interface{}{newEmail, newEmail}},
+		{"update events set email=? where email=?", []interface{}{newEmail, oldEmail}},
+		{"update or replace roles set email=? where email=?", []interface{}{newEmail, oldEmail}},
+		{"update elevations set email=? where email=?", []interface{}{newEmail, oldEmail}},
+		{"update or replace user_limits set email=? where email=?", []interface{}{newEmail, oldEmail}},
+		{"update or replace suspensions set email=? where email=?", []interface{}{newEmail, oldEmail}},
+		{"update suspensions set suspended_by=? where suspended_by=?", []interface{}{newEmail, oldEmail}},
+		{"update scheduled_revocations set email=? where email=?", []interface{}{newEmail, oldEmail}},
+		{"update scheduled_revocations set scheduled_by=? where scheduled_by=?", []interface{}{newEmail, oldEmail}},
+		// aliases always point at the current email, so that the hooks need only a single lookup
+		{"update aliases set email=? where email=?", []interface{}{newEmail, oldEmail}},
+		{"delete from aliases where old_email=email", nil},
+		{"insert into aliases (old_email, email, grace_until) values (?, ?, datetime('now', ?))", []interface{}{oldEmail, newEmail, grace}},
+	}
+	for _, s := range statements {
+		if _, err = tx.Exec(s.q, s.params...); err != nil {
+			return fail(err)
+		}
+	}
+
+	if err = tx.QueryRow("select count(*) from certs where email=? and cn is not null and revoked is null and replaced_by is null", newEmail).Scan(&n); err != nil {
+		return fail(err)
+	}
+	value := fmt.Sprintf("renamed from '%s'; %d certs valid for %d days pending reissue", oldEmail, n, graceDays)
+	if _, err = tx.Exec("insert into events (event, email, value) values (?, ?, ?)", "user renamed", newEmail, value); err != nil {
+		return fail(err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// loadAliases returns every alias involving email, as either the old or current email; or all
+// aliases, if email is "".
+func loadAliases(cxn *sql.DB, email string) []*alias {
+	q := "select old_email, email, strftime('%Y-%m-%dT%H:%M:%SZ', created), strftime('%Y-%m-%dT%H:%M:%SZ', grace_until) from aliases"
+	params := []interface{}{}
+	if email != "" {
+		q += " where email=? or old_email=?"
+		params = append(params, email, email)
+	}
+	rows, err := cxn.Query(q+" order by created", params...)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+
+	res := []*alias{}
+	for rows.Next() {
+		a := &alias{}
+		rows.Scan(&a.OldEmail, &a.Email, &a.Created, &a.GraceUntil)
+		res = append(res, a)
+	}
+	return res
+}
+
+/*
+ * API endpoint handlers
+ */
+
+func renameHandler(writer http.ResponseWriter, req *http.Request) {
+	// POST /rename/<email> -- move the indicated user to a new email
+	//   I: {Email: "", GraceDays: 14}
+	//   O: {Email: "", ReissueCerts: 0}
+	//   200: renamed; ReissueCerts of the user's certs remain valid for GraceDays (default 14)
+	//   400: missing or malformed emails, or negative GraceDays; 404: no such user;
+	//   409 (conflict): the new email already belongs to a user
+	// Non-POST: 405 (method not allowed)
+
+	TAG := "/rename/"
+
+	oldEmail, err := validate.Email(extractSegment(req.URL.Path, 2))
+	if err != nil {
+		sendBadRequest(writer, TAG, err)
+		return
+	}
+	reqBody := &struct {
+		Email     string
+		GraceDays *int
+	}{}
+	if err = httputil.PopulateFromBody(reqBody, req); err != nil {
+		log.Warn(TAG, "missing or malformed request JSON", req.URL.Path)
+		httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+		return
+	}
+	newEmail, err := validate.Email(reqBody.Email)
+	if err != nil {
+		sendBadRequest(writer, TAG, err)
+		return
+	}
+	graceDays := defaultRenameGraceDays
+	if reqBody.GraceDays != nil {
+		graceDays = *reqBody.GraceDays
+	}
+
+	cxn := getDB()
+	defer cxn.Close()
+	n, err := renameUser(cxn, oldEmail, newEmail, graceDays)
+	switch err {
+	case nil:
+	case errNoSuchUser:
+		log.Warn(TAG, "attempt to rename nonexistent user", oldEmail)
+		httputil.SendJSON(writer, http.StatusNotFound, struct{}{})
+		return
+	case errUserExists:
+		log.Warn(TAG, "attempt to rename onto existing user", oldEmail, newEmail)
+		httputil.SendJSON(writer, http.StatusConflict, struct{}{})
+		return
+	default:
+		sendBadRequest(writer, TAG, err)
+		return
+	}
+
+	log.Status(TAG, fmt.Sprintf("renamed '%s' to '%s' (%d certs to reissue)", oldEmail, newEmail, n))
+	httputil.SendJSON(writer, http.StatusOK, struct {
+		Email        string
+		ReissueCerts int
+	}{newEmail, n})
+}
+
+func aliasesHandler(writer http.ResponseWriter, req *http.Request) {
+	// GET /aliases -- fetch every recorded rename
+	//   I: None
+	//   O: {Aliases: [{OldEmail: "", Email: "", Created: "", GraceUntil: ""}]}
+	//   200: the object above
+	// GET /aliases/<email> -- fetch the renames involving email, whether as the old or current email
+	//   I: None
+	//   O: {Aliases: [{OldEmail: "", Email: "", Created: "", GraceUntil: ""}]}
+	//   200: the object above (which may be empty); 400: malformed email
+	// Non-GET: 405 (method not allowed)
+	// Email is always the user's current email; aliases are sorted oldest first.
+
+	TAG := "/aliases/"
+
+	email := extractSegment(req.URL.Path, 2)
+	if email != "" {
+		var err error
+		if email, err = validate.Email(email); err != nil {
+			sendBadRequest(writer, TAG, err)
+			return
+		}
+	}
+
+	cxn := getDB()
+	defer cxn.Close()
+	httputil.SendJSON(writer, http.StatusOK, struct{ Aliases []*alias }{loadAliases(cxn, email)})
+}
+
+// renameCommand implements `heimdall rename`.
+func renameCommand(args []string) error {
+	flags := flag.NewFlagSet("rename", flag.ExitOnError)
+	graceDays := flags.Int("grace", defaultRenameGraceDays, "days for which certs issued under the old email remain valid")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		return errors.New("usage: rename [-grace days] <old email> <new email>")
+	}
+
+	oldEmail, err := validate.Email(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	newEmail, err := validate.Email(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	cxn := getDB()
+	defer cxn.Close()
+	n, err := renameUser(cxn, oldEmail, newEmail, *graceDays)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("renamed '%s' to '%s'; %d certs to be reissued within %d days\n", oldEmail, newEmail, n, *graceDays)
+	return nil
+}
@@ -0,0 +1,64 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Renewed certs. Renewing a cert (POST /cert/<fingerprint>) issues its replacement and records it in
+// the old cert's replaced_by; the old cert keeps working meanwhile, so the device isn't cut off while
+// its owner installs the new .ovpn. ovpn-client-logger.py revokes the old cert as "superseded" when
+// the new one first connects, and revokeRenewedCerts does so when it expires, if that comes first.
+
+import (
+	"fmt"
+
+	"playground/log"
+)
+
+// revokeRenewedCerts revokes renewed certs that have expired while still awaiting their replacement's
+// first use. Certs reissued after a rename are left alone: their aliases' grace periods govern them.
+func revokeRenewedCerts() error {
+	cxn := getDB()
+	defer cxn.Close()
+
+	rows, err := cxn.Query("select email, fingerprint, replaced_by from certs where replaced_by is not null and cn is null and revoked is null and expires < date('now')")
+	if err != nil {
+		return err
+	}
+	type renewed struct{ Email, Fingerprint, ReplacedBy string }
+	certs := []*renewed{}
+	for rows.Next() {
+		r := &renewed{}
+		rows.Scan(&r.Email, &r.Fingerprint, &r.ReplacedBy)
+		certs = append(certs, r)
+	}
+	rows.Close()
+
+	for _, r := range certs {
+		res, err := cxn.Exec("update certs set revoked=datetime('now'), revoke_reason='superseded' where fingerprint=? and revoked is null", r.Fingerprint)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 { // revoked meanwhile
+			continue
+		}
+		value := fmt.Sprintf("%s (superseded; renewed as %s)", r.Fingerprint, r.ReplacedBy)
+		if _, err = cxn.Exec("insert into events (event, email, value) values (?, ?, ?)", "certificate revoked", r.Email, value); err != nil {
+			return err
+		}
+		log.Status("revokeRenewedCerts", fmt.Sprintf("revoked expired '%s' cert %s, renewed as %s", r.Email, r.Fingerprint, r.ReplacedBy))
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Administrative roles. Heimdall only stores them; what each role may do is up to Bifröst, which
+// also has its own config-file list of admins that aren't recorded here.
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"playground/httputil"
+	"playground/log"
+
+	"validate"
+)
+
+// the roles Bifröst knows how to enforce
+const (
+	roleAdmin       = "admin"
+	roleAuditor     = "auditor"
+	roleDomainAdmin = "domain-admin"
+)
+
+type userRole struct {
+	Email, Role string
+	Domains     []string
+	Modified    string
+}
+
+// validateRole checks a role assignment, canonicalizing its domains in place.
+func validateRole(r *userRole) error {
+	switch r.Role {
+	case roleAdmin, roleAuditor:
+		if len(r.Domains) > 0 {
+			return fmt.Errorf("role '%s' does not take domains", r.Role)
+		}
+	case roleDomainAdmin:
+		if len(r.Domains) == 0 {
+			return fmt.Errorf("role '%s' requires at least one domain", r.Role)
+		}
+	default:
+		return fmt.Errorf("unknown role '%s'", r.Role)
+	}
+	domains := []string{}
+	for _, d := range r.Domains {
+		d, err := validate.Domain(d)
+		if err != nil {
+			return err
+		}
+		domains = append(domains, d)
+	}
+	r.Domains = domains
+	return nil
+}
+
+// loadRoles returns the role of the indicated user, or of all users with roles if email is "".
+func loadRoles(cxn *sql.DB, email string) []*userRole {
+	q := "select email, role, domains, strftime('%Y-%m-%dT%H:%M:%SZ', modified) from roles"
+	params := []interface{}{}
+	if email != "" {
+		q += " where email=?"
+		params = append(params, email)
+	}
+	rows, err := cxn.Query(q+" order by email", params...)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+
+	res := []*userRole{}
+	for rows.Next() {
+		r := &userRole{}
+		var domains string
+		rows.Scan(&r.Email, &r.Role, &domains, &r.Modified)
+		r.Domains = strings.Fields(domains)
+		res = append(res, r)
+	}
+	return res
+}
+
+/*
+ * API endpoint handlers
+ */
+
+func rolesHandler(writer http.ResponseWriter, req *http.Request) {
+	// GET /roles -- fetch every user with an administrative role
+	//   I: None
+	//   O: {Roles: [{Email: "", Role: "", Domains: [""], Modified: ""}]}
+	//   200: the object above
+	// GET /roles/<email> -- fetch the role of the indicated user
+	//   I: None
+	//   O: {Email: "", Role: "", Domains: [""], Modified: ""}
+	//   200: the object above; 404: user has no role; 400: malformed email
+	// PUT /roles/<email> -- grant a role to the indicated user, replacing any they already have
+	//   I: {Role: "admin"|"auditor"|"domain-admin", Domains: [""]}
+	//   O: {Email: "", Role: "", Domains: [""], Modified: ""}
+	//   200: the role was granted; 400: malformed email, unknown role, or bad domains
+	//   Note: Domains is required for domain-admin, and not allowed otherwise
+	// DELETE /roles/<email> -- remove the indicated user's role
+	//   I: None
+	//   O: {}
+	//   200: the role was removed (idempotent); 400: malformed email
+	// Non-GET/PUT/DELETE: 405 (method not allowed)
+
+	TAG := "/roles/"
+
+	email := extractSegment(req.URL.Path, 2)
+	if email != "" {
+		var err error
+		if email, err = validate.Email(email); err != nil {
+			sendBadRequest(writer, TAG, err)
+			return
+		}
+	}
+	if email == "" && req.Method != "GET" {
+		httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+		return
+	}
+
+	cxn := getDB()
+	defer cxn.Close()
+
+	switch req.Method {
+	case "GET":
+		roles := loadRoles(cxn, email)
+		if email == "" {
+			httputil.SendJSON(writer, http.StatusOK, struct{ Roles []*userRole }{roles})
+			return
+		}
+		if len(roles) == 0 {
+			httputil.SendJSON(writer, http.StatusNotFound, struct{}{})
+			return
+		}
+		httputil.SendJSON(writer, http.StatusOK, roles[0])
+	case "PUT":
+		r := &userRole{}
+		if err := httputil.PopulateFromBody(r, req); err != nil {
+			log.Warn(TAG, "missing or malformed request JSON", req.URL.Path)
+			httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+			return
+		}
+		r.Email = email
+		if err := validateRole(r); err != nil {
+			sendBadRequest(writer, TAG, err)
+			return
+		}
+		domains := strings.Join(r.Domains, " ")
+		writeDatabaseByQuery("insert or replace into roles (email, role, domains) values (?, ?, ?)", email, r.Role, domains)
+		writeDatabaseByQuery("insert into events (event, email, value) values (?, ?, ?)", "role granted", email, strings.TrimSpace(r.Role+" "+domains))
+		log.Status(TAG, fmt.Sprintf("granted '%s' role '%s'", email, r.Role))
+		httputil.SendJSON(writer, http.StatusOK, loadRoles(cxn, email)[0])
+	case "DELETE":
+		roles := loadRoles(cxn, email)
+		if len(roles) == 0 {
+			httputil.SendJSON(writer, http.StatusOK, struct{}{})
+			return
+		}
+		writeDatabaseByQuery("delete from roles where email=?", email)
+		writeDatabaseByQuery("insert into events (event, email, value) values (?, ?, ?)", "role revoked", email, roles[0].Role)
+		log.Status(TAG, fmt.Sprintf("revoked '%s' role '%s'", email, roles[0].Role))
+		httputil.SendJSON(writer, http.StatusOK, struct{}{})
+	default:
+		panic("API method sentinel misconfiguration")
+	}
+}
@@ -0,0 +1,295 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Scheduled revocations, for offboarding that's known in advance. An admin schedules either a single
+// cert or a whole user (as for DELETE /user/<email>) to be revoked at a given time; expiryLoop
+// carries out those that are due, and records each in the event log as it happens.
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"playground/httputil"
+	"playground/log"
+
+	"validate"
+)
+
+type scheduledRevocation struct {
+	ID          int64
+	Email       string
+	Fingerprint string // "" to revoke all of the user's access
+	Reason      string // RFC 5280 reason for the certs revoked; see validate.RevocationReason
+	Due         string // as "2006-01-02T15:04:05Z"
+	ScheduledBy string
+	Created     string
+}
+
+const scheduleColumns = `id, email, ifnull(fingerprint, ''), reason, strftime('%Y-%m-%dT%H:%M:%SZ', due),
+	scheduled_by, strftime('%Y-%m-%dT%H:%M:%SZ', created)`
+
+// loadScheduledRevocations returns the pending revocations of the indicated user, or of all users
+// if email is "", soonest first.
+func loadScheduledRevocations(cxn *sql.DB, email string) []*scheduledRevocation {
+	q := "select " + scheduleColumns + " from scheduled_revocations"
+	params := []interface{}{}
+	if email != "" {
+		q += " where email=?"
+		params = append(params, email)
+	}
+	rows, err := cxn.Query(q+" order by due, id", params...)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+
+	res := []*scheduledRevocation{}
+	for rows.Next() {
+		r := &scheduledRevocation{}
+		rows.Scan(&r.ID, &r.Email, &r.Fingerprint, &r.Reason, &r.Due, &r.ScheduledBy, &r.Created)
+		res = append(res, r)
+	}
+	return res
+}
+
+// validateScheduledRevocation checks a revocation received from a client, canonicalizing it in place.
+// A cert must belong to the user, and not already be revoked for good.
+func validateScheduledRevocation(cxn *sql.DB, r *scheduledRevocation) error {
+	var err error
+	if r.Email, err = validate.Email(r.Email); err != nil {
+		return err
+	}
+	if r.Fingerprint != "" {
+		if r.Fingerprint, err = validate.Fingerprint(r.Fingerprint); err != nil {
+			return err
+		}
+		var n int
+		q := "select count(*) from certs where fingerprint=? and email=? and (revoked is null or revoke_reason=?)"
+		if err = cxn.QueryRow(q, r.Fingerprint, r.Email, validate.CertificateHold).Scan(&n); err != nil {
+			panic(err)
+		}
+		if n == 0 {
+			return errors.New("no such active cert for this user")
+		}
+	} else {
+		var n int
+		q := "select (select count(*) from totp where email=?) + (select count(*) from certs where email=? and revoked is null)"
+		if err = cxn.QueryRow(q, r.Email, r.Email).Scan(&n); err != nil {
+			panic(err)
+		}
+		if n == 0 {
+			return errors.New("no such user")
+		}
+	}
+	if r.Reason, err = validate.RevocationReason(r.Reason); err != nil {
+		return err
+	}
+	if r.Reason == validate.CertificateHold {
+		return errors.New("a hold can't be scheduled")
+	}
+	due, err := time.Parse(time.RFC3339, r.Due)
+	if err != nil {
+		return errors.New("due time must be a timestamp, as 2006-01-02T15:04:05Z")
+	}
+	if !due.After(time.Now()) {
+		return errors.New("due time must be in the future")
+	}
+	r.Due = due.UTC().Format("2006-01-02T15:04:05Z")
+	if r.ScheduledBy, err = validate.Email(r.ScheduledBy); err != nil {
+		return fmt.Errorf("bad ScheduledBy: %s", err)
+	}
+	return nil
+}
+
+// runScheduledRevocations carries out the revocations that are due, each in its own transaction.
+func runScheduledRevocations() error {
+	cxn := getDB()
+	defer cxn.Close()
+
+	rows, err := cxn.Query("select " + scheduleColumns + " from scheduled_revocations where due <= datetime('now') order by due, id")
+	if err != nil {
+		return err
+	}
+	due := []*scheduledRevocation{}
+	for rows.Next() {
+		r := &scheduledRevocation{}
+		rows.Scan(&r.ID, &r.Email, &r.Fingerprint, &r.Reason, &r.Due, &r.ScheduledBy, &r.Created)
+		due = append(due, r)
+	}
+	rows.Close()
+
+	for _, r := range due {
+		if err = runScheduledRevocation(cxn, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runScheduledRevocation(cxn *sql.DB, r *scheduledRevocation) error {
+	tx, err := cxn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var res sql.Result
+	if res, err = tx.Exec("delete from scheduled_revocations where id=?", r.ID); err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 { // i.e. cancelled meanwhile
+		return err
+	}
+
+	q := "update certs set revoked=datetime('now'), revoke_reason=? where email=? and (revoked is null or revoke_reason=?)"
+	params := []interface{}{r.Reason, r.Email, validate.CertificateHold}
+	if r.Fingerprint != "" {
+		q += " and fingerprint=?"
+		params = append(params, r.Fingerprint)
+	}
+	if res, err = tx.Exec(q, params...); err != nil {
+		return err
+	}
+	revoked, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	event, value := "certificate revoked", fmt.Sprintf("%s (%s; scheduled by '%s')", r.Fingerprint, r.Reason, r.ScheduledBy)
+	if r.Fingerprint == "" {
+		if _, err = tx.Exec("delete from totp where email=?", r.Email); err != nil {
+			return err
+		}
+		event, value = "user deleted", fmt.Sprintf("%d certs revoked (%s; scheduled by '%s')", revoked, r.Reason, r.ScheduledBy)
+	} else if revoked == 0 {
+		event = "scheduled revocation skipped" // revoked for good some other way meanwhile
+	}
+	if _, err = tx.Exec("insert into events (event, email, value) values (?, ?, ?)", event, r.Email, value); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	log.Status("runScheduledRevocation", fmt.Sprintf("carried out revocation #%d of '%s' scheduled by '%s'", r.ID, r.Email, r.ScheduledBy))
+	return nil
+}
+
+/*
+ * API endpoint handlers
+ */
+
+func revocationsHandler(writer http.ResponseWriter, req *http.Request) {
+	// GET /revocations?email=<email> -- fetch pending scheduled revocations
+	//   I: None
+	//   O: {Revocations: [{ID: 0, Email: "", Fingerprint: "", Reason: "", Due: "", ScheduledBy: "", Created: ""}]}
+	//   200: the object above; 400: malformed email
+	//   Note: email is optional, and limits the list to that user's revocations
+	// POST /revocations -- schedule a revocation
+	//   I: {Email: "", Fingerprint: "", Reason: "", Due: "", ScheduledBy: ""}
+	//   O: {ID: 0, Email: "", Fingerprint: "", Reason: "", Due: "", ScheduledBy: "", Created: ""}
+	//   201: scheduled; 400: malformed fields, cert isn't the user's or is already revoked, or Due
+	//   isn't in the future
+	//   Note: a Fingerprint of "" revokes all of the user's certs and deletes their TOTP seed, as for
+	//   DELETE /user/<email>; Reason defaults to "unspecified", and can't be "certificateHold"
+	// DELETE /revocations/<id>?by=<email> -- cancel a scheduled revocation
+	//   I: None
+	//   O: {}
+	//   200: cancelled; 404: no such pending revocation; 400: malformed id or by
+	// Non-GET/POST/DELETE: 405 (method not allowed)
+
+	TAG := "/revocations/"
+
+	cxn := getDB()
+	defer cxn.Close()
+
+	switch req.Method {
+	case "GET":
+		email := req.URL.Query().Get("email")
+		if email != "" {
+			var err error
+			if email, err = validate.Email(email); err != nil {
+				sendBadRequest(writer, TAG, err)
+				return
+			}
+		}
+		httputil.SendJSON(writer, http.StatusOK, struct{ Revocations []*scheduledRevocation }{loadScheduledRevocations(cxn, email)})
+	case "POST":
+		r := &scheduledRevocation{}
+		if err := httputil.PopulateFromBody(r, req); err != nil {
+			log.Warn(TAG, "missing or malformed request JSON", req.URL.Path)
+			httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+			return
+		}
+		if err := validateScheduledRevocation(cxn, r); err != nil {
+			sendBadRequest(writer, TAG, err)
+			return
+		}
+		res, err := cxn.Exec("insert into scheduled_revocations (email, fingerprint, reason, due, scheduled_by) values (?, ?, ?, datetime(?), ?)",
+			r.Email, nullable(r.Fingerprint), r.Reason, r.Due, r.ScheduledBy)
+		if err != nil {
+			panic(err)
+		}
+		if r.ID, err = res.LastInsertId(); err != nil {
+			panic(err)
+		}
+		what := "all access"
+		if r.Fingerprint != "" {
+			what = r.Fingerprint
+		}
+		writeDatabaseByQuery("insert into events (event, email, value) values (?, ?, ?)", "revocation scheduled", r.Email,
+			fmt.Sprintf("%s at %s by '%s' (%s)", what, r.Due, r.ScheduledBy, r.Reason))
+		log.Status(TAG, fmt.Sprintf("'%s' scheduled revocation #%d of '%s'", r.ScheduledBy, r.ID, r.Email))
+
+		rows, err := cxn.Query("select "+scheduleColumns+" from scheduled_revocations where id=?", r.ID)
+		if err != nil {
+			panic(err)
+		}
+		defer rows.Close()
+		if !rows.Next() {
+			panic("scheduled revocation vanished")
+		}
+		rows.Scan(&r.ID, &r.Email, &r.Fingerprint, &r.Reason, &r.Due, &r.ScheduledBy, &r.Created)
+		httputil.SendJSON(writer, http.StatusCreated, r)
+	case "DELETE":
+		id, err := strconv.ParseInt(extractSegment(req.URL.Path, 2), 10, 64)
+		if err != nil {
+			sendBadRequest(writer, TAG, errors.New("malformed revocation id"))
+			return
+		}
+		by, err := validate.Email(req.URL.Query().Get("by"))
+		if err != nil {
+			sendBadRequest(writer, TAG, err)
+			return
+		}
+		var email string
+		if err = cxn.QueryRow("select email from scheduled_revocations where id=?", id).Scan(&email); err == sql.ErrNoRows {
+			httputil.SendJSON(writer, http.StatusNotFound, struct{}{})
+			return
+		} else if err != nil {
+			panic(err)
+		}
+		writeDatabaseByQuery("delete from scheduled_revocations where id=?", id)
+		writeDatabaseByQuery("insert into events (event, email, value) values (?, ?, ?)", "scheduled revocation cancelled", email, fmt.Sprintf("#%d by '%s'", id, by))
+		log.Status(TAG, fmt.Sprintf("'%s' cancelled revocation #%d of '%s'", by, id, email))
+		httputil.SendJSON(writer, http.StatusOK, struct{}{})
+	default:
+		panic("API method sentinel misconfiguration")
+	}
+}
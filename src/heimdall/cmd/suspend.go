@@ -0,0 +1,220 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// User suspensions. A suspended user can neither connect to the VPN (both OpenVPN hooks check) nor
+// use Bifröst, but unlike DELETE /user/<email> their TOTP seed & certs are left alone, so lifting the
+// suspension restores access as it was. A suspension may end on its own on a given date.
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"playground/httputil"
+	"playground/log"
+
+	"validate"
+)
+
+type suspension struct {
+	Email       string
+	Reason      string
+	Until       string // the day the suspension ends on its own, as "2006-01-02"; "" for until lifted
+	SuspendedBy string
+	Created     string
+}
+
+// activeSuspension selects suspensions that haven't ended
+const activeSuspension = "(ends is null or ends > date('now'))"
+
+// loadSuspensions returns the active suspension of the indicated user, or of all suspended users
+// if email is "".
+func loadSuspensions(cxn *sql.DB, email string) []*suspension {
+	q := `select email, reason, ifnull(ends, ''), suspended_by, strftime('%Y-%m-%dT%H:%M:%SZ', created)
+		from suspensions where ` + activeSuspension
+	params := []interface{}{}
+	if email != "" {
+		q += " and email=?"
+		params = append(params, email)
+	}
+	rows, err := cxn.Query(q+" order by email", params...)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+
+	res := []*suspension{}
+	for rows.Next() {
+		s := &suspension{}
+		rows.Scan(&s.Email, &s.Reason, &s.Until, &s.SuspendedBy, &s.Created)
+		res = append(res, s)
+	}
+	return res
+}
+
+// validateSuspension checks a suspension received from a client, canonicalizing it in place.
+func validateSuspension(s *suspension) error {
+	if strings.TrimSpace(s.Reason) == "" {
+		return errors.New("a reason is required")
+	}
+	reason, err := validate.Description(s.Reason) // same rules as a description, since it ends up in events
+	if err != nil {
+		return fmt.Errorf("bad reason: %s", err)
+	}
+	s.Reason = reason
+	if s.Until != "" {
+		t, err := time.Parse("2006-01-02", s.Until)
+		if err != nil {
+			return errors.New("end date must be a date, as YYYY-MM-DD")
+		}
+		if !t.After(time.Now().UTC()) {
+			return errors.New("end date must be in the future")
+		}
+	}
+	if s.SuspendedBy, err = validate.Email(s.SuspendedBy); err != nil {
+		return fmt.Errorf("bad SuspendedBy: %s", err)
+	}
+	return nil
+}
+
+// expireSuspensions lifts suspensions whose end date has arrived, recording each in the event log.
+func expireSuspensions() error {
+	cxn := getDB()
+	defer cxn.Close()
+
+	rows, err := cxn.Query("select email from suspensions where not " + activeSuspension)
+	if err != nil {
+		return err
+	}
+	ended := []string{}
+	var email string
+	for rows.Next() {
+		rows.Scan(&email)
+		ended = append(ended, email)
+	}
+	rows.Close()
+
+	for _, email := range ended {
+		if _, err = cxn.Exec("delete from suspensions where email=? and not "+activeSuspension, email); err != nil {
+			return err
+		}
+		if _, err = cxn.Exec("insert into events (event, email, value) values (?, ?, ?)", "user unsuspended", email, "suspension ended as scheduled"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * API endpoint handlers
+ */
+
+func suspensionsHandler(writer http.ResponseWriter, req *http.Request) {
+	// GET /suspensions -- fetch every suspended user
+	//   I: None
+	//   O: {Suspensions: [{Email: "", Reason: "", Until: "", SuspendedBy: "", Created: ""}]}
+	//   200: the object above
+	// GET /suspensions/<email> -- fetch the suspension of the indicated user
+	//   I: None
+	//   O: {Email: "", Reason: "", Until: "", SuspendedBy: "", Created: ""}
+	//   200: the object above; 404: user isn't suspended; 400: malformed email
+	// PUT /suspensions/<email> -- suspend the indicated user, or change their suspension
+	//   I: {Reason: "", Until: "", SuspendedBy: ""}
+	//   O: same as GET
+	//   200: the user is suspended; 400: malformed email, missing reason or SuspendedBy, or bad Until
+	//   Note: Until is optional; the suspension ends on its own on that day, as YYYY-MM-DD
+	// DELETE /suspensions/<email>?by=<email> -- lift the suspension of the indicated user
+	//   I: None
+	//   O: {}
+	//   200: the suspension was lifted; 404: user isn't suspended; 400: malformed email or by
+	// Non-GET/PUT/DELETE: 405 (method not allowed)
+	// Suspensions whose Until has arrived are never returned, and are lifted within a minute or so.
+
+	TAG := "/suspensions/"
+
+	email := extractSegment(req.URL.Path, 2)
+	if email != "" {
+		var err error
+		if email, err = validate.Email(email); err != nil {
+			sendBadRequest(writer, TAG, err)
+			return
+		}
+	}
+	if email == "" && req.Method != "GET" {
+		httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+		return
+	}
+
+	cxn := getDB()
+	defer cxn.Close()
+
+	switch req.Method {
+	case "GET":
+		if email == "" {
+			httputil.SendJSON(writer, http.StatusOK, struct{ Suspensions []*suspension }{loadSuspensions(cxn, "")})
+			return
+		}
+	case "PUT":
+		s := &suspension{}
+		if err := httputil.PopulateFromBody(s, req); err != nil {
+			log.Warn(TAG, "missing or malformed request JSON", req.URL.Path)
+			httputil.SendJSON(writer, http.StatusBadRequest, struct{}{})
+			return
+		}
+		s.Email = email
+		if err := validateSuspension(s); err != nil {
+			sendBadRequest(writer, TAG, err)
+			return
+		}
+		writeDatabaseByQuery("insert or replace into suspensions (email, reason, ends, suspended_by) values (?, ?, ?, ?)", email, s.Reason, nullable(s.Until), s.SuspendedBy)
+		value := fmt.Sprintf("by '%s': %s", s.SuspendedBy, s.Reason)
+		if s.Until != "" {
+			value += " (until " + s.Until + ")"
+		}
+		writeDatabaseByQuery("insert into events (event, email, value) values (?, ?, ?)", "user suspended", email, value)
+		log.Status(TAG, fmt.Sprintf("'%s' suspended '%s'", s.SuspendedBy, email))
+	case "DELETE":
+		if err := req.ParseForm(); err != nil {
+			panic(err)
+		}
+		by, err := validate.Email(req.FormValue("by"))
+		if err != nil {
+			sendBadRequest(writer, TAG, err)
+			return
+		}
+		if len(loadSuspensions(cxn, email)) == 0 {
+			httputil.SendJSON(writer, http.StatusNotFound, struct{}{})
+			return
+		}
+		writeDatabaseByQuery("delete from suspensions where email=?", email)
+		writeDatabaseByQuery("insert into events (event, email, value) values (?, ?, ?)", "user unsuspended", email, fmt.Sprintf("by '%s'", by))
+		log.Status(TAG, fmt.Sprintf("'%s' lifted suspension of '%s'", by, email))
+		httputil.SendJSON(writer, http.StatusOK, struct{}{})
+		return
+	default:
+		panic("API method sentinel misconfiguration")
+	}
+
+	suspensions := loadSuspensions(cxn, email)
+	if len(suspensions) == 0 {
+		httputil.SendJSON(writer, http.StatusNotFound, struct{}{})
+		return
+	}
+	httputil.SendJSON(writer, http.StatusOK, suspensions[0])
+}
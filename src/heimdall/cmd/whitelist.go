@@ -0,0 +1,150 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Expiring whitelist entries, for contractors & guests. An entry may have a last day, a sponsor (the
+// admin who added it, whom Gjallarhorn reminds before it expires) and a note. An entry stops
+// granting access after its last day, whether or not expireWhitelist has run yet.
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"validate"
+)
+
+type whitelistEntry struct {
+	Email    string
+	Expires  string // the last day of access, as "2006-01-02"; "" for never
+	Sponsor  string
+	Note     string
+	Modified string
+}
+
+// activeWhitelist selects whitelist entries that haven't expired
+const activeWhitelist = "(expires is null or expires >= date('now'))"
+
+// loadWhitelist returns the whitelist entries that haven't expired, sorted by email.
+func loadWhitelist(cxn *sql.DB) []*whitelistEntry {
+	rows, err := cxn.Query(`select email, ifnull(expires, ''), sponsor, note, strftime('%Y-%m-%dT%H:%M:%SZ', modified)
+		from whitelist where ` + activeWhitelist + ` order by email`)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+
+	res := []*whitelistEntry{}
+	for rows.Next() {
+		e := &whitelistEntry{}
+		rows.Scan(&e.Email, &e.Expires, &e.Sponsor, &e.Note, &e.Modified)
+		res = append(res, e)
+	}
+	return res
+}
+
+// validateWhitelistEntry checks an entry received from a client, canonicalizing it in place.
+func validateWhitelistEntry(e *whitelistEntry) error {
+	if e.Expires != "" {
+		t, err := time.Parse("2006-01-02", e.Expires)
+		if err != nil {
+			return errors.New("expiry must be a date, as YYYY-MM-DD")
+		}
+		if t.Before(time.Now().UTC().Truncate(24 * time.Hour)) {
+			return errors.New("expiry may not be in the past")
+		}
+	}
+	if e.Sponsor != "" {
+		sponsor, err := validate.Email(e.Sponsor)
+		if err != nil {
+			return fmt.Errorf("bad sponsor: %s", err)
+		}
+		e.Sponsor = sponsor
+	}
+	if strings.TrimSpace(e.Note) != "" {
+		note, err := validate.Description(e.Note) // same rules as a description, since it ends up in events
+		if err != nil {
+			return fmt.Errorf("bad note: %s", err)
+		}
+		e.Note = note
+	}
+	return nil
+}
+
+// describeWhitelistEntry renders an entry for the event log.
+func describeWhitelistEntry(e *whitelistEntry) string {
+	parts := []string{}
+	if e.Expires != "" {
+		parts = append(parts, "until "+e.Expires)
+	}
+	if e.Sponsor != "" {
+		parts = append(parts, fmt.Sprintf("sponsored by '%s'", e.Sponsor))
+	}
+	if e.Note != "" {
+		parts = append(parts, e.Note)
+	}
+	return strings.Join(parts, "; ")
+}
+
+// expireWhitelist removes entries whose last day has passed, revoking the certs of each such user
+// unless they're entitled to them some other way (i.e. by domain, or as an admin), and records each
+// in the event log.
+func expireWhitelist() error {
+	cxn := getDB()
+	defer cxn.Close()
+
+	rows, err := cxn.Query("select email, sponsor from whitelist where not " + activeWhitelist)
+	if err != nil {
+		return err
+	}
+	expired := []*whitelistEntry{}
+	for rows.Next() {
+		e := &whitelistEntry{}
+		rows.Scan(&e.Email, &e.Sponsor)
+		expired = append(expired, e)
+	}
+	rows.Close()
+	if len(expired) == 0 {
+		return nil
+	}
+
+	s := loadSettings()
+	admins := loadAdmins(cxn)
+	for _, e := range expired {
+		var revoked int64
+		if !isEntitled(e.Email, s, admins) {
+			res, err := cxn.Exec("update certs set revoked=datetime('now'), revoke_reason='affiliationChanged' where email=? and (revoked is null or revoke_reason=?)", e.Email, validate.CertificateHold)
+			if err != nil {
+				return err
+			}
+			if revoked, err = res.RowsAffected(); err != nil {
+				return err
+			}
+		}
+		if _, err = cxn.Exec("delete from whitelist where email=? and not "+activeWhitelist, e.Email); err != nil {
+			return err
+		}
+		value := fmt.Sprintf("%d certs revoked", revoked)
+		if e.Sponsor != "" {
+			value += fmt.Sprintf(" (sponsored by '%s')", e.Sponsor)
+		}
+		if _, err = cxn.Exec("insert into events (event, email, value) values (?, ?, ?)", "whitelist expired", e.Email, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package validate normalizes and checks the user-supplied values that Bifröst and Heimdall store
+// and pass around: emails, domains, certificate fingerprints, device descriptions, and revocation
+// reasons. Both servers use it, so that a value accepted by one is always accepted by the other.
+//
+// Each function returns the canonical form of its input, or an error suitable for showing to a
+// user. Callers should store and compare only canonical forms.
+package validate
+
+import (
+	"errors"
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MaxDescriptionLength is the longest device description accepted, in characters.
+const MaxDescriptionLength = 64
+
+// maxEmailLength is the RFC 5321 limit on a forward-path
+const maxEmailLength = 254
+
+// CertificateHold is the revocation reason for a cert that is suspended rather than revoked for
+// good; unlike any other reason, it can be released.
+const CertificateHold = "certificateHold"
+
+// revocationReasons are the RFC 5280 CRLReason names a user or admin may give (codes 0, 1, 3, 4, 5,
+// 6 and 9); cACompromise, removeFromCRL and aACompromise don't apply to a single client cert.
+var revocationReasons = []string{
+	"unspecified", "keyCompromise", "affiliationChanged", "superseded", "cessationOfOperation",
+	CertificateHold, "privilegeWithdrawn",
+}
+
+var (
+	domainLabelRegex = regexp.MustCompile("^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$")
+	fingerprintRegex = regexp.MustCompile("^[0-9a-fA-F]{64}$")
+)
+
+// Email returns the canonical (trimmed, lower-case) form of a bare email address such as
+// "alice@example.com". Display names ("Alice <alice@example.com>") are rejected.
+func Email(s string) (string, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return "", errors.New("email address is missing")
+	}
+	if len(s) > maxEmailLength {
+		return "", errors.New("email address is too long")
+	}
+	addr, err := mail.ParseAddress(s)
+	if err != nil || addr.Name != "" || addr.Address != s {
+		return "", errors.New("'" + s + "' is not a valid email address")
+	}
+	at := strings.LastIndex(s, "@")
+	if at < 1 {
+		return "", errors.New("'" + s + "' is not a valid email address")
+	}
+	if _, err = Domain(s[at+1:]); err != nil {
+		return "", errors.New("'" + s + "' does not have a valid domain")
+	}
+	return s, nil
+}
+
+// Domain returns the canonical (trimmed, lower-case) form of a DNS domain name such as
+// "example.com". A leading "@" is tolerated and removed.
+func Domain(s string) (string, error) {
+	s = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(s)), "@")
+	if s == "" {
+		return "", errors.New("domain is missing")
+	}
+	if len(s) > 253 {
+		return "", errors.New("domain is too long")
+	}
+	labels := strings.Split(s, ".")
+	if len(labels) < 2 {
+		return "", errors.New("'" + s + "' is not a fully-qualified domain")
+	}
+	for _, label := range labels {
+		if !domainLabelRegex.MatchString(label) {
+			return "", errors.New("'" + s + "' is not a valid domain")
+		}
+	}
+	return s, nil
+}
+
+// Fingerprint checks that s is a hex SHA-256 certificate fingerprint, as stored by Heimdall.
+// Colons (as in OpenVPN's tls_digest_sha256) are removed; case is left alone, since fingerprints
+// are compared exactly.
+func Fingerprint(s string) (string, error) {
+	s = strings.Replace(strings.TrimSpace(s), ":", "", -1)
+	if s == "" {
+		return "", errors.New("fingerprint is missing")
+	}
+	if !fingerprintRegex.MatchString(s) {
+		return "", errors.New("fingerprint must be 64 hexadecimal digits")
+	}
+	return s, nil
+}
+
+// Description returns the canonical (trimmed) form of a device description. Descriptions end up in
+// emails and event logs, so they must be a single line of printable text of reasonable length.
+func Description(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", errors.New("description is missing")
+	}
+	if !utf8.ValidString(s) {
+		return "", errors.New("description is not valid text")
+	}
+	if utf8.RuneCountInString(s) > MaxDescriptionLength {
+		return "", errors.New("description is too long")
+	}
+	for _, r := range s {
+		if !unicode.IsPrint(r) && r != ' ' {
+			return "", errors.New("description may not contain line breaks or control characters")
+		}
+	}
+	return s, nil
+}
+
+// RevocationReason returns the canonical form of an RFC 5280 revocation reason, such as
+// "keyCompromise". Case is ignored, and "" means "unspecified".
+func RevocationReason(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "unspecified", nil
+	}
+	for _, name := range revocationReasons {
+		if strings.EqualFold(name, s) {
+			return name, nil
+		}
+	}
+	return "", errors.New("'" + s + "' is not a revocation reason")
+}
@@ -0,0 +1,122 @@
+// Copyright © 2018 Playground Global, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validate
+
+import (
+	"strings"
+	"testing"
+)
+
+// testCase is an input, and its canonical form; want == "" means the input must be rejected.
+type testCase struct {
+	in, want string
+}
+
+func check(t *testing.T, name string, f func(string) (string, error), cases []testCase) {
+	for _, c := range cases {
+		got, err := f(c.in)
+		switch {
+		case c.want == "" && err == nil:
+			t.Errorf("%s(%q) = %q; want an error", name, c.in, got)
+		case c.want != "" && err != nil:
+			t.Errorf("%s(%q) failed: %s; want %q", name, c.in, err, c.want)
+		case got != c.want:
+			t.Errorf("%s(%q) = %q; want %q", name, c.in, got, c.want)
+		}
+	}
+}
+
+func TestEmail(t *testing.T) {
+	check(t, "Email", Email, []testCase{
+		{"alice@example.com", "alice@example.com"},
+		{"  Alice@Example.COM\n", "alice@example.com"},
+		{"alice.b+vpn@corp.example.com", "alice.b+vpn@corp.example.com"},
+		{"", ""},
+		{"   ", ""},
+		{"alice", ""},
+		{"@example.com", ""},
+		{"alice@", ""},
+		{"alice@localhost", ""},
+		{"alice@exa_mple.com", ""},
+		{"Alice <alice@example.com>", ""},
+		{"alice@example.com, bob@example.com", ""},
+		{strings.Repeat("a", 250) + "@example.com", ""},
+	})
+}
+
+func TestDomain(t *testing.T) {
+	check(t, "Domain", Domain, []testCase{
+		{"example.com", "example.com"},
+		{" @Example.COM ", "example.com"},
+		{"corp-1.example.co.uk", "corp-1.example.co.uk"},
+		{"", ""},
+		{"@", ""},
+		{"example", ""},
+		{"-example.com", ""},
+		{"example-.com", ""},
+		{"example..com", ""},
+		{"exa mple.com", ""},
+		{"*.example.com", ""},
+		{strings.Repeat("a", 64) + ".com", ""},
+		{strings.Repeat("a.", 127) + "com", ""},
+	})
+}
+
+func TestFingerprint(t *testing.T) {
+	hex := strings.Repeat("0123456789abcDEF", 4)
+	colons := []string{}
+	for i := 0; i < len(hex); i += 2 {
+		colons = append(colons, hex[i:i+2])
+	}
+	check(t, "Fingerprint", Fingerprint, []testCase{
+		{hex, hex},
+		{" " + hex + "\n", hex},
+		{strings.Join(colons, ":"), hex},
+		{"", ""},
+		{hex[1:], ""},
+		{hex + "0", ""},
+		{strings.Replace(hex, "a", "g", 1), ""},
+	})
+}
+
+func TestDescription(t *testing.T) {
+	check(t, "Description", Description, []testCase{
+		{"laptop", "laptop"},
+		{"  Alice's laptop  ", "Alice's laptop"},
+		{"Größe Telefon ☎", "Größe Telefon ☎"},
+		{strings.Repeat("é", MaxDescriptionLength), strings.Repeat("é", MaxDescriptionLength)},
+		{"", ""},
+		{" \t ", ""},
+		{strings.Repeat("x", MaxDescriptionLength+1), ""},
+		{"two\nlines", ""},
+		{"tab\there", ""},
+		{"bell\x07", ""},
+		{"bad \xff utf-8", ""},
+	})
+}
+
+func TestRevocationReason(t *testing.T) {
+	check(t, "RevocationReason", RevocationReason, []testCase{
+		{"", "unspecified"},
+		{"  ", "unspecified"},
+		{"keyCompromise", "keyCompromise"},
+		{" KEYCOMPROMISE ", "keyCompromise"},
+		{"certificatehold", CertificateHold},
+		{"privilegeWithdrawn", "privilegeWithdrawn"},
+		{"cACompromise", ""},
+		{"removeFromCRL", ""},
+		{"lost", ""},
+	})
+}
@@ -24,15 +24,57 @@ function str(s) {
   return "";
 }
 
+// describes the users a whitelist or domain change took away access from, for the error modal;
+// null if there were none
+function lostAccess(artifact) {
+  if (!artifact.LostAccess || artifact.LostAccess.length < 1) {
+    return null;
+  }
+  let message = artifact.LostAccess.length + " users with devices lost access.";
+  if (artifact.Revoked > 0) {
+    message = artifact.LostAccess.length + " users lost access, and " + artifact.Revoked + " of their devices were revoked.";
+  }
+  return { Message: message, Extra: artifact.LostAccess.join(", "), Recoverable: true };
+}
+
+// converts between the UTC timestamps the API uses and the browser's local time, as shown by and
+// entered in datetime-local inputs
+function localTime(ts) {
+  return new Date(ts).toLocaleString();
+}
+function utcTime(local) {
+  return new Date(local).toISOString().replace(/\.\d+Z$/, "Z");
+}
+
 const globals = {
   IsAdmin: false,
   IsAllowed: false,
+  Role: "",
+  Can: { },
+  CanElevate: false,
+  ElevatedUntil: "",
   ServiceName: "Bifröst VPN",
   MaxClients: 2,
+  Profiles: [],
+  Suspended: false,
+  SuspendedUntil: "",
+  Lockdown: false,
   DefaultPath: "",
 };
 
+// RFC 5280 revocation reasons offered when deactivating a device; certificateHold can be undone
+const revocationReasons = [
+  { Reason: "unspecified", Label: "No particular reason" },
+  { Reason: "cessationOfOperation", Label: "Device no longer in use" },
+  { Reason: "superseded", Label: "Replaced by another device" },
+  { Reason: "keyCompromise", Label: "Device or its VPN file may be in someone else's hands" },
+  { Reason: "affiliationChanged", Label: "Owner's affiliation changed" },
+  { Reason: "privilegeWithdrawn", Label: "Access withdrawn" },
+  { Reason: "certificateHold", Label: "Put on hold (e.g. device misplaced), to be reactivated later" },
+];
+
 const generalError = { Message: "An error occurred in this app.", Extra: "Please reload this page.", Recoverable: false };
+const awaitingApproval = { Message: "Your change is awaiting approval.", Extra: "Another admin must approve it on the Approvals page before it takes effect.", Recoverable: true };
 
 const sorry = Vue.component('sorry', {
   template: "#sorry",
@@ -45,6 +87,7 @@ const users = Vue.component('users', {
   data: function() {
     return {
       users: [],
+      revocations: [],
       xhrPending: false,
       error: { },
     };
@@ -54,6 +97,7 @@ const users = Vue.component('users', {
     details: function(email) {
       this.$router.push("/users/" + email);
     },
+    localTime: localTime,
   },
   mounted: function() {
     this.xhrPending = true;
@@ -68,6 +112,92 @@ const users = Vue.component('users', {
       this.xhrPending = false;
       this.error = err.response.data.Error ? err.response.data.Error : generalError;
     });
+    axios.get("/api/revocations").then((res) => {
+      if (res.data.Artifact) {
+        this.revocations = res.data.Artifact.Revocations;
+      }
+    });
+  },
+});
+
+const massRevoke = Vue.component('mass-revoke', {
+  template: "#mass-revoke",
+  props: ["globals"],
+  data: function() {
+    return {
+      since: "",
+      until: "",
+      domain: "",
+      issuer: "",
+      description: "",
+      all: false,
+      reason: "keyCompromise",
+      reasons: revocationReasons.filter(r => r.Reason != "certificateHold"),
+      disconnect: true,
+      preview: null,
+      result: null,
+      confirming: false,
+      xhrPending: false,
+      error: { },
+    };
+  },
+  methods: {
+    clearError: function() { this.error = { }; },
+    request: function(digest) {
+      let body = { All: this.all, Reason: this.reason, Digest: digest, Disconnect: this.disconnect };
+      if (!this.all) { // the other criteria are only disabled, not cleared
+        body.Since = this.since ? utcTime(this.since) : "";
+        body.Until = this.until ? utcTime(this.until) : "";
+        body.Domain = this.domain;
+        body.Issuer = this.issuer;
+        body.Description = this.description;
+      }
+      return body;
+    },
+    doPreview: function() {
+      this.result = null;
+      this.xhrPending = true;
+      axios.post("/api/massrevoke", this.request("")).then((res) => {
+        this.xhrPending = false;
+        if (res.data.Artifact) {
+          this.preview = res.data.Artifact;
+        } else {
+          this.error = res.data.Error ? res.data.Error : generalError;
+        }
+      }).catch((err) => {
+        this.xhrPending = false;
+        this.error = err.response.data.Error ? err.response.data.Error : generalError;
+      });
+    },
+    clearPreview: function() {
+      this.preview = null;
+      this.confirming = false;
+    },
+    revoke: function() {
+      this.confirming = false;
+      this.xhrPending = true;
+      axios.post("/api/massrevoke", this.request(this.preview.Digest)).then((res) => {
+        this.xhrPending = false;
+        this.preview = null;
+        if (res.status == 202) {
+          this.error = awaitingApproval;
+          return;
+        }
+        if (res.data.Artifact) {
+          this.result = res.data.Artifact;
+          if (this.result.SessionsEnded < 0) {
+            this.error = { Message: "The devices were deactivated, but VPN sessions could not be ended.", Extra: "Check the OpenVPN server.", Recoverable: true };
+          }
+        } else {
+          this.error = res.data.Error ? res.data.Error : generalError;
+        }
+      }).catch((err) => {
+        this.xhrPending = false;
+        this.preview = null;
+        this.error = err.response.data.Error ? err.response.data.Error : generalError;
+      });
+    },
+    localTime: localTime,
   },
 });
 
@@ -77,7 +207,11 @@ const userWhitelist = Vue.component('user-whitelist', {
   data: function() {
     return {
       users: [],
+      entries: [],
       whitelistAdd: "",
+      whitelistExpires: "",
+      whitelistNote: "",
+      revoke: false,
       xhrPending: false,
       error: { },
     };
@@ -85,9 +219,11 @@ const userWhitelist = Vue.component('user-whitelist', {
   methods: {
     clearError: function() { this.error = { }; },
     remove: function(email) {
-      axios.delete("/api/whitelist/" + email).then((res) => {
+      axios.delete("/api/whitelist/" + email + (this.revoke ? "?revoke=true" : "")).then((res) => {
         if (res.data.Artifact) {
           this.users = res.data.Artifact.Users;
+          this.entries = res.data.Artifact.Entries;
+          this.error = lostAccess(res.data.Artifact) || { };
         } else {
           this.error = res.data.Error ? res.data.Error : generalError;
         }
@@ -96,9 +232,11 @@ const userWhitelist = Vue.component('user-whitelist', {
       });
     },
     addUser: function() {
-      axios.put("/api/whitelist/" + this.whitelistAdd).then((res) => {
+      let body = { Expires: this.whitelistExpires, Note: this.whitelistNote };
+      axios.put("/api/whitelist/" + this.whitelistAdd, body).then((res) => {
         if (res.data.Artifact) {
           this.users = res.data.Artifact.Users;
+          this.entries = res.data.Artifact.Entries;
         } else {
           this.error = res.data.Error ? res.data.Error : generalError;
         }
@@ -106,12 +244,87 @@ const userWhitelist = Vue.component('user-whitelist', {
         this.error = err.response.data.Error ? err.response.data.Error : generalError;
       });
       this.whitelistAdd = "";
+      this.whitelistExpires = "";
+      this.whitelistNote = "";
     },
   },
   mounted: function() {
     axios.get("/api/whitelist").then((res) => {
       if (res.data.Artifact) {
         this.users = res.data.Artifact.Users;
+        this.entries = res.data.Artifact.Entries;
+      } else {
+        this.error = res.data.Error ? res.data.Error : generalError;
+      }
+    }).catch((err) => {
+      this.error = err.response.data.Error ? err.response.data.Error : generalError;
+    });
+  },
+});
+
+const lockdown = Vue.component('lockdown', {
+  template: "#lockdown",
+  props: ["globals"],
+  data: function() {
+    return {
+      current: { Enabled: false },
+      reason: "",
+      breakGlass: "",
+      disconnect: false,
+      confirming: false,
+      xhrPending: false,
+      error: { },
+    };
+  },
+  methods: {
+    clearError: function() { this.error = { }; },
+    show: function(l) {
+      this.current = l;
+      this.reason = str(l.Reason);
+      this.breakGlass = l.BreakGlass ? l.BreakGlass.join(" ") : "";
+      this.disconnect = false;
+      globals.Lockdown = l.Enabled;
+    },
+    apply: function() {
+      let breakGlass = str(this.breakGlass).split(/[\s,]+/).filter(e => e != "");
+      let body = { Reason: this.reason, BreakGlass: breakGlass, Disconnect: this.disconnect };
+      this.confirming = false;
+      this.xhrPending = true;
+      axios.put("/api/lockdown", body).then((res) => {
+        this.xhrPending = false;
+        if (res.data.Artifact) {
+          this.show(res.data.Artifact);
+          if (res.data.Artifact.SessionsEnded < 0) {
+            this.error = { Message: "The service is locked down, but VPN sessions could not be ended.", Extra: "Check the OpenVPN server.", Recoverable: true };
+          }
+        } else {
+          this.error = res.data.Error ? res.data.Error : generalError;
+        }
+      }).catch((err) => {
+        this.xhrPending = false;
+        this.error = err.response.data.Error ? err.response.data.Error : generalError;
+      });
+    },
+    lift: function() {
+      this.xhrPending = true;
+      axios.delete("/api/lockdown").then((res) => {
+        this.xhrPending = false;
+        if (res.data.Artifact) {
+          this.show(res.data.Artifact);
+        } else {
+          this.error = res.data.Error ? res.data.Error : generalError;
+        }
+      }).catch((err) => {
+        this.xhrPending = false;
+        this.error = err.response.data.Error ? err.response.data.Error : generalError;
+      });
+    },
+    localTime: localTime,
+  },
+  mounted: function() {
+    axios.get("/api/lockdown").then((res) => {
+      if (res.data.Artifact) {
+        this.show(res.data.Artifact);
       } else {
         this.error = res.data.Error ? res.data.Error : generalError;
       }
@@ -131,6 +344,17 @@ const settings = Vue.component('settings', {
         this.clientLimit = res.data.Artifact.ClientLimit;
         this.clientCertDuration = res.data.Artifact.IssuedCertDuration;
         this.whitelistedDomains = res.data.Artifact.WhitelistedDomains;
+        this.rateLimitWindow = res.data.Artifact.RateLimitWindow;
+        this.issueLimitPerUser = res.data.Artifact.IssueLimitPerUser;
+        this.issueLimitGlobal = res.data.Artifact.IssueLimitGlobal;
+        this.revokeLimitPerUser = res.data.Artifact.RevokeLimitPerUser;
+        this.revokeLimitGlobal = res.data.Artifact.RevokeLimitGlobal;
+        this.totpLimitPerUser = res.data.Artifact.TOTPLimitPerUser;
+        this.totpLimitGlobal = res.data.Artifact.TOTPLimitGlobal;
+        this.dormancyDays = res.data.Artifact.DormancyDays;
+        this.dormancyWarningDays = res.data.Artifact.DormancyWarningDays;
+        this.keyAlgorithm = res.data.Artifact.KeyAlgorithm;
+        this.signatureHash = res.data.Artifact.SignatureHash;
       } else {
         this.error = res.data.Error ? res.data.Error : generalError;
       }
@@ -144,6 +368,18 @@ const settings = Vue.component('settings', {
       clientLimit: "",
       clientCertDuration: "",
       whitelistedDomains: "",
+      rateLimitWindow: "",
+      issueLimitPerUser: "",
+      issueLimitGlobal: "",
+      revokeLimitPerUser: "",
+      revokeLimitGlobal: "",
+      totpLimitPerUser: "",
+      totpLimitGlobal: "",
+      dormancyDays: "",
+      dormancyWarningDays: "",
+      keyAlgorithm: "",
+      signatureHash: "",
+      revoke: false,
       xhrPending: false,
       error: { },
     };
@@ -160,6 +396,17 @@ const settings = Vue.component('settings', {
         ClientLimit: parseInt(this.clientLimit),
         IssuedCertDuration: parseInt(this.clientCertDuration),
         WhitelistedDomains: whitelistedDomains,
+        RateLimitWindow: parseInt(this.rateLimitWindow),
+        IssueLimitPerUser: parseInt(this.issueLimitPerUser),
+        IssueLimitGlobal: parseInt(this.issueLimitGlobal),
+        RevokeLimitPerUser: parseInt(this.revokeLimitPerUser),
+        RevokeLimitGlobal: parseInt(this.revokeLimitGlobal),
+        TOTPLimitPerUser: parseInt(this.totpLimitPerUser),
+        TOTPLimitGlobal: parseInt(this.totpLimitGlobal),
+        DormancyDays: parseInt(this.dormancyDays),
+        DormancyWarningDays: parseInt(this.dormancyWarningDays),
+        KeyAlgorithm: this.keyAlgorithm,
+        SignatureHash: this.signatureHash,
       };
       if (payload.ClientLimit == NaN) {
         this.error = {Message: "Max clients must be a number.", Extra: "", Recoverable: true};
@@ -169,7 +416,26 @@ const settings = Vue.component('settings', {
         this.error = {Message: "Refresh period must be a number.", Extra: "", Recoverable: true};
         return;
       }
-      axios.put("/api/config", json=payload).then((res) => {
+      for (let k of ["RateLimitWindow", "IssueLimitPerUser", "IssueLimitGlobal", "RevokeLimitPerUser", "RevokeLimitGlobal", "TOTPLimitPerUser", "TOTPLimitGlobal"]) {
+        if (isNaN(payload[k])) {
+          this.error = {Message: "Rate limits must be numbers.", Extra: "Use 0 for no limit.", Recoverable: true};
+          return;
+        }
+      }
+      if (isNaN(payload.DormancyDays) || isNaN(payload.DormancyWarningDays)) {
+        this.error = {Message: "Dormancy periods must be numbers.", Extra: "Use 0 to never deactivate unused devices.", Recoverable: true};
+        return;
+      }
+      axios.put("/api/config" + (this.revoke ? "?revoke=true" : ""), json=payload).then((res) => {
+        if (res.status == 202) {
+          this.error = awaitingApproval;
+          return;
+        }
+        let lost = lostAccess(res.data.Artifact);
+        if (lost) {
+          this.error = lost;
+          return;
+        }
         this.$router.push(globals.DefaultPath);
         document.location.reload();
       }).catch((err) => {
@@ -185,17 +451,43 @@ const devices = Vue.component('devices', {
   data: function() {
     return {
       certs: [],
+      heldCerts: [],
+      reasons: revocationReasons,
       victim: "",
       victimDesc: "",
+      victimReason: "unspecified",
+      reissueDesc: "",
+      renewing: null,
+      renewCSR: "",
+      ovpn: "",
+      pendingServer: false,
+      reporting: false,
+      lost: [],
+      lostTOTP: false,
+      lostNote: "",
+      lostImgURL: "",
       xhrPending: "",
       error: { },
     };
   },
+  computed: {
+    needsReissue: function() {
+      return this.certs.some((c) => c.ReissueBy);
+    },
+    deviceCount: function() {
+      return this.certs.filter((c) => !c.ReplacedBy).length + this.heldCerts.length;
+    },
+    filename: function() {
+      return this.reissueDesc + ".ovpn";
+    },
+  },
   methods: {
     clearError: function() { this.error = { }; },
+    localTime: localTime,
     revoke: function(fingerprint) {
       this.victimDesc = "";
-      for (let c of this.certs) {
+      this.victimReason = "unspecified";
+      for (let c of this.certs.concat(this.heldCerts)) {
         if (c.Fingerprint == fingerprint) {
           this.victimDesc = c.Description;
           break;
@@ -213,7 +505,7 @@ const devices = Vue.component('devices', {
     },
     doRevoke: function(fingerprint) {
       this.xhrPending = true;
-      axios.delete("/api/certs/" + fingerprint).then((res) => {
+      axios.delete("/api/certs/" + fingerprint + "?reason=" + this.victimReason).then((res) => {
         this.xhrPending = false;
         this.clearRevoke();
         this.loadCerts();
@@ -222,15 +514,111 @@ const devices = Vue.component('devices', {
         this.error = err.response.data.Error ? err.response.data.Error : generalError;
       });   
     },
+    release: function(fingerprint) {
+      this.xhrPending = true;
+      axios.put("/api/certs/" + fingerprint).then((res) => {
+        this.xhrPending = false;
+        this.loadCerts();
+      }).catch((err) => {
+        this.xhrPending = false;
+        this.error = err.response.data.Error ? err.response.data.Error : generalError;
+      });
+    },
+    reportLost: function() {
+      this.lost = [];
+      this.lostTOTP = false;
+      this.lostNote = "";
+      this.reporting = true;
+    },
+    clearLost: function() {
+      this.reporting = false;
+      this.lostImgURL = "";
+    },
+    doReportLost: function() {
+      let payload = { Fingerprints: this.lost, RotateTOTP: this.lostTOTP, Note: this.lostNote };
+      this.xhrPending = true;
+      axios.post("/api/lost", json=payload).then((res) => {
+        this.xhrPending = false;
+        if (!res.data.Artifact) {
+          this.error = res.data.Error ? res.data.Error : generalError;
+          return;
+        }
+        this.loadCerts();
+        if (res.data.Artifact.ImageURL) {
+          this.lostImgURL = res.data.Artifact.ImageURL;
+        } else {
+          this.clearLost();
+        }
+      }).catch((err) => {
+        this.xhrPending = false;
+        this.error = err.response.data.Error ? err.response.data.Error : generalError;
+      });
+    },
     addDevice: function() {
       this.$router.push("/newdevice");
     },
+    reissue: function(cert) {
+      let payload = { "Description": cert.Description, "Replaces": cert.Fingerprint };
+      this.reissueDesc = cert.Description;
+      this.pendingServer = true;
+      axios.post("/api/certs", json=payload).then((res) => {
+        if (res.data.Artifact) {
+          this.ovpn = res.data.Artifact.OVPNDataURL;
+        } else {
+          this.pendingServer = false;
+          this.error = res.data.Error ? res.data.Error : generalError;
+        }
+      }).catch((err) => {
+        this.pendingServer = false;
+        this.error = err.response.data.Error ? err.response.data.Error : generalError;
+      });
+    },
+    renew: function(cert) {
+      if (cert.FromCSR) { // i.e. the device keeps its own key, so it needs a new CSR
+        this.renewCSR = "";
+        this.renewing = cert;
+        return;
+      }
+      this.doRenew(cert, "");
+    },
+    clearRenew: function() {
+      this.renewing = null;
+      this.renewCSR = "";
+    },
+    doRenew: function(cert, csr) {
+      if (cert.FromCSR && str(csr) == "") {
+        this.error = { Message: "You must paste a certificate signing request.", Extra: "", Recoverable: true};
+        return;
+      }
+      this.clearRenew();
+      this.reissueDesc = cert.Description;
+      this.pendingServer = true;
+      let payload = csr ? { "CSR": csr } : {};
+      axios.post("/api/certs/" + cert.Fingerprint, json=payload).then((res) => {
+        if (res.data.Artifact) {
+          this.ovpn = res.data.Artifact.OVPNDataURL;
+        } else {
+          this.pendingServer = false;
+          this.error = res.data.Error ? res.data.Error : generalError;
+        }
+      }).catch((err) => {
+        this.pendingServer = false;
+        this.error = err.response.data.Error ? err.response.data.Error : generalError;
+      });
+    },
+    doneReissue: function() {
+      this.pendingServer = false;
+      this.ovpn = "";
+      this.reissueDesc = "";
+      this.loadCerts();
+    },
     loadCerts: function() {
       this.xhrPending = true;
       axios.get("/api/certs").then((res) => {
         this.xhrPending = false;
         if (res.data.Artifact) {
           this.certs = res.data.Artifact.Certs;
+          this.heldCerts = res.data.Artifact.HeldCerts ? res.data.Artifact.HeldCerts : [];
         } else {
           this.error = res.data.Error ? res.data.Error : generalError;
         }
@@ -251,6 +639,9 @@ const newDevice = Vue.component('new-device', {
   data: function() {
     return {
       desc: "",
+      profile: "",
+      useCSR: false,
+      csr: "",
       pendingServer: false,
       ovpn: "",
       xhrPending: false,
@@ -269,7 +660,14 @@ const newDevice = Vue.component('new-device', {
         this.error = { Message: "You must enter a description.", Extra: "", Recoverable: true};
         return;
       }
-      let payload = { "Description": this.desc };
+      if (this.useCSR && str(this.csr) == "") {
+        this.error = { Message: "You must paste a certificate signing request.", Extra: "", Recoverable: true};
+        return;
+      }
+      let payload = { "Description": this.desc, "Profile": this.profile };
+      if (this.useCSR) {
+        payload.CSR = this.csr;
+      }
       this.pendingServer = true;
       axios.post("/api/certs", json=payload).then((res) => {
         if (res.data.Artifact) {
@@ -286,6 +684,7 @@ const newDevice = Vue.component('new-device', {
       this.pendingServer = false;
       this.ovpn = "";
       this.desc = "";
+      this.csr = "";
       this.$router.push(globals.DefaultPath);
     },
   },
@@ -297,10 +696,26 @@ const userDetails = Vue.component('user-details', {
   data: function() {
     return {
       activeCerts: [],
+      heldCerts: [],
+      reasons: revocationReasons,
+      aliases: [],
+      limits: { },
+      clientLimit: "",
+      certDuration: "",
+      suspension: null,
+      suspendReason: "",
+      suspendUntil: "",
+      revocations: [],
+      resetWhen: "",
       showDeleteConfirm: false,
+      showRename: false,
+      newEmail: "",
+      graceDays: 14,
       showRevokeConfirm: false,
       revocationVictim: "",
       revocationVictimDesc: "",
+      revocationReason: "unspecified",
+      revocationWhen: "",
       xhrPending: false,
       error: { },
     };
@@ -308,14 +723,51 @@ const userDetails = Vue.component('user-details', {
   methods: {
     clearError: function() { this.error = { }; },
     deleteUser: function() {
+      this.resetWhen = "";
       this.showDeleteConfirm = true;
     },
     cancelDeleteUser: function() {
       this.showDeleteConfirm = false;
     },
+    renameUser: function() {
+      this.newEmail = "";
+      this.graceDays = 14;
+      this.showRename = true;
+    },
+    cancelRenameUser: function() {
+      this.showRename = false;
+    },
+    doRenameUser: function() {
+      let payload = { "Email": str(this.newEmail).trim(), "GraceDays": parseInt(this.graceDays) };
+      if (payload.Email == "") {
+        this.error = { Message: "You must enter the user's new email address.", Extra: "", Recoverable: true};
+        return;
+      }
+      if (isNaN(payload.GraceDays) || payload.GraceDays < 0) {
+        this.error = { Message: "The grace period must be a number of days.", Extra: "", Recoverable: true};
+        return;
+      }
+      axios.post("/api/rename/" + this.email, json=payload).then((res) => {
+        if (res.data.Artifact) {
+          this.showRename = false;
+          this.$router.replace("/users/" + res.data.Artifact.Email);
+        } else {
+          this.error = res.data.Error ? res.data.Error : generalError;
+        }
+      }).catch((err) => {
+        this.error = err.response.data.Error ? err.response.data.Error : generalError;
+      });
+    },
     doDeleteUser: function() {
+      if (this.resetWhen != "") {
+        this.schedule({ "Email": this.email, "Fingerprint": "", "Reason": "", "Due": utcTime(this.resetWhen) });
+        return;
+      }
       axios.delete("/api/users/" + this.email).then((res) => {
-        if (res.data.Artifact) {
+        if (res.status == 202) {
+          this.showDeleteConfirm = false;
+          this.error = awaitingApproval;
+        } else if (res.data.Artifact) {
           this.$router.replace(this.globals.DefaultPath);
         } else {
           this.error = res.data.Error ? res.data.Error : generalError;
@@ -326,7 +778,9 @@ const userDetails = Vue.component('user-details', {
     },
     revoke: function(fingerprint) {
       this.revocationVictimDesc = "";
-      for (let c of this.activeCerts) {
+      this.revocationReason = "unspecified";
+      this.revocationWhen = "";
+      for (let c of this.activeCerts.concat(this.heldCerts)) {
         if (c.Fingerprint == fingerprint) {
           this.revocationVictimDesc = c.Description;
           break;
@@ -346,7 +800,11 @@ const userDetails = Vue.component('user-details', {
       this.showRevokeConfirm = false;
     },
     doRevoke: function() {
-      axios.delete("/api/certs/" + this.revocationVictim).then((res) => {
+      if (this.revocationWhen != "") {
+        this.schedule({ "Email": this.email, "Fingerprint": this.revocationVictim, "Reason": this.revocationReason, "Due": utcTime(this.revocationWhen) });
+        return;
+      }
+      axios.delete("/api/certs/" + this.revocationVictim + "?reason=" + this.revocationReason).then((res) => {
         if (res.data.Artifact) {
           this.clearRevoke();
           this.loadUserCerts();
@@ -357,10 +815,112 @@ const userDetails = Vue.component('user-details', {
         this.error = err.response.data.Error ? err.response.data.Error : generalError;
       });   
     },
+    schedule: function(payload) {
+      axios.post("/api/revocations", json=payload).then((res) => {
+        this.showDeleteConfirm = false;
+        this.clearRevoke();
+        if (res.status == 202) {
+          this.error = awaitingApproval;
+        } else if (res.data.Artifact) {
+          this.loadUserCerts();
+        } else {
+          this.error = res.data.Error ? res.data.Error : generalError;
+        }
+      }).catch((err) => {
+        this.error = err.response.data.Error ? err.response.data.Error : generalError;
+      });
+    },
+    cancelRevocation: function(id) {
+      axios.delete("/api/revocations/" + id).then((res) => {
+        if (res.data.Artifact) {
+          this.loadUserCerts();
+        } else {
+          this.error = res.data.Error ? res.data.Error : generalError;
+        }
+      }).catch((err) => {
+        this.error = err.response.data.Error ? err.response.data.Error : generalError;
+      });
+    },
+    deviceName: function(fingerprint) {
+      for (let c of this.activeCerts.concat(this.heldCerts)) {
+        if (c.Fingerprint == fingerprint) {
+          return c.Description;
+        }
+      }
+      return fingerprint.substring(0, 12);
+    },
+    localTime: localTime,
+    release: function(fingerprint) {
+      axios.put("/api/certs/" + fingerprint).then((res) => {
+        if (res.data.Artifact) {
+          this.loadUserCerts();
+        } else {
+          this.error = res.data.Error ? res.data.Error : generalError;
+        }
+      }).catch((err) => {
+        this.error = err.response.data.Error ? err.response.data.Error : generalError;
+      });
+    },
+    showLimits: function(limits) {
+      this.limits = limits;
+      this.clientLimit = limits.ClientLimit === null ? "" : String(limits.ClientLimit);
+      this.certDuration = limits.IssuedCertDuration === null ? "" : String(limits.IssuedCertDuration);
+    },
+    saveLimits: function() {
+      let parse = (v) => String(v).trim() == "" ? null : parseInt(v);
+      let payload = { "ClientLimit": parse(this.clientLimit), "IssuedCertDuration": parse(this.certDuration) };
+      if ((payload.ClientLimit !== null && isNaN(payload.ClientLimit)) || (payload.IssuedCertDuration !== null && isNaN(payload.IssuedCertDuration))) {
+        this.error = { Message: "Limits must be numbers, or blank for the defaults.", Extra: "", Recoverable: true};
+        return;
+      }
+      axios.put("/api/users/" + this.email, json=payload).then((res) => {
+        if (res.data.Artifact) {
+          this.showLimits(res.data.Artifact);
+        } else {
+          this.error = res.data.Error ? res.data.Error : generalError;
+        }
+      }).catch((err) => {
+        this.error = err.response.data.Error ? err.response.data.Error : generalError;
+      });
+    },
+    suspend: function() {
+      let payload = { "Reason": str(this.suspendReason).trim(), "Until": str(this.suspendUntil).trim() };
+      if (payload.Reason == "") {
+        this.error = { Message: "You must give a reason for the suspension.", Extra: "", Recoverable: true};
+        return;
+      }
+      axios.put("/api/suspensions/" + this.email, json=payload).then((res) => {
+        if (res.data.Artifact) {
+          this.loadUserCerts();
+        } else {
+          this.error = res.data.Error ? res.data.Error : generalError;
+        }
+      }).catch((err) => {
+        this.error = err.response.data.Error ? err.response.data.Error : generalError;
+      });
+    },
+    unsuspend: function() {
+      axios.delete("/api/suspensions/" + this.email).then((res) => {
+        if (res.data.Artifact) {
+          this.loadUserCerts();
+        } else {
+          this.error = res.data.Error ? res.data.Error : generalError;
+        }
+      }).catch((err) => {
+        this.error = err.response.data.Error ? err.response.data.Error : generalError;
+      });
+    },
     loadUserCerts: function() {
       axios.get("/api/users/" + this.email).then((res) => {
         if (res.data.Artifact) {
           this.activeCerts = res.data.Artifact.ActiveCerts;
+          this.heldCerts = res.data.Artifact.HeldCerts ? res.data.Artifact.HeldCerts : [];
+          this.aliases = res.data.Artifact.Aliases;
+          this.showLimits(res.data.Artifact.Limits);
+          this.suspension = res.data.Artifact.Suspension;
+          this.revocations = res.data.Artifact.Revocations ? res.data.Artifact.Revocations : [];
+          this.suspendReason = this.suspension ? this.suspension.Reason : "";
+          this.suspendUntil = this.suspension ? this.suspension.Until : "";
         } else {
           this.error = res.data.Error ? res.data.Error : generalError;
         }
@@ -369,6 +929,11 @@ const userDetails = Vue.component('user-details', {
       });   
     },
   },
+  watch: {
+    email: function() {
+      this.loadUserCerts();
+    },
+  },
   mounted: function() {
     this.loadUserCerts();
   },
@@ -422,12 +987,251 @@ const totp = Vue.component('password', {
   },
 });
 
+const domains = Vue.component('domains', {
+  template: "#domains",
+  props: [ "globals" ],
+  data: function() {
+    return {
+      domains: [],
+      profiles: [],
+      editing: null,
+      revoke: false,
+      xhrPending: false,
+      error: { },
+    };
+  },
+  methods: {
+    clearError: function() { this.error = { }; },
+    update: function(req) {
+      this.xhrPending = true;
+      req.then((res) => {
+        this.xhrPending = false;
+        if (res.status == 202) {
+          this.editing = null;
+          this.error = awaitingApproval;
+        } else if (res.data.Artifact) {
+          this.editing = null;
+          this.domains = res.data.Artifact.Domains;
+          this.profiles = res.data.Artifact.Profiles;
+          this.error = lostAccess(res.data.Artifact) || { };
+        } else {
+          this.error = res.data.Error ? res.data.Error : generalError;
+        }
+      }).catch((err) => {
+        this.xhrPending = false;
+        this.error = err.response.data.Error ? err.response.data.Error : generalError;
+      });
+    },
+    edit: function(d) {
+      if (d) {
+        this.editing = { IsNew: false, Domain: d.Domain, Enabled: d.Enabled, Profiles: d.Profiles.slice(),
+          ClientLimit: d.ClientLimit === null ? "" : String(d.ClientLimit),
+          IssuedCertDuration: d.IssuedCertDuration === null ? "" : String(d.IssuedCertDuration) };
+      } else {
+        this.editing = { IsNew: true, Domain: "", Enabled: true, Profiles: [], ClientLimit: "", IssuedCertDuration: "" };
+      }
+    },
+    cancel: function() {
+      this.editing = null;
+    },
+    save: function() {
+      let parse = (v) => String(v).trim() == "" ? null : parseInt(v);
+      let payload = { "Enabled": this.editing.Enabled, "Profiles": this.profiles.filter((p) => this.editing.Profiles.includes(p)),
+        "ClientLimit": parse(this.editing.ClientLimit), "IssuedCertDuration": parse(this.editing.IssuedCertDuration) };
+      if (str(this.editing.Domain).trim() == "") {
+        this.error = { Message: "You must enter a domain.", Extra: "", Recoverable: true};
+        return;
+      }
+      if ((payload.ClientLimit !== null && isNaN(payload.ClientLimit)) || (payload.IssuedCertDuration !== null && isNaN(payload.IssuedCertDuration))) {
+        this.error = { Message: "Limits must be numbers, or blank for the defaults.", Extra: "", Recoverable: true};
+        return;
+      }
+      let revoke = this.revoke ? "?revoke=true" : "";
+      this.update(axios.put("/api/config/domains/" + str(this.editing.Domain).trim() + revoke, json=payload));
+    },
+    remove: function(domain) {
+      this.update(axios.delete("/api/config/domains/" + domain + (this.revoke ? "?revoke=true" : "")));
+    },
+  },
+  mounted: function() {
+    this.update(axios.get("/api/config/domains"));
+  },
+});
+
+const roles = Vue.component('roles', {
+  template: "#roles",
+  props: [ "globals" ],
+  data: function() {
+    return {
+      roles: [],
+      email: "",
+      role: "auditor",
+      domains: "",
+      xhrPending: false,
+      error: { },
+    };
+  },
+  methods: {
+    clearError: function() { this.error = { }; },
+    update: function(req) {
+      this.xhrPending = true;
+      req.then((res) => {
+        this.xhrPending = false;
+        if (res.data.Artifact) {
+          this.roles = res.data.Artifact.Roles;
+        } else {
+          this.error = res.data.Error ? res.data.Error : generalError;
+        }
+      }).catch((err) => {
+        this.xhrPending = false;
+        this.error = err.response.data.Error ? err.response.data.Error : generalError;
+      });
+    },
+    grant: function() {
+      if (str(this.email) == "") {
+        this.error = { Message: "You must enter an email address.", Extra: "", Recoverable: true};
+        return;
+      }
+      let payload = { "Role": this.role, "Domains": [] };
+      if (this.role == "domain-admin") {
+        payload.Domains = this.domains.split(/[\s,]+/).filter((d) => d != "");
+      }
+      this.update(axios.put("/api/roles/" + this.email, json=payload));
+      this.email = "";
+      this.domains = "";
+    },
+    revoke: function(email) {
+      this.update(axios.delete("/api/roles/" + email));
+    },
+  },
+  mounted: function() {
+    this.update(axios.get("/api/roles"));
+  },
+});
+
+const elevation = Vue.component('elevation', {
+  template: "#elevation",
+  props: [ "globals" ],
+  data: function() {
+    return {
+      requireApproval: false,
+      maxMinutes: 60,
+      mine: [],
+      pending: [],
+      reason: "",
+      minutes: 60,
+      loaded: false,
+      xhrPending: false,
+      error: { },
+    };
+  },
+  computed: {
+    active: function() {
+      return this.mine.some((e) => e.Active);
+    },
+  },
+  methods: {
+    clearError: function() { this.error = { }; },
+    update: function(req) {
+      let wasActive = this.active;
+      this.xhrPending = true;
+      req.then((res) => {
+        this.xhrPending = false;
+        if (res.data.Artifact) {
+          this.requireApproval = res.data.Artifact.RequireApproval;
+          this.maxMinutes = res.data.Artifact.MaxMinutes;
+          this.mine = res.data.Artifact.Mine;
+          this.pending = res.data.Artifact.Pending;
+          if (this.minutes > this.maxMinutes) {
+            this.minutes = this.maxMinutes;
+          }
+          // permissions come from /api/init, so start over whenever they change
+          if (this.loaded && this.active != wasActive) {
+            document.location.reload();
+          }
+          this.loaded = true;
+        } else {
+          this.error = res.data.Error ? res.data.Error : generalError;
+        }
+      }).catch((err) => {
+        this.xhrPending = false;
+        this.error = err.response.data.Error ? err.response.data.Error : generalError;
+      });
+    },
+    request: function() {
+      if (str(this.reason) == "") {
+        this.error = { Message: "You must enter a reason.", Extra: "", Recoverable: true};
+        return;
+      }
+      let payload = { "Reason": this.reason, "Minutes": parseInt(this.minutes) };
+      this.update(axios.post("/api/elevation", json=payload));
+      this.reason = "";
+    },
+    end: function() {
+      this.update(axios.delete("/api/elevation"));
+    },
+    approve: function(id) {
+      this.update(axios.put("/api/elevation/" + id));
+    },
+    deny: function(id) {
+      this.update(axios.delete("/api/elevation/" + id));
+    },
+  },
+  mounted: function() {
+    this.update(axios.get("/api/elevation"));
+  },
+});
+
+const changes = Vue.component('changes', {
+  template: "#changes",
+  props: [ "globals" ],
+  data: function() {
+    return {
+      changes: [],
+      xhrPending: false,
+      error: { },
+    };
+  },
+  methods: {
+    clearError: function() { this.error = { }; },
+    update: function(req) {
+      this.xhrPending = true;
+      req.then((res) => {
+        this.xhrPending = false;
+        if (res.data.Artifact) {
+          this.changes = res.data.Artifact.Changes;
+        } else {
+          this.error = res.data.Error ? res.data.Error : generalError;
+        }
+      }).catch((err) => {
+        this.xhrPending = false;
+        this.error = err.response.data.Error ? err.response.data.Error : generalError;
+        axios.get("/api/changes").then((res) => {
+          if (res.data.Artifact) {
+            this.changes = res.data.Artifact.Changes;
+          }
+        });
+      });
+    },
+    approve: function(id) {
+      this.update(axios.put("/api/changes/" + id));
+    },
+    deny: function(id) {
+      this.update(axios.delete("/api/changes/" + id));
+    },
+  },
+  mounted: function() {
+    this.update(axios.get("/api/changes"));
+  },
+});
+
 const events = Vue.component('events', {
   template: "#events",
   props: [ "globals" ],
   data: function() {
     return {
       events: [],
+      confirmClear: false,
       refreshTimer: null,
       before: "",
       xhrPending: false,
@@ -473,6 +1277,18 @@ const events = Vue.component('events', {
         this.refreshTimer = null;
       }
     },
+    clear: function() {
+      this.confirmClear = false;
+      axios.delete("/api/events").then((res) => {
+        if (res.status == 202) {
+          this.error = awaitingApproval;
+        } else {
+          this.reset();
+        }
+      }).catch((err) => {
+        this.error = err.response.data.Error ? err.response.data.Error : generalError;
+      });
+    },
     export: function() {
       axios.get("/api/events?before=all").then((res) => {
         if (res.data.Artifact) {
@@ -509,9 +1325,17 @@ Vue.component('navbar', {
       if (res.data.Artifact) {
         globals.ServiceName = str(res.data.Artifact.ServiceName);
         globals.IsAdmin = res.data.Artifact.IsAdmin;
+        globals.Role = str(res.data.Artifact.Role);
+        globals.Can = res.data.Artifact.Can ? res.data.Artifact.Can : { };
+        globals.CanElevate = res.data.Artifact.CanElevate;
+        globals.ElevatedUntil = str(res.data.Artifact.ElevatedUntil);
         globals.MaxClients = res.data.Artifact.MaxClients;
+        globals.Profiles = res.data.Artifact.Profiles ? res.data.Artifact.Profiles : [];
         globals.DefaultPath = str(res.data.Artifact.DefaultPath);
-        globals.IsAllowed = globals.DefaultPath != "/sorry";
+        globals.IsAllowed = res.data.Artifact.IsAllowed;
+        globals.Suspended = res.data.Artifact.Suspended;
+        globals.SuspendedUntil = str(res.data.Artifact.SuspendedUntil);
+        globals.Lockdown = res.data.Artifact.Lockdown;
 
         if (str(this.$router.path) == "/" || str(this.$router.path) == "") {
           this.$router.replace(globals.DefaultPath);
@@ -572,6 +1396,10 @@ const router = new VueRouter({
     { path: "/newdevice", component: newDevice, props: {globals: globals} },
     { path: "/password", component: totp, props: {globals: globals} },
     { path: "/events", component: events, props: {globals: globals} },
+    { path: "/domains", component: domains, props: {globals: globals} },
+    { path: "/roles", component: roles, props: {globals: globals} },
+    { path: "/elevation", component: elevation, props: {globals: globals} },
+    { path: "/changes", component: changes, props: {globals: globals} },
   ],
 });
 